@@ -1,26 +1,70 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
 	cf_lager "code.cloudfoundry.org/cflager"
 	cf_debug_server "code.cloudfoundry.org/debugserver"
 	"code.cloudfoundry.org/lager"
 	"github.com/tedsuo/ifrit/grouper"
+	"github.com/tedsuo/ifrit/http_server"
 	"github.com/tedsuo/ifrit/sigmon"
 	"github.com/tedsuo/ifrit"
 	//"github.com/wdxxs2z/cf-storage-driver/storage_server"
 	"../../storage_server"
+	"../../storage_config"
+	"../../storage_auth"
+	"../../storage_broker"
+	"../../storage_csi"
+	"../../storage_docker"
 )
 
+var configFile string
+var authTokenFile string
+var brokerAddress string
+var brokerUsername string
+var brokerPasswordFile string
+var brokerStateFile string
+var dockerPluginConfig bool
+var adminAddress string
+var adminTokenFile string
+
 func parseConfig(config *storage_server.DriverServerConfig) {
 
 	flag.StringVar(&config.ListenAddress,"listenAddress","0.0.0.0:5566","host:port nfsdriver manager listen address")
 	flag.StringVar(&config.DriversPath, "driversPath", "/tmp/voldriver", "nfs driver path where the voldriver installed")
 	flag.StringVar(&config.Transport, "transport", "tcp", "tcp or unix transport protocol,default tcp")
-	flag.StringVar(&config.RegistryDriver, "registryDriver", "nfs", "support storage backend driver,now available drivers are nfs,local...")
+	flag.StringVar(&config.RegistryDriver, "registryDriver", "nfs", "support storage backend driver,now available drivers are nfs,local,smb,cephfs,glusterfs,sshfs,tmpfs,loop,hostpath,overlay,s3,webdav,fake...")
 	flag.StringVar(&config.MountDir, "local driver only use it", "/tmp/local", "fake local mount dir")
+	flag.StringVar(&config.LocalMountMode, "localMountMode", "symlink", "how the local driver mounts volumes: symlink (unprivileged) or bind (real bind mounts, requires root)")
+	flag.StringVar(&config.DataDir, "dataDir", "/var/vcap/data/storage-driver", "directory where backends keep their state such as mount client logs")
+	flag.StringVar(&config.SecretsDir, "secretsDir", "/var/vcap/data/storage-driver/secrets", "root only directory where backends keep credential files while mounting")
+	flag.StringVar(&config.AuditLogFile, "auditLogFile", "", "append volume lifecycle events as json lines to this file, disabled when empty")
+	flag.Int64Var(&config.AuditLogMaxSize, "auditLogMaxSize", 10*1024*1024, "size in bytes after which the audit log is rotated")
+	flag.IntVar(&config.AuditLogBackups, "auditLogBackups", 5, "number of rotated audit log files to keep")
+	flag.StringVar(&authTokenFile, "authTokenFile", "", "file holding the bearer token clients must send, written into the driver spec; authentication is disabled when empty")
+	flag.StringVar(&brokerAddress, "brokerAddress", "", "host:port the open service broker api listens on, disabled when empty")
+	flag.StringVar(&brokerUsername, "brokerUsername", "admin", "basic auth user the cloud controller uses for the service broker")
+	flag.StringVar(&brokerPasswordFile, "brokerPasswordFile", "", "file holding the basic auth password of the service broker")
+	flag.StringVar(&brokerStateFile, "brokerStateFile", "", "json file keeping service instances and bindings, defaults to <dataDir>/broker/state.json")
+	flag.StringVar(&config.DockerPlugin, "dockerPlugin", "", "serve docker as the volume plugin of this name on /run/docker/plugins/<name>.sock instead of listenAddress, disabled when empty")
+	flag.StringVar(&config.DockerMountsDir, "dockerMountsDir", storage_docker.MountsDir, "directory docker plugin volumes created without a localmountpoint are mounted in")
+	flag.BoolVar(&dockerPluginConfig, "dockerPluginConfig", false, "print the config.json of a managed docker plugin running -registryDriver as -dockerPlugin (default storage) and exit")
+	flag.StringVar(&config.CsiEndpoint, "csiEndpoint", "", "unix socket to serve the CSI identity and node services on instead of listenAddress, disabled when empty")
+	flag.StringVar(&config.CsiDriverName, "csiDriverName", storage_csi.DefaultDriverName, "name the CSI plugin reports, referenced by the CSIDriver object and storage classes")
+	flag.StringVar(&config.CsiNodeId, "csiNodeId", hostname(), "node id the CSI plugin reports, defaults to the hostname")
+	flag.StringVar(&config.CsiPublishMode, "csiPublishMode", "bind", "how staged CSI volumes are published to pods: bind (requires root) or symlink (for the fake backend)")
+	flag.StringVar(&config.CsiNfsShare, "csiNfsShare", "", "nfs export '<server>:/<export>' the CSI controller service creates volumes in as subdirectories, the controller is disabled when empty")
+	flag.StringVar(&config.CsiNfsOpts, "csiNfsOpts", "", "nfs mount opts for -csiNfsShare, also handed to the nodes in the volume context")
+	flag.StringVar(&adminAddress, "adminAddress", "", "host:port the admin api (volumes, health, force-unmount, forget) listens on, disabled when empty")
+	flag.StringVar(&adminTokenFile, "adminTokenFile", "", "file holding the bearer token admin api clients must send, required with -adminAddress")
+	flag.StringVar(&configFile, "configFile", "", "json file with reloadable backend settings (nfs option allowlist, mount retry policy), re-read on SIGHUP")
 
 	cf_lager.AddFlags(flag.CommandLine)
 	cf_debug_server.AddFlags(flag.CommandLine)
@@ -30,12 +74,31 @@ func parseConfig(config *storage_server.DriverServerConfig) {
 
 func init() {}
 
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
 func main() {
 	storageConfig := storage_server.DriverServerConfig{}
 
 	parseConfig(&storageConfig)
 
-	storageLogger, _ := cf_lager.New("storage-driver-server")
+	if dockerPluginConfig {
+		printPluginConfig(storageConfig)
+		return
+	}
+
+	storageLogger, logTap := cf_lager.New("storage-driver-server")
+
+	backendConfig, err := storage_config.LoadConfig(configFile)
+	exitOnFailure(storageLogger, err)
+	storageConfig.Backend = backendConfig
+
+	if authTokenFile != "" {
+		storageConfig.AuthToken, err = storage_auth.ReadToken(authTokenFile)
+		exitOnFailure(storageLogger, err)
+	}
 
 	storageServer := storage_server.NewStorageDriverServer(storageConfig)
 
@@ -44,13 +107,24 @@ func main() {
 	exitOnFailure(storageLogger, err)
 
 	servers := grouper.Members{
-		{"storage-driver-server", storageDriverServer},
+		{Name: "storage-driver-server", Runner: storageDriverServer},
+		{Name: "storage-driver-reloader", Runner: reloader(storageLogger, storageServer, backendConfig)},
 	}
 
-	var logTap *lager.ReconfigurableSink
+	if brokerAddress != "" {
+		broker, err := brokerServer(storageLogger, storageConfig.DataDir)
+		exitOnFailure(storageLogger, err)
+		servers = append(servers, grouper.Member{Name: "storage-broker", Runner: broker})
+	}
+
+	if adminAddress != "" {
+		admin, err := adminServer(storageLogger, storageServer)
+		exitOnFailure(storageLogger, err)
+		servers = append(servers, grouper.Member{Name: "storage-admin", Runner: admin})
+	}
 
 	if degugAddr := cf_debug_server.DebugAddress(flag.CommandLine); degugAddr != "" {
-		servers = append(grouper.Members{{"storage-driver-debug-server", cf_debug_server.Runner(degugAddr, logTap)}}, servers...)
+		servers = append(grouper.Members{{Name: "storage-driver-debug-server", Runner: debugServer(storageLogger, degugAddr, logTap, storageServer)}}, servers...)
 	}
 
 	runner := sigmon.New(grouper.NewOrdered(os.Interrupt,servers))
@@ -60,6 +134,99 @@ func main() {
 
 }
 
+func debugServer(logger lager.Logger, address string, sink *lager.ReconfigurableSink, server storage_server.StorageDriverServer) ifrit.Runner {
+	mux := http.NewServeMux()
+	mux.Handle("/", cf_debug_server.Handler(sink))
+	mux.Handle("/metrics", server.MetricsHandler())
+	return http_server.New(address, mux)
+}
+
+func printPluginConfig(config storage_server.DriverServerConfig) {
+	name := config.DockerPlugin
+	if name == "" {
+		name = "storage"
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(storage_docker.NewPluginConfig(name, config.RegistryDriver)); err != nil {
+		os.Exit(1)
+	}
+}
+
+func brokerServer(logger lager.Logger, dataDir string) (ifrit.Runner, error) {
+	password, err := storage_auth.ReadToken(brokerPasswordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	stateFile := brokerStateFile
+	if stateFile == "" {
+		stateFile = filepath.Join(dataDir, "broker", "state.json")
+	}
+	store, err := storage_broker.NewStore(stateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, err := storage_broker.NewHandler(logger, storage_broker.NewBroker(store), brokerUsername, password)
+	if err != nil {
+		return nil, err
+	}
+	return http_server.New(brokerAddress, handler), nil
+}
+
+func adminServer(logger lager.Logger, server storage_server.StorageDriverServer) (ifrit.Runner, error) {
+	token, err := storage_auth.ReadToken(adminTokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, err := server.AdminHandler(logger, token)
+	if err != nil {
+		return nil, err
+	}
+	return http_server.New(adminAddress, handler), nil
+}
+
+func reloader(logger lager.Logger, server storage_server.StorageDriverServer, current storage_config.Config) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		defer signal.Stop(hangups)
+
+		close(ready)
+
+		for {
+			select {
+			case <-hangups:
+				current = reloadConfig(logger, server, current)
+			case <-signals:
+				return nil
+			}
+		}
+	})
+}
+
+func reloadConfig(logger lager.Logger, server storage_server.StorageDriverServer, current storage_config.Config) storage_config.Config {
+	logger = logger.Session("reload-config", lager.Data{"config_file": configFile})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	config, err := storage_config.LoadConfig(configFile)
+	if err != nil {
+		logger.Error("failed-loading-config-keeping-current", err)
+		return current
+	}
+
+	if err = server.Reload(logger, config); err != nil {
+		logger.Error("failed-applying-config-keeping-current", err)
+		return current
+	}
+
+	logger.Info("config-reloaded", lager.Data{"changes": storage_config.Diff(current, config)})
+	return config
+}
+
 func untilTerminated(logger lager.Logger, process ifrit.Process) {
 	err := <-process.Wait()
 	exitOnFailure(logger, err)
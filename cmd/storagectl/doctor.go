@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"../../storage_auth"
+)
+
+// requirement is what a backend needs from the cell to mount.
+type requirement struct {
+	binaries []string
+	// one of them must be supported by the kernel
+	filesystems []string
+	packages    string
+	// privileged backends mount, which needs CAP_SYS_ADMIN
+	privileged bool
+}
+
+var requirements = map[string]requirement{
+	"nfs":       {binaries: []string{"mount", "umount", "mount.nfs"}, filesystems: []string{"nfs", "nfs4"}, packages: "nfs-common (nfs-utils)", privileged: true},
+	"smb":       {binaries: []string{"mount", "umount", "mount.cifs"}, filesystems: []string{"cifs"}, packages: "cifs-utils", privileged: true},
+	"cephfs":    {binaries: []string{"mount", "umount", "setfattr"}, filesystems: []string{"ceph", "fuse"}, packages: "ceph-common and attr (ceph-fuse without kernel support)", privileged: true},
+	"glusterfs": {binaries: []string{"mount", "umount", "mount.glusterfs"}, filesystems: []string{"fuse"}, packages: "glusterfs-client", privileged: true},
+	"sshfs":     {binaries: []string{"sshfs", "fusermount"}, filesystems: []string{"fuse"}, packages: "sshfs", privileged: true},
+	"s3":        {binaries: []string{"s3fs", "fusermount"}, filesystems: []string{"fuse"}, packages: "s3fs", privileged: true},
+	"webdav":    {binaries: []string{"mount", "umount", "mount.davfs"}, filesystems: []string{"fuse", "coda"}, packages: "davfs2", privileged: true},
+	"tmpfs":     {binaries: []string{"mount", "umount"}, filesystems: []string{"tmpfs"}, packages: "util-linux", privileged: true},
+	"loop":      {binaries: []string{"mount", "umount", "losetup", "mkfs.ext4", "e2fsck", "resize2fs"}, filesystems: []string{"ext4", "xfs"}, packages: "util-linux and e2fsprogs (xfsprogs for xfs)", privileged: true},
+	"hostpath":  {binaries: []string{"mount", "umount"}, packages: "util-linux", privileged: true},
+	"overlay":   {binaries: []string{"mount", "umount", "cp"}, filesystems: []string{"overlay"}, packages: "util-linux", privileged: true},
+	// local only mounts in bind mode, which -localMountMode tells the driver,
+	// not the doctor
+	"local": {},
+	"fake":  {},
+}
+
+type result struct {
+	status string
+	check  string
+	detail string
+}
+
+type doctor struct {
+	results []result
+	// run runs a command and returns its combined output
+	run func(name string, args ...string) ([]byte, error)
+}
+
+func runCommand(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func (d *doctor) pass(check, format string, args ...interface{}) {
+	d.results = append(d.results, result{"PASS", check, fmt.Sprintf(format, args...)})
+}
+
+func (d *doctor) warn(check, format string, args ...interface{}) {
+	d.results = append(d.results, result{"WARN", check, fmt.Sprintf(format, args...)})
+}
+
+func (d *doctor) fail(check, format string, args ...interface{}) {
+	d.results = append(d.results, result{"FAIL", check, fmt.Sprintf(format, args...)})
+}
+
+func (d *doctor) failed() bool {
+	for _, result := range d.results {
+		if result.status == "FAIL" {
+			return true
+		}
+	}
+	return false
+}
+
+type remotes []string
+
+func (r *remotes) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *remotes) Set(value string) error {
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		return fmt.Errorf("'%s' is not of the form host:port", value)
+	}
+	*r = append(*r, value)
+	return nil
+}
+
+// runDoctor checks whether the cell can run the given backends and prints a
+// line per check with what to do about failures. It exits 1 if one failed.
+func runDoctor(args []string) {
+	var (
+		backends string
+		remote   remotes
+		timeout  time.Duration
+	)
+	flags := flag.NewFlagSet("storagectl doctor", flag.ExitOnError)
+	flags.StringVar(&backends, "registryDriver", "nfs", "comma separated backends the driver runs, as in its -registryDriver")
+	flags.StringVar(&driversPath, "driversPath", "/tmp/voldriver", "directory the driver writes its spec to")
+	flags.StringVar(&driver, "driver", "", "driver whose listener is checked, all drivers in driversPath when empty")
+	flags.Var(&remote, "remote", "host:port of a storage server that must be reachable, e.g. 10.10.130.57:2049; may be repeated")
+	flags.DurationVar(&timeout, "timeout", 3*time.Second, "timeout for connecting to listeners and remote servers")
+	flags.Parse(args)
+
+	d := &doctor{run: runCommand}
+	filesystems, err := kernelFilesystems()
+	if err != nil {
+		d.warn("kernel", "cannot read /proc/filesystems: %s", err.Error())
+	}
+
+	privileged := false
+	for _, backend := range strings.Split(backends, ",") {
+		backend = strings.TrimSpace(backend)
+		requirement, ok := requirements[backend]
+		if !ok {
+			d.fail("backend "+backend, "unknown backend")
+			continue
+		}
+		privileged = privileged || requirement.privileged
+		d.checkBinaries(backend, requirement)
+		if filesystems != nil {
+			d.checkFilesystems(backend, requirement, filesystems)
+		}
+	}
+
+	if privileged {
+		d.checkPrivilege(os.Geteuid() == 0)
+	} else {
+		d.pass("privilege", "the backends mount without root")
+	}
+
+	d.checkDriversPath(driversPath)
+	d.checkListeners(driversPath, driver, timeout)
+	for _, address := range remote {
+		d.checkRemote(address, timeout)
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, result := range d.results {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", result.status, result.check, result.detail)
+	}
+	table.Flush()
+
+	if d.failed() {
+		os.Exit(1)
+	}
+}
+
+func (d *doctor) checkBinaries(backend string, requirement requirement) {
+	var missing []string
+	for _, binary := range requirement.binaries {
+		if _, err := exec.LookPath(binary); err != nil {
+			missing = append(missing, binary)
+		}
+	}
+	switch {
+	case len(requirement.binaries) == 0:
+		d.pass("binaries "+backend, "no helpers needed")
+	case len(missing) > 0:
+		d.fail("binaries "+backend, "%s not found in PATH, install %s", strings.Join(missing, ", "), requirement.packages)
+	default:
+		d.pass("binaries "+backend, "%s found", strings.Join(requirement.binaries, ", "))
+	}
+}
+
+// checkFilesystems only warns: most filesystems are modules the kernel loads
+// on the first mount.
+func (d *doctor) checkFilesystems(backend string, requirement requirement, filesystems map[string]bool) {
+	if len(requirement.filesystems) == 0 {
+		return
+	}
+	for _, filesystem := range requirement.filesystems {
+		if filesystems[filesystem] {
+			d.pass("filesystem "+backend, "%s supported by the kernel", filesystem)
+			return
+		}
+	}
+	d.warn("filesystem "+backend, "%s not in /proc/filesystems, load it with modprobe %s if mounts fail", strings.Join(requirement.filesystems, " or "), requirement.filesystems[0])
+}
+
+func kernelFilesystems() (map[string]bool, error) {
+	file, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	filesystems := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// lines are "nodev\tproc" or "\text4"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			filesystems[fields[len(fields)-1]] = true
+		}
+	}
+	return filesystems, scanner.Err()
+}
+
+// checkPrivilege mounts a tmpfs on a temp dir. Running as root is not enough
+// in a container without CAP_SYS_ADMIN, so only a real mount tells.
+func (d *doctor) checkPrivilege(root bool) {
+	dir, err := ioutil.TempDir("", "storagectl-doctor")
+	if err != nil {
+		d.fail("privilege", "cannot create a probe mountpoint: %s", err.Error())
+		return
+	}
+	defer os.Remove(dir)
+
+	if output, err := d.run("mount", "-t", "tmpfs", "-o", "size=1m", "storagectl-doctor", dir); err != nil {
+		hint := "run the driver (and this check) with sudo"
+		if root {
+			hint = "the driver needs CAP_SYS_ADMIN, run its container privileged"
+		}
+		d.fail("privilege", "cannot mount a tmpfs on %s: %s, %s", dir, commandError(output, err), hint)
+		return
+	}
+	if output, err := d.run("umount", dir); err != nil {
+		d.warn("privilege", "mounted a tmpfs on %s but cannot unmount it: %s", dir, commandError(output, err))
+		return
+	}
+	d.pass("privilege", "mounted and unmounted a tmpfs")
+}
+
+// commandError prefers what a command printed over its exit status.
+func commandError(output []byte, err error) string {
+	if message := strings.TrimSpace(string(output)); message != "" {
+		return message
+	}
+	return err.Error()
+}
+
+// checkDriversPath checks that the spec can be written; a missing directory
+// is created by the driver, so its closest existing parent must be writable.
+func (d *doctor) checkDriversPath(path string) {
+	dir := path
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	probe, err := ioutil.TempFile(dir, ".storagectl-doctor")
+	if err != nil {
+		d.fail("drivers path", "cannot write to %s: %s, choose a writable -driversPath", dir, err.Error())
+		return
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	if dir != path {
+		d.pass("drivers path", "%s does not exist yet, %s is writable", path, dir)
+		return
+	}
+	d.pass("drivers path", "%s is writable", path)
+}
+
+// checkListeners connects to the address of every driver spec, so a driver
+// that died or is firewalled off shows up before volman tries it.
+func (d *doctor) checkListeners(driversPath, driver string, timeout time.Duration) {
+	var specs []string
+	if driver != "" {
+		spec, err := findSpec(driversPath, driver)
+		if err != nil {
+			d.fail("listener "+driver, "%s, is the driver running?", err.Error())
+			return
+		}
+		specs = []string{spec}
+	} else {
+		for _, extension := range storage_auth.SpecExtensions {
+			matches, _ := filepath.Glob(filepath.Join(driversPath, "*"+extension))
+			specs = append(specs, matches...)
+		}
+		if len(specs) == 0 {
+			d.warn("listener", "no driver specs in %s, is the driver running?", driversPath)
+			return
+		}
+	}
+
+	for _, spec := range specs {
+		name := strings.TrimSuffix(filepath.Base(spec), filepath.Ext(spec))
+		network, address, err := specAddress(spec)
+		if err != nil {
+			d.fail("listener "+name, "%s", err.Error())
+			continue
+		}
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			d.fail("listener "+name, "cannot connect to %s: %s, check that the driver runs and that the port is open", address, err.Error())
+			continue
+		}
+		conn.Close()
+		d.pass("listener "+name, "%s accepts connections", address)
+	}
+}
+
+// specAddress returns where the driver of a spec listens.
+func specAddress(path string) (string, string, error) {
+	spec, err := storage_auth.ReadDriverSpec(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	if strings.HasPrefix(spec.Address, "unix://") || strings.HasSuffix(spec.Address, ".sock") {
+		return "unix", strings.TrimPrefix(spec.Address, "unix://"), nil
+	}
+	address, err := url.Parse(spec.Address)
+	if err != nil {
+		return "", "", err
+	}
+	host := address.Host
+	if address.Port() == "" {
+		port := "80"
+		if address.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(address.Hostname(), port)
+	}
+	return "tcp", host, nil
+}
+
+func (d *doctor) checkRemote(address string, timeout time.Duration) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		d.fail("remote "+address, "unreachable: %s, check routes and firewalls between the cell and the server", err.Error())
+		return
+	}
+	conn.Close()
+	d.pass("remote "+address, "reachable")
+}
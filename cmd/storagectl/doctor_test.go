@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Doctor", func() {
+	Context("the requirements", func() {
+		It("knows every backend of the driver", func() {
+			var backends []string
+			for backend := range requirements {
+				backends = append(backends, backend)
+			}
+			Expect(backends).To(ConsistOf("nfs", "local", "smb", "cephfs", "glusterfs", "sshfs", "s3", "webdav", "tmpfs", "hostpath", "overlay", "loop", "fake"))
+		})
+
+		It("names the packages of the helpers and filesystems a backend needs", func() {
+			for backend, requirement := range requirements {
+				if len(requirement.binaries) > 0 || len(requirement.filesystems) > 0 {
+					Expect(requirement.packages).NotTo(BeEmpty(), backend)
+				}
+			}
+		})
+
+		It("marks the backends that mount as privileged", func() {
+			for backend, requirement := range requirements {
+				Expect(requirement.privileged).To(Equal(len(requirement.binaries) > 0), backend)
+			}
+		})
+	})
+
+	Context("specAddress", func() {
+		var tempDir string
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "doctor")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tempDir)
+		})
+
+		write := func(name, contents string) string {
+			path := filepath.Join(tempDir, name)
+			Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+			return path
+		}
+
+		It("resolves the address of a spec", func() {
+			for _, entry := range []struct {
+				name, contents   string
+				network, address string
+			}{
+				{"tcp.spec", "http://127.0.0.1:7589\n", "tcp", "127.0.0.1:7589"},
+				{"noport.spec", "http://driver.local", "tcp", "driver.local:80"},
+				{"tls.json", `{"Name":"tls","Addr":"https://driver.local"}`, "tcp", "driver.local:443"},
+				{"token.json", `{"Name":"token","Addr":"http://[::1]:7589","Token":"s3cr3t"}`, "tcp", "[::1]:7589"},
+				{"unix.json", `{"Name":"unix","Addr":"unix:///var/vcap/sys/run/driver.sock"}`, "unix", "/var/vcap/sys/run/driver.sock"},
+				{"unix.spec", "/var/vcap/sys/run/driver.sock", "unix", "/var/vcap/sys/run/driver.sock"},
+			} {
+				network, address, err := specAddress(write(entry.name, entry.contents))
+				Expect(err).NotTo(HaveOccurred(), entry.name)
+				Expect(network).To(Equal(entry.network), entry.name)
+				Expect(address).To(Equal(entry.address), entry.name)
+			}
+		})
+
+		It("takes the socket itself as the address of a socket spec", func() {
+			path := write("driver.sock", "")
+
+			network, address, err := specAddress(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(network).To(Equal("unix"))
+			Expect(address).To(Equal(path))
+		})
+
+		It("fails on a broken spec", func() {
+			_, _, err := specAddress(write("broken.json", "{"))
+			Expect(err).To(MatchError(HavePrefix("invalid driver spec")))
+
+			_, _, err = specAddress(write("bad.spec", "http://%zz"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("checkPrivilege", func() {
+		var (
+			d        *doctor
+			commands [][]string
+			failures map[string]error
+		)
+
+		BeforeEach(func() {
+			commands = nil
+			failures = map[string]error{}
+			d = &doctor{run: func(name string, args ...string) ([]byte, error) {
+				commands = append(commands, append([]string{name}, args...))
+				if err, ok := failures[name]; ok {
+					return []byte(name + ": permission denied\n"), err
+				}
+				return nil, nil
+			}}
+		})
+
+		It("passes when a tmpfs can be mounted and unmounted", func() {
+			d.checkPrivilege(false)
+
+			Expect(d.results).To(Equal([]result{{"PASS", "privilege", "mounted and unmounted a tmpfs"}}))
+			Expect(commands).To(HaveLen(2))
+			Expect(commands[0][:6]).To(Equal([]string{"mount", "-t", "tmpfs", "-o", "size=1m", "storagectl-doctor"}))
+			Expect(commands[1]).To(Equal([]string{"umount", commands[0][6]}))
+			Expect(commands[0][6]).NotTo(BeAnExistingFile())
+		})
+
+		It("fails with the output of mount and asks a user for sudo", func() {
+			failures["mount"] = errors.New("exit status 32")
+			d.checkPrivilege(false)
+
+			Expect(d.failed()).To(BeTrue())
+			Expect(d.results[0].detail).To(ContainSubstring("mount: permission denied, run the driver (and this check) with sudo"))
+			Expect(commands).To(HaveLen(1))
+		})
+
+		It("asks root for CAP_SYS_ADMIN", func() {
+			failures["mount"] = errors.New("exit status 32")
+			d.checkPrivilege(true)
+
+			Expect(d.results[0].detail).To(HaveSuffix("the driver needs CAP_SYS_ADMIN, run its container privileged"))
+		})
+
+		It("warns about a probe mount it cannot unmount", func() {
+			failures["umount"] = errors.New("exit status 32")
+			d.checkPrivilege(true)
+
+			Expect(d.results[0].status).To(Equal("WARN"))
+			Expect(d.results[0].detail).To(ContainSubstring("umount: permission denied"))
+		})
+	})
+})
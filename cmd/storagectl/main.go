@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"../../storage_auth"
+)
+
+const usage = `usage: storagectl <command> [flags] [volume]
+
+commands:
+  activate             show what the driver implements
+  create <volume>      create a volume from the -opt flags
+  list                 list the volumes
+  get <volume>         show a volume
+  mount <volume>       mount a volume and print its mountpoint
+  unmount <volume>     unmount a volume once
+  path <volume>        print the mountpoint of a mounted volume
+  remove <volume>      unmount and remove a volume
+  capabilities         show the scope of the driver
+  doctor               check that the cell can mount, see storagectl doctor -h
+  snapshot <volume>    snapshot a local volume as -snapshot through the admin api
+  snapshots [volume]   list the snapshots, of one volume if given
+  restore <volume>     restore an unmounted local volume from -snapshot
+  delete-snapshot <s>  delete a snapshot
+
+flags:
+`
+
+// opts collects repeated -opt key=value flags. true and false become
+// booleans, everything else is passed on as a string.
+type opts map[string]interface{}
+
+func (o opts) String() string {
+	return fmt.Sprint(map[string]interface{}(o))
+}
+
+func (o opts) Set(value string) error {
+	separator := strings.Index(value, "=")
+	if separator < 1 {
+		return fmt.Errorf("'%s' is not of the form key=value", value)
+	}
+	key, optValue := value[:separator], value[separator+1:]
+	switch optValue {
+	case "true":
+		o[key] = true
+	case "false":
+		o[key] = false
+	default:
+		o[key] = optValue
+	}
+	return nil
+}
+
+type command struct {
+	needsVolume bool
+	run         func(logger lager.Logger, client voldriver.Driver, volume string, opts opts) (interface{}, string)
+}
+
+// each command returns the response to print as json and the error the driver
+// reported, if any
+var commands = map[string]command{
+	"activate": {run: func(logger lager.Logger, client voldriver.Driver, volume string, opts opts) (interface{}, string) {
+		response := client.Activate(logger)
+		return response, response.Err
+	}},
+	"create": {needsVolume: true, run: func(logger lager.Logger, client voldriver.Driver, volume string, opts opts) (interface{}, string) {
+		response := client.Create(logger, voldriver.CreateRequest{Name: volume, Opts: opts})
+		return response, response.Err
+	}},
+	"list": {run: func(logger lager.Logger, client voldriver.Driver, volume string, opts opts) (interface{}, string) {
+		response := client.List(logger)
+		return response, response.Err
+	}},
+	"get": {needsVolume: true, run: func(logger lager.Logger, client voldriver.Driver, volume string, opts opts) (interface{}, string) {
+		response := client.Get(logger, voldriver.GetRequest{Name: volume})
+		return response, response.Err
+	}},
+	"mount": {needsVolume: true, run: func(logger lager.Logger, client voldriver.Driver, volume string, opts opts) (interface{}, string) {
+		response := client.Mount(logger, voldriver.MountRequest{Name: volume, Opts: opts})
+		return response, response.Err
+	}},
+	"unmount": {needsVolume: true, run: func(logger lager.Logger, client voldriver.Driver, volume string, opts opts) (interface{}, string) {
+		response := client.Unmount(logger, voldriver.UnmountRequest{Name: volume})
+		return response, response.Err
+	}},
+	"path": {needsVolume: true, run: func(logger lager.Logger, client voldriver.Driver, volume string, opts opts) (interface{}, string) {
+		response := client.Path(logger, voldriver.PathRequest{Name: volume})
+		return response, response.Err
+	}},
+	"remove": {needsVolume: true, run: func(logger lager.Logger, client voldriver.Driver, volume string, opts opts) (interface{}, string) {
+		response := client.Remove(logger, voldriver.RemoveRequest{Name: volume})
+		return response, response.Err
+	}},
+	"capabilities": {run: func(logger lager.Logger, client voldriver.Driver, volume string, opts opts) (interface{}, string) {
+		return client.Capabilities(logger), ""
+	}},
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		fmt.Fprint(os.Stderr, usage)
+		newFlagSet(opts{}).PrintDefaults()
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	if name == "doctor" {
+		runDoctor(os.Args[2:])
+		return
+	}
+	if snapshotCommands[name] {
+		runSnapshot(name, os.Args[2:])
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fail("unknown command '%s', run storagectl help", name)
+	}
+
+	opts := opts{}
+	flags := newFlagSet(opts)
+	flags.Parse(os.Args[2:])
+
+	volume := flags.Arg(0)
+	if cmd.needsVolume && volume == "" {
+		fail("%s needs a volume name", name)
+	}
+	if flags.NArg() > 1 {
+		fail("unexpected arguments %v, flags go before the volume name", flags.Args()[1:])
+	}
+
+	token := ""
+	if authTokenFile != "" {
+		var err error
+		if token, err = storage_auth.ReadToken(authTokenFile); err != nil {
+			fail("%s", err.Error())
+		}
+	}
+
+	spec, err := findSpec(driversPath, driver)
+	if err != nil {
+		fail("%s", err.Error())
+	}
+	client, err := newClient(spec, token)
+	if err != nil {
+		fail("%s", err.Error())
+	}
+
+	logger := lager.NewLogger("storagectl")
+	if debug {
+		logger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.DEBUG))
+	}
+
+	response, driverErr := cmd.run(logger, client, volume, opts)
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(response)
+	} else {
+		printTable(response)
+	}
+	if driverErr != "" {
+		fail("%s", driverErr)
+	}
+}
+
+var (
+	driversPath   string
+	driver        string
+	authTokenFile string
+	jsonOutput    bool
+	debug         bool
+)
+
+func newFlagSet(opts opts) *flag.FlagSet {
+	flags := flag.NewFlagSet("storagectl", flag.ExitOnError)
+	flags.StringVar(&driversPath, "driversPath", "/tmp/voldriver", "directory with the driver specs")
+	flags.StringVar(&driver, "driver", "", "driver to talk to, e.g. nfsdriver; may be left out when driversPath holds a single spec")
+	flags.StringVar(&authTokenFile, "authTokenFile", "", "file holding the bearer token, defaults to the token of a json spec")
+	flags.BoolVar(&jsonOutput, "json", false, "print the driver's response as json")
+	flags.BoolVar(&debug, "debug", false, "log the requests to stderr")
+	flags.Var(opts, "opt", "key=value passed in the Opts of create and mount, may be repeated")
+	return flags
+}
+
+func printTable(response interface{}) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer table.Flush()
+
+	switch response := response.(type) {
+	case voldriver.ActivateResponse:
+		fmt.Fprintf(table, "IMPLEMENTS\n%s\n", strings.Join(response.Implements, ","))
+	case voldriver.ListResponse:
+		fmt.Fprintln(table, "NAME\tMOUNTPOINT\tMOUNTS")
+		for _, volume := range response.Volumes {
+			fmt.Fprintf(table, "%s\t%s\t%d\n", volume.Name, volume.Mountpoint, volume.MountCount)
+		}
+	case voldriver.GetResponse:
+		if response.Err == "" {
+			fmt.Fprintln(table, "NAME\tMOUNTPOINT\tMOUNTS")
+			fmt.Fprintf(table, "%s\t%s\t%d\n", response.Volume.Name, response.Volume.Mountpoint, response.Volume.MountCount)
+		}
+	case voldriver.MountResponse:
+		if response.Err == "" {
+			fmt.Fprintln(table, response.Mountpoint)
+		}
+	case voldriver.PathResponse:
+		if response.Err == "" {
+			fmt.Fprintln(table, response.Mountpoint)
+		}
+	case voldriver.CapabilitiesResponse:
+		fmt.Fprintf(table, "SCOPE\n%s\n", response.Capabilities.Scope)
+	case voldriver.ErrorResponse:
+		if response.Err == "" {
+			fmt.Fprintln(table, "OK")
+		}
+	}
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "storagectl: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/voldriver"
+
+	"../../storage_auth"
+	"../../storage_ops"
+)
+
+// snapshotCommands go to the admin api of the driver instead of its volman
+// routes.
+var snapshotCommands = map[string]bool{
+	"snapshot":        true,
+	"snapshots":       true,
+	"restore":         true,
+	"delete-snapshot": true,
+}
+
+func runSnapshot(name string, args []string) {
+	var (
+		adminAddress   string
+		adminTokenFile string
+		snapshot       string
+	)
+	flags := flag.NewFlagSet("storagectl "+name, flag.ExitOnError)
+	flags.StringVar(&adminAddress, "adminAddress", "127.0.0.1:7591", "host:port of the admin api, the -adminAddress of the driver")
+	flags.StringVar(&adminTokenFile, "adminTokenFile", "", "file holding the bearer token of the admin api")
+	flags.StringVar(&snapshot, "snapshot", "", "name of the snapshot to take or restore")
+	flags.BoolVar(&jsonOutput, "json", false, "print the response as json")
+	flags.Parse(args)
+
+	if adminTokenFile == "" {
+		fail("%s needs -adminTokenFile", name)
+	}
+	token, err := storage_auth.ReadToken(adminTokenFile)
+	if err != nil {
+		fail("%s", err.Error())
+	}
+	if flags.NArg() > 1 {
+		fail("unexpected arguments %v, flags go before the volume name", flags.Args()[1:])
+	}
+	argument := flags.Arg(0)
+
+	client := &adminClient{address: "http://" + adminAddress, token: token}
+	var response interface{}
+	switch name {
+	case "snapshot":
+		if argument == "" || snapshot == "" {
+			fail("usage: storagectl snapshot -snapshot <snapshot> <volume>")
+		}
+		var taken storage_ops.Snapshot
+		err = client.do("POST", "/snapshots?volume="+url.QueryEscape(argument), map[string]string{"name": snapshot}, &taken)
+		response = []storage_ops.Snapshot{taken}
+	case "snapshots":
+		var snapshots []storage_ops.Snapshot
+		err = client.do("GET", "/snapshots?volume="+url.QueryEscape(argument), nil, &snapshots)
+		response = snapshots
+	case "restore":
+		if argument == "" || snapshot == "" {
+			fail("usage: storagectl restore -snapshot <snapshot> <volume>")
+		}
+		err = client.do("POST", "/volume/restore?volume="+url.QueryEscape(argument), map[string]string{"snapshot": snapshot}, nil)
+	case "delete-snapshot":
+		if argument == "" {
+			fail("usage: storagectl delete-snapshot <snapshot>")
+		}
+		err = client.do("DELETE", "/snapshots/"+url.PathEscape(argument), nil, nil)
+	}
+	if err != nil {
+		fail("%s", err.Error())
+	}
+
+	if jsonOutput && response != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(response)
+		return
+	}
+	snapshots, ok := response.([]storage_ops.Snapshot)
+	if !ok {
+		fmt.Println("OK")
+		return
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer table.Flush()
+	fmt.Fprintln(table, "NAME\tVOLUME\tCREATED\tTAKEN WHILE MOUNTED")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%t\n", snapshot.Name, snapshot.Volume, snapshot.CreatedAt.Local().Format(time.RFC3339), snapshot.Mounted)
+	}
+}
+
+type adminClient struct {
+	address string
+	token   string
+}
+
+func (c *adminClient) do(method, path string, request, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, c.address+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var failure voldriver.Error
+		json.NewDecoder(resp.Body).Decode(&failure)
+		if failure.Description == "" {
+			failure.Description = strings.ToLower(http.StatusText(resp.StatusCode))
+		}
+		return fmt.Errorf("%s", failure.Description)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/voldriver"
+
+	"../../storage_auth"
+)
+
+// findSpec returns the spec file of driver in driversPath. Without a driver
+// name the only driver installed there is used.
+func findSpec(driversPath, driver string) (string, error) {
+	if driver != "" {
+		return storage_auth.FindDriverSpec(driversPath, driver)
+	}
+
+	entries, err := ioutil.ReadDir(driversPath)
+	if err != nil {
+		return "", err
+	}
+	var specs []string
+	for _, entry := range entries {
+		for _, extension := range storage_auth.SpecExtensions {
+			if strings.HasSuffix(entry.Name(), extension) {
+				specs = append(specs, entry.Name())
+			}
+		}
+	}
+	switch len(specs) {
+	case 0:
+		return "", fmt.Errorf("no driver specs in '%s'", driversPath)
+	case 1:
+		return filepath.Join(driversPath, specs[0]), nil
+	}
+	return "", fmt.Errorf("several drivers in '%s' (%s), choose one with -driver", driversPath, strings.Join(specs, ", "))
+}
+
+// newClient connects to the driver described by the spec at path. The token
+// of a json spec is used unless one is given explicitly.
+func newClient(path, token string) (voldriver.Driver, error) {
+	spec, err := storage_auth.ReadDriverSpec(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if token != "" {
+		spec.Token = token
+	}
+	return storage_auth.NewRemoteClient(spec)
+}
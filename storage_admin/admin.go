@@ -0,0 +1,363 @@
+package storage_admin
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"../storage_audit"
+	"../storage_metrics"
+	"../storage_ops"
+)
+
+const (
+	HealthUnmounted = "unmounted"
+	HealthHealthy   = "healthy"
+	HealthStale     = "stale"
+	HealthHung      = "hung"
+)
+
+// StatTimeout bounds the health check of a mountpoint. A hard mounted nfs
+// export whose server is gone blocks stat forever.
+const StatTimeout = 2 * time.Second
+
+// maxForcedUnmounts bounds force-unmount for backends whose mount count does
+// not go down.
+const maxForcedUnmounts = 1000
+
+// Forgetter is implemented by backends that can drop a volume from their
+// bookkeeping without unmounting it or touching its data, for mounts that were
+// cleaned up behind the driver's back.
+type Forgetter interface {
+	Forget(logger lager.Logger, name string) error
+}
+
+type Volume struct {
+	Name         string `json:"name"`
+	Backend      string `json:"backend"`
+	Remote       string `json:"remote,omitempty"`
+	Mountpoint   string `json:"mountpoint,omitempty"`
+	MountCount   int    `json:"mount_count"`
+	Health       string `json:"health"`
+	HealthDetail string `json:"health_detail,omitempty"`
+	VolumeState
+}
+
+type Health struct {
+	Backend   string   `json:"backend"`
+	Healthy   bool     `json:"healthy"`
+	Volumes   int      `json:"volumes"`
+	Mounted   int      `json:"mounted"`
+	Unhealthy []string `json:"unhealthy"`
+}
+
+var ErrVolumeNotFound = fmt.Errorf("volume not found")
+
+var ErrSnapshotsNotSupported = fmt.Errorf("the backend does not support snapshots")
+
+var ErrLayersNotSupported = fmt.Errorf("the backend does not keep layers")
+
+var ErrAuditLogDisabled = fmt.Errorf("the audit log is disabled")
+
+var ErrFaultsNotSupported = fmt.Errorf("the backend does not inject faults")
+
+// Admin answers for the volumes of one backend. The driver calls go through
+// the tracker, so what an operator does shows up in the volume state too.
+type Admin struct {
+	backend string
+	driver  voldriver.Driver
+	tracker *Tracker
+	auditor *storage_audit.Auditor
+	os      osshim.Os
+}
+
+// NewAdmin describes the volumes of driver, which must be a
+// storage_metrics.VolumeReporter, and changes them through tracker. auditor
+// is nil when the audit log is disabled.
+func NewAdmin(backend string, driver voldriver.Driver, tracker *Tracker, auditor *storage_audit.Auditor, os osshim.Os) *Admin {
+	return &Admin{
+		backend: backend,
+		driver:  driver,
+		tracker: tracker,
+		auditor: auditor,
+		os:      os,
+	}
+}
+
+func (a *Admin) Volumes(logger lager.Logger) []Volume {
+	stats := a.stats()
+	names := []string{}
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	volumes := []Volume{}
+	for _, name := range names {
+		volumes = append(volumes, a.describe(logger, name, stats[name]))
+	}
+	return volumes
+}
+
+func (a *Admin) Volume(logger lager.Logger, name string) (Volume, error) {
+	stat, ok := a.stats()[name]
+	if !ok {
+		return Volume{}, ErrVolumeNotFound
+	}
+	return a.describe(logger, name, stat), nil
+}
+
+func (a *Admin) Health(logger lager.Logger) Health {
+	health := Health{Backend: a.backend, Healthy: true, Unhealthy: []string{}}
+	for _, volume := range a.Volumes(logger) {
+		health.Volumes++
+		if volume.MountCount > 0 {
+			health.Mounted++
+		}
+		if volume.Health == HealthStale || volume.Health == HealthHung {
+			health.Healthy = false
+			health.Unhealthy = append(health.Unhealthy, volume.Name)
+		}
+	}
+	return health
+}
+
+// ForceUnmount unmounts the volume until no consumer holds it any more. The
+// attempt is recorded in the audit log as done by caller.
+func (a *Admin) ForceUnmount(logger lager.Logger, name, caller string) (volume Volume, err error) {
+	logger = logger.Session("force-unmount", lager.Data{"volume": name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	stat, ok := a.stats()[name]
+	if !ok {
+		return Volume{}, ErrVolumeNotFound
+	}
+	defer a.audit(logger, "force-unmount", name, caller)(&err)
+
+	for i := 0; stat.MountCount > 0; i++ {
+		if i == maxForcedUnmounts {
+			return Volume{}, fmt.Errorf("volume '%s' is still mounted %d times after %d unmounts", name, stat.MountCount, i)
+		}
+		response := a.tracker.Unmount(logger, voldriver.UnmountRequest{Name: name})
+		if response.Err != "" {
+			return Volume{}, fmt.Errorf("unmounting volume '%s' failed: %s", name, response.Err)
+		}
+		if stat, ok = a.stats()[name]; !ok {
+			// backends like fake drop the volume with its last mount
+			a.tracker.ClearConsumers(name)
+			return Volume{Name: name, Backend: a.backend, Health: HealthUnmounted}, nil
+		}
+	}
+
+	a.tracker.ClearConsumers(name)
+	logger.Info("unmounted")
+	return a.describe(logger, name, stat), nil
+}
+
+// Forget drops the volume from the backend, the attempt is recorded in the
+// audit log as done by caller.
+func (a *Admin) Forget(logger lager.Logger, name, caller string) (err error) {
+	forgetter, ok := a.driver.(Forgetter)
+	if !ok {
+		return fmt.Errorf("the %s backend cannot forget volumes", a.backend)
+	}
+	if _, ok := a.stats()[name]; !ok {
+		return ErrVolumeNotFound
+	}
+	defer a.audit(logger, "forget", name, caller)(&err)
+
+	if err := forgetter.Forget(logger, name); err != nil {
+		return err
+	}
+	a.tracker.Forget(name)
+	return nil
+}
+
+// audit describes the volume before an operation changes it. The returned
+// function records the outcome of the operation, its error if *err is set.
+func (a *Admin) audit(logger lager.Logger, operation, name, caller string) func(err *error) {
+	if a.auditor == nil {
+		return func(*error) {}
+	}
+
+	event := storage_audit.Event{Operation: operation, Volume: name, Caller: caller}
+	if targeter, ok := a.driver.(storage_audit.VolumeTargeter); ok {
+		event.RemoteTarget, event.LocalPath, _ = targeter.VolumeTarget(name)
+	}
+
+	return func(err *error) {
+		event.Timestamp = time.Now().UTC()
+		event.Result = "success"
+		if *err != nil {
+			event.Result = "failure"
+			event.Err = (*err).Error()
+		}
+		if recordErr := a.auditor.Record(event); recordErr != nil {
+			logger.Error("failed-recording-event", recordErr, lager.Data{"operation": operation})
+		}
+	}
+}
+
+func (a *Admin) Snapshots(logger lager.Logger, volumeName string) ([]storage_ops.Snapshot, error) {
+	snapshotter, err := a.snapshotter()
+	if err != nil {
+		return nil, err
+	}
+	return snapshotter.Snapshots(logger, volumeName)
+}
+
+func (a *Admin) Snapshot(logger lager.Logger, volumeName, snapshotName string) (storage_ops.Snapshot, error) {
+	snapshotter, err := a.snapshotter()
+	if err != nil {
+		return storage_ops.Snapshot{}, err
+	}
+	if _, ok := a.stats()[volumeName]; !ok {
+		return storage_ops.Snapshot{}, ErrVolumeNotFound
+	}
+	return snapshotter.Snapshot(logger, volumeName, snapshotName)
+}
+
+func (a *Admin) Restore(logger lager.Logger, volumeName, snapshotName string) error {
+	snapshotter, err := a.snapshotter()
+	if err != nil {
+		return err
+	}
+	if _, ok := a.stats()[volumeName]; !ok {
+		return ErrVolumeNotFound
+	}
+	return snapshotter.Restore(logger, volumeName, snapshotName)
+}
+
+func (a *Admin) DeleteSnapshot(logger lager.Logger, snapshotName string) error {
+	snapshotter, err := a.snapshotter()
+	if err != nil {
+		return err
+	}
+	return snapshotter.DeleteSnapshot(logger, snapshotName)
+}
+
+func (a *Admin) snapshotter() (storage_ops.Snapshotter, error) {
+	snapshotter, ok := a.driver.(storage_ops.Snapshotter)
+	if !ok {
+		return nil, ErrSnapshotsNotSupported
+	}
+	return snapshotter, nil
+}
+
+// Events returns the audit log of a volume, which outlives the volume.
+func (a *Admin) Events(logger lager.Logger, volumeName string) ([]storage_audit.Event, error) {
+	if a.auditor == nil {
+		return nil, ErrAuditLogDisabled
+	}
+
+	events, err := a.auditor.Events(volumeName)
+	if err != nil {
+		logger.Error("failed-reading-events", err, lager.Data{"volume": volumeName})
+		return nil, err
+	}
+	return events, nil
+}
+
+func (a *Admin) Discard(logger lager.Logger, volumeName string) error {
+	layers, err := a.layerManager()
+	if err != nil {
+		return err
+	}
+	if _, ok := a.stats()[volumeName]; !ok {
+		return ErrVolumeNotFound
+	}
+	return layers.Discard(logger, volumeName)
+}
+
+func (a *Admin) Commit(logger lager.Logger, volumeName, baseName string) (string, error) {
+	layers, err := a.layerManager()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := a.stats()[volumeName]; !ok {
+		return "", ErrVolumeNotFound
+	}
+	return layers.Commit(logger, volumeName, baseName)
+}
+
+func (a *Admin) layerManager() (storage_ops.LayerManager, error) {
+	layers, ok := a.driver.(storage_ops.LayerManager)
+	if !ok {
+		return nil, ErrLayersNotSupported
+	}
+	return layers, nil
+}
+
+func (a *Admin) Faults() (storage_ops.Faults, error) {
+	injector, ok := a.driver.(storage_ops.FaultInjector)
+	if !ok {
+		return storage_ops.Faults{}, ErrFaultsNotSupported
+	}
+	return injector.Faults(), nil
+}
+
+func (a *Admin) SetFaults(logger lager.Logger, faults storage_ops.Faults) error {
+	injector, ok := a.driver.(storage_ops.FaultInjector)
+	if !ok {
+		return ErrFaultsNotSupported
+	}
+	return injector.SetFaults(logger, faults)
+}
+
+func (a *Admin) stats() map[string]storage_metrics.VolumeStat {
+	stats := map[string]storage_metrics.VolumeStat{}
+	if reporter, ok := a.driver.(storage_metrics.VolumeReporter); ok {
+		for _, stat := range reporter.VolumeStats() {
+			stats[stat.Name] = stat
+		}
+	}
+	return stats
+}
+
+func (a *Admin) describe(logger lager.Logger, name string, stat storage_metrics.VolumeStat) Volume {
+	volume := Volume{
+		Name:        name,
+		Backend:     a.backend,
+		MountCount:  stat.MountCount,
+		Health:      HealthUnmounted,
+		VolumeState: a.tracker.State(name),
+	}
+	if targeter, ok := a.driver.(storage_audit.VolumeTargeter); ok {
+		volume.Remote, volume.Mountpoint, _ = targeter.VolumeTarget(name)
+	}
+	if volume.MountCount > 0 {
+		volume.Health, volume.HealthDetail = a.check(logger, volume.Mountpoint)
+	}
+	return volume
+}
+
+// check stats the mountpoint of a mounted volume. A stat that does not return
+// in time is left behind, it cannot be interrupted.
+func (a *Admin) check(logger lager.Logger, mountpoint string) (string, string) {
+	if mountpoint == "" {
+		return HealthHealthy, ""
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := a.os.Stat(mountpoint)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			logger.Info("stale-mountpoint", lager.Data{"mountpoint": mountpoint, "error": err.Error()})
+			return HealthStale, err.Error()
+		}
+		return HealthHealthy, ""
+	case <-time.After(StatTimeout):
+		logger.Info("hung-mountpoint", lager.Data{"mountpoint": mountpoint})
+		return HealthHung, fmt.Sprintf("stat %s did not return within %s", mountpoint, StatTimeout)
+	}
+}
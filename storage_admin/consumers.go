@@ -0,0 +1,91 @@
+package storage_admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"../storage_http"
+)
+
+// LocalConsumer stands for clients of a unix socket, which have no address.
+const LocalConsumer = "local"
+
+type consumerRequest struct {
+	Name string
+	// ID is the container docker mounts the volume for
+	ID string
+}
+
+type consumerResponse struct {
+	Err string
+}
+
+// NewConsumerHandler records in tracker who mounted the volumes served by
+// handler: the docker container if the request names one, the host the
+// request came from otherwise.
+func NewConsumerHandler(logger lager.Logger, handler http.Handler, tracker *Tracker) http.Handler {
+	logger = logger.Session("consumers")
+
+	mounts := map[string]bool{}
+	for _, route := range voldriver.Routes {
+		switch route.Name {
+		case voldriver.MountRoute:
+			mounts[route.Path] = true
+		case voldriver.UnmountRoute:
+			mounts[route.Path] = false
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mount, ok := mounts[req.URL.Path]
+		if !ok {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			logger.Error("failed-reading-request-body", err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var request consumerRequest
+		json.Unmarshal(body, &request)
+
+		recorder := storage_http.NewResponseRecorder(w)
+		handler.ServeHTTP(recorder, req)
+
+		var response consumerResponse
+		json.Unmarshal(recorder.Body(), &response)
+		if response.Err != "" {
+			return
+		}
+
+		consumer, exclusive := request.ID, request.ID != ""
+		if !exclusive {
+			consumer = remoteHost(req.RemoteAddr)
+		}
+		if mount {
+			tracker.AddConsumer(request.Name, consumer, exclusive)
+		} else {
+			tracker.RemoveConsumer(request.Name, consumer, exclusive)
+		}
+	})
+}
+
+func remoteHost(remoteAddr string) string {
+	if remoteAddr == "" || remoteAddr == "@" {
+		return LocalConsumer
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,283 @@
+package storage_admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	cf_http_handlers "code.cloudfoundry.org/cfhttp/handlers"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"github.com/tedsuo/rata"
+
+	"../storage_auth"
+	"../storage_ops"
+)
+
+const (
+	HealthRoute         = "Health"
+	VolumesRoute        = "Volumes"
+	VolumeRoute         = "Volume"
+	ForceUnmountRoute   = "ForceUnmount"
+	ForgetRoute         = "Forget"
+	SnapshotsRoute      = "Snapshots"
+	SnapshotRoute       = "Snapshot"
+	RestoreRoute        = "Restore"
+	DeleteSnapshotRoute = "DeleteSnapshot"
+	DiscardRoute        = "Discard"
+	CommitRoute         = "Commit"
+	AuditEventsRoute    = "AuditEvents"
+	FaultsRoute         = "Faults"
+	SetFaultsRoute      = "SetFaults"
+)
+
+// Routes take the volume as the volume query parameter, volume names may
+// contain slashes.
+var Routes = rata.Routes{
+	{Path: "/health", Method: "GET", Name: HealthRoute},
+	{Path: "/volumes", Method: "GET", Name: VolumesRoute},
+	{Path: "/volume", Method: "GET", Name: VolumeRoute},
+	{Path: "/volume/force-unmount", Method: "POST", Name: ForceUnmountRoute},
+	{Path: "/volume/forget", Method: "POST", Name: ForgetRoute},
+	{Path: "/snapshots", Method: "GET", Name: SnapshotsRoute},
+	{Path: "/snapshots", Method: "POST", Name: SnapshotRoute},
+	{Path: "/volume/restore", Method: "POST", Name: RestoreRoute},
+	{Path: "/snapshots/:snapshot", Method: "DELETE", Name: DeleteSnapshotRoute},
+	{Path: "/volume/discard", Method: "POST", Name: DiscardRoute},
+	{Path: "/volume/commit", Method: "POST", Name: CommitRoute},
+	{Path: "/audit/events", Method: "GET", Name: AuditEventsRoute},
+	{Path: "/fake/faults", Method: "GET", Name: FaultsRoute},
+	{Path: "/fake/faults", Method: "PUT", Name: SetFaultsRoute},
+}
+
+type SnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+type RestoreRequest struct {
+	Snapshot string `json:"snapshot"`
+}
+
+type CommitRequest struct {
+	Base string `json:"base"`
+}
+
+type CommitResponse struct {
+	Base string `json:"base"`
+	Path string `json:"path"`
+}
+
+// NewHandler serves the admin api of admin to clients sending
+// "Authorization: Bearer <token>". Unlike the driver routes it answers with
+// real status codes, its clients are operators and scripts.
+func NewHandler(logger lager.Logger, admin *Admin, token string) (http.Handler, error) {
+	logger = logger.Session("admin")
+
+	handlers := rata.Handlers{
+		HealthRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			health := admin.Health(logger)
+			status := http.StatusOK
+			if !health.Healthy {
+				status = http.StatusServiceUnavailable
+			}
+			cf_http_handlers.WriteJSONResponse(w, status, health)
+		}),
+
+		VolumesRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, admin.Volumes(logger))
+		}),
+
+		VolumeRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			name, ok := volumeName(w, req)
+			if !ok {
+				return
+			}
+			volume, err := admin.Volume(logger, name)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, volume)
+		}),
+
+		ForceUnmountRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			name, ok := volumeName(w, req)
+			if !ok {
+				return
+			}
+			volume, err := admin.ForceUnmount(logger, name, req.RemoteAddr)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, volume)
+		}),
+
+		ForgetRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			name, ok := volumeName(w, req)
+			if !ok {
+				return
+			}
+			if err := admin.Forget(logger, name, req.RemoteAddr); err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, struct{}{})
+		}),
+
+		SnapshotsRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			snapshots, err := admin.Snapshots(logger, req.URL.Query().Get("volume"))
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, snapshots)
+		}),
+
+		SnapshotRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			name, ok := volumeName(w, req)
+			if !ok {
+				return
+			}
+			var request SnapshotRequest
+			if !decode(w, req, &request) {
+				return
+			}
+			snapshot, err := admin.Snapshot(logger, name, request.Name)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusCreated, snapshot)
+		}),
+
+		RestoreRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			name, ok := volumeName(w, req)
+			if !ok {
+				return
+			}
+			var request RestoreRequest
+			if !decode(w, req, &request) {
+				return
+			}
+			if err := admin.Restore(logger, name, request.Snapshot); err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, struct{}{})
+		}),
+
+		DeleteSnapshotRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if err := admin.DeleteSnapshot(logger, rata.Param(req, "snapshot")); err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, struct{}{})
+		}),
+
+		DiscardRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			name, ok := volumeName(w, req)
+			if !ok {
+				return
+			}
+			if err := admin.Discard(logger, name); err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, struct{}{})
+		}),
+
+		CommitRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			name, ok := volumeName(w, req)
+			if !ok {
+				return
+			}
+			var request CommitRequest
+			if !decode(w, req, &request) {
+				return
+			}
+			path, err := admin.Commit(logger, name, request.Base)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusCreated, CommitResponse{Base: request.Base, Path: path})
+		}),
+
+		AuditEventsRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			name, ok := volumeName(w, req)
+			if !ok {
+				return
+			}
+			events, err := admin.Events(logger, name)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, events)
+		}),
+
+		FaultsRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			faults, err := admin.Faults()
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, faults)
+		}),
+
+		SetFaultsRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var faults storage_ops.Faults
+			if !decode(w, req, &faults) {
+				return
+			}
+			if err := admin.SetFaults(logger, faults); err != nil {
+				writeError(w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, faults)
+		}),
+	}
+
+	router, err := rata.NewRouter(Routes, handlers)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := []byte(token)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !storage_auth.Authorized(req, expected) {
+			logger.Info("unauthorized-request", lager.Data{"path": req.URL.Path, "remote_addr": req.RemoteAddr})
+			cf_http_handlers.WriteJSONResponse(w, http.StatusUnauthorized, voldriver.Error{Description: "Unauthorized: missing or invalid bearer token"})
+			return
+		}
+		router.ServeHTTP(w, req)
+	}), nil
+}
+
+func volumeName(w http.ResponseWriter, req *http.Request) (string, bool) {
+	name := req.URL.Query().Get("volume")
+	if name == "" {
+		cf_http_handlers.WriteJSONResponse(w, http.StatusBadRequest, voldriver.Error{Description: "Missing mandatory 'volume' parameter"})
+		return "", false
+	}
+	return name, true
+}
+
+func decode(w http.ResponseWriter, req *http.Request, request interface{}) bool {
+	if err := json.NewDecoder(req.Body).Decode(request); err != nil {
+		cf_http_handlers.WriteJSONResponse(w, http.StatusBadRequest, voldriver.Error{Description: "Invalid request body: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrVolumeNotFound, storage_ops.ErrSnapshotNotFound:
+		cf_http_handlers.WriteJSONResponse(w, http.StatusNotFound, voldriver.Error{Description: err.Error()})
+	case ErrSnapshotsNotSupported, ErrLayersNotSupported, ErrAuditLogDisabled, ErrFaultsNotSupported:
+		cf_http_handlers.WriteJSONResponse(w, http.StatusNotImplemented, voldriver.Error{Description: err.Error()})
+	default:
+		cf_http_handlers.WriteJSONResponse(w, http.StatusConflict, voldriver.Error{Description: err.Error()})
+	}
+}
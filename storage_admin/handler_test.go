@@ -0,0 +1,183 @@
+package storage_admin_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_admin"
+	"../storage_audit"
+	"../storage_local/fake"
+	"../storage_redact"
+)
+
+// stuckDriver fails every unmount while stuck is set.
+type stuckDriver struct {
+	*storage_fakedriver.FakeDriver
+	stuck bool
+}
+
+func (d *stuckDriver) Unmount(logger lager.Logger, unmountRequest voldriver.UnmountRequest) voldriver.ErrorResponse {
+	if d.stuck {
+		return voldriver.ErrorResponse{Err: "device is busy"}
+	}
+	return d.FakeDriver.Unmount(logger, unmountRequest)
+}
+
+var _ = Describe("Admin API", func() {
+	const volume = "/tmp/app1"
+
+	var (
+		logger  *lagertest.TestLogger
+		tempDir string
+		driver  *stuckDriver
+		tracker *storage_admin.Tracker
+		auditor *storage_audit.Auditor
+		handler http.Handler
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "admin")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("admin")
+		driver = &stuckDriver{FakeDriver: storage_fakedriver.NewFakeDriver(filepath.Join(tempDir, "fake"))}
+		tracker = storage_admin.NewTracker(driver)
+		auditor, err = storage_audit.NewAuditor(filepath.Join(tempDir, "audit.log"), 0, 0, storage_redact.NewRedactor(nil))
+		Expect(err).NotTo(HaveOccurred())
+
+		admin := storage_admin.NewAdmin("fake", driver, tracker, auditor, &osshim.OsShim{})
+		handler, err = storage_admin.NewHandler(logger, admin, "secret")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(tracker.Create(logger, voldriver.CreateRequest{Name: volume}).Err).To(BeEmpty())
+	})
+
+	AfterEach(func() {
+		auditor.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	call := func(method, path string, body interface{}, response interface{}) int {
+		var contents []byte
+		if body != nil {
+			var err error
+			contents, err = json.Marshal(body)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(contents))
+		req.RemoteAddr = "10.0.0.5:41234"
+		req.Header.Set("Authorization", "Bearer secret")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if response != nil {
+			Expect(json.Unmarshal(recorder.Body.Bytes(), response)).To(Succeed())
+		}
+		return recorder.Code
+	}
+
+	query := "?volume=" + url.QueryEscape(volume)
+
+	operations := func() []string {
+		events, err := auditor.Events(volume)
+		Expect(err).NotTo(HaveOccurred())
+		operations := []string{}
+		for _, event := range events {
+			operations = append(operations, event.Operation+" "+event.Result)
+		}
+		return operations
+	}
+
+	It("refuses requests without the token", func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/volumes", nil))
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("addresses volumes whose names contain slashes by the volume parameter", func() {
+		var described storage_admin.Volume
+		Expect(call("GET", "/volume"+query, nil, &described)).To(Equal(http.StatusOK))
+		Expect(described.Name).To(Equal(volume))
+		Expect(described.Backend).To(Equal("fake"))
+
+		Expect(call("GET", "/volume?volume=unknown", nil, nil)).To(Equal(http.StatusNotFound))
+	})
+
+	It("answers 400 when the volume parameter is missing", func() {
+		for _, route := range []struct{ method, path string }{
+			{"GET", "/volume"},
+			{"POST", "/volume/force-unmount"},
+			{"POST", "/volume/forget"},
+			{"POST", "/snapshots"},
+			{"POST", "/volume/restore"},
+			{"POST", "/volume/discard"},
+			{"POST", "/volume/commit"},
+			{"GET", "/audit/events"},
+		} {
+			var response voldriver.Error
+			Expect(call(route.method, route.path, struct{}{}, &response)).To(Equal(http.StatusBadRequest), route.path)
+			Expect(response.Description).To(ContainSubstring("'volume'"))
+		}
+	})
+
+	It("force-unmounts a volume for all consumers and audits it", func() {
+		Expect(tracker.Mount(logger, voldriver.MountRequest{Name: volume}).Err).To(BeEmpty())
+		Expect(tracker.Mount(logger, voldriver.MountRequest{Name: volume}).Err).To(BeEmpty())
+
+		var unmounted storage_admin.Volume
+		Expect(call("POST", "/volume/force-unmount"+query, nil, &unmounted)).To(Equal(http.StatusOK))
+		Expect(unmounted.MountCount).To(Equal(0))
+		Expect(unmounted.Health).To(Equal(storage_admin.HealthUnmounted))
+
+		events, err := auditor.Events(volume)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Operation).To(Equal("force-unmount"))
+		Expect(events[0].Result).To(Equal("success"))
+		Expect(events[0].Caller).To(Equal("10.0.0.5:41234"))
+		Expect(events[0].LocalPath).NotTo(BeEmpty())
+	})
+
+	It("forgets a volume and audits it", func() {
+		Expect(call("POST", "/volume/forget"+query, nil, nil)).To(Equal(http.StatusOK))
+		Expect(driver.Get(logger, voldriver.GetRequest{Name: volume}).Err).To(ContainSubstring("not found"))
+		Expect(operations()).To(Equal([]string{"forget success"}))
+
+		Expect(call("POST", "/volume/forget"+query, nil, nil)).To(Equal(http.StatusNotFound))
+		Expect(operations()).To(Equal([]string{"forget success"}))
+	})
+
+	It("audits a force-unmount that fails", func() {
+		Expect(tracker.Mount(logger, voldriver.MountRequest{Name: volume}).Err).To(BeEmpty())
+		driver.stuck = true
+
+		var response voldriver.Error
+		Expect(call("POST", "/volume/force-unmount"+query, nil, &response)).To(Equal(http.StatusConflict))
+		Expect(response.Description).To(ContainSubstring("device is busy"))
+
+		events, err := auditor.Events(volume)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].Result).To(Equal("failure"))
+		Expect(events[0].Err).To(ContainSubstring("device is busy"))
+	})
+
+	It("answers 501 for operations the backend does not support", func() {
+		Expect(call("POST", "/snapshots"+query, storage_admin.SnapshotRequest{Name: "snap"}, nil)).To(Equal(http.StatusNotImplemented))
+		Expect(call("POST", "/volume/discard"+query, nil, nil)).To(Equal(http.StatusNotImplemented))
+	})
+})
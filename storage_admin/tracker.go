@@ -0,0 +1,187 @@
+package storage_admin
+
+import (
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+)
+
+// VolumeState is what the driver has seen happen to a volume since it
+// started.
+type VolumeState struct {
+	CreatedAt       *time.Time     `json:"created_at,omitempty"`
+	LastMountedAt   *time.Time     `json:"last_mounted_at,omitempty"`
+	LastUnmountedAt *time.Time     `json:"last_unmounted_at,omitempty"`
+	LastError       string         `json:"last_error,omitempty"`
+	LastErrorAt     *time.Time     `json:"last_error_at,omitempty"`
+	Consumers       map[string]int `json:"consumers"`
+}
+
+// Tracker wraps a driver and keeps the state of every volume that passes
+// through it.
+type Tracker struct {
+	driver  voldriver.Driver
+	lock    sync.Mutex
+	volumes map[string]*VolumeState
+	now     func() time.Time
+}
+
+func NewTracker(driver voldriver.Driver) *Tracker {
+	return &Tracker{
+		driver:  driver,
+		volumes: map[string]*VolumeState{},
+		now:     time.Now,
+	}
+}
+
+// State returns a copy of the state of the volume called name.
+func (t *Tracker) State(name string) VolumeState {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	state := VolumeState{Consumers: map[string]int{}}
+	if volume, ok := t.volumes[name]; ok {
+		state = *volume
+		state.Consumers = map[string]int{}
+		for consumer, count := range volume.Consumers {
+			state.Consumers[consumer] = count
+		}
+	}
+	return state
+}
+
+// Forget drops the state of a volume the backend no longer knows.
+func (t *Tracker) Forget(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.volumes, name)
+}
+
+// ClearConsumers is called once a volume was unmounted for all of them.
+func (t *Tracker) ClearConsumers(name string) {
+	t.update(name, func(state *VolumeState, now time.Time) {
+		state.Consumers = map[string]int{}
+	})
+}
+
+// AddConsumer records a successful mount by consumer. Docker containers
+// (exclusive) hold a volume once however often they mount it, other consumers
+// are counted per mount.
+func (t *Tracker) AddConsumer(name, consumer string, exclusive bool) {
+	t.update(name, func(state *VolumeState, now time.Time) {
+		if exclusive {
+			state.Consumers[consumer] = 1
+		} else {
+			state.Consumers[consumer]++
+		}
+	})
+}
+
+func (t *Tracker) RemoveConsumer(name, consumer string, exclusive bool) {
+	t.update(name, func(state *VolumeState, now time.Time) {
+		state.Consumers[consumer]--
+		if exclusive || state.Consumers[consumer] <= 0 {
+			delete(state.Consumers, consumer)
+		}
+	})
+}
+
+func (t *Tracker) update(name string, change func(state *VolumeState, now time.Time)) {
+	if name == "" {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	state, ok := t.volumes[name]
+	if !ok {
+		state = &VolumeState{Consumers: map[string]int{}}
+		t.volumes[name] = state
+	}
+	change(state, t.now())
+}
+
+func (t *Tracker) recordError(name, err string) {
+	if err == "" {
+		return
+	}
+	t.update(name, func(state *VolumeState, now time.Time) {
+		state.LastError = err
+		state.LastErrorAt = &now
+	})
+}
+
+func (t *Tracker) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return t.driver.Activate(logger)
+}
+
+func (t *Tracker) Get(logger lager.Logger, getRequest voldriver.GetRequest) voldriver.GetResponse {
+	return t.driver.Get(logger, getRequest)
+}
+
+func (t *Tracker) List(logger lager.Logger) voldriver.ListResponse {
+	return t.driver.List(logger)
+}
+
+func (t *Tracker) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	response := t.driver.Create(logger, createRequest)
+	if response.Err != "" {
+		t.recordError(createRequest.Name, response.Err)
+		return response
+	}
+	t.update(createRequest.Name, func(state *VolumeState, now time.Time) {
+		// a repeated create of an existing volume is not a new volume
+		if state.CreatedAt == nil {
+			state.CreatedAt = &now
+		}
+	})
+	return response
+}
+
+func (t *Tracker) Mount(logger lager.Logger, mountRequest voldriver.MountRequest) voldriver.MountResponse {
+	response := t.driver.Mount(logger, mountRequest)
+	if response.Err != "" {
+		t.recordError(mountRequest.Name, response.Err)
+		return response
+	}
+	t.update(mountRequest.Name, func(state *VolumeState, now time.Time) {
+		state.LastMountedAt = &now
+	})
+	return response
+}
+
+func (t *Tracker) Path(logger lager.Logger, pathRequest voldriver.PathRequest) voldriver.PathResponse {
+	response := t.driver.Path(logger, pathRequest)
+	t.recordError(pathRequest.Name, response.Err)
+	return response
+}
+
+func (t *Tracker) Unmount(logger lager.Logger, unmountRequest voldriver.UnmountRequest) voldriver.ErrorResponse {
+	response := t.driver.Unmount(logger, unmountRequest)
+	if response.Err != "" {
+		t.recordError(unmountRequest.Name, response.Err)
+		return response
+	}
+	t.update(unmountRequest.Name, func(state *VolumeState, now time.Time) {
+		state.LastUnmountedAt = &now
+	})
+	return response
+}
+
+func (t *Tracker) Remove(logger lager.Logger, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse {
+	response := t.driver.Remove(logger, removeRequest)
+	if response.Err != "" {
+		t.recordError(removeRequest.Name, response.Err)
+		return response
+	}
+	t.Forget(removeRequest.Name)
+	return response
+}
+
+func (t *Tracker) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return t.driver.Capabilities(logger)
+}
@@ -0,0 +1,172 @@
+package storage_audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"../storage_redact"
+)
+
+type Event struct {
+	Timestamp    time.Time              `json:"timestamp"`
+	Operation    string                 `json:"operation"`
+	Volume       string                 `json:"volume"`
+	RemoteTarget string                 `json:"remote_target,omitempty"`
+	LocalPath    string                 `json:"local_path,omitempty"`
+	Caller       string                 `json:"caller"`
+	Result       string                 `json:"result"`
+	Err          string                 `json:"error,omitempty"`
+	Opts         map[string]interface{} `json:"opts,omitempty"`
+}
+
+// VolumeTargeter is implemented by backends that can tell which remote
+// share and local path a volume refers to.
+type VolumeTargeter interface {
+	VolumeTarget(name string) (remote string, local string, ok bool)
+}
+
+// Auditor appends events as json lines to a file and rotates it once it grows
+// beyond maxSize bytes, keeping at most maxBackups rotated files.
+type Auditor struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	redactor   *storage_redact.Redactor
+}
+
+func NewAuditor(path string, maxSize int64, maxBackups int, redactor *storage_redact.Redactor) (*Auditor, error) {
+	auditor := &Auditor{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		redactor:   redactor,
+	}
+	if err := auditor.open(); err != nil {
+		return nil, err
+	}
+	return auditor, nil
+}
+
+func (a *Auditor) SetRedactor(redactor *storage_redact.Redactor) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.redactor = redactor
+}
+
+func (a *Auditor) Record(event Event) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	event.Opts = a.redactor.Opts(event.Opts)
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	written, err := a.file.Write(line)
+	a.size += int64(written)
+	return err
+}
+
+// Events returns the recorded events of a volume, oldest first, including
+// those in rotated files.
+func (a *Auditor) Events(volume string) ([]Event, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	events := []Event{}
+	for i := a.maxBackups; i >= 0; i-- {
+		file, err := os.Open(a.backupPath(i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				continue
+			}
+			if event.Volume == volume {
+				events = append(events, event)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (a *Auditor) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.file.Close()
+}
+
+func (a *Auditor) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+func (a *Auditor) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	if a.maxBackups < 1 {
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return a.open()
+	}
+
+	for i := a.maxBackups - 1; i >= 0; i-- {
+		err := os.Rename(a.backupPath(i), a.backupPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return a.open()
+}
+
+func (a *Auditor) backupPath(index int) string {
+	if index == 0 {
+		return a.path
+	}
+	return fmt.Sprintf("%s.%d", a.path, index)
+}
+
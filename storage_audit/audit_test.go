@@ -0,0 +1,173 @@
+package storage_audit_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_audit"
+	"../storage_redact"
+)
+
+var _ = Describe("Auditor", func() {
+	var (
+		tempDir string
+		path    string
+		auditor *storage_audit.Auditor
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "audit")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(tempDir, "audit.log")
+	})
+
+	AfterEach(func() {
+		if auditor != nil {
+			auditor.Close()
+			auditor = nil
+		}
+		os.RemoveAll(tempDir)
+	})
+
+	newAuditor := func(maxSize int64, maxBackups int) {
+		var err error
+		auditor, err = storage_audit.NewAuditor(path, maxSize, maxBackups, storage_redact.NewRedactor(storage_redact.DefaultSensitiveOpts))
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	record := func(volume string, count int) {
+		for i := 0; i < count; i++ {
+			Expect(auditor.Record(storage_audit.Event{Operation: fmt.Sprintf("mount-%d", i), Volume: volume, Caller: "10.0.0.1", Result: "success"})).To(Succeed())
+		}
+	}
+
+	operations := func(events []storage_audit.Event) []string {
+		result := []string{}
+		for _, event := range events {
+			result = append(result, event.Operation)
+		}
+		return result
+	}
+
+	lines := func(path string) []string {
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	}
+
+	It("appends events as json lines to a file only root can read", func() {
+		newAuditor(0, 0)
+		record("vol", 2)
+
+		Expect(lines(path)).To(HaveLen(2))
+		Expect(lines(path)[0]).To(MatchRegexp(`^\{"timestamp":".*","operation":"mount-0","volume":"vol","caller":"10.0.0.1","result":"success"\}$`))
+
+		info, err := os.Stat(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("redacts the opts of an event", func() {
+		newAuditor(0, 0)
+		Expect(auditor.Record(storage_audit.Event{Operation: "create", Volume: "vol", Opts: map[string]interface{}{
+			"username": "alice",
+			"password": "s3cr3t",
+			"nested":   map[string]interface{}{"secret": "hidden"},
+		}})).To(Succeed())
+
+		Expect(lines(path)[0]).NotTo(ContainSubstring("s3cr3t"))
+		Expect(lines(path)[0]).NotTo(ContainSubstring("hidden"))
+
+		events, err := auditor.Events("vol")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events[0].Opts).To(Equal(map[string]interface{}{
+			"username": "alice",
+			"password": storage_redact.Redacted,
+			"nested":   map[string]interface{}{"secret": storage_redact.Redacted},
+		}))
+	})
+
+	It("redacts with the redactor it is given later", func() {
+		newAuditor(0, 0)
+		auditor.SetRedactor(storage_redact.NewRedactor(storage_redact.DefaultSensitiveOpts).With("username"))
+
+		Expect(auditor.Record(storage_audit.Event{Operation: "create", Volume: "vol", Opts: map[string]interface{}{"username": "alice"}})).To(Succeed())
+		Expect(lines(path)[0]).NotTo(ContainSubstring("alice"))
+	})
+
+	Context("rotation", func() {
+		var lineSize int64
+
+		BeforeEach(func() {
+			// every event of record has the same size
+			newAuditor(0, 0)
+			record("vol", 1)
+			info, err := os.Stat(path)
+			Expect(err).NotTo(HaveOccurred())
+			lineSize = info.Size()
+			Expect(auditor.Close()).To(Succeed())
+			Expect(os.Remove(path)).To(Succeed())
+		})
+
+		It("rotates once the file would grow beyond the max size and keeps the backups", func() {
+			newAuditor(3*lineSize, 2)
+			record("vol", 10)
+
+			Expect(lines(path)).To(HaveLen(1))
+			Expect(lines(path + ".1")).To(HaveLen(3))
+			Expect(lines(path + ".2")).To(HaveLen(3))
+			Expect(path + ".3").NotTo(BeAnExistingFile())
+
+			for _, file := range []string{path, path + ".1", path + ".2"} {
+				info, err := os.Stat(file)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(info.Size()).To(BeNumerically("<=", 3*lineSize))
+			}
+		})
+
+		It("returns the events of a volume across the rotated files, oldest first", func() {
+			newAuditor(3*lineSize, 2)
+			for i := 0; i < 7; i++ {
+				Expect(auditor.Record(storage_audit.Event{Operation: fmt.Sprintf("mount-%d", i), Volume: "vol", Caller: "10.0.0.1", Result: "success"})).To(Succeed())
+				Expect(auditor.Record(storage_audit.Event{Operation: fmt.Sprintf("mount-%d", i), Volume: "lov", Caller: "10.0.0.1", Result: "success"})).To(Succeed())
+			}
+			Expect(path + ".2").To(BeAnExistingFile())
+
+			events, err := auditor.Events("vol")
+			Expect(err).NotTo(HaveOccurred())
+			// three events a file, the six oldest fell out with the third backup
+			Expect(operations(events)).To(Equal([]string{"mount-3", "mount-4", "mount-5", "mount-6"}))
+		})
+
+		It("continues the size of an existing file", func() {
+			newAuditor(3*lineSize, 1)
+			record("vol", 2)
+			Expect(auditor.Close()).To(Succeed())
+
+			newAuditor(3*lineSize, 1)
+			record("vol", 2)
+
+			Expect(lines(path)).To(HaveLen(1))
+			Expect(lines(path + ".1")).To(HaveLen(3))
+		})
+
+		It("starts over without backups", func() {
+			newAuditor(3*lineSize, 0)
+			record("vol", 4)
+
+			Expect(lines(path)).To(HaveLen(1))
+			Expect(path + ".1").NotTo(BeAnExistingFile())
+
+			events, err := auditor.Events("vol")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(operations(events)).To(Equal([]string{"mount-3"}))
+		})
+	})
+})
@@ -0,0 +1,103 @@
+package storage_audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"../storage_http"
+)
+
+var auditedRoutes = map[string]string{
+	voldriver.CreateRoute:  "create",
+	voldriver.MountRoute:   "mount",
+	voldriver.UnmountRoute: "unmount",
+	voldriver.RemoveRoute:  "remove",
+}
+
+type auditedRequest struct {
+	Name string
+	Opts map[string]interface{}
+}
+
+type auditedResponse struct {
+	Err        string
+	Mountpoint string
+}
+
+// NewAuditHandler records the volume lifecycle requests served by handler.
+func NewAuditHandler(logger lager.Logger, handler http.Handler, auditor *Auditor, targeter VolumeTargeter) http.Handler {
+	logger = logger.Session("audit")
+
+	paths := map[string]string{}
+	for _, route := range voldriver.Routes {
+		if operation, ok := auditedRoutes[route.Name]; ok {
+			paths[route.Path] = operation
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		operation, ok := paths[req.URL.Path]
+		if !ok {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			logger.Error("failed-reading-request-body", err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var request auditedRequest
+		json.Unmarshal(body, &request)
+
+		event := Event{
+			Operation: operation,
+			Volume:    request.Name,
+			Caller:    req.RemoteAddr,
+			Opts:      request.Opts,
+		}
+		describe(targeter, &event)
+
+		recorder := storage_http.NewResponseRecorder(w)
+		handler.ServeHTTP(recorder, req)
+
+		var response auditedResponse
+		json.Unmarshal(recorder.Body(), &response)
+
+		event.Timestamp = time.Now().UTC()
+		event.Result = "success"
+		if response.Err != "" {
+			event.Result = "failure"
+			event.Err = response.Err
+		}
+		if response.Mountpoint != "" {
+			event.LocalPath = response.Mountpoint
+		}
+		if event.RemoteTarget == "" {
+			describe(targeter, &event)
+		}
+
+		if err := auditor.Record(event); err != nil {
+			logger.Error("failed-recording-event", err, lager.Data{"operation": operation, "volume": request.Name})
+		}
+	})
+}
+
+func describe(targeter VolumeTargeter, event *Event) {
+	if targeter == nil {
+		return
+	}
+	if remote, local, ok := targeter.VolumeTarget(event.Volume); ok {
+		event.RemoteTarget = remote
+		if event.LocalPath == "" {
+			event.LocalPath = local
+		}
+	}
+}
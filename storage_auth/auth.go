@@ -0,0 +1,62 @@
+package storage_auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	cf_http_handlers "code.cloudfoundry.org/cfhttp/handlers"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+const bearerPrefix = "Bearer "
+
+// AuthDriverSpec is the json driver spec with the token a client has to send.
+type AuthDriverSpec struct {
+	voldriver.DriverSpec
+	Token string `json:"Token,omitempty"`
+}
+
+func ReadToken(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", errors.New("token file '" + path + "' is empty")
+	}
+	return token, nil
+}
+
+// NewAuthHandler only passes requests carrying "Authorization: Bearer <token>"
+// on to handler. Like the driver handlers it answers rejected requests with 200
+// and the reason in Err, because Docker style clients ignore the status code.
+func NewAuthHandler(logger lager.Logger, handler http.Handler, token string) http.Handler {
+	logger = logger.Session("auth")
+	expected := []byte(token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !Authorized(req, expected) {
+			logger.Info("unauthorized-request", lager.Data{"path": req.URL.Path, "remote_addr": req.RemoteAddr})
+			cf_http_handlers.WriteJSONResponse(w, driverhttp.StatusInternalServerError, voldriver.ErrorResponse{Err: "Unauthorized: missing or invalid bearer token"})
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func Authorized(req *http.Request, expected []byte) bool {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return false
+	}
+
+	provided := []byte(strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix)))
+	return subtle.ConstantTimeCompare(provided, expected) == 1
+}
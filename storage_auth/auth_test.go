@@ -0,0 +1,121 @@
+package storage_auth_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	"../storage_auth"
+)
+
+var _ = Describe("Auth", func() {
+	Context("Authorized", func() {
+		var req *http.Request
+
+		BeforeEach(func() {
+			req = httptest.NewRequest("POST", "/VolumeDriver.Create", nil)
+		})
+
+		It("accepts the bearer token", func() {
+			req.Header.Set("Authorization", "Bearer s3cr3t")
+			Expect(storage_auth.Authorized(req, []byte("s3cr3t"))).To(BeTrue())
+		})
+
+		It("refuses a request without a token", func() {
+			Expect(storage_auth.Authorized(req, []byte("s3cr3t"))).To(BeFalse())
+		})
+
+		It("refuses a wrong token", func() {
+			req.Header.Set("Authorization", "Bearer guessed")
+			Expect(storage_auth.Authorized(req, []byte("s3cr3t"))).To(BeFalse())
+		})
+
+		It("refuses a token that is not a bearer token", func() {
+			req.Header.Set("Authorization", "Basic s3cr3t")
+			Expect(storage_auth.Authorized(req, []byte("s3cr3t"))).To(BeFalse())
+		})
+	})
+
+	Context("NewAuthHandler", func() {
+		var (
+			logger  *lagertest.TestLogger
+			called  bool
+			handler http.Handler
+		)
+
+		BeforeEach(func() {
+			logger = lagertest.NewTestLogger("auth")
+			called = false
+			handler = storage_auth.NewAuthHandler(logger, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				called = true
+				w.WriteHeader(http.StatusOK)
+			}), "s3cr3t")
+		})
+
+		serve := func(header string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/VolumeDriver.Create", nil)
+			if header != "" {
+				req.Header.Set("Authorization", header)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		It("passes an authorized request on", func() {
+			Expect(serve("Bearer s3cr3t").Code).To(Equal(http.StatusOK))
+			Expect(called).To(BeTrue())
+		})
+
+		It("answers a missing or wrong token with 200 and the reason in Err", func() {
+			for _, header := range []string{"", "Bearer guessed"} {
+				recorder := serve(header)
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+
+				var response voldriver.ErrorResponse
+				Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+				Expect(response.Err).To(Equal("Unauthorized: missing or invalid bearer token"))
+			}
+			Expect(called).To(BeFalse())
+			Expect(logger.Buffer()).To(gbytes.Say("unauthorized-request"))
+		})
+	})
+
+	Context("ReadToken", func() {
+		var tempDir string
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "auth")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tempDir)
+		})
+
+		It("trims the token", func() {
+			path := filepath.Join(tempDir, "token")
+			Expect(ioutil.WriteFile(path, []byte("s3cr3t\n"), 0600)).To(Succeed())
+
+			Expect(storage_auth.ReadToken(path)).To(Equal("s3cr3t"))
+		})
+
+		It("refuses an empty token", func() {
+			path := filepath.Join(tempDir, "token")
+			Expect(ioutil.WriteFile(path, []byte(" \n"), 0600)).To(Succeed())
+
+			_, err := storage_auth.ReadToken(path)
+			Expect(err).To(MatchError("token file '" + path + "' is empty"))
+		})
+	})
+})
@@ -0,0 +1,86 @@
+package storage_auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/http_wrap"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+// SpecExtensions are the kinds of driver specs volman reads, in the order it
+// prefers them.
+var SpecExtensions = []string{".sock", ".spec", ".json"}
+
+// FindDriverSpec returns the spec file of the driver named driver in
+// driversPath.
+func FindDriverSpec(driversPath, driver string) (string, error) {
+	for _, extension := range SpecExtensions {
+		path := filepath.Join(driversPath, driver+extension)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no spec for driver '%s' in '%s'", driver, driversPath)
+}
+
+// ReadDriverSpec reads the spec at path. The address of a socket spec is the
+// socket itself.
+func ReadDriverSpec(path string) (AuthDriverSpec, error) {
+	var spec AuthDriverSpec
+
+	switch filepath.Ext(path) {
+	case ".sock":
+		spec.Address = path
+	case ".spec":
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return spec, err
+		}
+		spec.Address = strings.TrimSpace(string(contents))
+	case ".json":
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return spec, err
+		}
+		if err := json.Unmarshal(contents, &spec); err != nil {
+			return spec, fmt.Errorf("invalid driver spec '%s': %s", path, err.Error())
+		}
+	default:
+		return spec, fmt.Errorf("unknown driver spec '%s'", path)
+	}
+	return spec, nil
+}
+
+// NewRemoteClient connects to the driver of spec and sends its token, if it
+// has one, with every request. driverhttp.NewRemoteClient alone never sends a
+// token.
+func NewRemoteClient(spec AuthDriverSpec) (voldriver.Driver, error) {
+	// the unix client wants the socket path, not a unix:// url
+	address := strings.TrimPrefix(spec.Address, "unix://")
+	client, err := driverhttp.NewRemoteClient(address, spec.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.Token != "" {
+		client.HttpClient = &bearerClient{client: client.HttpClient, token: spec.Token}
+	}
+	return client, nil
+}
+
+type bearerClient struct {
+	client http_wrap.Client
+	token  string
+}
+
+func (c *bearerClient) Do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", bearerPrefix+c.token)
+	return c.client.Do(req)
+}
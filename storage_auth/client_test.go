@@ -0,0 +1,97 @@
+package storage_auth_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_auth"
+	"../storage_config"
+	"../storage_local/fake"
+)
+
+var _ = Describe("Client", func() {
+	var (
+		logger      *lagertest.TestLogger
+		tempDir     string
+		driversPath string
+		server      *httptest.Server
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "auth-client")
+		Expect(err).NotTo(HaveOccurred())
+		driversPath = filepath.Join(tempDir, "drivers")
+		Expect(os.MkdirAll(driversPath, 0700)).To(Succeed())
+
+		logger = lagertest.NewTestLogger("client")
+		driver := storage_fakedriver.NewFakeDriver(filepath.Join(tempDir, "fake"))
+		Expect(driver.Reload(logger, storage_config.DefaultConfig())).To(Succeed())
+
+		handler, err := driverhttp.NewHandler(logger, driver)
+		Expect(err).NotTo(HaveOccurred())
+		server = httptest.NewServer(storage_auth.NewAuthHandler(logger, handler, "s3cr3t"))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	// writeSpec writes the json spec the way the driver server does
+	writeSpec := func(token string) {
+		spec := storage_auth.AuthDriverSpec{
+			DriverSpec: voldriver.DriverSpec{Name: "fakedriver", Address: server.URL},
+			Token:      token,
+		}
+		specJson, err := json.Marshal(spec)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(voldriver.WriteDriverSpec(logger, driversPath, "fakedriver", "json", specJson)).To(Succeed())
+	}
+
+	connect := func() voldriver.Driver {
+		path, err := storage_auth.FindDriverSpec(driversPath, "fakedriver")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(path).To(Equal(filepath.Join(driversPath, "fakedriver.json")))
+
+		spec, err := storage_auth.ReadDriverSpec(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		client, err := storage_auth.NewRemoteClient(spec)
+		Expect(err).NotTo(HaveOccurred())
+		return client
+	}
+
+	It("sends the token of the json spec with every request", func() {
+		writeSpec("s3cr3t")
+		client := connect()
+
+		Expect(client.Activate(logger).Err).To(BeEmpty())
+		Expect(client.Create(logger, voldriver.CreateRequest{Name: "vol"}).Err).To(BeEmpty())
+		Expect(client.List(logger).Volumes).To(ConsistOf(voldriver.VolumeInfo{Name: "vol"}))
+	})
+
+	It("is refused with a wrong token", func() {
+		writeSpec("guessed")
+		Expect(connect().Activate(logger).Err).To(Equal("Unauthorized: missing or invalid bearer token"))
+	})
+
+	It("is refused without a token", func() {
+		writeSpec("")
+		Expect(connect().Activate(logger).Err).To(Equal("Unauthorized: missing or invalid bearer token"))
+	})
+
+	It("finds no spec for an unknown driver", func() {
+		_, err := storage_auth.FindDriverSpec(driversPath, "otherdriver")
+		Expect(err).To(MatchError("no spec for driver 'otherdriver' in '" + driversPath + "'"))
+	})
+})
@@ -0,0 +1,287 @@
+package storage_broker
+
+import (
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	ServiceId           = "cf-storage-driver-volume"
+	NfsPlanId           = "cf-storage-driver-nfs"
+	LocalPlanId         = "cf-storage-driver-local"
+	RequiresVolumeMount = "volume_mount"
+	NfsMountsRoot       = "/var/vcap/data/volumes/nfs"
+)
+
+type Plan struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Free        bool   `json:"free"`
+
+	driver string
+}
+
+type Service struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Bindable    bool     `json:"bindable"`
+	Requires    []string `json:"requires"`
+	Plans       []Plan   `json:"plans"`
+}
+
+type Catalog struct {
+	Services []Service `json:"services"`
+}
+
+type ProvisionDetails struct {
+	ServiceId  string                 `json:"service_id"`
+	PlanId     string                 `json:"plan_id"`
+	OrgGuid    string                 `json:"organization_guid"`
+	SpaceGuid  string                 `json:"space_guid"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+type BindDetails struct {
+	ServiceId  string                 `json:"service_id"`
+	PlanId     string                 `json:"plan_id"`
+	AppGuid    string                 `json:"app_guid"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+type SharedDevice struct {
+	VolumeId    string                 `json:"volume_id"`
+	MountConfig map[string]interface{} `json:"mount_config"`
+}
+
+type VolumeMount struct {
+	Driver       string       `json:"driver"`
+	ContainerDir string       `json:"container_dir"`
+	Mode         string       `json:"mode"`
+	DeviceType   string       `json:"device_type"`
+	Device       SharedDevice `json:"device"`
+}
+
+type BindResponse struct {
+	Credentials  map[string]interface{} `json:"credentials"`
+	VolumeMounts []VolumeMount          `json:"volume_mounts"`
+}
+
+// BrokerError carries the status code the Open Service Broker API defines for
+// a failure.
+type BrokerError struct {
+	Status      int
+	Description string
+}
+
+func (e *BrokerError) Error() string {
+	return e.Description
+}
+
+func badRequest(description string) error {
+	return &BrokerError{Status: http.StatusBadRequest, Description: description}
+}
+
+var (
+	ErrInstanceExists = &BrokerError{Status: http.StatusConflict, Description: "service instance already exists with different parameters"}
+	ErrBindingExists  = &BrokerError{Status: http.StatusConflict, Description: "service binding already exists with different parameters"}
+	ErrGone           = &BrokerError{Status: http.StatusGone, Description: "does not exist"}
+)
+
+// Broker provisions volumes of the nfs and local drivers for Cloud Foundry.
+// Provisioning only records the mount config; the driver creates the volume
+// when the first app using it is started.
+type Broker struct {
+	store *Store
+	plans map[string]Plan
+}
+
+func NewBroker(store *Store) *Broker {
+	plans := map[string]Plan{}
+	for _, plan := range []Plan{
+		{Id: NfsPlanId, Name: "nfs", Description: "Existing NFS export, mounted by the nfs driver", Free: true, driver: "nfsdriver"},
+		{Id: LocalPlanId, Name: "local", Description: "Directory on the cell, for testing only", Free: true, driver: "localdriver"},
+	} {
+		plans[plan.Id] = plan
+	}
+	return &Broker{store: store, plans: plans}
+}
+
+func (b *Broker) Catalog() Catalog {
+	plans := []Plan{b.plans[NfsPlanId], b.plans[LocalPlanId]}
+	return Catalog{Services: []Service{{
+		Id:          ServiceId,
+		Name:        "storage-volume",
+		Description: "Persistent volumes mounted by cf-storage-driver",
+		Bindable:    true,
+		Requires:    []string{RequiresVolumeMount},
+		Plans:       plans,
+	}}}
+}
+
+// Provision returns false when an identical instance already exists.
+func (b *Broker) Provision(logger lager.Logger, instanceId string, details ProvisionDetails) (bool, error) {
+	logger = logger.Session("provision", lager.Data{"instance_id": instanceId, "plan_id": details.PlanId})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if instanceId == "" || instanceId == "." || instanceId == ".." || strings.Contains(instanceId, "/") {
+		return false, badRequest("invalid instance_id '" + instanceId + "'")
+	}
+	if details.ServiceId != ServiceId {
+		return false, badRequest("unknown service_id '" + details.ServiceId + "'")
+	}
+	mountConfig, err := b.mountConfig(instanceId, details.PlanId, details.Parameters)
+	if err != nil {
+		return false, err
+	}
+
+	instance := ServiceInstance{
+		PlanId:      details.PlanId,
+		OrgGuid:     details.OrgGuid,
+		SpaceGuid:   details.SpaceGuid,
+		MountConfig: mountConfig,
+	}
+	existing, created, err := b.store.PutInstanceIfAbsent(instanceId, instance)
+	if err != nil || created {
+		return created, err
+	}
+	if !reflect.DeepEqual(existing, instance) {
+		return false, ErrInstanceExists
+	}
+	return false, nil
+}
+
+func (b *Broker) mountConfig(instanceId, planId string, parameters map[string]interface{}) (map[string]interface{}, error) {
+	switch planId {
+	case NfsPlanId:
+		share, _ := parameters["share"].(string)
+		separator := strings.Index(share, ":/")
+		if separator < 1 {
+			return nil, badRequest("parameter 'share' must have the form '<server>:/<export>'")
+		}
+		opts, ok := parameters["opts"].(string)
+		if _, present := parameters["opts"]; present && !ok {
+			return nil, badRequest("parameter 'opts' must be a string")
+		}
+		return map[string]interface{}{
+			"remoteinfo":       share[:separator],
+			"remotemountpoint": share[separator+1:],
+			"localmountpoint":  path.Join(NfsMountsRoot, instanceId),
+			"opts":             opts,
+		}, nil
+	case LocalPlanId:
+		mountConfig := map[string]interface{}{}
+		for key, value := range parameters {
+			if key != "readonly" && key != "propagation" {
+				return nil, badRequest("the local plan only accepts the parameters 'readonly' and 'propagation'")
+			}
+			mountConfig[key] = value
+		}
+		return mountConfig, nil
+	}
+	return nil, badRequest("unknown plan_id '" + planId + "'")
+}
+
+func (b *Broker) Deprovision(logger lager.Logger, instanceId string) error {
+	logger = logger.Session("deprovision", lager.Data{"instance_id": instanceId})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	switch err := b.store.DeleteInstanceIfUnbound(instanceId); err {
+	case errNoInstance:
+		return ErrGone
+	case errBound:
+		return badRequest(err.Error())
+	default:
+		return err
+	}
+}
+
+// Bind returns false when an identical binding already exists.
+func (b *Broker) Bind(logger lager.Logger, instanceId, bindingId string, details BindDetails) (BindResponse, bool, error) {
+	logger = logger.Session("bind", lager.Data{"instance_id": instanceId, "binding_id": bindingId})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if _, ok := b.store.Instance(instanceId); !ok {
+		return BindResponse{}, false, badRequest("service instance '" + instanceId + "' does not exist")
+	}
+	if details.AppGuid == "" {
+		return BindResponse{}, false, &BrokerError{Status: http.StatusUnprocessableEntity, Description: "only app bindings are supported"}
+	}
+
+	binding := ServiceBinding{
+		InstanceId:   instanceId,
+		AppGuid:      details.AppGuid,
+		ContainerDir: path.Join("/var/vcap/data", instanceId),
+	}
+	for key, value := range details.Parameters {
+		switch key {
+		case "mount":
+			dir, ok := value.(string)
+			if !ok || !path.IsAbs(dir) {
+				return BindResponse{}, false, badRequest("parameter 'mount' must be an absolute path")
+			}
+			binding.ContainerDir = path.Clean(dir)
+		case "readonly":
+			readOnly, ok := value.(bool)
+			if !ok {
+				return BindResponse{}, false, badRequest("parameter 'readonly' must be a boolean")
+			}
+			binding.ReadOnly = readOnly
+		default:
+			return BindResponse{}, false, badRequest("unknown bind parameter '" + key + "', use 'mount' or 'readonly'")
+		}
+	}
+
+	// the instance may have been deprovisioned since it was looked up
+	instance, existing, created, err := b.store.PutBindingIfAbsent(bindingId, binding)
+	if err == errNoInstance {
+		return BindResponse{}, false, badRequest("service instance '" + instanceId + "' does not exist")
+	}
+	if err != nil {
+		return BindResponse{}, false, err
+	}
+	if !created && existing != binding {
+		return BindResponse{}, false, ErrBindingExists
+	}
+
+	return b.bindResponse(instanceId, instance, binding), created, nil
+}
+
+func (b *Broker) bindResponse(instanceId string, instance ServiceInstance, binding ServiceBinding) BindResponse {
+	mode := "rw"
+	if binding.ReadOnly {
+		mode = "r"
+	}
+	return BindResponse{
+		Credentials: map[string]interface{}{},
+		VolumeMounts: []VolumeMount{{
+			Driver:       b.plans[instance.PlanId].driver,
+			ContainerDir: binding.ContainerDir,
+			Mode:         mode,
+			DeviceType:   "shared",
+			Device: SharedDevice{
+				VolumeId:    instanceId,
+				MountConfig: instance.MountConfig,
+			},
+		}},
+	}
+}
+
+func (b *Broker) Unbind(logger lager.Logger, bindingId string) error {
+	logger = logger.Session("unbind", lager.Data{"binding_id": bindingId})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := b.store.DeleteBinding(bindingId); err != errNoBinding {
+		return err
+	}
+	return ErrGone
+}
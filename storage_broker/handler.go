@@ -0,0 +1,137 @@
+package storage_broker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	cf_http_handlers "code.cloudfoundry.org/cfhttp/handlers"
+	"code.cloudfoundry.org/lager"
+	"github.com/tedsuo/rata"
+)
+
+const (
+	CatalogRoute     = "Catalog"
+	ProvisionRoute   = "Provision"
+	DeprovisionRoute = "Deprovision"
+	BindRoute        = "Bind"
+	UnbindRoute      = "Unbind"
+)
+
+var Routes = rata.Routes{
+	{Path: "/v2/catalog", Method: "GET", Name: CatalogRoute},
+	{Path: "/v2/service_instances/:instance_id", Method: "PUT", Name: ProvisionRoute},
+	{Path: "/v2/service_instances/:instance_id", Method: "DELETE", Name: DeprovisionRoute},
+	{Path: "/v2/service_instances/:instance_id/service_bindings/:binding_id", Method: "PUT", Name: BindRoute},
+	{Path: "/v2/service_instances/:instance_id/service_bindings/:binding_id", Method: "DELETE", Name: UnbindRoute},
+}
+
+type errorResponse struct {
+	Description string `json:"description"`
+}
+
+var empty = struct{}{}
+
+// NewHandler serves the Open Service Broker API v2 for broker, guarded by
+// basic auth with the given credentials.
+func NewHandler(logger lager.Logger, broker *Broker, username, password string) (http.Handler, error) {
+	logger = logger.Session("broker")
+
+	handlers := rata.Handlers{
+		CatalogRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, broker.Catalog())
+		}),
+
+		ProvisionRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var details ProvisionDetails
+			if !decode(w, req, &details) {
+				return
+			}
+			created, err := broker.Provision(logger, rata.Param(req, "instance_id"), details)
+			if err != nil {
+				writeError(logger, w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, status(created), empty)
+		}),
+
+		DeprovisionRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if err := broker.Deprovision(logger, rata.Param(req, "instance_id")); err != nil {
+				writeError(logger, w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, empty)
+		}),
+
+		BindRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var details BindDetails
+			if !decode(w, req, &details) {
+				return
+			}
+			response, created, err := broker.Bind(logger, rata.Param(req, "instance_id"), rata.Param(req, "binding_id"), details)
+			if err != nil {
+				writeError(logger, w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, status(created), response)
+		}),
+
+		UnbindRoute: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if err := broker.Unbind(logger, rata.Param(req, "binding_id")); err != nil {
+				writeError(logger, w, err)
+				return
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, empty)
+		}),
+	}
+
+	router, err := rata.NewRouter(Routes, handlers)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, pass, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			logger.Info("unauthorized", lager.Data{"remote": req.RemoteAddr})
+			w.Header().Set("WWW-Authenticate", `Basic realm="cf-storage-driver broker"`)
+			cf_http_handlers.WriteJSONResponse(w, http.StatusUnauthorized, errorResponse{Description: "Unauthorized"})
+			return
+		}
+		if req.Header.Get("X-Broker-API-Version") == "" {
+			cf_http_handlers.WriteJSONResponse(w, http.StatusPreconditionFailed, errorResponse{Description: "Missing X-Broker-API-Version header"})
+			return
+		}
+		router.ServeHTTP(w, req)
+	}), nil
+}
+
+func status(created bool) int {
+	if created {
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
+
+func decode(w http.ResponseWriter, req *http.Request, details interface{}) bool {
+	if err := json.NewDecoder(req.Body).Decode(details); err != nil {
+		cf_http_handlers.WriteJSONResponse(w, http.StatusBadRequest, errorResponse{Description: "Invalid request body: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+func writeError(logger lager.Logger, w http.ResponseWriter, err error) {
+	if brokerErr, ok := err.(*BrokerError); ok {
+		if brokerErr.Status == http.StatusGone {
+			cf_http_handlers.WriteJSONResponse(w, http.StatusGone, empty)
+			return
+		}
+		cf_http_handlers.WriteJSONResponse(w, brokerErr.Status, errorResponse{Description: brokerErr.Description})
+		return
+	}
+	logger.Error("broker-failure", err)
+	cf_http_handlers.WriteJSONResponse(w, http.StatusInternalServerError, errorResponse{Description: err.Error()})
+}
@@ -0,0 +1,274 @@
+package storage_broker_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_broker"
+)
+
+var _ = Describe("Broker API", func() {
+	var (
+		logger    *lagertest.TestLogger
+		tempDir   string
+		stateFile string
+		handler   http.Handler
+	)
+
+	newHandler := func() http.Handler {
+		store, err := storage_broker.NewStore(stateFile)
+		Expect(err).NotTo(HaveOccurred())
+		handler, err := storage_broker.NewHandler(logger, storage_broker.NewBroker(store), "broker", "secret")
+		Expect(err).NotTo(HaveOccurred())
+		return handler
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "broker")
+		Expect(err).NotTo(HaveOccurred())
+		stateFile = filepath.Join(tempDir, "broker", "state.json")
+
+		logger = lagertest.NewTestLogger("broker")
+		handler = newHandler()
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	call := func(method, path string, body interface{}) (int, map[string]interface{}) {
+		var reader *bytes.Reader
+		if body != nil {
+			contents, err := json.Marshal(body)
+			Expect(err).NotTo(HaveOccurred())
+			reader = bytes.NewReader(contents)
+		} else {
+			reader = bytes.NewReader(nil)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.SetBasicAuth("broker", "secret")
+		req.Header.Set("X-Broker-API-Version", "2.13")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		response := map[string]interface{}{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		return recorder.Code, response
+	}
+
+	nfsInstance := func(share string) storage_broker.ProvisionDetails {
+		return storage_broker.ProvisionDetails{
+			ServiceId:  storage_broker.ServiceId,
+			PlanId:     storage_broker.NfsPlanId,
+			OrgGuid:    "org",
+			SpaceGuid:  "space",
+			Parameters: map[string]interface{}{"share": share},
+		}
+	}
+
+	provision := func(instanceId string, details storage_broker.ProvisionDetails) int {
+		code, _ := call("PUT", "/v2/service_instances/"+instanceId, details)
+		return code
+	}
+
+	bindDetails := storage_broker.BindDetails{ServiceId: storage_broker.ServiceId, PlanId: storage_broker.NfsPlanId, AppGuid: "app"}
+
+	bind := func(instanceId, bindingId string, details storage_broker.BindDetails) (int, map[string]interface{}) {
+		return call("PUT", "/v2/service_instances/"+instanceId+"/service_bindings/"+bindingId, details)
+	}
+
+	It("requires basic auth and the api version", func() {
+		req := httptest.NewRequest("GET", "/v2/catalog", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+
+		req.SetBasicAuth("broker", "secret")
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusPreconditionFailed))
+	})
+
+	It("serves the catalog", func() {
+		code, catalog := call("GET", "/v2/catalog", nil)
+		Expect(code).To(Equal(http.StatusOK))
+		services := catalog["services"].([]interface{})
+		Expect(services).To(HaveLen(1))
+		Expect(services[0].(map[string]interface{})["requires"]).To(ConsistOf(storage_broker.RequiresVolumeMount))
+	})
+
+	Describe("provision", func() {
+		It("creates the instance once and returns 200 for the same request", func() {
+			Expect(provision("instance", nfsInstance("server:/export"))).To(Equal(http.StatusCreated))
+			Expect(provision("instance", nfsInstance("server:/export"))).To(Equal(http.StatusOK))
+		})
+
+		It("returns 409 for the same id with other parameters", func() {
+			Expect(provision("instance", nfsInstance("server:/export"))).To(Equal(http.StatusCreated))
+			Expect(provision("instance", nfsInstance("server:/other"))).To(Equal(http.StatusConflict))
+		})
+
+		It("creates one instance for concurrent requests with other parameters", func() {
+			codes := make(chan int, 10)
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					codes <- provision("instance", nfsInstance(fmt.Sprintf("server:/export%d", i)))
+				}(i)
+			}
+			wg.Wait()
+			close(codes)
+
+			counts := map[int]int{}
+			for code := range codes {
+				counts[code]++
+			}
+			Expect(counts).To(Equal(map[int]int{http.StatusCreated: 1, http.StatusConflict: 9}))
+		})
+
+		It("rejects unknown plans and malformed shares", func() {
+			details := nfsInstance("server:/export")
+			details.PlanId = "unknown"
+			Expect(provision("instance", details)).To(Equal(http.StatusBadRequest))
+			Expect(provision("instance", nfsInstance("export"))).To(Equal(http.StatusBadRequest))
+		})
+
+		It("keeps the instances across restarts", func() {
+			Expect(provision("instance", nfsInstance("server:/export"))).To(Equal(http.StatusCreated))
+
+			handler = newHandler()
+			Expect(provision("instance", nfsInstance("server:/export"))).To(Equal(http.StatusOK))
+			info, err := os.Stat(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+	})
+
+	Describe("bind", func() {
+		BeforeEach(func() {
+			Expect(provision("instance", nfsInstance("server:/export"))).To(Equal(http.StatusCreated))
+		})
+
+		It("returns the volume mount of the instance", func() {
+			code, response := bind("instance", "binding", bindDetails)
+			Expect(code).To(Equal(http.StatusCreated))
+
+			mounts := response["volume_mounts"].([]interface{})
+			Expect(mounts).To(HaveLen(1))
+			mount := mounts[0].(map[string]interface{})
+			Expect(mount["driver"]).To(Equal("nfsdriver"))
+			Expect(mount["container_dir"]).To(Equal("/var/vcap/data/instance"))
+			Expect(mount["mode"]).To(Equal("rw"))
+			Expect(mount["device_type"]).To(Equal("shared"))
+
+			device := mount["device"].(map[string]interface{})
+			Expect(device["volume_id"]).To(Equal("instance"))
+			Expect(device["mount_config"]).To(Equal(map[string]interface{}{
+				"remoteinfo":       "server",
+				"remotemountpoint": "/export",
+				"localmountpoint":  storage_broker.NfsMountsRoot + "/instance",
+				"opts":             "",
+			}))
+		})
+
+		It("returns 200 for the same request and 409 for other parameters", func() {
+			code, _ := bind("instance", "binding", bindDetails)
+			Expect(code).To(Equal(http.StatusCreated))
+			code, response := bind("instance", "binding", bindDetails)
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(response["volume_mounts"]).To(HaveLen(1))
+
+			details := bindDetails
+			details.Parameters = map[string]interface{}{"readonly": true}
+			code, _ = bind("instance", "binding", details)
+			Expect(code).To(Equal(http.StatusConflict))
+		})
+
+		It("rejects bindings of unknown instances and without an app", func() {
+			code, _ := bind("unknown", "binding", bindDetails)
+			Expect(code).To(Equal(http.StatusBadRequest))
+
+			details := bindDetails
+			details.AppGuid = ""
+			code, _ = bind("instance", "binding", details)
+			Expect(code).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("returns 410 for an unknown binding on unbind", func() {
+			code, _ := bind("instance", "binding", bindDetails)
+			Expect(code).To(Equal(http.StatusCreated))
+
+			code, _ = call("DELETE", "/v2/service_instances/instance/service_bindings/binding", nil)
+			Expect(code).To(Equal(http.StatusOK))
+			code, _ = call("DELETE", "/v2/service_instances/instance/service_bindings/binding", nil)
+			Expect(code).To(Equal(http.StatusGone))
+		})
+	})
+
+	Describe("deprovision", func() {
+		BeforeEach(func() {
+			Expect(provision("instance", nfsInstance("server:/export"))).To(Equal(http.StatusCreated))
+		})
+
+		It("deletes the instance and returns 410 afterwards", func() {
+			code, _ := call("DELETE", "/v2/service_instances/instance", nil)
+			Expect(code).To(Equal(http.StatusOK))
+			code, _ = call("DELETE", "/v2/service_instances/instance", nil)
+			Expect(code).To(Equal(http.StatusGone))
+		})
+
+		It("refuses an instance with bindings", func() {
+			code, _ := bind("instance", "binding", bindDetails)
+			Expect(code).To(Equal(http.StatusCreated))
+
+			code, response := call("DELETE", "/v2/service_instances/instance", nil)
+			Expect(code).To(Equal(http.StatusBadRequest))
+			Expect(response["description"]).To(Equal("service instance still has bindings"))
+		})
+
+		It("never leaves a binding to a deleted instance when racing a bind", func() {
+			for i := 0; i < 20; i++ {
+				instanceId := fmt.Sprintf("racing-%d", i)
+				Expect(provision(instanceId, nfsInstance("server:/export"))).To(Equal(http.StatusCreated))
+
+				var bindCode, deprovisionCode int
+				var wg sync.WaitGroup
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+					defer GinkgoRecover()
+					bindCode, _ = bind(instanceId, "binding-"+instanceId, bindDetails)
+				}()
+				go func() {
+					defer wg.Done()
+					defer GinkgoRecover()
+					deprovisionCode, _ = call("DELETE", "/v2/service_instances/"+instanceId, nil)
+				}()
+				wg.Wait()
+
+				if bindCode == http.StatusCreated {
+					Expect(deprovisionCode).To(Equal(http.StatusBadRequest))
+				} else {
+					Expect(bindCode).To(Equal(http.StatusBadRequest))
+					Expect(deprovisionCode).To(Equal(http.StatusOK))
+				}
+			}
+		})
+	})
+})
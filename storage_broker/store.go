@@ -0,0 +1,174 @@
+package storage_broker
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type ServiceInstance struct {
+	PlanId      string                 `json:"plan_id"`
+	OrgGuid     string                 `json:"organization_guid"`
+	SpaceGuid   string                 `json:"space_guid"`
+	MountConfig map[string]interface{} `json:"mount_config"`
+}
+
+type ServiceBinding struct {
+	InstanceId   string `json:"instance_id"`
+	AppGuid      string `json:"app_guid"`
+	ContainerDir string `json:"container_dir"`
+	ReadOnly     bool   `json:"readonly"`
+}
+
+var (
+	errNoInstance = errors.New("service instance does not exist")
+	errNoBinding  = errors.New("service binding does not exist")
+	errBound      = errors.New("service instance still has bindings")
+)
+
+type state struct {
+	Instances map[string]ServiceInstance `json:"instances"`
+	Bindings  map[string]ServiceBinding  `json:"bindings"`
+}
+
+// Store keeps instances and bindings in a json file, so they survive broker
+// restarts. Every change is written before it is acknowledged.
+type Store struct {
+	path  string
+	lock  sync.Mutex
+	state state
+}
+
+func NewStore(path string) (*Store, error) {
+	store := &Store{
+		path: path,
+		state: state{
+			Instances: map[string]ServiceInstance{},
+			Bindings:  map[string]ServiceBinding{},
+		},
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &store.state); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *Store) Instance(instanceId string) (ServiceInstance, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	instance, ok := s.state.Instances[instanceId]
+	return instance, ok
+}
+
+// PutInstanceIfAbsent stores instance unless an instance with the same id
+// exists, which it returns instead.
+func (s *Store) PutInstanceIfAbsent(instanceId string, instance ServiceInstance) (ServiceInstance, bool, error) {
+	var existing ServiceInstance
+	var found bool
+	err := s.update(func(state *state) error {
+		if existing, found = state.Instances[instanceId]; !found {
+			state.Instances[instanceId] = instance
+		}
+		return nil
+	})
+	return existing, err == nil && !found, err
+}
+
+// DeleteInstanceIfUnbound deletes an instance that has no bindings.
+func (s *Store) DeleteInstanceIfUnbound(instanceId string) error {
+	return s.update(func(state *state) error {
+		if _, ok := state.Instances[instanceId]; !ok {
+			return errNoInstance
+		}
+		for _, binding := range state.Bindings {
+			if binding.InstanceId == instanceId {
+				return errBound
+			}
+		}
+		delete(state.Instances, instanceId)
+		return nil
+	})
+}
+
+// PutBindingIfAbsent stores binding unless a binding with the same id exists,
+// which it returns instead. It also returns the instance of the binding,
+// which has to exist.
+func (s *Store) PutBindingIfAbsent(bindingId string, binding ServiceBinding) (ServiceInstance, ServiceBinding, bool, error) {
+	var instance ServiceInstance
+	var existing ServiceBinding
+	var found bool
+	err := s.update(func(state *state) error {
+		var ok bool
+		if instance, ok = state.Instances[binding.InstanceId]; !ok {
+			return errNoInstance
+		}
+		if existing, found = state.Bindings[bindingId]; !found {
+			state.Bindings[bindingId] = binding
+		}
+		return nil
+	})
+	return instance, existing, err == nil && !found, err
+}
+
+func (s *Store) DeleteBinding(bindingId string) error {
+	return s.update(func(state *state) error {
+		if _, ok := state.Bindings[bindingId]; !ok {
+			return errNoBinding
+		}
+		delete(state.Bindings, bindingId)
+		return nil
+	})
+}
+
+// update applies change to a copy of the state and only keeps it once it is
+// on disk. The check and the change of the state are made under one lock; an
+// error of change leaves the state as it was.
+func (s *Store) update(change func(*state) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	updated := state{
+		Instances: map[string]ServiceInstance{},
+		Bindings:  map[string]ServiceBinding{},
+	}
+	for id, instance := range s.state.Instances {
+		updated.Instances[id] = instance
+	}
+	for id, binding := range s.state.Bindings {
+		updated.Bindings[id] = binding
+	}
+	if err := change(&updated); err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	// the mount configs may hold credentials
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, contents, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	s.state = updated
+	return nil
+}
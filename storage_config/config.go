@@ -0,0 +1,188 @@
+package storage_config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"../storage_redact"
+)
+
+// Config holds the parts of the driver configuration that can be changed at
+// runtime by sending SIGHUP to the driver process.
+type Config struct {
+	MountRetry    RetryPolicy    `json:"mount_retry"`
+	SensitiveOpts []string       `json:"sensitive_opts"`
+	Nfs           NfsConfig      `json:"nfs"`
+	Tmpfs         TmpfsConfig    `json:"tmpfs"`
+	HostPath      HostPathConfig `json:"hostpath"`
+	Overlay       OverlayConfig  `json:"overlay"`
+}
+
+type RetryPolicy struct {
+	Attempts int      `json:"attempts"`
+	Interval Duration `json:"interval"`
+}
+
+type NfsConfig struct {
+	AllowedOptions []string `json:"allowed_options"`
+}
+
+type TmpfsConfig struct {
+	BudgetBytes int64 `json:"budget_bytes"`
+}
+
+// HostPathConfig lists the directories below which host-path volumes may be
+// created. No volumes can be created while it is empty.
+type HostPathConfig struct {
+	AllowedRoots []string `json:"allowed_roots"`
+}
+
+// OverlayConfig lists the backends whose volumes may serve as base of an
+// overlay volume. Bases committed by the overlay backend itself are always
+// allowed.
+type OverlayConfig struct {
+	BaseDrivers []string `json:"base_drivers"`
+}
+
+// Reloadable is implemented by backends that accept configuration changes
+// without being restarted.
+type Reloadable interface {
+	Reload(logger lager.Logger, config Config) error
+}
+
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1s\": %s", err.Error())
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MountRetry: RetryPolicy{
+			Attempts: 3,
+			Interval: Duration(time.Second),
+		},
+		SensitiveOpts: storage_redact.DefaultSensitiveOpts,
+		Tmpfs: TmpfsConfig{
+			BudgetBytes: 1024 * 1024 * 1024,
+		},
+		Overlay: OverlayConfig{
+			BaseDrivers: []string{"local", "nfs"},
+		},
+	}
+}
+
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	if path == "" {
+		return config, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if err = json.Unmarshal(contents, &config); err != nil {
+		return Config{}, fmt.Errorf("invalid config file '%s': %s", path, err.Error())
+	}
+
+	if err = config.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config file '%s': %s", path, err.Error())
+	}
+	return config, nil
+}
+
+func (c Config) Redactor() *storage_redact.Redactor {
+	return storage_redact.NewRedactor(c.SensitiveOpts)
+}
+
+func (c Config) Validate() error {
+	if c.MountRetry.Attempts < 1 {
+		return errors.New("mount_retry.attempts must be at least 1")
+	}
+	if c.MountRetry.Interval < 0 {
+		return errors.New("mount_retry.interval must not be negative")
+	}
+	for _, key := range c.SensitiveOpts {
+		if key == "" {
+			return errors.New("sensitive_opts must not contain empty names")
+		}
+	}
+	for _, option := range c.Nfs.AllowedOptions {
+		if option == "" || strings.ContainsAny(option, ",= ") {
+			return fmt.Errorf("nfs.allowed_options contains invalid option name '%s'", option)
+		}
+	}
+	if c.Tmpfs.BudgetBytes < 0 {
+		return errors.New("tmpfs.budget_bytes must not be negative")
+	}
+	if err := validateRoots("hostpath.allowed_roots", c.HostPath.AllowedRoots); err != nil {
+		return err
+	}
+	for _, backend := range c.Overlay.BaseDrivers {
+		if backend == "" || strings.ContainsAny(backend, "/. ") {
+			return fmt.Errorf("overlay.base_drivers contains invalid backend name '%s'", backend)
+		}
+	}
+	return nil
+}
+
+func validateRoots(name string, roots []string) error {
+	for _, root := range roots {
+		if !filepath.IsAbs(root) || filepath.Clean(root) == "/" {
+			return fmt.Errorf("%s contains invalid root '%s', roots must be absolute and not /", name, root)
+		}
+	}
+	return nil
+}
+
+// Diff reports every setting that differs between two configs, keyed by its
+// json path, so reloads can be logged.
+func Diff(oldConfig, newConfig Config) lager.Data {
+	changes := lager.Data{}
+	diffValues(changes, "", reflect.ValueOf(oldConfig), reflect.ValueOf(newConfig))
+	return changes
+}
+
+func diffValues(changes lager.Data, path string, oldValue, newValue reflect.Value) {
+	if oldValue.Kind() == reflect.Struct && oldValue.Type() != reflect.TypeOf(Duration(0)) {
+		for i := 0; i < oldValue.NumField(); i++ {
+			field := oldValue.Type().Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			diffValues(changes, name, oldValue.Field(i), newValue.Field(i))
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(oldValue.Interface(), newValue.Interface()) {
+		changes[path] = lager.Data{"old": oldValue.Interface(), "new": newValue.Interface()}
+	}
+}
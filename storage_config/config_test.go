@@ -0,0 +1,162 @@
+package storage_config_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_config"
+)
+
+var _ = Describe("Config", func() {
+	Context("Validate", func() {
+		It("accepts the default config", func() {
+			Expect(storage_config.DefaultConfig().Validate()).To(Succeed())
+		})
+
+		It("rejects invalid settings", func() {
+			for _, entry := range []struct {
+				change func(*storage_config.Config)
+				err    string
+			}{
+				{func(c *storage_config.Config) { c.MountRetry.Attempts = 0 }, "mount_retry.attempts must be at least 1"},
+				{func(c *storage_config.Config) { c.MountRetry.Interval = -1 }, "mount_retry.interval must not be negative"},
+				{func(c *storage_config.Config) { c.SensitiveOpts = []string{"password", ""} }, "sensitive_opts must not contain empty names"},
+				{func(c *storage_config.Config) { c.Nfs.AllowedOptions = []string{"vers=4"} }, "nfs.allowed_options contains invalid option name 'vers=4'"},
+				{func(c *storage_config.Config) { c.Nfs.AllowedOptions = []string{""} }, "nfs.allowed_options contains invalid option name ''"},
+				{func(c *storage_config.Config) { c.Tmpfs.BudgetBytes = -1 }, "tmpfs.budget_bytes must not be negative"},
+				{func(c *storage_config.Config) { c.HostPath.AllowedRoots = []string{"data"} }, "hostpath.allowed_roots contains invalid root 'data', roots must be absolute and not /"},
+				{func(c *storage_config.Config) { c.HostPath.AllowedRoots = []string{"/data/.."} }, "hostpath.allowed_roots contains invalid root '/data/..', roots must be absolute and not /"},
+				{func(c *storage_config.Config) { c.Overlay.BaseDrivers = []string{"nfs v4"} }, "overlay.base_drivers contains invalid backend name 'nfs v4'"},
+			} {
+				config := storage_config.DefaultConfig()
+				entry.change(&config)
+				Expect(config.Validate()).To(MatchError(entry.err))
+			}
+		})
+	})
+
+	Context("LoadConfig", func() {
+		var (
+			tempDir string
+			path    string
+		)
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "config")
+			Expect(err).NotTo(HaveOccurred())
+			path = filepath.Join(tempDir, "config.json")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tempDir)
+		})
+
+		write := func(contents string) {
+			Expect(ioutil.WriteFile(path, []byte(contents), 0600)).To(Succeed())
+		}
+
+		It("returns the default config without a file", func() {
+			Expect(storage_config.LoadConfig("")).To(Equal(storage_config.DefaultConfig()))
+		})
+
+		It("overrides the defaults with the settings of the file", func() {
+			write(`{"mount_retry":{"attempts":5,"interval":"250ms"},"tmpfs":{"budget_bytes":1048576}}`)
+
+			expected := storage_config.DefaultConfig()
+			expected.MountRetry = storage_config.RetryPolicy{Attempts: 5, Interval: storage_config.Duration(250 * time.Millisecond)}
+			expected.Tmpfs.BudgetBytes = 1048576
+			Expect(storage_config.LoadConfig(path)).To(Equal(expected))
+		})
+
+		It("reads what it writes", func() {
+			config := storage_config.DefaultConfig()
+			config.HostPath.AllowedRoots = []string{"/var/vcap/store/datasets"}
+			contents, err := json.Marshal(config)
+			Expect(err).NotTo(HaveOccurred())
+			write(string(contents))
+
+			Expect(storage_config.LoadConfig(path)).To(Equal(config))
+		})
+
+		It("rejects an invalid file", func() {
+			for _, entry := range []struct {
+				contents string
+				err      string
+			}{
+				{`{"mount_retry":`, "unexpected end of JSON input"},
+				{`{"mount_retry":{"interval":1}}`, `duration must be a string such as "1s"`},
+				{`{"mount_retry":{"interval":"soon"}}`, `time: invalid duration "soon"`},
+				{`{"mount_retry":{"attempts":0}}`, "mount_retry.attempts must be at least 1"},
+				{`{"hostpath":{"allowed_roots":["/"]}}`, "hostpath.allowed_roots contains invalid root '/'"},
+			} {
+				write(entry.contents)
+
+				_, err := storage_config.LoadConfig(path)
+				Expect(err).To(HaveOccurred(), entry.contents)
+				Expect(err.Error()).To(HavePrefix("invalid config file '"+path+"': "), entry.contents)
+				Expect(err.Error()).To(ContainSubstring(entry.err), entry.contents)
+			}
+		})
+
+		It("fails on a missing file", func() {
+			_, err := storage_config.LoadConfig(filepath.Join(tempDir, "missing.json"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("keeps the running config when the changed file is invalid", func() {
+			logger := lagertest.NewTestLogger("config")
+			holder := storage_config.NewHolder()
+
+			write(`{"mount_retry":{"attempts":5,"interval":"1s"}}`)
+			running, err := storage_config.LoadConfig(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(holder.Reload(logger, running)).To(Succeed())
+
+			write(`{"mount_retry":{"attempts":0,"interval":"1s"}}`)
+			if config, err := storage_config.LoadConfig(path); err == nil {
+				holder.Reload(logger, config)
+			}
+
+			Expect(holder.Config()).To(Equal(running))
+			Expect(holder.Config().MountRetry.Attempts).To(Equal(5))
+		})
+	})
+
+	Context("Diff", func() {
+		It("reports nothing for equal configs", func() {
+			Expect(storage_config.Diff(storage_config.DefaultConfig(), storage_config.DefaultConfig())).To(BeEmpty())
+		})
+
+		It("reports every changed setting by its json path", func() {
+			oldConfig := storage_config.DefaultConfig()
+			newConfig := storage_config.DefaultConfig()
+			newConfig.MountRetry.Interval = storage_config.Duration(5 * time.Second)
+			newConfig.Nfs.AllowedOptions = []string{"vers"}
+			newConfig.Overlay.BaseDrivers = []string{"local"}
+
+			Expect(storage_config.Diff(oldConfig, newConfig)).To(Equal(lager.Data{
+				"mount_retry.interval": lager.Data{"old": storage_config.Duration(time.Second), "new": storage_config.Duration(5 * time.Second)},
+				"nfs.allowed_options":  lager.Data{"old": []string(nil), "new": []string{"vers"}},
+				"overlay.base_drivers": lager.Data{"old": []string{"local", "nfs"}, "new": []string{"local"}},
+			}))
+		})
+
+		It("logs durations as strings", func() {
+			newConfig := storage_config.DefaultConfig()
+			newConfig.MountRetry.Interval = storage_config.Duration(5 * time.Second)
+
+			contents, err := json.Marshal(storage_config.Diff(storage_config.DefaultConfig(), newConfig))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(MatchJSON(`{"mount_retry.interval":{"old":"1s","new":"5s"}}`))
+		})
+	})
+})
@@ -0,0 +1,64 @@
+package storage_config
+
+import (
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+
+	"../storage_redact"
+)
+
+// Holder keeps the current config of a backend. Backends embed it to become
+// Reloadable and take a copy of the config at the start of each operation.
+type Holder struct {
+	lock       sync.RWMutex
+	config     Config
+	secretOpts []string
+	redactor   *storage_redact.Redactor
+}
+
+// NewHolder starts with the default config. secretOpts are the Opts of the
+// backend that carry credentials, they are redacted whatever sensitive_opts
+// says.
+func NewHolder(secretOpts ...string) *Holder {
+	config := DefaultConfig()
+	return &Holder{
+		config:     config,
+		secretOpts: secretOpts,
+		redactor:   config.Redactor().With(secretOpts...),
+	}
+}
+
+func (h *Holder) Reload(logger lager.Logger, config Config) error {
+	logger = logger.Session("reload")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := config.Validate(); err != nil {
+		logger.Error("invalid-config", err)
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.config = config
+	h.redactor = config.Redactor().With(h.secretOpts...)
+	return nil
+}
+
+func (h *Holder) Config() Config {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.config
+}
+
+// SecretOpts returns the credential opts the backend declared.
+func (h *Holder) SecretOpts() []string {
+	return h.secretOpts
+}
+
+func (h *Holder) Redactor() *storage_redact.Redactor {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.redactor
+}
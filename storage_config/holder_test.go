@@ -0,0 +1,59 @@
+package storage_config_test
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_config"
+)
+
+var _ = Describe("Holder", func() {
+	var (
+		logger *lagertest.TestLogger
+		holder *storage_config.Holder
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("holder")
+		holder = storage_config.NewHolder("private_key")
+	})
+
+	It("starts with the default config", func() {
+		Expect(holder.Config()).To(Equal(storage_config.DefaultConfig()))
+		Expect(holder.SecretOpts()).To(Equal([]string{"private_key"}))
+	})
+
+	It("redacts the declared secret opts and the sensitive opts of the config", func() {
+		Expect(holder.Redactor().IsSensitive("private_key")).To(BeTrue())
+		Expect(holder.Redactor().IsSensitive("password")).To(BeTrue())
+		Expect(holder.Redactor().IsSensitive("username")).To(BeFalse())
+	})
+
+	It("keeps redacting the declared secret opts after a reload without them", func() {
+		config := storage_config.DefaultConfig()
+		config.SensitiveOpts = []string{"token"}
+		Expect(holder.Reload(logger, config)).To(Succeed())
+
+		Expect(holder.Config()).To(Equal(config))
+		Expect(holder.Redactor().IsSensitive("private_key")).To(BeTrue())
+		Expect(holder.Redactor().IsSensitive("api_token")).To(BeTrue())
+		Expect(holder.Redactor().IsSensitive("password")).To(BeFalse())
+	})
+
+	It("keeps the running config when the new one is invalid", func() {
+		config := storage_config.DefaultConfig()
+		config.MountRetry.Interval = storage_config.Duration(5 * time.Second)
+		Expect(holder.Reload(logger, config)).To(Succeed())
+
+		invalid := storage_config.DefaultConfig()
+		invalid.MountRetry.Attempts = 0
+		invalid.SensitiveOpts = []string{}
+		Expect(holder.Reload(logger, invalid)).To(MatchError("mount_retry.attempts must be at least 1"))
+
+		Expect(holder.Config()).To(Equal(config))
+		Expect(holder.Redactor().IsSensitive("password")).To(BeTrue())
+	})
+})
@@ -0,0 +1,312 @@
+package storage_csi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	OnDeleteDelete  = "delete"
+	OnDeleteArchive = "archive"
+	ArchivePrefix   = "archived-"
+
+	// controllerVolume is the name of the temporary nfs volume the export is
+	// mounted as while a subdirectory is created or deleted
+	controllerVolume = "csi-controller"
+)
+
+// archiveTimeFormat suffixes archived directories, so a volume deleted again
+// after its name was reused does not collide with the first archive.
+const archiveTimeFormat = "20060102T150405.000000000Z"
+
+// nfsVolume is a subdirectory of an export. DeleteVolume only gets the volume
+// id, so everything it needs, including the onDelete policy and the mount opts
+// of the storage class, is kept in it.
+type nfsVolume struct {
+	Server   string
+	Export   string
+	Subdir   string
+	OnDelete string
+	Opts     string
+}
+
+func (v nfsVolume) id() string {
+	return fmt.Sprintf("%s:%s#%s#%s#%s", v.Server, v.Export, v.Subdir, v.OnDelete, v.Opts)
+}
+
+// parseVolumeId also takes the ids of volumes created before the opts were
+// kept in them, which are mounted with defaultOpts.
+func parseVolumeId(id, defaultOpts string) (nfsVolume, error) {
+	parts := strings.Split(id, "#")
+	if len(parts) != 3 && len(parts) != 4 {
+		return nfsVolume{}, fmt.Errorf("volume id '%s' is not of the form '<server>:<export>#<subdir>#<onDelete>#<opts>'", id)
+	}
+	server, export, err := splitShare(parts[0])
+	if err != nil {
+		return nfsVolume{}, err
+	}
+	if err := checkSubdir(parts[1]); err != nil {
+		return nfsVolume{}, err
+	}
+	if parts[2] != OnDeleteDelete && parts[2] != OnDeleteArchive {
+		return nfsVolume{}, fmt.Errorf("unknown onDelete '%s'", parts[2])
+	}
+	volume := nfsVolume{Server: server, Export: export, Subdir: parts[1], OnDelete: parts[2], Opts: defaultOpts}
+	if len(parts) == 4 {
+		volume.Opts = parts[3]
+	}
+	return volume, nil
+}
+
+func splitShare(share string) (string, string, error) {
+	separator := strings.Index(share, ":/")
+	if separator < 1 {
+		return "", "", fmt.Errorf("share '%s' must have the form '<server>:/<export>'", share)
+	}
+	return share[:separator], path.Clean(share[separator+1:]), nil
+}
+
+func checkSubdir(subdir string) error {
+	if subdir == "" || subdir == "." || subdir == ".." || strings.ContainsAny(subdir, "/#") {
+		return fmt.Errorf("'%s' cannot be used as a directory name", subdir)
+	}
+	return nil
+}
+
+// controllerServer provisions volumes as subdirectories of an nfs export. The
+// export is mounted with the nfs backend only while a call needs it, so calls
+// are serialized.
+type controllerServer struct {
+	csi.UnimplementedControllerServer
+
+	logger  lager.Logger
+	driver  voldriver.Driver
+	os      osshim.Os
+	workDir string
+	share   string
+	opts    string
+
+	lock sync.Mutex
+}
+
+// NewControllerServer provisions on share with the nfs mount opts, unless a
+// storage class overrides them with its 'share' and 'opts' parameters.
+func NewControllerServer(logger lager.Logger, driver voldriver.Driver, os osshim.Os, workDir, share, opts string) csi.ControllerServer {
+	return &controllerServer{
+		logger:  logger.Session("csi-controller"),
+		driver:  driver,
+		os:      os,
+		workDir: workDir,
+		share:   share,
+		opts:    opts,
+	}
+}
+
+func (c *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	logger := c.logger.Session("create-volume", lager.Data{"name": req.GetName(), "parameters": req.GetParameters()})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if err := checkSubdir(req.GetName()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume_capabilities are required")
+	}
+	for _, capability := range req.GetVolumeCapabilities() {
+		if err := checkCapability(capability); err != nil {
+			return nil, err
+		}
+	}
+
+	share, opts, onDelete := c.share, c.opts, OnDeleteDelete
+	for key, value := range req.GetParameters() {
+		switch key {
+		case "share":
+			share = value
+		case "opts":
+			if strings.Contains(value, "#") {
+				return nil, status.Error(codes.InvalidArgument, "parameter 'opts' must not contain '#'")
+			}
+			opts = value
+		case "onDelete":
+			if value != OnDeleteDelete && value != OnDeleteArchive {
+				return nil, status.Errorf(codes.InvalidArgument, "parameter 'onDelete' must be '%s' or '%s'", OnDeleteDelete, OnDeleteArchive)
+			}
+			onDelete = value
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown parameter '%s', use 'share', 'opts' or 'onDelete'", key)
+		}
+	}
+	server, export, err := splitShare(share)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	volume := nfsVolume{Server: server, Export: export, Subdir: req.GetName(), OnDelete: onDelete, Opts: opts}
+
+	err = c.withExport(logger, volume, func(dir string) error {
+		err := c.os.Mkdir(dir, 0777)
+		if os.IsExist(err) {
+			logger.Info("directory-exists")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// pods write as arbitrary users, the umask must not restrict them
+		return c.os.Chmod(dir, 0777)
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId: volume.id(),
+			// nfs cannot enforce a quota on a directory
+			CapacityBytes: req.GetCapacityRange().GetRequiredBytes(),
+			VolumeContext: volumeContext(volume),
+		},
+	}, nil
+}
+
+func (c *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	logger := c.logger.Session("delete-volume", lager.Data{"volume_id": req.GetVolumeId()})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id is required")
+	}
+	volume, err := parseVolumeId(req.GetVolumeId(), c.opts)
+	if err != nil {
+		// not a volume of this plugin, so there is nothing to delete
+		logger.Info("unknown-volume-id", lager.Data{"reason": err.Error()})
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	err = c.withExport(logger, volume, func(dir string) error {
+		if _, err := c.os.Stat(dir); os.IsNotExist(err) {
+			logger.Info("directory-already-gone")
+			return nil
+		}
+		if volume.OnDelete == OnDeleteArchive {
+			archived := filepath.Join(filepath.Dir(dir), ArchivePrefix+volume.Subdir+"-"+time.Now().UTC().Format(archiveTimeFormat))
+			logger.Info("archiving", lager.Data{"archived": archived})
+			return c.os.Rename(dir, archived)
+		}
+		logger.Info("deleting")
+		return c.os.RemoveAll(dir)
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+func (c *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	logger := c.logger.Session("validate-volume-capabilities", lager.Data{"volume_id": req.GetVolumeId()})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if req.GetVolumeId() == "" || len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume_id and volume_capabilities are required")
+	}
+	volume, err := parseVolumeId(req.GetVolumeId(), c.opts)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	exists := false
+	err = c.withExport(logger, volume, func(dir string) error {
+		_, err := c.os.Stat(dir)
+		exists = err == nil
+		return nil
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "volume '%s' does not exist", req.GetVolumeId())
+	}
+
+	for _, capability := range req.GetVolumeCapabilities() {
+		if err := checkCapability(capability); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+func (c *controllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	return &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.ControllerServiceCapability{{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+			},
+		}},
+	}, nil
+}
+
+// withExport mounts the export of volume with its opts and calls action with
+// the path of the volume's directory in it.
+func (c *controllerServer) withExport(logger lager.Logger, volume nfsVolume, action func(dir string) error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	mountPoint := filepath.Join(c.workDir, "export")
+	createResponse := c.driver.Create(logger, voldriver.CreateRequest{
+		Name: controllerVolume,
+		Opts: map[string]interface{}{
+			"remoteinfo":       volume.Server,
+			"remotemountpoint": volume.Export,
+			"localmountpoint":  mountPoint,
+			"opts":             volume.Opts,
+		},
+	})
+	if createResponse.Err != "" {
+		return fmt.Errorf("%s", createResponse.Err)
+	}
+	defer c.driver.Remove(logger, voldriver.RemoveRequest{Name: controllerVolume})
+
+	mountResponse := c.driver.Mount(logger, voldriver.MountRequest{Name: controllerVolume})
+	if mountResponse.Err != "" {
+		return fmt.Errorf("%s", mountResponse.Err)
+	}
+
+	err := action(filepath.Join(mountResponse.Mountpoint, volume.Subdir))
+
+	if response := c.driver.Unmount(logger, voldriver.UnmountRequest{Name: controllerVolume}); response.Err != "" {
+		logger.Error("failed-unmounting-export", fmt.Errorf("%s", response.Err))
+	}
+	return err
+}
+
+// volumeContext holds the create opts the nfs backend of the node service
+// needs to mount the directory.
+func volumeContext(volume nfsVolume) map[string]string {
+	return map[string]string{
+		"remoteinfo":       volume.Server,
+		"remotemountpoint": path.Join(volume.Export, volume.Subdir),
+		"opts":             volume.Opts,
+	}
+}
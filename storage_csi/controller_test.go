@@ -0,0 +1,221 @@
+package storage_csi_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"../storage_csi"
+	"../storage_local/fake"
+)
+
+// exportDriver stands in for the nfs backend: every create of the export
+// volume is recorded, and removing it keeps the directories, like unmounting
+// an nfs export keeps the files on the server.
+type exportDriver struct {
+	*storage_fakedriver.FakeDriver
+
+	lock    sync.Mutex
+	creates []map[string]interface{}
+}
+
+func (d *exportDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	d.lock.Lock()
+	d.creates = append(d.creates, createRequest.Opts)
+	d.lock.Unlock()
+	return d.FakeDriver.Create(logger, createRequest)
+}
+
+func (d *exportDriver) Remove(logger lager.Logger, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse {
+	if err := d.FakeDriver.Forget(logger, removeRequest.Name); err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	return voldriver.ErrorResponse{}
+}
+
+func (d *exportDriver) lastOpts() interface{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.creates[len(d.creates)-1]["opts"]
+}
+
+var _ = Describe("CSI controller service", func() {
+	var (
+		logger     *lagertest.TestLogger
+		tempDir    string
+		driver     *exportDriver
+		controller csi.ControllerServer
+		ctx        context.Context
+		capability *csi.VolumeCapability
+		exportDir  string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "csi-controller")
+		Expect(err).NotTo(HaveOccurred())
+		logger = lagertest.NewTestLogger("csi-controller")
+		ctx = context.Background()
+
+		driver = &exportDriver{FakeDriver: storage_fakedriver.NewFakeDriver(filepath.Join(tempDir, "fake"))}
+		controller = storage_csi.NewControllerServer(logger, driver, &osshim.OsShim{}, filepath.Join(tempDir, "controller"), "10.0.0.1:/exports", "vers=4")
+
+		capability = &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		}
+
+		// the fake backend mounts every volume of a name in the same directory
+		exportDir = exportMountpoint(driver, logger)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	expectCode := func(err error, code codes.Code) {
+		Expect(err).To(HaveOccurred())
+		Expect(status.Code(err)).To(Equal(code))
+	}
+
+	create := func(name string, parameters map[string]string) (*csi.CreateVolumeResponse, error) {
+		return controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               name,
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+			Parameters:         parameters,
+		})
+	}
+
+	remove := func(volumeId string) {
+		_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeId})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	validate := func(volumeId string) error {
+		_, err := controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           volumeId,
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+		})
+		return err
+	}
+
+	entries := func() []string {
+		infos, err := ioutil.ReadDir(exportDir)
+		Expect(err).NotTo(HaveOccurred())
+		names := []string{}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+
+	Context("CreateVolume", func() {
+		It("creates a directory everyone can write to and keeps the opts in the id", func() {
+			response, err := create("pvc-1", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.Volume.VolumeId).To(Equal("10.0.0.1:/exports#pvc-1#delete#vers=4"))
+			Expect(response.Volume.VolumeContext).To(Equal(map[string]string{
+				"remoteinfo":       "10.0.0.1",
+				"remotemountpoint": "/exports/pvc-1",
+				"opts":             "vers=4",
+			}))
+
+			info, err := os.Stat(filepath.Join(exportDir, "pvc-1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0777)))
+			Expect(driver.lastOpts()).To(Equal("vers=4"))
+		})
+
+		It("takes the share, opts and onDelete of the storage class", func() {
+			response, err := create("pvc-1", map[string]string{"share": "10.0.0.2:/other", "opts": "vers=3,nolock", "onDelete": "archive"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.Volume.VolumeId).To(Equal("10.0.0.2:/other#pvc-1#archive#vers=3,nolock"))
+			Expect(driver.lastOpts()).To(Equal("vers=3,nolock"))
+		})
+
+		It("refuses bad parameters", func() {
+			_, err := create("pvc-1", map[string]string{"opts": "vers=3#x"})
+			expectCode(err, codes.InvalidArgument)
+			_, err = create("pvc-1", map[string]string{"onDelete": "keep"})
+			expectCode(err, codes.InvalidArgument)
+			_, err = create("pvc-1", map[string]string{"size": "1G"})
+			expectCode(err, codes.InvalidArgument)
+			_, err = create("../pvc", nil)
+			expectCode(err, codes.InvalidArgument)
+		})
+	})
+
+	Context("DeleteVolume", func() {
+		It("mounts the export with the opts the volume was created with", func() {
+			response, err := create("pvc-1", map[string]string{"opts": "vers=3"})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(validate(response.Volume.VolumeId)).To(Succeed())
+			Expect(driver.lastOpts()).To(Equal("vers=3"))
+
+			remove(response.Volume.VolumeId)
+			Expect(driver.lastOpts()).To(Equal("vers=3"))
+			Expect(entries()).To(BeEmpty())
+		})
+
+		It("mounts volumes created before the opts were kept in the id with the default opts", func() {
+			_, err := create("pvc-1", map[string]string{"opts": "vers=3"})
+			Expect(err).NotTo(HaveOccurred())
+
+			remove("10.0.0.1:/exports#pvc-1#delete")
+			Expect(driver.lastOpts()).To(Equal("vers=4"))
+			Expect(entries()).To(BeEmpty())
+		})
+
+		It("archives every incarnation of a volume name", func() {
+			for i := 0; i < 2; i++ {
+				response, err := create("pvc-1", map[string]string{"onDelete": "archive"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ioutil.WriteFile(filepath.Join(exportDir, "pvc-1", "data"), []byte("data"), 0644)).To(Succeed())
+				remove(response.Volume.VolumeId)
+			}
+
+			archives := entries()
+			Expect(archives).To(HaveLen(2))
+			for _, archive := range archives {
+				Expect(archive).To(MatchRegexp(`^archived-pvc-1-\d{8}T\d{6}\.\d{9}Z$`))
+				Expect(filepath.Join(exportDir, archive, "data")).To(BeAnExistingFile())
+			}
+		})
+
+		It("succeeds for volumes that are gone or not of this plugin", func() {
+			remove("10.0.0.1:/exports#pvc-1#delete#vers=4")
+			remove("some-other-volume")
+		})
+	})
+
+	Context("ValidateVolumeCapabilities", func() {
+		It("does not find a volume whose directory is gone", func() {
+			expectCode(validate("10.0.0.1:/exports#pvc-1#delete#vers=4"), codes.NotFound)
+			expectCode(validate("some-other-volume"), codes.NotFound)
+		})
+	})
+})
+
+// exportMountpoint finds the directory the fake backend mounts the export
+// volume of the controller in.
+func exportMountpoint(driver *exportDriver, logger lager.Logger) string {
+	Expect(driver.FakeDriver.Create(logger, voldriver.CreateRequest{Name: "csi-controller"}).Err).To(BeEmpty())
+	response := driver.FakeDriver.Mount(logger, voldriver.MountRequest{Name: "csi-controller"})
+	Expect(response.Err).To(BeEmpty())
+	Expect(driver.FakeDriver.Unmount(logger, voldriver.UnmountRequest{Name: "csi-controller"}).Err).To(BeEmpty())
+	Expect(driver.FakeDriver.Forget(logger, "csi-controller")).To(Succeed())
+	return response.Mountpoint
+}
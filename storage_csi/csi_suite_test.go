@@ -0,0 +1,13 @@
+package storage_csi_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCsi(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "CSI Suite")
+}
@@ -0,0 +1,46 @@
+package storage_csi
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+const (
+	DefaultDriverName = "storage-driver.csi.wdxxs2z.github.com"
+	VendorVersion     = "0.1.0"
+)
+
+type identityServer struct {
+	csi.UnimplementedIdentityServer
+
+	name         string
+	capabilities []*csi.PluginCapability
+}
+
+// NewIdentityServer reports the plugin as name. The node service needs no
+// plugin capability, the controller service adds its own.
+func NewIdentityServer(name string, capabilities ...csi.PluginCapability_Service_Type) csi.IdentityServer {
+	server := &identityServer{name: name}
+	for _, capability := range capabilities {
+		server.capabilities = append(server.capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{Type: capability},
+			},
+		})
+	}
+	return server
+}
+
+func (s *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: s.name, VendorVersion: VendorVersion}, nil
+}
+
+func (s *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{Capabilities: s.capabilities}, nil
+}
+
+// Probe is always ready, the backends are created before the server starts.
+func (s *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
@@ -0,0 +1,313 @@
+package storage_csi
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"../storage_local/local"
+	"../storage_local/mountutil"
+)
+
+// nodeServer adapts the node service onto a voldriver backend. Staging creates
+// the volume from its volume context and mounts it once per node, publishing
+// makes the staged mount available at the pod's target path with mounter.
+// Both are recorded in stateFile before they are acknowledged.
+type nodeServer struct {
+	csi.UnimplementedNodeServer
+
+	logger    lager.Logger
+	driver    voldriver.Driver
+	mounter   storage_localdriver.Mounter
+	invoker   storage_mountutil.Invoker
+	os        osshim.Os
+	nodeId    string
+	stateFile string
+
+	lock      sync.Mutex
+	staged    map[string]stagedVolume
+	published map[string]string
+}
+
+// NewNodeServer restores what was staged and published before a restart from
+// stateFile. The backend forgot its volumes with the restart, so staged
+// volumes are created and mounted again; a volume that cannot be restored is
+// logged and left out.
+func NewNodeServer(logger lager.Logger, driver voldriver.Driver, mounter storage_localdriver.Mounter, invoker storage_mountutil.Invoker, os osshim.Os, nodeId, stateFile string) (csi.NodeServer, error) {
+	n := &nodeServer{
+		logger:    logger.Session("csi-node"),
+		driver:    driver,
+		mounter:   mounter,
+		invoker:   invoker,
+		os:        os,
+		nodeId:    nodeId,
+		stateFile: stateFile,
+		staged:    map[string]stagedVolume{},
+	}
+
+	state, err := loadNodeState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	n.published = state.Published
+
+	logger = n.logger.Session("restore")
+	for volumeId, volume := range state.Staged {
+		if err := n.restage(logger, volumeId, volume); err != nil {
+			logger.Error("failed-restoring-volume", err, lager.Data{"volume_id": volumeId, "staging_path": volume.StagingPath})
+			continue
+		}
+		logger.Info("restored-volume", lager.Data{"volume_id": volumeId, "staging_path": volume.StagingPath})
+		n.staged[volumeId] = volume
+	}
+
+	if err := n.save(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// restage mounts a volume staged before the restart again. A mount the
+// backend left at the staging path is replaced; the bind mounts of pods
+// published from it stay.
+func (n *nodeServer) restage(logger lager.Logger, volumeId string, volume stagedVolume) error {
+	if n.isMountPoint(volume.StagingPath) {
+		if err := n.invoker.Invoke(logger, "umount", []string{volume.StagingPath}); err != nil {
+			return err
+		}
+	}
+
+	if response := n.driver.Create(logger, voldriver.CreateRequest{Name: volumeId, Opts: volume.Opts}); response.Err != "" {
+		return errors.New(response.Err)
+	}
+	if response := n.driver.Mount(logger, voldriver.MountRequest{Name: volumeId}); response.Err != "" {
+		return errors.New(response.Err)
+	}
+	return nil
+}
+
+// isMountPoint reports whether path is on another device than its parent or
+// is a stale mount.
+func (n *nodeServer) isMountPoint(path string) bool {
+	info, err := n.os.Lstat(path)
+	if err != nil {
+		return storage_mountutil.IsStaleMount(err)
+	}
+	parent, err := n.os.Lstat(filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	parentStat, parentOk := parent.Sys().(*syscall.Stat_t)
+	return ok && parentOk && stat.Dev != parentStat.Dev
+}
+
+// save has to be called with the lock held, or before the server is shared.
+func (n *nodeServer) save() error {
+	return saveNodeState(n.stateFile, nodeState{Staged: n.staged, Published: n.published})
+}
+
+func (n *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	logger := n.logger.Session("stage", lager.Data{"volume_id": req.GetVolumeId(), "staging_path": req.GetStagingTargetPath()})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if req.GetVolumeId() == "" || req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id and staging_target_path are required")
+	}
+	if err := checkCapability(req.GetVolumeCapability()); err != nil {
+		return nil, err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if staged, ok := n.staged[req.GetVolumeId()]; ok {
+		if staged.StagingPath != req.GetStagingTargetPath() {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume '%s' is already staged at '%s'", req.GetVolumeId(), staged.StagingPath)
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// the volume context carries the create opts of the backend, secrets such
+	// as smb passwords are passed separately by the CO
+	opts := map[string]interface{}{}
+	for key, value := range req.GetVolumeContext() {
+		opts[key] = value
+	}
+	for key, value := range req.GetSecrets() {
+		opts[key] = value
+	}
+	if _, ok := opts["localmountpoint"]; !ok {
+		opts["localmountpoint"] = req.GetStagingTargetPath()
+	}
+
+	createResponse := n.driver.Create(logger, voldriver.CreateRequest{Name: req.GetVolumeId(), Opts: opts})
+	if createResponse.Err != "" {
+		return nil, status.Error(codes.InvalidArgument, createResponse.Err)
+	}
+	mountResponse := n.driver.Mount(logger, voldriver.MountRequest{Name: req.GetVolumeId()})
+	if mountResponse.Err != "" {
+		return nil, status.Error(codes.Internal, mountResponse.Err)
+	}
+
+	n.staged[req.GetVolumeId()] = stagedVolume{StagingPath: req.GetStagingTargetPath(), Opts: opts}
+	if err := n.save(); err != nil {
+		logger.Error("failed-saving-state", err)
+		delete(n.staged, req.GetVolumeId())
+		n.driver.Unmount(logger, voldriver.UnmountRequest{Name: req.GetVolumeId()})
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume only unmounts; the backend keeps the volume so that data
+// of backends like local is not deleted when a pod moves away.
+func (n *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	logger := n.logger.Session("unstage", lager.Data{"volume_id": req.GetVolumeId(), "staging_path": req.GetStagingTargetPath()})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if req.GetVolumeId() == "" || req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id and staging_target_path are required")
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.staged[req.GetVolumeId()]; !ok {
+		logger.Info("volume-not-staged")
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	response := n.driver.Unmount(logger, voldriver.UnmountRequest{Name: req.GetVolumeId()})
+	if response.Err != "" {
+		return nil, status.Error(codes.Internal, response.Err)
+	}
+
+	delete(n.staged, req.GetVolumeId())
+	if err := n.save(); err != nil {
+		logger.Error("failed-saving-state", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (n *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	logger := n.logger.Session("publish", lager.Data{"volume_id": req.GetVolumeId(), "target_path": req.GetTargetPath()})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if req.GetVolumeId() == "" || req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id and target_path are required")
+	}
+	if err := checkCapability(req.GetVolumeCapability()); err != nil {
+		return nil, err
+	}
+	options := storage_localdriver.MountOptions{ReadOnly: req.GetReadonly()}
+	if err := n.mounter.Validate(options); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if volumeId, ok := n.published[req.GetTargetPath()]; ok {
+		if volumeId != req.GetVolumeId() {
+			return nil, status.Errorf(codes.FailedPrecondition, "target path '%s' is used by volume '%s'", req.GetTargetPath(), volumeId)
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+	if _, ok := n.staged[req.GetVolumeId()]; !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume '%s' is not staged", req.GetVolumeId())
+	}
+
+	// backends such as local and fake do not mount at the staging path, the
+	// volume is published from wherever the backend mounted it
+	pathResponse := n.driver.Path(logger, voldriver.PathRequest{Name: req.GetVolumeId()})
+	if pathResponse.Err != "" {
+		return nil, status.Error(codes.Internal, pathResponse.Err)
+	}
+
+	// the CO may have created the target directory, which would stand in the
+	// way of a symlink; a non-empty directory is left alone
+	n.os.Remove(req.GetTargetPath())
+
+	if err := n.mounter.Mount(logger, pathResponse.Mountpoint, req.GetTargetPath(), options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	n.published[req.GetTargetPath()] = req.GetVolumeId()
+	if err := n.save(); err != nil {
+		logger.Error("failed-saving-state", err)
+		delete(n.published, req.GetTargetPath())
+		n.mounter.Unmount(logger, req.GetTargetPath())
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (n *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	logger := n.logger.Session("unpublish", lager.Data{"volume_id": req.GetVolumeId(), "target_path": req.GetTargetPath()})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if req.GetVolumeId() == "" || req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_id and target_path are required")
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.published[req.GetTargetPath()]; !ok {
+		logger.Info("target-not-published")
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	if err := n.mounter.Unmount(logger, req.GetTargetPath()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	delete(n.published, req.GetTargetPath())
+	if err := n.save(); err != nil {
+		logger.Error("failed-saving-state", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (n *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME},
+			},
+		}},
+	}, nil
+}
+
+func (n *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: n.nodeId}, nil
+}
+
+// checkCapability accepts filesystem volumes in any access mode; the
+// backends have no block devices to hand out.
+func checkCapability(capability *csi.VolumeCapability) error {
+	if capability == nil {
+		return status.Error(codes.InvalidArgument, "volume_capability is required")
+	}
+	if capability.GetMount() == nil {
+		return status.Error(codes.InvalidArgument, "only mount volumes are supported, block volumes are not")
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package storage_csi_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/tedsuo/ifrit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"../storage_csi"
+	"../storage_local/fake"
+	"../storage_local/local"
+	"../storage_local/mountutil/mountutilfakes"
+)
+
+// These specs follow csi-sanity: they talk to the plugin over its socket the
+// way kubelet does, with the fake backend behind the node service.
+var _ = Describe("CSI node plugin", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeInvoker *mountutilfakes.FakeInvoker
+		tempDir     string
+		stateFile   string
+		backend     *storage_fakedriver.FakeDriver
+		process     ifrit.Process
+		conn        *grpc.ClientConn
+		identity    csi.IdentityClient
+		node        csi.NodeClient
+		ctx         context.Context
+
+		stagingPath string
+		targetPath  string
+		capability  *csi.VolumeCapability
+	)
+
+	start := func() {
+		backend = storage_fakedriver.NewFakeDriver(filepath.Join(tempDir, "fake"))
+		nodeServer, err := storage_csi.NewNodeServer(logger, backend, storage_localdriver.NewSymlinkMounter(&osshim.OsShim{}), fakeInvoker, &osshim.OsShim{}, "node-1", stateFile)
+		Expect(err).NotTo(HaveOccurred())
+
+		socket := filepath.Join(tempDir, "csi", "csi.sock")
+		process = ifrit.Invoke(storage_csi.NewServer(logger, socket, storage_csi.Services{
+			Identity: storage_csi.NewIdentityServer(storage_csi.DefaultDriverName),
+			Node:     nodeServer,
+		}))
+
+		conn, err = grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		identity = csi.NewIdentityClient(conn)
+		node = csi.NewNodeClient(conn)
+	}
+
+	stop := func() {
+		conn.Close()
+		process.Signal(os.Interrupt)
+		Eventually(process.Wait()).Should(Receive(BeNil()))
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "csi")
+		Expect(err).NotTo(HaveOccurred())
+		logger = lagertest.NewTestLogger("csi")
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		stateFile = filepath.Join(tempDir, "data", "csi", "node.json")
+		ctx = context.Background()
+
+		stagingPath = filepath.Join(tempDir, "staging")
+		targetPath = filepath.Join(tempDir, "target")
+		capability = &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}
+
+		start()
+	})
+
+	AfterEach(func() {
+		stop()
+		os.RemoveAll(tempDir)
+	})
+
+	expectCode := func(err error, code codes.Code) {
+		Expect(err).To(HaveOccurred())
+		Expect(status.Code(err)).To(Equal(code))
+	}
+
+	stage := func(volumeId, path string) error {
+		_, err := node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeId,
+			StagingTargetPath: path,
+			VolumeCapability:  capability,
+		})
+		return err
+	}
+
+	unstage := func(volumeId string) error {
+		_, err := node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeId, StagingTargetPath: stagingPath})
+		return err
+	}
+
+	publish := func(volumeId, path string) error {
+		_, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          volumeId,
+			StagingTargetPath: stagingPath,
+			TargetPath:        path,
+			VolumeCapability:  capability,
+		})
+		return err
+	}
+
+	unpublish := func(volumeId, path string) error {
+		_, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeId, TargetPath: path})
+		return err
+	}
+
+	mountCount := func(volumeId string) int {
+		return backend.Get(logger, voldriver.GetRequest{Name: volumeId}).Volume.MountCount
+	}
+
+	Describe("Identity Service", func() {
+		It("returns the plugin name and version", func() {
+			response, err := identity.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.GetName()).To(Equal(storage_csi.DefaultDriverName))
+			Expect(response.GetVendorVersion()).To(Equal(storage_csi.VendorVersion))
+		})
+
+		It("is ready", func() {
+			_, err := identity.Probe(ctx, &csi.ProbeRequest{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("has no plugin capabilities without a controller", func() {
+			response, err := identity.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.GetCapabilities()).To(BeEmpty())
+		})
+	})
+
+	Describe("Node Service", func() {
+		It("reports the stage and unstage capability", func() {
+			response, err := node.NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.GetCapabilities()).To(HaveLen(1))
+			Expect(response.GetCapabilities()[0].GetRpc().GetType()).To(Equal(csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME))
+		})
+
+		It("returns the node id", func() {
+			response, err := node.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.GetNodeId()).To(Equal("node-1"))
+		})
+
+		Context("with invalid arguments", func() {
+			It("requires a volume id and paths", func() {
+				expectCode(stage("", stagingPath), codes.InvalidArgument)
+				expectCode(stage("vol", ""), codes.InvalidArgument)
+				expectCode(unstage(""), codes.InvalidArgument)
+				expectCode(publish("", targetPath), codes.InvalidArgument)
+				expectCode(publish("vol", ""), codes.InvalidArgument)
+				expectCode(unpublish("", targetPath), codes.InvalidArgument)
+				expectCode(unpublish("vol", ""), codes.InvalidArgument)
+			})
+
+			It("requires a volume capability", func() {
+				capability = nil
+				expectCode(stage("vol", stagingPath), codes.InvalidArgument)
+				expectCode(publish("vol", targetPath), codes.InvalidArgument)
+			})
+
+			It("rejects block volumes", func() {
+				capability.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+				expectCode(stage("vol", stagingPath), codes.InvalidArgument)
+				expectCode(publish("vol", targetPath), codes.InvalidArgument)
+			})
+		})
+
+		Context("with failed preconditions", func() {
+			It("does not publish a volume that is not staged", func() {
+				expectCode(publish("vol", targetPath), codes.FailedPrecondition)
+			})
+
+			It("does not stage a volume at a second staging path", func() {
+				Expect(stage("vol", stagingPath)).To(Succeed())
+				expectCode(stage("vol", filepath.Join(tempDir, "other")), codes.FailedPrecondition)
+			})
+
+			It("does not publish two volumes at the same target path", func() {
+				Expect(stage("vol", stagingPath)).To(Succeed())
+				Expect(stage("other", filepath.Join(tempDir, "other"))).To(Succeed())
+				Expect(publish("vol", targetPath)).To(Succeed())
+				expectCode(publish("other", targetPath), codes.FailedPrecondition)
+			})
+		})
+
+		It("stages, publishes, unpublishes and unstages a volume idempotently", func() {
+			Expect(stage("vol", stagingPath)).To(Succeed())
+			Expect(stage("vol", stagingPath)).To(Succeed())
+			Expect(mountCount("vol")).To(Equal(1))
+
+			Expect(publish("vol", targetPath)).To(Succeed())
+			Expect(publish("vol", targetPath)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(targetPath, "data"), []byte("data"), 0644)).To(Succeed())
+			path := backend.Path(logger, voldriver.PathRequest{Name: "vol"}).Mountpoint
+			Expect(filepath.Join(path, "data")).To(BeARegularFile())
+
+			Expect(unpublish("vol", targetPath)).To(Succeed())
+			Expect(unpublish("vol", targetPath)).To(Succeed())
+			Expect(targetPath).NotTo(BeAnExistingFile())
+
+			Expect(unstage("vol")).To(Succeed())
+			Expect(unstage("vol")).To(Succeed())
+			Expect(mountCount("vol")).To(Equal(0))
+		})
+
+		It("keeps its state private, it holds the node stage secrets", func() {
+			Expect(stage("vol", stagingPath)).To(Succeed())
+			info, err := os.Stat(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		Context("after a restart", func() {
+			BeforeEach(func() {
+				Expect(stage("vol", stagingPath)).To(Succeed())
+				Expect(publish("vol", targetPath)).To(Succeed())
+
+				stop()
+				start()
+			})
+
+			It("mounts the staged volumes again", func() {
+				Expect(mountCount("vol")).To(Equal(1))
+				Expect(stage("vol", stagingPath)).To(Succeed())
+				Expect(mountCount("vol")).To(Equal(1))
+			})
+
+			It("leaves a staging path that is no mount point alone", func() {
+				Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+			})
+
+			It("unpublishes and unstages what was published before", func() {
+				Expect(publish("vol", targetPath)).To(Succeed())
+
+				Expect(unpublish("vol", targetPath)).To(Succeed())
+				_, err := os.Lstat(targetPath)
+				Expect(os.IsNotExist(err)).To(BeTrue())
+
+				Expect(unstage("vol")).To(Succeed())
+				Expect(mountCount("vol")).To(Equal(0))
+			})
+
+			It("still refuses a target path used by another volume", func() {
+				Expect(stage("other", filepath.Join(tempDir, "other"))).To(Succeed())
+				expectCode(publish("other", targetPath), codes.FailedPrecondition)
+			})
+		})
+
+		Context("when a staged volume cannot be restored", func() {
+			BeforeEach(func() {
+				Expect(stage("vol", stagingPath)).To(Succeed())
+				stop()
+
+				Expect(os.RemoveAll(filepath.Join(tempDir, "fake"))).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(tempDir, "fake"), nil, 0644)).To(Succeed())
+				start()
+			})
+
+			It("starts without it", func() {
+				Expect(logger.Buffer()).To(gbytes.Say("failed-restoring-volume"))
+				expectCode(publish("vol", targetPath), codes.FailedPrecondition)
+			})
+		})
+	})
+})
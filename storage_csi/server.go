@@ -0,0 +1,77 @@
+package storage_csi
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/tedsuo/ifrit"
+	"google.golang.org/grpc"
+)
+
+// Services are the CSI services a server registers; a nil service is left
+// out.
+type Services struct {
+	Identity   csi.IdentityServer
+	Node       csi.NodeServer
+	Controller csi.ControllerServer
+}
+
+// NewServer serves services over gRPC on the unix socket at socketPath, which
+// is where kubelet and the sidecars expect the plugin.
+func NewServer(logger lager.Logger, socketPath string, services Services) ifrit.Runner {
+	logger = logger.Session("csi-server", lager.Data{"socket": socketPath})
+
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		if err := os.MkdirAll(filepath.Dir(socketPath), 0750); err != nil {
+			return err
+		}
+		// a socket left behind by a crashed plugin would fail the listen
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return err
+		}
+
+		server := grpc.NewServer(grpc.UnaryInterceptor(logErrors(logger)))
+		if services.Identity != nil {
+			csi.RegisterIdentityServer(server, services.Identity)
+		}
+		if services.Node != nil {
+			csi.RegisterNodeServer(server, services.Node)
+		}
+		if services.Controller != nil {
+			csi.RegisterControllerServer(server, services.Controller)
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- server.Serve(listener)
+		}()
+		logger.Info("started")
+		close(ready)
+
+		select {
+		case <-signals:
+			server.GracefulStop()
+			return nil
+		case err := <-errs:
+			return err
+		}
+	})
+}
+
+func logErrors(logger lager.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		response, err := handler(ctx, req)
+		if err != nil {
+			logger.Error("failed-call", err, lager.Data{"method": info.FullMethod})
+		}
+		return response, err
+	}
+}
@@ -0,0 +1,61 @@
+package storage_csi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// nodeState is what the node service staged and published. It is kept in a
+// json file, so a restarted plugin still unmounts what it mounted before.
+type nodeState struct {
+	Staged    map[string]stagedVolume `json:"staged"`
+	Published map[string]string       `json:"published"`
+}
+
+type stagedVolume struct {
+	StagingPath string                 `json:"staging_path"`
+	Opts        map[string]interface{} `json:"opts"`
+}
+
+func loadNodeState(path string) (nodeState, error) {
+	state := nodeState{
+		Staged:    map[string]stagedVolume{},
+		Published: map[string]string{},
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(contents, &state); err != nil {
+		return state, err
+	}
+	if state.Staged == nil {
+		state.Staged = map[string]stagedVolume{}
+	}
+	if state.Published == nil {
+		state.Published = map[string]string{}
+	}
+	return state, nil
+}
+
+func saveNodeState(path string, state nodeState) error {
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// the opts include the node stage secrets
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,301 @@
+package storage_docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	cf_http_handlers "code.cloudfoundry.org/cfhttp/handlers"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	"code.cloudfoundry.org/voldriver/driverhttp"
+)
+
+const (
+	MountPath   = "/VolumeDriver.Mount"
+	UnmountPath = "/VolumeDriver.Unmount"
+	CreatePath  = "/VolumeDriver.Create"
+	GetPath     = "/VolumeDriver.Get"
+	ListPath    = "/VolumeDriver.List"
+)
+
+// MountRequest is the Docker form of a mount or unmount request. ID names the
+// container asking for the volume.
+type MountRequest struct {
+	Name string
+	ID   string
+	Opts map[string]interface{}
+}
+
+// Volume is a volume as Docker lists it: the mount count moves into Status,
+// which docker volume inspect shows, and Mountpoint is only set while the
+// volume is mounted.
+type Volume struct {
+	Name       string
+	Mountpoint string                 `json:",omitempty"`
+	Status     map[string]interface{} `json:",omitempty"`
+}
+
+type GetResponse struct {
+	Volume Volume
+	Err    string
+}
+
+type ListResponse struct {
+	Volumes []Volume
+	Err     string
+}
+
+// containers tracks which containers use a volume, so a container that mounts
+// twice, e.g. after a daemon restart, holds a single reference and unmounting
+// a container that never mounted is a no-op. The map is kept in stateFile, so
+// containers that mounted before a plugin restart still release their
+// reference. A volume is marked busy while the driver mounts or unmounts it
+// for a container; other volumes are not held up meanwhile.
+type containers struct {
+	stateFile string
+
+	lock    sync.Mutex
+	volumes map[string]map[string]bool
+	busy    map[string]chan struct{}
+}
+
+// NewHandler serves the Docker volume plugin protocol for driver. Mount and
+// Unmount are counted per container; the other calls are passed on to the
+// regular driver handler, which already speaks the same protocol, except for
+// Get and List whose volumes are returned in Docker's form. Volumes created
+// without a localmountpoint, which docker volume create users do not know
+// about, are mounted in mountsDir; with an empty mountsDir the backend picks
+// the mountpoint itself. Which container uses which volume is kept in
+// stateFile, the containers of volumes driver no longer knows are dropped when
+// it is loaded.
+func NewHandler(logger lager.Logger, driver voldriver.Driver, mountsDir, stateFile string) (http.Handler, error) {
+	logger = logger.Session("docker-plugin")
+
+	driverHandler, err := driverhttp.NewHandler(logger, driver)
+	if err != nil {
+		return nil, err
+	}
+
+	tracked, err := loadTracked(logger, driver, stateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case CreatePath:
+			var request voldriver.CreateRequest
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				cf_http_handlers.WriteJSONResponse(w, http.StatusOK, voldriver.ErrorResponse{Err: err.Error()})
+				return
+			}
+			if request.Opts == nil {
+				request.Opts = map[string]interface{}{}
+			}
+			if _, ok := request.Opts["localmountpoint"]; !ok && mountsDir != "" {
+				request.Opts["localmountpoint"] = filepath.Join(mountsDir, request.Name)
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, driver.Create(logger, request))
+			return
+		case GetPath:
+			var request voldriver.GetRequest
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				cf_http_handlers.WriteJSONResponse(w, http.StatusOK, GetResponse{Err: err.Error()})
+				return
+			}
+			response := driver.Get(logger, request)
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, GetResponse{Volume: dockerVolume(response.Volume), Err: response.Err})
+			return
+		case ListPath:
+			response := driver.List(logger)
+			volumes := []Volume{}
+			for _, volume := range response.Volumes {
+				volumes = append(volumes, dockerVolume(volume))
+			}
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, ListResponse{Volumes: volumes, Err: response.Err})
+			return
+		case MountPath, UnmountPath:
+		default:
+			driverHandler.ServeHTTP(w, req)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, voldriver.ErrorResponse{Err: err.Error()})
+			return
+		}
+		var request MountRequest
+		if err := json.Unmarshal(body, &request); err != nil || request.ID == "" {
+			// without a container ID the request is counted by the driver itself
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			driverHandler.ServeHTTP(w, req)
+			return
+		}
+
+		if req.URL.Path == MountPath {
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, tracked.mount(logger, driver, request))
+		} else {
+			cf_http_handlers.WriteJSONResponse(w, http.StatusOK, tracked.unmount(logger, driver, request))
+		}
+	}), nil
+}
+
+func dockerVolume(volume voldriver.VolumeInfo) Volume {
+	if volume.Name == "" {
+		return Volume{}
+	}
+	dockerVolume := Volume{
+		Name:   volume.Name,
+		Status: map[string]interface{}{"mount_count": volume.MountCount},
+	}
+	if volume.MountCount > 0 {
+		dockerVolume.Mountpoint = volume.Mountpoint
+	}
+	return dockerVolume
+}
+
+func loadTracked(logger lager.Logger, driver voldriver.Driver, stateFile string) (*containers, error) {
+	logger = logger.Session("load-containers", lager.Data{"state_file": stateFile})
+
+	volumes, err := loadContainers(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	for name := range volumes {
+		if response := driver.Get(logger, voldriver.GetRequest{Name: name}); response.Err != "" {
+			logger.Info("dropping-unknown-volume", lager.Data{"volume": name, "containers": len(volumes[name])})
+			delete(volumes, name)
+		}
+	}
+
+	c := &containers{stateFile: stateFile, volumes: volumes, busy: map[string]chan struct{}{}}
+	if err := c.save(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// acquire waits until no other mount or unmount of the container references
+// of volumeName is in flight and marks the volume busy.
+func (c *containers) acquire(volumeName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for {
+		busy, ok := c.busy[volumeName]
+		if !ok {
+			break
+		}
+		c.lock.Unlock()
+		<-busy
+		c.lock.Lock()
+	}
+	c.busy[volumeName] = make(chan struct{})
+}
+
+func (c *containers) release(volumeName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	close(c.busy[volumeName])
+	delete(c.busy, volumeName)
+}
+
+func (c *containers) mounted(volumeName, containerId string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.volumes[volumeName][containerId]
+}
+
+// save has to be called with the lock held, or before the handler is shared.
+func (c *containers) save() error {
+	return saveContainers(c.stateFile, c.volumes)
+}
+
+func (c *containers) add(volumeName, containerId string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.volumes[volumeName] == nil {
+		c.volumes[volumeName] = map[string]bool{}
+	}
+	c.volumes[volumeName][containerId] = true
+	if err := c.save(); err != nil {
+		c.drop(volumeName, containerId)
+		return err
+	}
+	return nil
+}
+
+func (c *containers) remove(volumeName, containerId string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.drop(volumeName, containerId)
+	return c.save()
+}
+
+func (c *containers) drop(volumeName, containerId string) {
+	delete(c.volumes[volumeName], containerId)
+	if len(c.volumes[volumeName]) == 0 {
+		delete(c.volumes, volumeName)
+	}
+}
+
+func (c *containers) mount(logger lager.Logger, driver voldriver.Driver, request MountRequest) voldriver.MountResponse {
+	logger = logger.Session("mount", lager.Data{"volume": request.Name, "container": request.ID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	c.acquire(request.Name)
+	defer c.release(request.Name)
+
+	if c.mounted(request.Name, request.ID) {
+		logger.Info("container-already-mounted")
+		path := driver.Path(logger, voldriver.PathRequest{Name: request.Name})
+		return voldriver.MountResponse{Mountpoint: path.Mountpoint, Err: path.Err}
+	}
+
+	response := driver.Mount(logger, voldriver.MountRequest{Name: request.Name, Opts: request.Opts})
+	if response.Err != "" {
+		return response
+	}
+
+	if err := c.add(request.Name, request.ID); err != nil {
+		logger.Error("failed-saving-state", err)
+		driver.Unmount(logger, voldriver.UnmountRequest{Name: request.Name})
+		return voldriver.MountResponse{Err: err.Error()}
+	}
+	return response
+}
+
+func (c *containers) unmount(logger lager.Logger, driver voldriver.Driver, request MountRequest) voldriver.ErrorResponse {
+	logger = logger.Session("unmount", lager.Data{"volume": request.Name, "container": request.ID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	c.acquire(request.Name)
+	defer c.release(request.Name)
+
+	if !c.mounted(request.Name, request.ID) {
+		logger.Info("container-not-mounted")
+		return voldriver.ErrorResponse{}
+	}
+
+	response := driver.Unmount(logger, voldriver.UnmountRequest{Name: request.Name})
+	if response.Err != "" {
+		return response
+	}
+
+	if err := c.remove(request.Name, request.ID); err != nil {
+		logger.Error("failed-saving-state", err)
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	return response
+}
@@ -0,0 +1,289 @@
+package storage_docker_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_docker"
+	"../storage_local/fake"
+	"../storage_ops"
+)
+
+// recordingDriver records the create requests it is sent and holds mounts of
+// the volumes in hold until their channel is closed.
+type recordingDriver struct {
+	*storage_fakedriver.FakeDriver
+
+	lock     sync.Mutex
+	creates  []voldriver.CreateRequest
+	hold     map[string]chan struct{}
+	mounting chan string
+}
+
+func (d *recordingDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	d.lock.Lock()
+	d.creates = append(d.creates, createRequest)
+	d.lock.Unlock()
+	return d.FakeDriver.Create(logger, createRequest)
+}
+
+func (d *recordingDriver) Mount(logger lager.Logger, mountRequest voldriver.MountRequest) voldriver.MountResponse {
+	d.lock.Lock()
+	hold := d.hold[mountRequest.Name]
+	d.lock.Unlock()
+	if hold != nil {
+		d.mounting <- mountRequest.Name
+		<-hold
+	}
+	return d.FakeDriver.Mount(logger, mountRequest)
+}
+
+var _ = Describe("Docker plugin handler", func() {
+	var (
+		logger    *lagertest.TestLogger
+		tempDir   string
+		mountsDir string
+		stateFile string
+		driver    *recordingDriver
+		handler   http.Handler
+	)
+
+	newHandler := func(mountsDir string) http.Handler {
+		handler, err := storage_docker.NewHandler(logger, driver, mountsDir, stateFile)
+		Expect(err).NotTo(HaveOccurred())
+		return handler
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "docker")
+		Expect(err).NotTo(HaveOccurred())
+		mountsDir = filepath.Join(tempDir, "mounts")
+		stateFile = filepath.Join(tempDir, "data", "docker", "containers.json")
+
+		logger = lagertest.NewTestLogger("docker")
+		driver = &recordingDriver{
+			FakeDriver: storage_fakedriver.NewFakeDriver(filepath.Join(tempDir, "fake")),
+			hold:       map[string]chan struct{}{},
+			mounting:   make(chan string, 1),
+		}
+		handler = newHandler(mountsDir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	call := func(handler http.Handler, path string, body interface{}) map[string]interface{} {
+		contents, err := json.Marshal(body)
+		Expect(err).NotTo(HaveOccurred())
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", path, bytes.NewReader(contents)))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		response := map[string]interface{}{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		return response
+	}
+
+	create := func(name string, opts map[string]interface{}) {
+		Expect(call(handler, storage_docker.CreatePath, voldriver.CreateRequest{Name: name, Opts: opts})).To(HaveKeyWithValue("Err", ""))
+	}
+
+	mount := func(handler http.Handler, name, container string) map[string]interface{} {
+		return call(handler, storage_docker.MountPath, storage_docker.MountRequest{Name: name, ID: container})
+	}
+
+	unmount := func(handler http.Handler, name, container string) map[string]interface{} {
+		return call(handler, storage_docker.UnmountPath, storage_docker.MountRequest{Name: name, ID: container})
+	}
+
+	mountCount := func(name string) int {
+		response := driver.Get(logger, voldriver.GetRequest{Name: name})
+		Expect(response.Err).To(BeEmpty())
+		return response.Volume.MountCount
+	}
+
+	Context("Create", func() {
+		It("mounts volumes created without a localmountpoint in the mounts dir", func() {
+			create("shared", map[string]interface{}{"size": "1m"})
+			create("own", map[string]interface{}{"localmountpoint": "/tmp/own"})
+			create("bare", nil)
+
+			Expect(driver.creates).To(Equal([]voldriver.CreateRequest{
+				{Name: "shared", Opts: map[string]interface{}{"size": "1m", "localmountpoint": filepath.Join(mountsDir, "shared")}},
+				{Name: "own", Opts: map[string]interface{}{"localmountpoint": "/tmp/own"}},
+				{Name: "bare", Opts: map[string]interface{}{"localmountpoint": filepath.Join(mountsDir, "bare")}},
+			}))
+		})
+
+		It("leaves the mountpoint to the backend without a mounts dir", func() {
+			handler = newHandler("")
+			create("shared", map[string]interface{}{"size": "1m"})
+
+			Expect(driver.creates).To(Equal([]voldriver.CreateRequest{
+				{Name: "shared", Opts: map[string]interface{}{"size": "1m"}},
+			}))
+		})
+	})
+
+	Context("Get and List", func() {
+		BeforeEach(func() {
+			create("mounted", nil)
+			create("idle", nil)
+			Expect(mount(handler, "mounted", "container-1")).To(HaveKeyWithValue("Err", ""))
+		})
+
+		It("only shows the mountpoint of mounted volumes and the mount count as status", func() {
+			response := call(handler, storage_docker.GetPath, voldriver.GetRequest{Name: "mounted"})
+			Expect(response["Volume"]).To(HaveKeyWithValue("Mountpoint", Not(BeEmpty())))
+			Expect(response["Volume"]).To(HaveKeyWithValue("Status", map[string]interface{}{"mount_count": float64(1)}))
+
+			response = call(handler, storage_docker.GetPath, voldriver.GetRequest{Name: "idle"})
+			Expect(response["Volume"]).NotTo(HaveKey("Mountpoint"))
+			Expect(response["Volume"]).To(HaveKeyWithValue("Status", map[string]interface{}{"mount_count": float64(0)}))
+
+			response = call(handler, storage_docker.ListPath, nil)
+			Expect(response["Volumes"]).To(HaveLen(2))
+		})
+
+		It("reports unknown volumes as errors", func() {
+			response := call(handler, storage_docker.GetPath, voldriver.GetRequest{Name: "missing"})
+			Expect(response["Err"]).To(ContainSubstring("not found"))
+		})
+	})
+
+	Context("Mount and Unmount", func() {
+		BeforeEach(func() {
+			create("shared", nil)
+		})
+
+		It("holds one reference per container", func() {
+			first := mount(handler, "shared", "container-1")
+			Expect(first).To(HaveKeyWithValue("Err", ""))
+			Expect(mount(handler, "shared", "container-1")).To(Equal(first))
+			Expect(mount(handler, "shared", "container-2")).To(HaveKeyWithValue("Err", ""))
+			Expect(mountCount("shared")).To(Equal(2))
+
+			Expect(unmount(handler, "shared", "container-1")).To(HaveKeyWithValue("Err", ""))
+			Expect(unmount(handler, "shared", "container-1")).To(HaveKeyWithValue("Err", ""))
+			Expect(mountCount("shared")).To(Equal(1))
+
+			Expect(unmount(handler, "shared", "container-3")).To(HaveKeyWithValue("Err", ""))
+			Expect(mountCount("shared")).To(Equal(1))
+		})
+
+		It("leaves requests without a container to the driver", func() {
+			Expect(call(handler, storage_docker.MountPath, voldriver.MountRequest{Name: "shared"})).To(HaveKeyWithValue("Err", ""))
+			Expect(call(handler, storage_docker.MountPath, voldriver.MountRequest{Name: "shared"})).To(HaveKeyWithValue("Err", ""))
+			Expect(mountCount("shared")).To(Equal(2))
+		})
+
+		It("does not count a container whose mount failed", func() {
+			Expect(driver.SetFaults(logger, storage_ops.Faults{FailMounts: 1})).To(Succeed())
+			Expect(mount(handler, "shared", "container-1")["Err"]).To(ContainSubstring("injected failure"))
+
+			Expect(unmount(handler, "shared", "container-1")).To(HaveKeyWithValue("Err", ""))
+			Expect(mount(handler, "shared", "container-1")).To(HaveKeyWithValue("Err", ""))
+			Expect(mountCount("shared")).To(Equal(1))
+		})
+
+		It("keeps the containers in a state file only the plugin can read", func() {
+			Expect(mount(handler, "shared", "container-1")).To(HaveKeyWithValue("Err", ""))
+
+			info, err := os.Stat(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+			contents, err := ioutil.ReadFile(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(MatchJSON(`{"shared":{"container-1":true}}`))
+		})
+
+		It("releases the references of containers that mounted before a restart", func() {
+			Expect(mount(handler, "shared", "container-1")).To(HaveKeyWithValue("Err", ""))
+			Expect(mount(handler, "shared", "container-2")).To(HaveKeyWithValue("Err", ""))
+
+			restarted := newHandler(mountsDir)
+			Expect(mount(restarted, "shared", "container-1")).To(HaveKeyWithValue("Err", ""))
+			Expect(mountCount("shared")).To(Equal(2))
+
+			Expect(unmount(restarted, "shared", "container-1")).To(HaveKeyWithValue("Err", ""))
+			Expect(unmount(restarted, "shared", "container-2")).To(HaveKeyWithValue("Err", ""))
+			Expect(mountCount("shared")).To(Equal(0))
+		})
+
+		It("drops the containers of volumes the driver no longer knows on a restart", func() {
+			Expect(mount(handler, "shared", "container-1")).To(HaveKeyWithValue("Err", ""))
+			Expect(driver.Forget(logger, "shared")).To(Succeed())
+
+			newHandler(mountsDir)
+			contents, err := ioutil.ReadFile(stateFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(contents).To(MatchJSON(`{}`))
+		})
+
+		It("refuses to start from a corrupt state file", func() {
+			Expect(ioutil.WriteFile(stateFile, []byte("{"), 0600)).To(Succeed())
+
+			_, err := storage_docker.NewHandler(logger, driver, mountsDir, stateFile)
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("while the driver mounts a volume", func() {
+			var (
+				hold    chan struct{}
+				mounted chan map[string]interface{}
+			)
+
+			BeforeEach(func() {
+				create("other", nil)
+
+				hold = make(chan struct{})
+				driver.hold["shared"] = hold
+				mounted = make(chan map[string]interface{}, 1)
+				go func(handler http.Handler, mounted chan map[string]interface{}) {
+					defer GinkgoRecover()
+					mounted <- mount(handler, "shared", "container-1")
+				}(handler, mounted)
+				Eventually(driver.mounting).Should(Receive(Equal("shared")))
+			})
+
+			It("mounts and unmounts other volumes meanwhile", func() {
+				Expect(mount(handler, "other", "container-1")).To(HaveKeyWithValue("Err", ""))
+				Expect(unmount(handler, "other", "container-1")).To(HaveKeyWithValue("Err", ""))
+				Expect(mountCount("other")).To(Equal(0))
+
+				close(hold)
+				Eventually(mounted).Should(Receive(HaveKeyWithValue("Err", "")))
+			})
+
+			It("lets an unmount of the same volume wait for the mount", func() {
+				unmounted := make(chan map[string]interface{}, 1)
+				go func(handler http.Handler, unmounted chan map[string]interface{}) {
+					defer GinkgoRecover()
+					unmounted <- unmount(handler, "shared", "container-1")
+				}(handler, unmounted)
+				Consistently(unmounted).ShouldNot(Receive())
+
+				close(hold)
+				Eventually(mounted).Should(Receive(HaveKeyWithValue("Err", "")))
+				Eventually(unmounted).Should(Receive(HaveKeyWithValue("Err", "")))
+				Expect(mountCount("shared")).To(Equal(0))
+			})
+		})
+	})
+})
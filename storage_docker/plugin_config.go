@@ -0,0 +1,98 @@
+package storage_docker
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	// PluginsDir is where Docker looks for the sockets of plugins, both of
+	// legacy ones on the host and of managed ones inside their rootfs.
+	PluginsDir      = "/run/docker/plugins"
+	PropagatedMount = "/var/lib/docker-volumes"
+	VolumeInterface = "docker.volumedriver/1.0"
+	Executable      = "/nfsdriver"
+	// MountsDir is where volumes created without a localmountpoint are
+	// mounted, below the propagated mount so containers see them.
+	MountsDir = PropagatedMount + "/volumes"
+)
+
+// SocketPath is the socket a plugin called name listens on.
+func SocketPath(name string) string {
+	return filepath.Join(PluginsDir, name+".sock")
+}
+
+type PluginInterface struct {
+	Types  []string `json:"types"`
+	Socket string   `json:"socket"`
+}
+
+type PluginNetwork struct {
+	Type string `json:"type"`
+}
+
+type PluginLinux struct {
+	Capabilities    []string `json:"capabilities"`
+	AllowAllDevices bool     `json:"allowAllDevices"`
+}
+
+type PluginMount struct {
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Options     []string `json:"options"`
+}
+
+// PluginConfig is the config.json of a managed (v2) Docker plugin.
+type PluginConfig struct {
+	Description     string          `json:"description"`
+	Documentation   string          `json:"documentation"`
+	Entrypoint      []string        `json:"entrypoint"`
+	Interface       PluginInterface `json:"interface"`
+	Network         PluginNetwork   `json:"network"`
+	PropagatedMount string          `json:"propagatedmount"`
+	Linux           PluginLinux     `json:"linux"`
+	Mounts          []PluginMount   `json:"mounts"`
+}
+
+// NewPluginConfig describes a managed plugin called name that runs backend.
+// Volumes are mounted below the propagated mount so Docker can bind them into
+// containers, and the plugin keeps its own state there as well.
+func NewPluginConfig(name, backend string) PluginConfig {
+	return PluginConfig{
+		Description:   fmt.Sprintf("cf-storage-driver %s volumes", backend),
+		Documentation: "https://github.com/wdxxs2z/cf-storage-driver",
+		Entrypoint: []string{
+			Executable,
+			"-dockerPlugin", name,
+			"-registryDriver", backend,
+			"-dataDir", filepath.Join(PropagatedMount, "data"),
+			// the propagated mount is visible on the host, credentials
+			// stay in the plugin's rootfs
+			"-secretsDir", "/run/storage-driver/secrets",
+		},
+		Interface: PluginInterface{
+			Types:  []string{VolumeInterface},
+			Socket: name + ".sock",
+		},
+		// mount clients such as nfs and cephfs must reach the servers the
+		// host can reach
+		Network:         PluginNetwork{Type: "host"},
+		PropagatedMount: PropagatedMount,
+		Linux: PluginLinux{
+			Capabilities: []string{"CAP_SYS_ADMIN"},
+			// fuse and loop devices
+			AllowAllDevices: true,
+		},
+		Mounts: []PluginMount{{
+			Name:        "dev",
+			Description: "fuse and loop devices for the s3, webdav, sshfs and loop backends",
+			Source:      "/dev",
+			Destination: "/dev",
+			Type:        "bind",
+			Options:     []string{"rbind"},
+		}},
+	}
+}
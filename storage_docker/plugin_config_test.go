@@ -0,0 +1,67 @@
+package storage_docker_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_docker"
+)
+
+var _ = Describe("PluginConfig", func() {
+	var config storage_docker.PluginConfig
+
+	BeforeEach(func() {
+		config = storage_docker.NewPluginConfig("storage", "cephfs")
+	})
+
+	It("runs the backend as a plugin listening on the socket of its name", func() {
+		Expect(config.Entrypoint).To(Equal([]string{
+			storage_docker.Executable,
+			"-dockerPlugin", "storage",
+			"-registryDriver", "cephfs",
+			"-dataDir", "/var/lib/docker-volumes/data",
+			"-secretsDir", "/run/storage-driver/secrets",
+		}))
+		Expect(config.Interface.Types).To(Equal([]string{"docker.volumedriver/1.0"}))
+		Expect(config.Interface.Socket).To(Equal("storage.sock"))
+		Expect(storage_docker.SocketPath("storage")).To(Equal("/run/docker/plugins/storage.sock"))
+	})
+
+	It("mounts the volumes below the propagated mount", func() {
+		Expect(config.PropagatedMount).To(Equal("/var/lib/docker-volumes"))
+		Expect(storage_docker.MountsDir).To(HavePrefix(config.PropagatedMount + "/"))
+	})
+
+	It("can mount on the host network with the devices of the fuse and loop backends", func() {
+		Expect(config.Network.Type).To(Equal("host"))
+		Expect(config.Linux.Capabilities).To(Equal([]string{"CAP_SYS_ADMIN"}))
+		Expect(config.Linux.AllowAllDevices).To(BeTrue())
+		Expect(config.Mounts).To(ConsistOf(storage_docker.PluginMount{
+			Name:        "dev",
+			Description: "fuse and loop devices for the s3, webdav, sshfs and loop backends",
+			Source:      "/dev",
+			Destination: "/dev",
+			Type:        "bind",
+			Options:     []string{"rbind"},
+		}))
+	})
+
+	It("marshals to the keys of docker's config.json", func() {
+		contents, err := json.Marshal(config)
+		Expect(err).NotTo(HaveOccurred())
+
+		var fields map[string]interface{}
+		Expect(json.Unmarshal(contents, &fields)).To(Succeed())
+		Expect(fields).To(HaveKey("propagatedmount"))
+		Expect(fields).To(HaveKeyWithValue("interface", map[string]interface{}{
+			"types":  []interface{}{"docker.volumedriver/1.0"},
+			"socket": "storage.sock",
+		}))
+		Expect(fields).To(HaveKeyWithValue("linux", map[string]interface{}{
+			"capabilities":    []interface{}{"CAP_SYS_ADMIN"},
+			"allowAllDevices": true,
+		}))
+	})
+})
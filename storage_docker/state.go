@@ -0,0 +1,44 @@
+package storage_docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// loadContainers reads which containers use which volume from path. A plugin
+// that never saved any has an empty map.
+func loadContainers(path string) (map[string]map[string]bool, error) {
+	volumes := map[string]map[string]bool{}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return volumes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &volumes); err != nil {
+		return nil, err
+	}
+	if volumes == nil {
+		volumes = map[string]map[string]bool{}
+	}
+	return volumes, nil
+}
+
+func saveContainers(path string, volumes map[string]map[string]bool) error {
+	contents, err := json.Marshal(volumes)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
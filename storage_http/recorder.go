@@ -0,0 +1,29 @@
+// Package storage_http holds what the handlers wrapping the driver handlers
+// share.
+package storage_http
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// ResponseRecorder passes a response on to the client and keeps a copy of its
+// body, so a wrapping handler can look at the answer of the driver.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w}
+}
+
+func (r *ResponseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// Body returns what was written so far.
+func (r *ResponseRecorder) Body() []byte {
+	return r.body.Bytes()
+}
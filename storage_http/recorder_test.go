@@ -0,0 +1,28 @@
+package storage_http_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_http"
+)
+
+var _ = Describe("ResponseRecorder", func() {
+	It("passes the response on and keeps a copy of the body", func() {
+		writer := httptest.NewRecorder()
+		recorder := storage_http.NewResponseRecorder(writer)
+
+		recorder.Header().Set("Content-Type", "application/json")
+		recorder.WriteHeader(http.StatusOK)
+		recorder.Write([]byte(`{"Err":`))
+		recorder.Write([]byte(`""}`))
+
+		Expect(recorder.Body()).To(MatchJSON(`{"Err":""}`))
+		Expect(writer.Body.String()).To(Equal(`{"Err":""}`))
+		Expect(writer.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(writer.Code).To(Equal(http.StatusOK))
+	})
+})
@@ -0,0 +1,297 @@
+package storage_cephfsdriver
+
+import (
+	"os"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/goshims/ioutil"
+
+	"fmt"
+	"strconv"
+	"strings"
+
+	"../../storage_config"
+	"../mountutil"
+)
+
+const (
+	Name = "cephfs"
+)
+
+// SecretOpts are redacted from logs and the audit log.
+var SecretOpts = []string{"secret"}
+
+type CephfsLocalDriver struct {
+	secretsDir       string
+	userInvoker      storage_mountutil.Invoker
+	os               osshim.Os
+	useSystemUtil    ioutilshim.Ioutil
+
+	*storage_mountutil.Volumes
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	Monitors         []string
+	Path             string
+	ClientName       string
+	Secret           string `json:"-"`
+	LocalMountPoint  string
+	QuotaBytes       int64
+	QuotaFiles       int64
+	ForceFuse        bool
+	Fuse             bool
+}
+
+func NewCephfsLocalDriver(secretsDir string) *CephfsLocalDriver {
+	return NewCephfsDriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, storage_mountutil.NewRealInvoker(), secretsDir)
+}
+
+func NewCephfsDriverWithSystemUtilAndInvoker(ioutil ioutilshim.Ioutil, os osshim.Os, invoker storage_mountutil.Invoker, secretsDir string) *CephfsLocalDriver {
+	d := &CephfsLocalDriver{
+		secretsDir:    secretsDir,
+		userInvoker:   invoker,
+		os:            os,
+		useSystemUtil: ioutil,
+		Holder:        storage_config.NewHolder(SecretOpts...),
+	}
+	d.Volumes = storage_mountutil.NewVolumes(Name, d)
+	return d
+}
+
+func (d *CephfsLocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *CephfsLocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "global"},
+	}
+}
+
+func (d *CephfsLocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	newVolume := &volumeMetadata{}
+	var err *voldriver.ErrorResponse
+	var value string
+
+	if value, err = storage_mountutil.ExtractValue(logger, "monitors", createRequest.Opts); err != nil {
+		return *err
+	}
+	for _, monitor := range strings.Split(value, ",") {
+		if monitor = strings.TrimSpace(monitor); monitor != "" {
+			newVolume.Monitors = append(newVolume.Monitors, monitor)
+		}
+	}
+	if len(newVolume.Monitors) == 0 {
+		return voldriver.ErrorResponse{Err: "Opts.monitors must list at least one monitor"}
+	}
+
+	if newVolume.Path, err = storage_mountutil.ExtractOptionalValue(logger, "path", createRequest.Opts, "/"); err != nil {
+		return *err
+	}
+	if !strings.HasPrefix(newVolume.Path, "/") {
+		return voldriver.ErrorResponse{Err: "Opts.path must be absolute"}
+	}
+	if newVolume.ClientName, err = storage_mountutil.ExtractOptionalValue(logger, "client", createRequest.Opts, "admin"); err != nil {
+		return *err
+	}
+	newVolume.ClientName = strings.TrimPrefix(newVolume.ClientName, "client.")
+	if newVolume.Secret, err = storage_mountutil.ExtractValue(logger, "secret", createRequest.Opts); err != nil {
+		return *err
+	}
+	if strings.ContainsAny(newVolume.Secret, "\n ") {
+		return voldriver.ErrorResponse{Err: "Opts.secret must not contain whitespace"}
+	}
+	// the client name ends up in the mount options and the keyring section
+	if strings.ContainsAny(newVolume.ClientName, ",\n ]") {
+		return voldriver.ErrorResponse{Err: "Opts.client must not contain whitespace, ',' or ']'"}
+	}
+	if newVolume.LocalMountPoint, err = storage_mountutil.ExtractValue(logger, "localmountpoint", createRequest.Opts); err != nil {
+		return *err
+	}
+
+	if newVolume.QuotaBytes, err = extractQuota(logger, "quota_bytes", createRequest.Opts); err != nil {
+		return *err
+	}
+	if newVolume.QuotaFiles, err = extractQuota(logger, "quota_files", createRequest.Opts); err != nil {
+		return *err
+	}
+
+	if value, err = storage_mountutil.ExtractOptionalValue(logger, "fuse", createRequest.Opts, "false"); err != nil {
+		return *err
+	}
+	newVolume.ForceFuse = value == "true"
+
+	return d.Volumes.Add(logger, createRequest.Name, newVolume, nil)
+}
+
+func extractQuota(logger lager.Logger, key string, opts map[string]interface{}) (int64, *voldriver.ErrorResponse) {
+	value, err := storage_mountutil.ExtractOptionalValue(logger, key, opts, "0")
+	if err != nil {
+		return 0, err
+	}
+
+	quota, parseErr := strconv.ParseInt(value, 10, 64)
+	if parseErr != nil || quota < 0 {
+		logger.Info("invalid-" + key)
+		return 0, &voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.%s must be a non negative integer", key)}
+	}
+	return quota, nil
+}
+
+func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
+	return strings.Join(volume.Monitors, ",") == strings.Join(v.Monitors, ",") &&
+		volume.Path == v.Path &&
+		volume.ClientName == v.ClientName &&
+		volume.Secret == v.Secret &&
+		volume.LocalMountPoint == v.LocalMountPoint &&
+		volume.QuotaBytes == v.QuotaBytes &&
+		volume.QuotaFiles == v.QuotaFiles &&
+		volume.ForceFuse == v.ForceFuse
+}
+
+func (v *volumeMetadata) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*volumeMetadata)
+	return ok && v.equals(volume)
+}
+
+func (v *volumeMetadata) MountPoint() string {
+	return v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Target() string {
+	return strings.Join(v.Monitors, ",") + ":" + v.Path
+}
+
+func (v *volumeMetadata) Server() string {
+	return v.Monitors[0]
+}
+
+// Attach mounts the volume with the kernel client, falling back to ceph-fuse
+// where the kernel client is missing or fails.
+func (d *CephfsLocalDriver) Attach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	config := d.Config()
+
+	err := d.os.MkdirAll(volume.LocalMountPoint, os.ModePerm)
+	if err != nil {
+		logger.Error("failed-create-mountdir", err)
+		return fmt.Errorf("unable to create local mount point")
+	}
+
+	// unlike mount.ceph, ceph-fuse may need the key again to re-authenticate,
+	// so the secret files stay on disk until the volume is unmounted
+	secretFile := storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".secret")
+	keyringFile := storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".keyring")
+	if err = d.writeSecrets(volume, secretFile, keyringFile); err != nil {
+		logger.Error("failed-writing-secret-files", err)
+		return fmt.Errorf("unable to write secret file")
+	}
+
+	volume.Fuse = volume.ForceFuse
+	if !volume.Fuse {
+		kernelArgs := []string{"-t", "ceph", volume.Target(), volume.LocalMountPoint, "-o", fmt.Sprintf("name=%s,secretfile=%s", volume.ClientName, secretFile)}
+		err = storage_mountutil.MountWithRetry(logger, d.userInvoker, config.MountRetry, "mount", kernelArgs)
+		if err != nil {
+			logger.Error("kernel-mount-failed-falling-back-to-ceph-fuse", err)
+			volume.Fuse = true
+		}
+	}
+
+	if volume.Fuse {
+		fuseArgs := []string{volume.LocalMountPoint, "-m", strings.Join(volume.Monitors, ","), "-n", "client." + volume.ClientName, "-r", volume.Path, "-k", keyringFile}
+		err = storage_mountutil.MountWithRetry(logger, d.userInvoker, config.MountRetry, "ceph-fuse", fuseArgs)
+	}
+
+	if err != nil {
+		d.removeSecrets(logger, secretFile, keyringFile)
+		return err
+	}
+
+	if err = d.setQuotas(logger, volume); err != nil {
+		d.Detach(logger, volumeName, volume)
+		return fmt.Errorf("unable to set quota (%s)", err.Error())
+	}
+	return nil
+}
+
+// Detach unmounts the volume and removes its secret files.
+func (d *CephfsLocalDriver) Detach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	var err error
+	if volume.Fuse {
+		err = d.userInvoker.Invoke(logger, "fusermount", []string{"-u", volume.LocalMountPoint})
+	} else {
+		err = d.userInvoker.Invoke(logger, "umount", []string{volume.LocalMountPoint})
+	}
+	if err != nil {
+		logger.Error("failed-invoking-umount", err)
+		return err
+	}
+
+	d.removeSecrets(logger,
+		storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".secret"),
+		storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".keyring"))
+
+	if err := d.os.Remove(volume.LocalMountPoint); err != nil {
+		logger.Error("failed-removing-mountpoint", err)
+	}
+	return nil
+}
+
+func (d *CephfsLocalDriver) writeSecrets(volume *volumeMetadata, secretFile, keyringFile string) error {
+	err := storage_mountutil.WriteSecretFile(d.useSystemUtil, d.os, secretFile, []byte(volume.Secret))
+	if err != nil {
+		return err
+	}
+
+	keyring := fmt.Sprintf("[client.%s]\n\tkey = %s\n", volume.ClientName, volume.Secret)
+	return storage_mountutil.WriteSecretFile(d.useSystemUtil, d.os, keyringFile, []byte(keyring))
+}
+
+func (d *CephfsLocalDriver) removeSecrets(logger lager.Logger, files ...string) {
+	for _, file := range files {
+		if err := storage_mountutil.RemoveSecretFile(d.os, file); err != nil {
+			logger.Error("failed-removing-secret-file", err)
+		}
+	}
+}
+
+// setQuotas applies CephFS quotas through the ceph.quota.* extended attributes
+// of the mounted subdirectory. A zero value leaves the attribute alone, so
+// clients without the cephx 'p' capability can mount volumes without quotas.
+func (d *CephfsLocalDriver) setQuotas(logger lager.Logger, volume *volumeMetadata) error {
+	quotas := []struct {
+		attribute string
+		value     int64
+	}{
+		{"ceph.quota.max_bytes", volume.QuotaBytes},
+		{"ceph.quota.max_files", volume.QuotaFiles},
+	}
+
+	for _, quota := range quotas {
+		if quota.value == 0 {
+			continue
+		}
+		args := []string{"-n", quota.attribute, "-v", strconv.FormatInt(quota.value, 10), volume.LocalMountPoint}
+		if err := d.userInvoker.Invoke(logger, "setfattr", args); err != nil {
+			logger.Error("failed-setting-quota", err, lager.Data{"attribute": quota.attribute})
+			return err
+		}
+	}
+	return nil
+}
+
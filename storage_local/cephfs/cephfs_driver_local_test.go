@@ -0,0 +1,211 @@
+package storage_cephfsdriver_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_config"
+	"../cephfs"
+	"../mountutil/mountutilfakes"
+)
+
+const secret = "AQBc3ph5ecr3tk3y=="
+
+var _ = Describe("CephfsLocalDriver", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeInvoker *mountutilfakes.FakeInvoker
+		tempDir     string
+		mountPoint  string
+		config      storage_config.Config
+		driver      *storage_cephfsdriver.CephfsLocalDriver
+		opts        map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "cephfs-driver")
+		Expect(err).NotTo(HaveOccurred())
+		mountPoint = filepath.Join(tempDir, "mounts", "vol")
+
+		logger = lagertest.NewTestLogger("cephfs")
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		driver = storage_cephfsdriver.NewCephfsDriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, fakeInvoker, filepath.Join(tempDir, "secrets"))
+
+		// the secret is redacted even when sensitive_opts does not name it
+		config = storage_config.DefaultConfig()
+		config.MountRetry.Attempts = 1
+		config.MountRetry.Interval = 0
+		config.SensitiveOpts = []string{}
+		Expect(driver.Reload(logger, config)).To(Succeed())
+
+		opts = map[string]interface{}{
+			"monitors":        "10.0.0.1:6789,10.0.0.2:6789",
+			"path":            "/data",
+			"client":          "apps",
+			"secret":          secret,
+			"localmountpoint": mountPoint,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	create := func() voldriver.ErrorResponse {
+		return driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: opts})
+	}
+
+	secretFiles := func() []string {
+		files, err := ioutil.ReadDir(filepath.Join(tempDir, "secrets"))
+		Expect(err).NotTo(HaveOccurred())
+		names := []string{}
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		return names
+	}
+
+	It("declares the secret", func() {
+		Expect(driver.SecretOpts()).To(ConsistOf("secret"))
+	})
+
+	Context("#Create", func() {
+		It("requires a secret", func() {
+			delete(opts, "secret")
+			Expect(create().Err).To(Equal("Missing Mandatory 'secret' field in Opts"))
+		})
+
+		It("rejects whitespace in the secret", func() {
+			opts["secret"] = "AQD abc"
+			Expect(create().Err).To(Equal("Opts.secret must not contain whitespace"))
+		})
+
+		It("rejects a client name that would break the mount options or the keyring", func() {
+			for _, client := range []string{"apps ro", "apps,name=admin", "apps]"} {
+				opts["client"] = client
+				Expect(create().Err).To(Equal("Opts.client must not contain whitespace, ',' or ']'"), client)
+			}
+		})
+
+		It("requires non negative quotas", func() {
+			opts["quota_files"] = "-1"
+			Expect(create().Err).To(Equal("Opts.quota_files must be a non negative integer"))
+		})
+	})
+
+	Context("#Mount", func() {
+		BeforeEach(func() {
+			Expect(create().Err).To(BeEmpty())
+		})
+
+		It("passes the secret in a file and never logs it", func() {
+			var contents string
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				option := args[len(args)-1]
+				secretFile := option[strings.Index(option, "secretfile=")+len("secretfile="):]
+				data, err := ioutil.ReadFile(secretFile)
+				Expect(err).NotTo(HaveOccurred())
+				contents = string(data)
+				return nil
+			}
+
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(BeEmpty())
+			Expect(response.Mountpoint).To(Equal(mountPoint))
+
+			_, executable, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(executable).To(Equal("mount"))
+			Expect(args[0:4]).To(Equal([]string{"-t", "ceph", "10.0.0.1:6789,10.0.0.2:6789:/data", mountPoint}))
+			Expect(strings.Join(args, " ")).NotTo(ContainSubstring(secret))
+			Expect(contents).To(Equal(secret))
+
+			Expect(string(logger.Buffer().Contents())).NotTo(ContainSubstring(secret))
+		})
+
+		It("falls back to ceph-fuse with a keyring and never logs it", func() {
+			var keyring string
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				if executable == "mount" {
+					return errors.New("unknown filesystem type 'ceph'")
+				}
+				data, err := ioutil.ReadFile(args[len(args)-1])
+				Expect(err).NotTo(HaveOccurred())
+				keyring = string(data)
+				return nil
+			}
+
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+
+			_, executable, args := fakeInvoker.InvokeArgsForCall(1)
+			Expect(executable).To(Equal("ceph-fuse"))
+			Expect(strings.Join(args, " ")).NotTo(ContainSubstring(secret))
+			Expect(keyring).To(Equal("[client.apps]\n\tkey = " + secret + "\n"))
+
+			Expect(string(logger.Buffer().Contents())).NotTo(ContainSubstring(secret))
+		})
+
+		It("leaves the quota attributes alone without quotas", func() {
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+			_, executable, _ := fakeInvoker.InvokeArgsForCall(0)
+			Expect(executable).To(Equal("mount"))
+		})
+
+		It("sets only the quotas that are not zero", func() {
+			opts["quota_bytes"] = "10737418240"
+			opts["quota_files"] = "0"
+			Expect(driver.Create(logger, voldriver.CreateRequest{Name: "quota", Opts: opts}).Err).To(BeEmpty())
+
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "quota"}).Err).To(BeEmpty())
+
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(2))
+			_, executable, args := fakeInvoker.InvokeArgsForCall(1)
+			Expect(executable).To(Equal("setfattr"))
+			Expect(args).To(Equal([]string{"-n", "ceph.quota.max_bytes", "-v", "10737418240", mountPoint}))
+		})
+
+		It("detaches the volume when a quota cannot be set", func() {
+			opts["quota_files"] = "1000"
+			Expect(driver.Create(logger, voldriver.CreateRequest{Name: "quota", Opts: opts}).Err).To(BeEmpty())
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				if executable == "setfattr" {
+					return errors.New("Operation not permitted")
+				}
+				return nil
+			}
+
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "quota"}).Err).To(ContainSubstring("unable to set quota (Operation not permitted)"))
+			_, executable, _ := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+			Expect(executable).To(Equal("umount"))
+			Expect(secretFiles()).To(BeEmpty())
+		})
+
+		It("removes the secret files after unmounting", func() {
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(secretFiles()).To(HaveLen(2))
+
+			Expect(driver.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(secretFiles()).To(BeEmpty())
+		})
+
+		It("removes the secret files when the mount fails", func() {
+			fakeInvoker.InvokeReturns(errors.New("connection timed out"))
+
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(Equal("Error mounting 'vol' (connection timed out)"))
+			Expect(secretFiles()).To(BeEmpty())
+		})
+	})
+})
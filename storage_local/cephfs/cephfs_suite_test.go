@@ -0,0 +1,13 @@
+package storage_cephfsdriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCephfsDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cephfs Driver Suite")
+}
@@ -0,0 +1,311 @@
+package storage_fakedriver
+
+import (
+	"os"
+	"path/filepath"
+
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"fmt"
+	"sync"
+	"time"
+
+	"../../storage_config"
+	"../../storage_metrics"
+	"../../storage_ops"
+	"../mountutil"
+)
+
+const (
+	Name = "fake"
+
+	StaleError = "stale NFS file handle"
+)
+
+// FakeDriver implements the driver contract with plain directories, so it
+// needs no privileges and no storage server.
+type FakeDriver struct {
+	rootDir     string
+	volumes     map[string]*volumeMetadata
+	os          osshim.Os
+	faults      storage_ops.Faults
+	volumesLock sync.RWMutex
+
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	Dir        string
+	MountCount int
+}
+
+func NewFakeDriver(rootDir string) *FakeDriver {
+	return NewFakeDriverWithOs(&osshim.OsShim{}, rootDir)
+}
+
+func NewFakeDriverWithOs(os osshim.Os, rootDir string) *FakeDriver {
+	return &FakeDriver{
+		rootDir: rootDir,
+		volumes: map[string]*volumeMetadata{},
+		os:      os,
+		Holder:  storage_config.NewHolder(),
+	}
+}
+
+func (d *FakeDriver) Faults() storage_ops.Faults {
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+	return d.faults
+}
+
+func (d *FakeDriver) SetFaults(logger lager.Logger, faults storage_ops.Faults) error {
+	if faults.FailMounts < 0 || faults.Latency < 0 {
+		return fmt.Errorf("fail_mounts and latency must not be negative")
+	}
+
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
+	logger.Info("set-faults", lager.Data{"faults": faults})
+	d.faults = faults
+	return nil
+}
+
+// delay sleeps for the injected latency. It must not be called with
+// volumesLock held.
+func (d *FakeDriver) delay() {
+	if latency := d.Faults().Latency; latency > 0 {
+		time.Sleep(time.Duration(latency))
+	}
+}
+
+func (d *FakeDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *FakeDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "local"},
+	}
+}
+
+func (d *FakeDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.delay()
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
+	if _, ok := d.volumes[createRequest.Name]; ok {
+		logger.Info("duplicate-volume", lager.Data{"volume_name": createRequest.Name})
+		return voldriver.ErrorResponse{}
+	}
+
+	volume := &volumeMetadata{Dir: storage_mountutil.VolumeFilePath(filepath.Join(d.rootDir, "volumes"), createRequest.Name, "")}
+	if err := d.os.MkdirAll(volume.Dir, os.ModePerm); err != nil {
+		logger.Error("failed-creating-volume-dir", err)
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Error creating '%s' (%s)", createRequest.Name, err.Error())}
+	}
+
+	logger.Info("create-volume", lager.Data{"volume_name": createRequest.Name, "dir": volume.Dir})
+	d.volumes[createRequest.Name] = volume
+	return voldriver.ErrorResponse{}
+}
+
+func (d *FakeDriver) Get(logger lager.Logger, getRequest voldriver.GetRequest) voldriver.GetResponse {
+	logger = logger.Session("get")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.delay()
+
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
+	if volume, ok := d.volumes[getRequest.Name]; ok {
+		if volume.MountCount > 0 {
+			return voldriver.GetResponse{Volume: voldriver.VolumeInfo{
+				Name:       getRequest.Name,
+				Mountpoint: volume.Dir,
+				MountCount: volume.MountCount,
+			}}
+		}
+		return voldriver.GetResponse{Volume: voldriver.VolumeInfo{Name: getRequest.Name}}
+	}
+	return voldriver.GetResponse{Err: fmt.Sprintf("Volume %s not found", getRequest.Name)}
+}
+
+func (d *FakeDriver) Path(logger lager.Logger, pathRequest voldriver.PathRequest) voldriver.PathResponse {
+	logger = logger.Session("path")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.delay()
+
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
+	volume, ok := d.volumes[pathRequest.Name]
+	if !ok {
+		return voldriver.PathResponse{Err: fmt.Sprintf("Volume %s not found", pathRequest.Name)}
+	}
+	if volume.MountCount == 0 {
+		return voldriver.PathResponse{Err: fmt.Sprintf("Volume %s is not mounted", pathRequest.Name)}
+	}
+	if d.faults.Stale {
+		return voldriver.PathResponse{Err: fmt.Sprintf("stat %s: %s", volume.Dir, StaleError)}
+	}
+	return voldriver.PathResponse{Mountpoint: volume.Dir}
+}
+
+func (d *FakeDriver) List(logger lager.Logger) voldriver.ListResponse {
+	logger = logger.Session("list")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.delay()
+
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
+	listResponse := voldriver.ListResponse{}
+	for name, volume := range d.volumes {
+		volinfo := voldriver.VolumeInfo{Name: name, MountCount: volume.MountCount}
+		if volume.MountCount > 0 {
+			volinfo.Mountpoint = volume.Dir
+		}
+		listResponse.Volumes = append(listResponse.Volumes, volinfo)
+	}
+	return listResponse
+}
+
+func (d *FakeDriver) Mount(logger lager.Logger, mountRequest voldriver.MountRequest) voldriver.MountResponse {
+	logger = logger.Session("mount", lager.Data{"volume": mountRequest.Name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.delay()
+
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
+	volume, ok := d.volumes[mountRequest.Name]
+	if !ok {
+		return voldriver.MountResponse{Err: fmt.Sprintf("Volume '%s' not found", mountRequest.Name)}
+	}
+
+	if volume.MountCount > 0 {
+		if d.faults.Stale {
+			return voldriver.MountResponse{Err: fmt.Sprintf("Error mounting '%s' (stat %s: %s)", mountRequest.Name, volume.Dir, StaleError)}
+		}
+		volume.MountCount++
+		return voldriver.MountResponse{Mountpoint: volume.Dir}
+	}
+
+	if d.faults.FailMounts > 0 {
+		d.faults.FailMounts--
+		logger.Info("injected-mount-failure", lager.Data{"remaining": d.faults.FailMounts})
+		return voldriver.MountResponse{Err: fmt.Sprintf("Error mounting '%s' (injected failure)", mountRequest.Name)}
+	}
+
+	volume.MountCount = 1
+	return voldriver.MountResponse{Mountpoint: volume.Dir}
+}
+
+func (d *FakeDriver) Unmount(logger lager.Logger, unmountRequest voldriver.UnmountRequest) voldriver.ErrorResponse {
+	logger = logger.Session("unmount", lager.Data{"volume": unmountRequest.Name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.delay()
+
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
+	volume, ok := d.volumes[unmountRequest.Name]
+	if !ok {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' not found", unmountRequest.Name)}
+	}
+	if volume.MountCount == 0 {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' not mounted", unmountRequest.Name)}
+	}
+
+	volume.MountCount--
+	return voldriver.ErrorResponse{}
+}
+
+func (d *FakeDriver) Remove(logger lager.Logger, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse {
+	logger = logger.Session("remove", lager.Data{"volume": removeRequest})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.delay()
+
+	if removeRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
+	volume, exists := d.volumes[removeRequest.Name]
+	if !exists {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' not found", removeRequest.Name)}
+	}
+
+	if err := d.os.RemoveAll(volume.Dir); err != nil {
+		logger.Error("failed-removing-volume-dir", err)
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Failed removing '%s' (%s)", removeRequest.Name, err.Error())}
+	}
+
+	delete(d.volumes, removeRequest.Name)
+	return voldriver.ErrorResponse{}
+}
+
+func (d *FakeDriver) VolumeStats() []storage_metrics.VolumeStat {
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
+	stats := []storage_metrics.VolumeStat{}
+	for name, volume := range d.volumes {
+		stats = append(stats, storage_metrics.VolumeStat{Name: name, Host: "localhost", MountCount: volume.MountCount})
+	}
+	return stats
+}
+
+func (d *FakeDriver) VolumeTarget(name string) (string, string, bool) {
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
+	volume, ok := d.volumes[name]
+	if !ok {
+		return "", "", false
+	}
+	return volume.Dir, volume.Dir, true
+}
+
+func (d *FakeDriver) Forget(logger lager.Logger, name string) error {
+	logger = logger.Session("forget", lager.Data{"volume": name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
+	if _, ok := d.volumes[name]; !ok {
+		return fmt.Errorf("volume '%s' not found", name)
+	}
+	delete(d.volumes, name)
+	return nil
+}
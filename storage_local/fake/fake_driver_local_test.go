@@ -0,0 +1,117 @@
+package storage_fakedriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_config"
+	"../../storage_ops"
+	"../fake"
+)
+
+var _ = Describe("FakeDriver", func() {
+	var (
+		logger  *lagertest.TestLogger
+		rootDir string
+		driver  *storage_fakedriver.FakeDriver
+	)
+
+	BeforeEach(func() {
+		var err error
+		rootDir, err = ioutil.TempDir("", "fake-driver")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("fake")
+		driver = storage_fakedriver.NewFakeDriver(rootDir)
+		Expect(driver.Reload(logger, storage_config.DefaultConfig())).To(Succeed())
+
+		Expect(driver.Create(logger, voldriver.CreateRequest{Name: "vol"}).Err).To(BeEmpty())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(rootDir)
+	})
+
+	mount := func() voldriver.MountResponse {
+		return driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+	}
+
+	It("mounts a plain directory", func() {
+		response := mount()
+		Expect(response.Err).To(BeEmpty())
+		Expect(response.Mountpoint).To(BeADirectory())
+		Expect(driver.Path(logger, voldriver.PathRequest{Name: "vol"}).Mountpoint).To(Equal(response.Mountpoint))
+	})
+
+	It("refuses negative faults", func() {
+		Expect(driver.SetFaults(logger, storage_ops.Faults{FailMounts: -1})).To(MatchError("fail_mounts and latency must not be negative"))
+		Expect(driver.SetFaults(logger, storage_ops.Faults{Latency: -1})).To(HaveOccurred())
+		Expect(driver.Faults()).To(Equal(storage_ops.Faults{}))
+	})
+
+	Context("with failing mounts", func() {
+		BeforeEach(func() {
+			Expect(driver.SetFaults(logger, storage_ops.Faults{FailMounts: 2})).To(Succeed())
+		})
+
+		It("fails the next mounts and counts them down", func() {
+			Expect(mount().Err).To(Equal("Error mounting 'vol' (injected failure)"))
+			Expect(driver.Faults().FailMounts).To(Equal(1))
+			Expect(mount().Err).To(Equal("Error mounting 'vol' (injected failure)"))
+			Expect(driver.Faults().FailMounts).To(Equal(0))
+
+			Expect(mount().Err).To(BeEmpty())
+		})
+
+		It("does not fail a mount of a volume that is already mounted", func() {
+			Expect(driver.SetFaults(logger, storage_ops.Faults{})).To(Succeed())
+			Expect(mount().Err).To(BeEmpty())
+			Expect(driver.SetFaults(logger, storage_ops.Faults{FailMounts: 1})).To(Succeed())
+
+			Expect(mount().Err).To(BeEmpty())
+			Expect(driver.Faults().FailMounts).To(Equal(1))
+		})
+	})
+
+	Context("with stale mounts", func() {
+		BeforeEach(func() {
+			Expect(mount().Err).To(BeEmpty())
+			Expect(driver.SetFaults(logger, storage_ops.Faults{Stale: true})).To(Succeed())
+		})
+
+		It("reports a stale handle on path and on further mounts", func() {
+			Expect(driver.Path(logger, voldriver.PathRequest{Name: "vol"}).Err).To(HaveSuffix(storage_fakedriver.StaleError))
+			Expect(mount().Err).To(ContainSubstring(storage_fakedriver.StaleError))
+		})
+
+		It("still unmounts, so the stale mount can be recovered", func() {
+			Expect(driver.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(driver.SetFaults(logger, storage_ops.Faults{})).To(Succeed())
+
+			Expect(mount().Err).To(BeEmpty())
+		})
+
+		It("mounts a volume that was not mounted yet", func() {
+			Expect(driver.Create(logger, voldriver.CreateRequest{Name: "other"}).Err).To(BeEmpty())
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "other"}).Err).To(BeEmpty())
+		})
+	})
+
+	Context("with latency", func() {
+		It("delays every request", func() {
+			latency := 50 * time.Millisecond
+			Expect(driver.SetFaults(logger, storage_ops.Faults{Latency: storage_config.Duration(latency)})).To(Succeed())
+
+			start := time.Now()
+			Expect(mount().Err).To(BeEmpty())
+			Expect(driver.List(logger).Volumes).To(HaveLen(1))
+			Expect(time.Since(start)).To(BeNumerically(">=", 2*latency))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package storage_fakedriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestFakeDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Fake Driver Suite")
+}
@@ -0,0 +1,206 @@
+package storage_glusterfsdriver
+
+import (
+	"os"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/goshims/ioutil"
+
+	"fmt"
+	"strings"
+
+	"../../storage_config"
+	"../mountutil"
+)
+
+const (
+	Name = "glusterfs"
+
+	logExcerptLines = 20
+)
+
+type GlusterfsLocalDriver struct {
+	logDir           string
+	userInvoker      storage_mountutil.Invoker
+	os               osshim.Os
+	useSystemUtil    ioutilshim.Ioutil
+
+	*storage_mountutil.Volumes
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	Servers          []string
+	Volume           string
+	LocalMountPoint  string
+}
+
+func NewGlusterfsLocalDriver(logDir string) *GlusterfsLocalDriver {
+	return NewGlusterfsDriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, storage_mountutil.NewRealInvoker(), logDir)
+}
+
+func NewGlusterfsDriverWithSystemUtilAndInvoker(ioutil ioutilshim.Ioutil, os osshim.Os, invoker storage_mountutil.Invoker, logDir string) *GlusterfsLocalDriver {
+	d := &GlusterfsLocalDriver{
+		logDir:        logDir,
+		userInvoker:   invoker,
+		os:            os,
+		useSystemUtil: ioutil,
+		Holder:        storage_config.NewHolder(),
+	}
+	d.Volumes = storage_mountutil.NewVolumes(Name, d)
+	return d
+}
+
+func (d *GlusterfsLocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *GlusterfsLocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "global"},
+	}
+}
+
+func (d *GlusterfsLocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	newVolume := &volumeMetadata{}
+	var err *voldriver.ErrorResponse
+	var servers string
+
+	if servers, err = storage_mountutil.ExtractValue(logger, "servers", createRequest.Opts); err != nil {
+		return *err
+	}
+	for _, server := range strings.Split(servers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			newVolume.Servers = append(newVolume.Servers, server)
+		}
+	}
+	if len(newVolume.Servers) == 0 {
+		return voldriver.ErrorResponse{Err: "Opts.servers must list at least one server"}
+	}
+	if newVolume.Volume, err = storage_mountutil.ExtractValue(logger, "volume", createRequest.Opts); err != nil {
+		return *err
+	}
+	if newVolume.Volume == "" || strings.ContainsAny(newVolume.Volume, "/, ") {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.volume '%s' is not a valid gluster volume name", newVolume.Volume)}
+	}
+	if newVolume.LocalMountPoint, err = storage_mountutil.ExtractValue(logger, "localmountpoint", createRequest.Opts); err != nil {
+		return *err
+	}
+
+	return d.Volumes.Add(logger, createRequest.Name, newVolume, nil)
+}
+
+func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
+	return strings.Join(volume.Servers, ",") == strings.Join(v.Servers, ",") &&
+		volume.Volume == v.Volume &&
+		volume.LocalMountPoint == v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*volumeMetadata)
+	return ok && v.equals(volume)
+}
+
+func (v *volumeMetadata) MountPoint() string {
+	return v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Target() string {
+	return v.Servers[0] + ":/" + v.Volume
+}
+
+func (v *volumeMetadata) Server() string {
+	return v.Servers[0]
+}
+
+func (d *GlusterfsLocalDriver) Attach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	config := d.Config()
+
+	err := d.os.MkdirAll(volume.LocalMountPoint, os.ModePerm)
+	if err != nil {
+		logger.Error("failed-create-mountdir", err)
+		return fmt.Errorf("unable to create local mount point")
+	}
+
+	logFile := d.logFile(volumeName)
+	if err = d.os.MkdirAll(d.logDir, 0700); err != nil {
+		logger.Error("failed-create-logdir", err)
+		return fmt.Errorf("unable to create log directory")
+	}
+	// start every mount with an empty log, so the excerpt only shows this attempt
+	d.os.Remove(logFile)
+
+	mountOptions := []string{"log-file=" + logFile}
+	if len(volume.Servers) > 1 {
+		mountOptions = append(mountOptions, "backup-volfile-servers="+strings.Join(volume.Servers[1:], ":"))
+	}
+
+	cmdArgs := []string{"-t", "glusterfs", "-o", strings.Join(mountOptions, ","), volume.Target(), volume.LocalMountPoint}
+	if err := storage_mountutil.MountWithRetry(logger, d.userInvoker, config.MountRetry, "mount", cmdArgs); err != nil {
+		return fmt.Errorf("%s%s", err.Error(), d.logExcerpt(logFile))
+	}
+	return nil
+}
+
+func (d *GlusterfsLocalDriver) Detach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	cmdArgs := []string{volume.LocalMountPoint}
+	if !d.alive(volume) {
+		// a plain umount fails on the dead mount of a crashed client
+		cmdArgs = []string{"-l", volume.LocalMountPoint}
+	}
+	if err := d.userInvoker.Invoke(logger, "umount", cmdArgs); err != nil {
+		logger.Error("failed-invoking-umount", err)
+		return err
+	}
+
+	if err := d.os.Remove(volume.LocalMountPoint); err != nil {
+		logger.Error("failed-removing-mountpoint", err)
+	}
+	return nil
+}
+
+// Alive reports whether the glusterfs client serving the volume still runs.
+func (d *GlusterfsLocalDriver) Alive(logger lager.Logger, volumeName string, volume storage_mountutil.Volume) bool {
+	return d.alive(volume.(*volumeMetadata))
+}
+
+// Destroy drops the client log of the volume.
+func (d *GlusterfsLocalDriver) Destroy(logger lager.Logger, volumeName string, volume storage_mountutil.Volume) error {
+	d.os.Remove(d.logFile(volumeName))
+	return nil
+}
+
+func (d *GlusterfsLocalDriver) logFile(volumeName string) string {
+	return storage_mountutil.VolumeFilePath(d.logDir, volumeName, ".log")
+}
+
+func (d *GlusterfsLocalDriver) logExcerpt(logFile string) string {
+	contents, err := d.useSystemUtil.ReadFile(logFile)
+	if err != nil || len(strings.TrimSpace(string(contents))) == 0 {
+		return ""
+	}
+	return "\nglusterfs client log:\n" + storage_mountutil.Tail(contents, logExcerptLines)
+}
+
+// alive reports whether the FUSE client serving the mountpoint is still
+// running, a dead client leaves "transport endpoint is not connected" behind.
+func (d *GlusterfsLocalDriver) alive(volume *volumeMetadata) bool {
+	_, err := d.os.Stat(volume.LocalMountPoint)
+	return !storage_mountutil.IsStaleMount(err)
+}
+
@@ -0,0 +1,183 @@
+package storage_glusterfsdriver_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_config"
+	"../glusterfs"
+	"../mountutil/mountutilfakes"
+)
+
+// deadClientOs answers a stat of the mountpoint the way a crashed FUSE client
+// leaves it behind.
+type deadClientOs struct {
+	osshim.OsShim
+	mountPoint string
+	dead       bool
+}
+
+func (o *deadClientOs) Stat(name string) (os.FileInfo, error) {
+	if o.dead && name == o.mountPoint {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: syscall.ENOTCONN}
+	}
+	return o.OsShim.Stat(name)
+}
+
+var _ = Describe("GlusterfsLocalDriver", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeInvoker *mountutilfakes.FakeInvoker
+		fakeOs      *deadClientOs
+		tempDir     string
+		mountPoint  string
+		driver      *storage_glusterfsdriver.GlusterfsLocalDriver
+		opts        map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "glusterfs-driver")
+		Expect(err).NotTo(HaveOccurred())
+		mountPoint = filepath.Join(tempDir, "mounts", "vol")
+
+		logger = lagertest.NewTestLogger("glusterfs")
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		fakeOs = &deadClientOs{mountPoint: mountPoint}
+		driver = storage_glusterfsdriver.NewGlusterfsDriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, fakeOs, fakeInvoker, filepath.Join(tempDir, "logs"))
+
+		config := storage_config.DefaultConfig()
+		config.MountRetry.Interval = 0
+		Expect(driver.Reload(logger, config)).To(Succeed())
+
+		opts = map[string]interface{}{
+			"servers":         "gluster1, gluster2,gluster3",
+			"volume":          "data",
+			"localmountpoint": mountPoint,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	create := func() voldriver.ErrorResponse {
+		return driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: opts})
+	}
+
+	mountOptions := func(args []string) []string {
+		Expect(args[2]).To(Equal("-o"))
+		return strings.Split(args[3], ",")
+	}
+
+	Context("#Create", func() {
+		It("requires at least one server", func() {
+			opts["servers"] = " , "
+			Expect(create().Err).To(Equal("Opts.servers must list at least one server"))
+		})
+
+		It("rejects an invalid volume name", func() {
+			opts["volume"] = "data/sub"
+			Expect(create().Err).To(Equal("Opts.volume 'data/sub' is not a valid gluster volume name"))
+		})
+	})
+
+	Context("#Mount", func() {
+		BeforeEach(func() {
+			Expect(create().Err).To(BeEmpty())
+		})
+
+		It("mounts the volume from the first server and lists the others as backup volfile servers", func() {
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(BeEmpty())
+			Expect(response.Mountpoint).To(Equal(mountPoint))
+
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+			_, executable, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(executable).To(Equal("mount"))
+			Expect(args[0:2]).To(Equal([]string{"-t", "glusterfs"}))
+			Expect(mountOptions(args)).To(ContainElement("backup-volfile-servers=gluster2:gluster3"))
+			Expect(args[4:]).To(Equal([]string{"gluster1:/data", mountPoint}))
+		})
+
+		It("passes no backup volfile servers for a single server", func() {
+			opts["servers"] = "gluster1"
+			Expect(driver.Create(logger, voldriver.CreateRequest{Name: "single", Opts: opts}).Err).To(BeEmpty())
+
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "single"}).Err).To(BeEmpty())
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			for _, option := range mountOptions(args) {
+				Expect(option).NotTo(HavePrefix("backup-volfile-servers="))
+			}
+		})
+
+		It("appends the end of the client log to a failed mount", func() {
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				for _, option := range mountOptions(args) {
+					if strings.HasPrefix(option, "log-file=") {
+						var lines []string
+						for i := 1; i <= 25; i++ {
+							lines = append(lines, fmt.Sprintf("line %d", i))
+						}
+						lines = append(lines, "E [glusterfsd-mgmt.c] failed to fetch volume file")
+						contents := strings.Join(lines, "\n") + "\n"
+						Expect(ioutil.WriteFile(strings.TrimPrefix(option, "log-file="), []byte(contents), 0600)).To(Succeed())
+					}
+				}
+				return errors.New("exit status 1")
+			}
+
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(ContainSubstring("exit status 1\nglusterfs client log:\n"))
+			Expect(response.Err).To(ContainSubstring("failed to fetch volume file"))
+			Expect(response.Err).To(ContainSubstring("line 7\n"))
+			Expect(response.Err).NotTo(ContainSubstring("line 6\n"))
+		})
+
+		It("reports a failed mount without an excerpt when the client logged nothing", func() {
+			fakeInvoker.InvokeReturns(errors.New("exit status 1"))
+
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(Equal("Error mounting 'vol' (exit status 1)"))
+		})
+	})
+
+	Context("#Unmount", func() {
+		BeforeEach(func() {
+			Expect(create().Err).To(BeEmpty())
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+		})
+
+		It("unmounts a live client with a plain umount", func() {
+			Expect(driver.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(2))
+			_, executable, args := fakeInvoker.InvokeArgsForCall(1)
+			Expect(executable).To(Equal("umount"))
+			Expect(args).To(Equal([]string{mountPoint}))
+		})
+
+		It("unmounts a dead client lazily", func() {
+			fakeOs.dead = true
+
+			Expect(driver.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+
+			_, executable, args := fakeInvoker.InvokeArgsForCall(fakeInvoker.InvokeCallCount() - 1)
+			Expect(executable).To(Equal("umount"))
+			Expect(args).To(Equal([]string{"-l", mountPoint}))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package storage_glusterfsdriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestGlusterfsDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Glusterfs Driver Suite")
+}
@@ -0,0 +1,175 @@
+package storage_hostpathdriver
+
+import (
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/filepath"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"fmt"
+
+	"../../storage_config"
+	"../local"
+	"../mountutil"
+)
+
+const (
+	Name = "hostpath"
+)
+
+// HostPathLocalDriver exposes existing directories of the cell. The source
+// directories are owned by the operator and are never modified or deleted.
+type HostPathLocalDriver struct {
+	mountRoot string
+	mounter   storage_localdriver.Mounter
+	os        osshim.Os
+	filepath  filepathshim.Filepath
+
+	*storage_mountutil.Volumes
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	Source          string
+	ReadOnly        bool
+	LocalMountPoint string
+}
+
+func NewHostPathLocalDriver(mountRoot string) *HostPathLocalDriver {
+	os := &osshim.OsShim{}
+	return NewHostPathDriverWithMounter(os, &filepathshim.FilepathShim{}, storage_localdriver.NewBindMounter(os, storage_mountutil.NewRealInvoker()), mountRoot)
+}
+
+func NewHostPathDriverWithMounter(os osshim.Os, filepath filepathshim.Filepath, mounter storage_localdriver.Mounter, mountRoot string) *HostPathLocalDriver {
+	d := &HostPathLocalDriver{
+		mountRoot: mountRoot,
+		mounter:   mounter,
+		os:        os,
+		filepath:  filepath,
+		Holder:    storage_config.NewHolder(),
+	}
+	d.Volumes = storage_mountutil.NewVolumes(Name, d)
+	return d
+}
+
+func (d *HostPathLocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *HostPathLocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "local"},
+	}
+}
+
+func (d *HostPathLocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	newVolume := &volumeMetadata{}
+	var err *voldriver.ErrorResponse
+	var readOnly string
+
+	if newVolume.Source, err = storage_mountutil.ExtractValue(logger, "source", createRequest.Opts); err != nil {
+		return *err
+	}
+	if !filepath.IsAbs(newVolume.Source) {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.source '%s' must be an absolute path", newVolume.Source)}
+	}
+	newVolume.Source = filepath.Clean(newVolume.Source)
+	if _, checkErr := d.checkSource(d.Config().HostPath.AllowedRoots, newVolume.Source); checkErr != nil {
+		logger.Info("source-not-allowed", lager.Data{"source": newVolume.Source, "reason": checkErr.Error()})
+		return voldriver.ErrorResponse{Err: checkErr.Error()}
+	}
+
+	if readOnly, err = storage_mountutil.ExtractOptionalValue(logger, "readonly", createRequest.Opts, "false"); err != nil {
+		return *err
+	}
+	newVolume.ReadOnly = readOnly == "true"
+
+	// a caller chosen mountpoint would let the bind mount cover any
+	// directory of the cell
+	if _, ok := createRequest.Opts["localmountpoint"]; ok {
+		return voldriver.ErrorResponse{Err: "Opts.localmountpoint is not supported, hostpath volumes are mounted below the data dir"}
+	}
+	newVolume.LocalMountPoint = storage_mountutil.VolumeFilePath(d.mountRoot, createRequest.Name, "")
+
+	return d.Volumes.Add(logger, createRequest.Name, newVolume, nil)
+}
+
+func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
+	return volume.Source == v.Source &&
+		volume.ReadOnly == v.ReadOnly &&
+		volume.LocalMountPoint == v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*volumeMetadata)
+	return ok && v.equals(volume)
+}
+
+func (v *volumeMetadata) MountPoint() string {
+	return v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Target() string {
+	return v.Source
+}
+
+func (v *volumeMetadata) Server() string {
+	return "localhost"
+}
+
+// checkSource makes sure source is an existing directory below one of the
+// allowed roots and returns it with its symlinks resolved.
+func (d *HostPathLocalDriver) checkSource(allowedRoots []string, source string) (string, error) {
+	resolved, err := storage_mountutil.ResolveBelowRoots(d.filepath, source, allowedRoots)
+	if err != nil {
+		return "", fmt.Errorf("Opts.source: %s", err.Error())
+	}
+
+	info, err := d.os.Lstat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("Opts.source '%s' cannot be accessed (%s)", source, err.Error())
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("Opts.source '%s' is not a directory", source)
+	}
+	return resolved, nil
+}
+
+func (d *HostPathLocalDriver) Attach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	config := d.Config()
+
+	// the allowlist may have shrunk since the volume was created. The resolved
+	// path is mounted rather than the source, so a symlink swapped into the
+	// source after the check cannot redirect the mount.
+	resolved, err := d.checkSource(config.HostPath.AllowedRoots, volume.Source)
+	if err != nil {
+		logger.Info("source-not-allowed", lager.Data{"source": volume.Source, "reason": err.Error()})
+		return err
+	}
+
+	options := storage_localdriver.MountOptions{ReadOnly: volume.ReadOnly}
+	if err := d.mounter.Mount(logger, resolved, volume.LocalMountPoint, options); err != nil {
+		logger.Error("failed-mounting-volume", err)
+		return err
+	}
+	return nil
+}
+
+// Detach only unbinds the volume, its source directory is left untouched.
+func (d *HostPathLocalDriver) Detach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	return d.mounter.Unmount(logger, volume.LocalMountPoint)
+}
@@ -0,0 +1,103 @@
+package storage_hostpathdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/filepath"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_config"
+	"../hostpath"
+	"../local"
+	"../mountutil/mountutilfakes"
+)
+
+var _ = Describe("HostPathLocalDriver", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeInvoker *mountutilfakes.FakeInvoker
+		tempDir     string
+		root        string
+		outside     string
+		driver      *storage_hostpathdriver.HostPathLocalDriver
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "hostpath-driver")
+		Expect(err).NotTo(HaveOccurred())
+		tempDir, err = filepath.EvalSymlinks(tempDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		root = filepath.Join(tempDir, "datasets")
+		outside = filepath.Join(tempDir, "etc")
+		Expect(os.MkdirAll(filepath.Join(root, "imagenet"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(outside, 0755)).To(Succeed())
+		Expect(os.Symlink(filepath.Join(root, "imagenet"), filepath.Join(root, "latest"))).To(Succeed())
+
+		logger = lagertest.NewTestLogger("hostpath")
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		osShim := &osshim.OsShim{}
+		driver = storage_hostpathdriver.NewHostPathDriverWithMounter(osShim, &filepathshim.FilepathShim{}, storage_localdriver.NewBindMounter(osShim, fakeInvoker), filepath.Join(tempDir, "mounts"))
+
+		config := storage_config.DefaultConfig()
+		config.HostPath.AllowedRoots = []string{root}
+		Expect(driver.Reload(logger, config)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	create := func(opts map[string]interface{}) voldriver.ErrorResponse {
+		return driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: opts})
+	}
+
+	Context("#Create", func() {
+		It("accepts a directory below an allowed root", func() {
+			Expect(create(map[string]interface{}{"source": filepath.Join(root, "imagenet")}).Err).To(BeEmpty())
+		})
+
+		It("refuses a symlink pointing outside the allowed roots", func() {
+			Expect(os.Symlink(outside, filepath.Join(root, "escape"))).To(Succeed())
+
+			response := create(map[string]interface{}{"source": filepath.Join(root, "escape")})
+			Expect(response.Err).To(ContainSubstring("is not below one of the allowed roots"))
+		})
+
+		It("refuses a caller chosen mountpoint", func() {
+			response := create(map[string]interface{}{"source": filepath.Join(root, "imagenet"), "localmountpoint": outside})
+			Expect(response.Err).To(Equal("Opts.localmountpoint is not supported, hostpath volumes are mounted below the data dir"))
+		})
+	})
+
+	Context("#Mount", func() {
+		It("bind mounts the resolved source", func() {
+			Expect(create(map[string]interface{}{"source": filepath.Join(root, "latest")}).Err).To(BeEmpty())
+
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(BeEmpty())
+			Expect(filepath.Dir(response.Mountpoint)).To(Equal(filepath.Join(tempDir, "mounts")))
+
+			_, executable, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(executable).To(Equal("mount"))
+			Expect(args).To(Equal([]string{"--bind", filepath.Join(root, "imagenet"), response.Mountpoint}))
+		})
+
+		It("refuses a source that was swapped for a symlink leaving the allowed roots", func() {
+			Expect(create(map[string]interface{}{"source": filepath.Join(root, "latest")}).Err).To(BeEmpty())
+			Expect(os.Remove(filepath.Join(root, "latest"))).To(Succeed())
+			Expect(os.Symlink(outside, filepath.Join(root, "latest"))).To(Succeed())
+
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(ContainSubstring("is not below one of the allowed roots"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package storage_hostpathdriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestHostPathDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "HostPath Driver Suite")
+}
@@ -6,23 +6,38 @@ import (
 	"os"
 
 	"strings"
+	"sync"
 
 	"path/filepath"
 
 	"code.cloudfoundry.org/goshims/filepath"
+	"code.cloudfoundry.org/goshims/ioutil"
 	"code.cloudfoundry.org/goshims/os"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/voldriver"
 	//"context"
 	"golang.org/x/crypto/bcrypt"
 	//"syscall"
+
+	"../../storage_metrics"
+	"../mountutil"
 )
 
 const VolumesRootDir = "_volumes"
 const MountsRootDir = "_mounts"
 
+// SecretOpts are redacted from the audit log.
+var SecretOpts = []string{"passcode"}
+
 type LocalVolumeInfo struct {
-	passcode []byte
+	passcode     []byte
+	mountOptions MountOptions
+	// busy is closed when the mount, unmount or restore in flight on the
+	// volume is done; nil while the volume is idle.
+	busy chan struct{}
+	// copying is closed when the snapshot being taken of the volume is done;
+	// nil while no snapshot is taken. The volume stays mountable meanwhile.
+	copying chan struct{}
 
 	voldriver.VolumeInfo // see voldriver.resources.go
 }
@@ -32,18 +47,55 @@ type LocalDriver struct {
 	os            osshim.Os
 	filepath      filepathshim.Filepath
 	mountPathRoot string
+	mounter       Mounter
+	volumesLock   sync.RWMutex
+	ioutil        ioutilshim.Ioutil
+	invoker       storage_mountutil.Invoker
+	// seeding holds the names of the volumes being created from a snapshot,
+	// the channel is closed when the copy is done.
+	seeding map[string]chan struct{}
+
+	snapshotsLock sync.Mutex
+	// snapshotReaders counts the copies being made of each snapshot, which
+	// cannot be deleted meanwhile.
+	snapshotReaders map[string]int
 }
 
 func NewLocalDriver(mountDir string) *LocalDriver {
 	return WrapLocalDriver(&osshim.OsShim{}, &filepathshim.FilepathShim{}, mountDir)
 }
 
+// NewLocalDriverWithMode returns a driver that mounts volumes with symlinks or
+// with bind mounts, see NewMounter.
+func NewLocalDriverWithMode(mountDir, mode string) (*LocalDriver, error) {
+	mounter, err := NewMounter(mode)
+	if err != nil {
+		return nil, err
+	}
+	return WrapLocalDriverWithMounter(&osshim.OsShim{}, &filepathshim.FilepathShim{}, mountDir, mounter), nil
+}
+
 func WrapLocalDriver(os osshim.Os, filepath filepathshim.Filepath, mountPathRoot string) *LocalDriver {
+	return WrapLocalDriverWithMounter(os, filepath, mountPathRoot, NewSymlinkMounter(os))
+}
+
+func WrapLocalDriverWithMounter(os osshim.Os, filepath filepathshim.Filepath, mountPathRoot string, mounter Mounter) *LocalDriver {
+	return WrapLocalDriverWithInvoker(os, filepath, mountPathRoot, mounter, storage_mountutil.NewRealInvoker())
+}
+
+// WrapLocalDriverWithInvoker returns a driver that copies snapshots with
+// invoker.
+func WrapLocalDriverWithInvoker(os osshim.Os, filepath filepathshim.Filepath, mountPathRoot string, mounter Mounter, invoker storage_mountutil.Invoker) *LocalDriver {
 	return &LocalDriver{
-		volumes:       map[string]*LocalVolumeInfo{},
-		os:            os,
-		filepath:      filepath,
-		mountPathRoot: mountPathRoot,
+		volumes:         map[string]*LocalVolumeInfo{},
+		os:              os,
+		filepath:        filepath,
+		mountPathRoot:   mountPathRoot,
+		mounter:         mounter,
+		ioutil:          &ioutilshim.IoutilShim{},
+		invoker:         invoker,
+		seeding:         map[string]chan struct{}{},
+		snapshotReaders: map[string]int{},
 	}
 }
 
@@ -54,12 +106,22 @@ func (d *LocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
 }
 
 func (d *LocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
 	logger = logger.Session("create")
 	var ok bool
 	if createRequest.Name == "" {
 		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
 	}
 
+	// a create seeding the same name decides between duplicate and new
+	for seeding, ok := d.seeding[createRequest.Name]; ok; seeding, ok = d.seeding[createRequest.Name] {
+		d.volumesLock.Unlock()
+		<-seeding
+		d.volumesLock.Lock()
+	}
+
 	var existingVolume *LocalVolumeInfo
 	if existingVolume, ok = d.volumes[createRequest.Name]; !ok {
 		logger.Info("creating-volume", lager.Data{"volume_name": createRequest.Name, "volume_id": createRequest.Name})
@@ -76,7 +138,22 @@ func (d *LocalDriver) Create(logger lager.Logger, createRequest voldriver.Create
 				volInfo.passcode = passhash
 			}
 		}
-		d.volumes[createRequest.Name] = &volInfo
+
+		readOnly, errResponse := storage_mountutil.ExtractOptionalValue(logger, "readonly", createRequest.Opts, "false")
+		if errResponse != nil {
+			return *errResponse
+		}
+		volInfo.mountOptions.ReadOnly = readOnly == "true"
+		if volInfo.mountOptions.Propagation, errResponse = storage_mountutil.ExtractOptionalValue(logger, "propagation", createRequest.Opts, ""); errResponse != nil {
+			return *errResponse
+		}
+		if err := d.mounter.Validate(volInfo.mountOptions); err != nil {
+			return voldriver.ErrorResponse{Err: fmt.Sprintf("Invalid Opts: %s", err.Error())}
+		}
+		fromSnapshot, errResponse := storage_mountutil.ExtractOptionalValue(logger, "from_snapshot", createRequest.Opts, "")
+		if errResponse != nil {
+			return *errResponse
+		}
 
 		createDir := d.volumePath(logger, createRequest.Name)
 		logger.Info("creating-volume-folder", lager.Data{"volume": createDir})
@@ -84,6 +161,24 @@ func (d *LocalDriver) Create(logger lager.Logger, createRequest voldriver.Create
 		//defer syscall.Umask(orig)
 		d.os.MkdirAll(createDir, os.ModePerm)
 
+		if fromSnapshot != "" {
+			// the copy runs outside volumesLock, the volume is added once it
+			// is complete
+			seeding := make(chan struct{})
+			d.seeding[createRequest.Name] = seeding
+			d.volumesLock.Unlock()
+			err := d.seed(logger, fromSnapshot, createDir)
+			d.volumesLock.Lock()
+			delete(d.seeding, createRequest.Name)
+			close(seeding)
+
+			if err != nil {
+				logger.Error("failed-seeding-volume", err, lager.Data{"snapshot": fromSnapshot})
+				return voldriver.ErrorResponse{Err: fmt.Sprintf("Error creating volume from snapshot '%s': %s", fromSnapshot, err.Error())}
+			}
+		}
+		d.volumes[createRequest.Name] = &volInfo
+
 		return voldriver.ErrorResponse{}
 	}
 
@@ -96,6 +191,9 @@ func (d *LocalDriver) Create(logger lager.Logger, createRequest voldriver.Create
 }
 
 func (d *LocalDriver) List(logger lager.Logger) voldriver.ListResponse {
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
 	listResponse := voldriver.ListResponse{}
 	for _, volume := range d.volumes {
 		listResponse.Volumes = append(listResponse.Volumes, volume.VolumeInfo)
@@ -105,6 +203,9 @@ func (d *LocalDriver) List(logger lager.Logger) voldriver.ListResponse {
 }
 
 func (d *LocalDriver) Mount(logger lager.Logger, mountRequest voldriver.MountRequest) voldriver.MountResponse {
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
 	logger = logger.Session("mount", lager.Data{"volume": mountRequest.Name})
 
 	if mountRequest.Name == "" {
@@ -113,7 +214,7 @@ func (d *LocalDriver) Mount(logger lager.Logger, mountRequest voldriver.MountReq
 
 	var vol *LocalVolumeInfo
 	var ok bool
-	if vol, ok = d.volumes[mountRequest.Name]; !ok {
+	if vol, ok = d.idle(mountRequest.Name, false); !ok {
 		return voldriver.MountResponse{Err: fmt.Sprintf("Volume '%s' must be created before being mounted", mountRequest.Name)}
 	}
 
@@ -140,7 +241,15 @@ func (d *LocalDriver) Mount(logger lager.Logger, mountRequest voldriver.MountReq
 	logger.Info("mounting-volume", lager.Data{"id": vol.Name, "mountpoint": mountPath})
 
 	if vol.MountCount < 1 {
-		err := d.mount(logger, volumePath, mountPath)
+		// a bind mount runs a command, which must not block the other
+		// volumes, so it runs outside volumesLock with the volume marked busy
+		vol.busy = make(chan struct{})
+		d.volumesLock.Unlock()
+		err := d.mounter.Mount(logger, volumePath, mountPath, vol.mountOptions)
+		d.volumesLock.Lock()
+		close(vol.busy)
+		vol.busy = nil
+
 		if err != nil {
 			logger.Error("mount-volume-failed", err)
 			return voldriver.MountResponse{Err: fmt.Sprintf("Error mounting volume: %s", err.Error())}
@@ -156,6 +265,9 @@ func (d *LocalDriver) Mount(logger lager.Logger, mountRequest voldriver.MountReq
 }
 
 func (d *LocalDriver) Path(logger lager.Logger, pathRequest voldriver.PathRequest) voldriver.PathResponse {
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
 	logger = logger.Session("path", lager.Data{"volume": pathRequest.Name})
 
 	if pathRequest.Name == "" {
@@ -179,12 +291,16 @@ func (d *LocalDriver) Path(logger lager.Logger, pathRequest voldriver.PathReques
 }
 
 func (d *LocalDriver) Unmount(logger lager.Logger, unmountRequest voldriver.UnmountRequest) voldriver.ErrorResponse {
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
 	logger = logger.Session("unmount", lager.Data{"volume": unmountRequest.Name})
 
 	if unmountRequest.Name == "" {
 		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
 	}
 
+	d.idle(unmountRequest.Name, false)
 	mountPath, err := d.get(logger, unmountRequest.Name)
 	if err != nil {
 		logger.Error("failed-no-such-volume-found", err, lager.Data{"mountpoint": mountPath})
@@ -202,6 +318,9 @@ func (d *LocalDriver) Unmount(logger lager.Logger, unmountRequest voldriver.Unmo
 }
 
 func (d *LocalDriver) Remove(logger lager.Logger, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse {
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
 	logger = logger.Session("remove", lager.Data{"volume": removeRequest})
 	logger.Info("start")
 	defer logger.Info("end")
@@ -213,9 +332,9 @@ func (d *LocalDriver) Remove(logger lager.Logger, removeRequest voldriver.Remove
 	var response voldriver.ErrorResponse
 	var vol *LocalVolumeInfo
 	var exists bool
-	if vol, exists = d.volumes[removeRequest.Name]; !exists {
-		logger.Error("failed-volume-removal", fmt.Errorf(fmt.Sprintf("Volume %s not found", removeRequest.Name)))
-		return voldriver.ErrorResponse{fmt.Sprintf("Volume '%s' not found", removeRequest.Name)}
+	if vol, exists = d.idle(removeRequest.Name, true); !exists {
+		logger.Error("failed-volume-removal", fmt.Errorf("Volume %s not found", removeRequest.Name))
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' not found", removeRequest.Name)}
 	}
 
 	if vol.Mountpoint != "" {
@@ -240,6 +359,9 @@ func (d *LocalDriver) Remove(logger lager.Logger, removeRequest voldriver.Remove
 }
 
 func (d *LocalDriver) Get(logger lager.Logger, getRequest voldriver.GetRequest) voldriver.GetResponse {
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
 	mountpoint, err := d.get(logger, getRequest.Name)
 	if err != nil {
 		return voldriver.GetResponse{Err: err.Error()}
@@ -257,6 +379,80 @@ func (d *LocalDriver) get(logger lager.Logger, volumeName string) (string, error
 	return "", errors.New("Volume not found")
 }
 
+// idle waits until no restore is in flight on the volume, and no snapshot
+// is taken of it if copies is set. It has to be called with volumesLock held,
+// which is released while waiting, so the volume may be gone afterwards.
+func (d *LocalDriver) idle(volumeName string, copies bool) (*LocalVolumeInfo, bool) {
+	for {
+		volume, ok := d.volumes[volumeName]
+		if !ok {
+			return nil, false
+		}
+
+		done := volume.busy
+		if done == nil && copies {
+			done = volume.copying
+		}
+		if done == nil {
+			return volume, true
+		}
+
+		d.volumesLock.Unlock()
+		<-done
+		d.volumesLock.Lock()
+	}
+}
+
+// release closes and clears marker, the busy or copying channel of a volume.
+func (d *LocalDriver) release(marker *chan struct{}) {
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
+	close(*marker)
+	*marker = nil
+}
+
+func (d *LocalDriver) VolumeStats() []storage_metrics.VolumeStat {
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
+	stats := []storage_metrics.VolumeStat{}
+	for name, volume := range d.volumes {
+		stats = append(stats, storage_metrics.VolumeStat{Name: name, Host: "localhost", MountCount: volume.MountCount})
+	}
+	return stats
+}
+
+func (d *LocalDriver) VolumeTarget(name string) (string, string, bool) {
+	d.volumesLock.RLock()
+	defer d.volumesLock.RUnlock()
+
+	volume, ok := d.volumes[name]
+	if !ok {
+		return "", "", false
+	}
+	return filepath.Join(d.mountPathRoot, VolumesRootDir, name), volume.Mountpoint, true
+}
+
+func (d *LocalDriver) SecretOpts() []string {
+	return SecretOpts
+}
+
+func (d *LocalDriver) Forget(logger lager.Logger, name string) error {
+	logger = logger.Session("forget", lager.Data{"volume": name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.volumesLock.Lock()
+	defer d.volumesLock.Unlock()
+
+	if _, ok := d.idle(name, true); !ok {
+		return fmt.Errorf("volume '%s' not found", name)
+	}
+	delete(d.volumes, name)
+	return nil
+}
+
 func (d *LocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
 	return voldriver.CapabilitiesResponse{
 		Capabilities: voldriver.CapabilityInfo{Scope: "local"},
@@ -306,13 +502,8 @@ func (d *LocalDriver) volumePath(logger lager.Logger, volumeId string) string {
 	return filepath.Join(volumesPathRoot, volumeId)
 }
 
-func (d *LocalDriver) mount(logger lager.Logger, volumePath, mountPath string) error {
-	logger.Info("link", lager.Data{"src": volumePath, "tgt": mountPath})
-	//orig := syscall.Umask(000)
-	//defer syscall.Umask(orig)
-	return d.os.Symlink(volumePath, mountPath)
-}
-
+// unmount has to be called with volumesLock held and the volume idle. The
+// lock is released while the mounter unmounts the volume.
 func (d *LocalDriver) unmount(logger lager.Logger, name string, mountPath string) voldriver.ErrorResponse {
 	logger = logger.Session("unmount")
 	logger.Info("start")
@@ -330,14 +521,24 @@ func (d *LocalDriver) unmount(logger lager.Logger, name string, mountPath string
 		return voldriver.ErrorResponse{Err: errText}
 	}
 
-	d.volumes[name].MountCount--
-	if d.volumes[name].MountCount > 0 {
-		logger.Info("volume-still-in-use", lager.Data{"name": name, "count": d.volumes[name].MountCount})
+	volume := d.volumes[name]
+	volume.MountCount--
+	if volume.MountCount > 0 {
+		logger.Info("volume-still-in-use", lager.Data{"name": name, "count": volume.MountCount})
 		return voldriver.ErrorResponse{}
 	} else {
 		logger.Info("unmount-volume-folder", lager.Data{"mountpath": mountPath})
-		err := d.os.Remove(mountPath)
+
+		// like the mount, the unmount runs outside volumesLock
+		volume.busy = make(chan struct{})
+		d.volumesLock.Unlock()
+		err := d.mounter.Unmount(logger, mountPath)
+		d.volumesLock.Lock()
+		close(volume.busy)
+		volume.busy = nil
+
 		if err != nil {
+			volume.MountCount++
 			logger.Error("unmount-failed", err)
 			return voldriver.ErrorResponse{Err: fmt.Sprintf("Error unmounting volume: %s", err.Error())}
 		}
@@ -345,7 +546,7 @@ func (d *LocalDriver) unmount(logger lager.Logger, name string, mountPath string
 
 	logger.Info("unmounted-volume")
 
-	d.volumes[name].Mountpoint = ""
+	volume.Mountpoint = ""
 
 	return voldriver.ErrorResponse{}
 }
\ No newline at end of file
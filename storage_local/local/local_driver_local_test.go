@@ -0,0 +1,132 @@
+package storage_localdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/filepath"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../local"
+	"../mountutil/mountutilfakes"
+)
+
+const passcode = "0p3n-s3s4m3"
+
+var _ = Describe("LocalDriver", func() {
+	var (
+		logger  *lagertest.TestLogger
+		tempDir string
+		driver  *storage_localdriver.LocalDriver
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "local-driver")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("local")
+		driver = storage_localdriver.NewLocalDriver(tempDir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("declares the passcode as secret", func() {
+		Expect(driver.SecretOpts()).To(ConsistOf("passcode"))
+	})
+
+	Context("with a passcode", func() {
+		BeforeEach(func() {
+			response := driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: map[string]interface{}{"passcode": passcode}})
+			Expect(response.Err).To(BeEmpty())
+		})
+
+		It("does not log the passcode on create", func() {
+			Expect(string(logger.Buffer().Contents())).To(ContainSubstring("creating-volume"))
+			Expect(string(logger.Buffer().Contents())).NotTo(ContainSubstring(passcode))
+		})
+
+		It("requires the passcode to mount", func() {
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(Equal("Volume vol requires a passcode"))
+
+			response = driver.Mount(logger, voldriver.MountRequest{Name: "vol", Opts: map[string]interface{}{"passcode": "guess"}})
+			Expect(response.Err).To(Equal("Volume vol access denied"))
+		})
+
+		It("mounts with the passcode and does not log it", func() {
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol", Opts: map[string]interface{}{"passcode": passcode}})
+			Expect(response.Err).To(BeEmpty())
+			Expect(response.Mountpoint).To(Equal(filepath.Join(tempDir, storage_localdriver.MountsRootDir, "vol")))
+
+			Expect(string(logger.Buffer().Contents())).NotTo(ContainSubstring(passcode))
+		})
+	})
+
+	Context("in bind mode while a mount command hangs", func() {
+		var (
+			fakeInvoker *mountutilfakes.FakeInvoker
+			release     chan struct{}
+			mounted     chan voldriver.MountResponse
+		)
+
+		BeforeEach(func() {
+			release = make(chan struct{})
+			hanging, released := filepath.Join(tempDir, storage_localdriver.MountsRootDir, "vol"), release
+			fakeInvoker = &mountutilfakes.FakeInvoker{}
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				if args[len(args)-1] == hanging {
+					<-released
+				}
+				return nil
+			}
+			mounter := storage_localdriver.NewBindMounter(&osshim.OsShim{}, fakeInvoker)
+			driver = storage_localdriver.WrapLocalDriverWithMounter(&osshim.OsShim{}, &filepathshim.FilepathShim{}, tempDir, mounter)
+
+			Expect(driver.Create(logger, voldriver.CreateRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(driver.Create(logger, voldriver.CreateRequest{Name: "other"}).Err).To(BeEmpty())
+
+			mounted = make(chan voldriver.MountResponse, 1)
+			go func(driver voldriver.Driver, logger lager.Logger, mounted chan<- voldriver.MountResponse) {
+				mounted <- driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			}(driver, logger, mounted)
+			Eventually(fakeInvoker.InvokeCallCount).Should(Equal(1))
+		})
+
+		AfterEach(func() {
+			select {
+			case <-release:
+			default:
+				close(release)
+			}
+		})
+
+		It("serves the other volumes", func() {
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "other"}).Err).To(BeEmpty())
+			Expect(driver.Unmount(logger, voldriver.UnmountRequest{Name: "other"}).Err).To(BeEmpty())
+			Expect(driver.List(logger).Volumes).To(HaveLen(2))
+			Expect(mounted).NotTo(Receive())
+		})
+
+		It("mounts the volume once for a concurrent mount", func() {
+			again := make(chan voldriver.MountResponse, 1)
+			go func(driver voldriver.Driver, logger lager.Logger) {
+				again <- driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			}(driver, logger)
+			Consistently(again).ShouldNot(Receive())
+
+			close(release)
+			Eventually(mounted).Should(Receive(WithTransform(func(r voldriver.MountResponse) string { return r.Err }, BeEmpty())))
+			Eventually(again).Should(Receive(WithTransform(func(r voldriver.MountResponse) string { return r.Err }, BeEmpty())))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+		})
+	})
+})
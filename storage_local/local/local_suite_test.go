@@ -0,0 +1,13 @@
+package storage_localdriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestLocalDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Local Driver Suite")
+}
@@ -0,0 +1,123 @@
+package storage_localdriver
+
+import (
+	"fmt"
+	"os"
+
+	"code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+
+	"../mountutil"
+)
+
+const (
+	SymlinkMode = "symlink"
+	BindMode    = "bind"
+)
+
+var propagations = map[string]bool{
+	"private": true, "rprivate": true,
+	"shared": true, "rshared": true,
+	"slave": true, "rslave": true,
+}
+
+type MountOptions struct {
+	ReadOnly    bool
+	Propagation string
+}
+
+// Mounter makes the directory of a volume available at its mount path.
+type Mounter interface {
+	Validate(options MountOptions) error
+	Mount(logger lager.Logger, volumePath, mountPath string, options MountOptions) error
+	Unmount(logger lager.Logger, mountPath string) error
+}
+
+// NewMounter returns the mounter for mode, symlink or bind.
+func NewMounter(mode string) (Mounter, error) {
+	switch mode {
+	case "", SymlinkMode:
+		return NewSymlinkMounter(&osshim.OsShim{}), nil
+	case BindMode:
+		return NewBindMounter(&osshim.OsShim{}, storage_mountutil.NewRealInvoker()), nil
+	}
+	return nil, fmt.Errorf("unknown local mount mode '%s', use %s or %s", mode, SymlinkMode, BindMode)
+}
+
+// symlinkMounter needs no privileges, but the link target is not visible
+// inside containers that only see the mount path.
+type symlinkMounter struct {
+	os osshim.Os
+}
+
+func NewSymlinkMounter(os osshim.Os) Mounter {
+	return &symlinkMounter{os: os}
+}
+
+func (m *symlinkMounter) Validate(options MountOptions) error {
+	if options.ReadOnly || options.Propagation != "" {
+		return fmt.Errorf("readonly and propagation require the %s mount mode", BindMode)
+	}
+	return nil
+}
+
+func (m *symlinkMounter) Mount(logger lager.Logger, volumePath, mountPath string, options MountOptions) error {
+	logger.Info("link", lager.Data{"src": volumePath, "tgt": mountPath})
+	return m.os.Symlink(volumePath, mountPath)
+}
+
+func (m *symlinkMounter) Unmount(logger lager.Logger, mountPath string) error {
+	logger.Info("unlink", lager.Data{"tgt": mountPath})
+	return m.os.Remove(mountPath)
+}
+
+type bindMounter struct {
+	os      osshim.Os
+	invoker storage_mountutil.Invoker
+}
+
+func NewBindMounter(os osshim.Os, invoker storage_mountutil.Invoker) Mounter {
+	return &bindMounter{os: os, invoker: invoker}
+}
+
+func (m *bindMounter) Validate(options MountOptions) error {
+	if options.Propagation != "" && !propagations[options.Propagation] {
+		return fmt.Errorf("unknown propagation '%s'", options.Propagation)
+	}
+	return nil
+}
+
+func (m *bindMounter) Mount(logger lager.Logger, volumePath, mountPath string, options MountOptions) error {
+	logger.Info("bind", lager.Data{"src": volumePath, "tgt": mountPath, "options": options})
+
+	if err := m.os.MkdirAll(mountPath, os.ModePerm); err != nil {
+		return err
+	}
+	if err := m.invoker.Invoke(logger, "mount", []string{"--bind", volumePath, mountPath}); err != nil {
+		m.os.Remove(mountPath)
+		return err
+	}
+
+	// read-only and propagation cannot be set by the initial bind mount
+	var err error
+	if options.ReadOnly {
+		err = m.invoker.Invoke(logger, "mount", []string{"-o", "remount,bind,ro", mountPath})
+	}
+	if err == nil && options.Propagation != "" {
+		err = m.invoker.Invoke(logger, "mount", []string{"--make-" + options.Propagation, mountPath})
+	}
+	if err != nil {
+		m.Unmount(logger, mountPath)
+		return err
+	}
+	return nil
+}
+
+func (m *bindMounter) Unmount(logger lager.Logger, mountPath string) error {
+	logger.Info("unbind", lager.Data{"tgt": mountPath})
+
+	if err := m.invoker.Invoke(logger, "umount", []string{mountPath}); err != nil {
+		return err
+	}
+	return m.os.Remove(mountPath)
+}
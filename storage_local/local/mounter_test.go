@@ -0,0 +1,153 @@
+package storage_localdriver_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../local"
+	"../mountutil/mountutilfakes"
+)
+
+var _ = Describe("Mounter", func() {
+	var (
+		logger     *lagertest.TestLogger
+		tempDir    string
+		volumePath string
+		mountPath  string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "local-mounter")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("mounter")
+		volumePath = filepath.Join(tempDir, "volume")
+		Expect(os.Mkdir(volumePath, 0755)).To(Succeed())
+		mountPath = filepath.Join(tempDir, "mounts", "vol")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("picks the mounter of the mode", func() {
+		_, err := storage_localdriver.NewMounter("")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = storage_localdriver.NewMounter(storage_localdriver.BindMode)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = storage_localdriver.NewMounter("overlay")
+		Expect(err).To(MatchError("unknown local mount mode 'overlay', use symlink or bind"))
+	})
+
+	Context("symlink", func() {
+		var mounter storage_localdriver.Mounter
+
+		BeforeEach(func() {
+			mounter = storage_localdriver.NewSymlinkMounter(&osshim.OsShim{})
+			Expect(os.MkdirAll(filepath.Dir(mountPath), 0755)).To(Succeed())
+		})
+
+		It("links the mount path to the volume", func() {
+			Expect(mounter.Mount(logger, volumePath, mountPath, storage_localdriver.MountOptions{})).To(Succeed())
+			target, err := os.Readlink(mountPath)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(target).To(Equal(volumePath))
+
+			Expect(mounter.Unmount(logger, mountPath)).To(Succeed())
+			Expect(mountPath).NotTo(BeAnExistingFile())
+		})
+
+		It("cannot mount read-only or with a propagation", func() {
+			Expect(mounter.Validate(storage_localdriver.MountOptions{ReadOnly: true})).NotTo(Succeed())
+			Expect(mounter.Validate(storage_localdriver.MountOptions{Propagation: "rshared"})).NotTo(Succeed())
+		})
+	})
+
+	Context("bind", func() {
+		var (
+			fakeInvoker *mountutilfakes.FakeInvoker
+			mounter     storage_localdriver.Mounter
+		)
+
+		BeforeEach(func() {
+			fakeInvoker = &mountutilfakes.FakeInvoker{}
+			mounter = storage_localdriver.NewBindMounter(&osshim.OsShim{}, fakeInvoker)
+		})
+
+		invocations := func() [][]string {
+			calls := [][]string{}
+			for i := 0; i < fakeInvoker.InvokeCallCount(); i++ {
+				_, executable, args := fakeInvoker.InvokeArgsForCall(i)
+				calls = append(calls, append([]string{executable}, args...))
+			}
+			return calls
+		}
+
+		It("bind mounts the volume onto a created mount path", func() {
+			Expect(mounter.Mount(logger, volumePath, mountPath, storage_localdriver.MountOptions{})).To(Succeed())
+			Expect(mountPath).To(BeADirectory())
+			Expect(invocations()).To(Equal([][]string{{"mount", "--bind", volumePath, mountPath}}))
+		})
+
+		It("remounts read-only and sets the propagation", func() {
+			options := storage_localdriver.MountOptions{ReadOnly: true, Propagation: "rslave"}
+			Expect(mounter.Mount(logger, volumePath, mountPath, options)).To(Succeed())
+			Expect(invocations()).To(Equal([][]string{
+				{"mount", "--bind", volumePath, mountPath},
+				{"mount", "-o", "remount,bind,ro", mountPath},
+				{"mount", "--make-rslave", mountPath},
+			}))
+		})
+
+		It("accepts only the propagations of mount", func() {
+			Expect(mounter.Validate(storage_localdriver.MountOptions{ReadOnly: true, Propagation: "rshared"})).To(Succeed())
+			Expect(mounter.Validate(storage_localdriver.MountOptions{Propagation: "unbindable"})).To(MatchError("unknown propagation 'unbindable'"))
+		})
+
+		It("removes the mount path when the bind mount fails", func() {
+			fakeInvoker.InvokeReturns(errors.New("permission denied"))
+
+			Expect(mounter.Mount(logger, volumePath, mountPath, storage_localdriver.MountOptions{})).To(MatchError("permission denied"))
+			Expect(mountPath).NotTo(BeAnExistingFile())
+		})
+
+		It("unmounts and removes the mount path when the remount fails", func() {
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				if args[0] == "-o" {
+					return errors.New("remount failed")
+				}
+				return nil
+			}
+
+			options := storage_localdriver.MountOptions{ReadOnly: true, Propagation: "rslave"}
+			Expect(mounter.Mount(logger, volumePath, mountPath, options)).To(MatchError("remount failed"))
+			Expect(invocations()).To(Equal([][]string{
+				{"mount", "--bind", volumePath, mountPath},
+				{"mount", "-o", "remount,bind,ro", mountPath},
+				{"umount", mountPath},
+			}))
+			Expect(mountPath).NotTo(BeAnExistingFile())
+		})
+
+		It("keeps the mount path when the unmount fails", func() {
+			Expect(mounter.Mount(logger, volumePath, mountPath, storage_localdriver.MountOptions{})).To(Succeed())
+			fakeInvoker.InvokeReturns(errors.New("target is busy"))
+
+			Expect(mounter.Unmount(logger, mountPath)).To(MatchError("target is busy"))
+			Expect(mountPath).To(BeADirectory())
+
+			fakeInvoker.InvokeReturns(nil)
+			Expect(mounter.Unmount(logger, mountPath)).To(Succeed())
+			Expect(mountPath).NotTo(BeAnExistingFile())
+		})
+	})
+})
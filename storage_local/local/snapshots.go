@@ -0,0 +1,279 @@
+package storage_localdriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"../../storage_ops"
+)
+
+const SnapshotsRootDir = "_snapshots"
+
+const (
+	snapshotDataDir      = "data"
+	snapshotMetadataFile = "snapshot.json"
+)
+
+var snapshotNames = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func (d *LocalDriver) Snapshot(logger lager.Logger, volumeName, snapshotName string) (storage_ops.Snapshot, error) {
+	logger = logger.Session("snapshot", lager.Data{"volume": volumeName, "snapshot": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if !snapshotNames.MatchString(snapshotName) {
+		return storage_ops.Snapshot{}, fmt.Errorf("invalid snapshot name '%s', use letters, digits, '.', '_' and '-'", snapshotName)
+	}
+
+	// the volume is marked as copied instead of holding volumesLock during
+	// the copy, so only removing, forgetting or restoring it waits for the
+	// copy
+	d.volumesLock.Lock()
+	volume, ok := d.idle(volumeName, true)
+	if !ok {
+		d.volumesLock.Unlock()
+		return storage_ops.Snapshot{}, fmt.Errorf("volume '%s' not found", volumeName)
+	}
+	volume.copying = make(chan struct{})
+	mounted := volume.MountCount > 0
+	d.volumesLock.Unlock()
+	defer d.release(&volume.copying)
+
+	// the directory reserves the name, it is not listed, restored or deleted
+	// before its metadata is written
+	d.snapshotsLock.Lock()
+	snapshotPath := d.snapshotPath(logger, snapshotName)
+	err := d.os.Mkdir(snapshotPath, os.ModePerm)
+	d.snapshotsLock.Unlock()
+	if err != nil {
+		if os.IsExist(err) {
+			return storage_ops.Snapshot{}, fmt.Errorf("snapshot '%s' already exists", snapshotName)
+		}
+		return storage_ops.Snapshot{}, err
+	}
+
+	snapshot := storage_ops.Snapshot{
+		Name:      snapshotName,
+		Volume:    volumeName,
+		CreatedAt: time.Now().UTC(),
+		Mounted:   mounted,
+	}
+	if err := d.copy(logger, d.volumePath(logger, volumeName), filepath.Join(snapshotPath, snapshotDataDir)); err != nil {
+		d.os.RemoveAll(snapshotPath)
+		return storage_ops.Snapshot{}, err
+	}
+
+	// written last: a snapshot without metadata was interrupted and is not
+	// listed
+	d.snapshotsLock.Lock()
+	defer d.snapshotsLock.Unlock()
+
+	metadata, err := json.Marshal(snapshot)
+	if err == nil {
+		err = d.ioutil.WriteFile(filepath.Join(snapshotPath, snapshotMetadataFile), metadata, 0644)
+	}
+	if err != nil {
+		d.os.RemoveAll(snapshotPath)
+		return storage_ops.Snapshot{}, err
+	}
+
+	logger.Info("snapshot-taken", lager.Data{"mounted": snapshot.Mounted})
+	return snapshot, nil
+}
+
+func (d *LocalDriver) Restore(logger lager.Logger, volumeName, snapshotName string) error {
+	logger = logger.Session("restore", lager.Data{"volume": volumeName, "snapshot": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	// the volume is marked busy, so it is not mounted while it is replaced,
+	// and the copy runs outside volumesLock
+	d.volumesLock.Lock()
+	volume, ok := d.idle(volumeName, true)
+	if !ok {
+		d.volumesLock.Unlock()
+		return fmt.Errorf("volume '%s' not found", volumeName)
+	}
+	if volume.MountCount > 0 {
+		d.volumesLock.Unlock()
+		return fmt.Errorf("volume '%s' is mounted, unmount it before restoring", volumeName)
+	}
+	volume.busy = make(chan struct{})
+	d.volumesLock.Unlock()
+	defer d.release(&volume.busy)
+
+	snapshot, done, err := d.useSnapshot(logger, snapshotName)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if snapshot.Volume != volumeName {
+		logger.Info("restoring-snapshot-of-other-volume", lager.Data{"snapshot_volume": snapshot.Volume})
+	}
+
+	// the snapshot is copied next to the volume first, so a failed copy leaves
+	// the volume as it was
+	workDir, err := d.ioutil.TempDir(d.snapshotPath(logger, ""), ".restore-")
+	if err != nil {
+		return err
+	}
+	defer d.os.RemoveAll(workDir)
+
+	restored := filepath.Join(workDir, snapshotDataDir)
+	if err := d.copy(logger, filepath.Join(d.snapshotPath(logger, snapshotName), snapshotDataDir), restored); err != nil {
+		return err
+	}
+
+	volumePath := d.volumePath(logger, volumeName)
+	replaced := filepath.Join(workDir, "replaced")
+	if err := d.os.Rename(volumePath, replaced); err != nil {
+		return err
+	}
+	if err := d.os.Rename(restored, volumePath); err != nil {
+		d.os.Rename(replaced, volumePath)
+		return err
+	}
+	return nil
+}
+
+func (d *LocalDriver) Snapshots(logger lager.Logger, volumeName string) ([]storage_ops.Snapshot, error) {
+	d.snapshotsLock.Lock()
+	defer d.snapshotsLock.Unlock()
+
+	entries, err := d.ioutil.ReadDir(d.snapshotPath(logger, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []storage_ops.Snapshot{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !snapshotNames.MatchString(entry.Name()) {
+			continue
+		}
+		snapshot, err := d.readSnapshot(logger, entry.Name())
+		if err != nil {
+			continue
+		}
+		if volumeName == "" || snapshot.Volume == volumeName {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+func (d *LocalDriver) DeleteSnapshot(logger lager.Logger, snapshotName string) error {
+	logger = logger.Session("delete-snapshot", lager.Data{"snapshot": snapshotName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	d.snapshotsLock.Lock()
+	defer d.snapshotsLock.Unlock()
+
+	if _, err := d.readSnapshot(logger, snapshotName); err != nil {
+		return err
+	}
+	if d.snapshotReaders[snapshotName] > 0 {
+		return fmt.Errorf("snapshot '%s' is being copied", snapshotName)
+	}
+	return d.os.RemoveAll(d.snapshotPath(logger, snapshotName))
+}
+
+// useSnapshot keeps a snapshot from being deleted until done is called, so
+// it can be copied outside snapshotsLock.
+func (d *LocalDriver) useSnapshot(logger lager.Logger, snapshotName string) (storage_ops.Snapshot, func(), error) {
+	d.snapshotsLock.Lock()
+	defer d.snapshotsLock.Unlock()
+
+	snapshot, err := d.readSnapshot(logger, snapshotName)
+	if err != nil {
+		return snapshot, nil, err
+	}
+	d.snapshotReaders[snapshotName]++
+
+	return snapshot, func() {
+		d.snapshotsLock.Lock()
+		defer d.snapshotsLock.Unlock()
+
+		d.snapshotReaders[snapshotName]--
+		if d.snapshotReaders[snapshotName] == 0 {
+			delete(d.snapshotReaders, snapshotName)
+		}
+	}, nil
+}
+
+// seed copies a snapshot into the directory of a volume being created. The
+// name of the volume is reserved in seeding.
+func (d *LocalDriver) seed(logger lager.Logger, snapshotName, volumePath string) error {
+	_, done, err := d.useSnapshot(logger, snapshotName)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// a forgotten volume of the same name left its data behind
+	entries, err := d.ioutil.ReadDir(volumePath)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("volume directory '%s' is not empty", volumePath)
+	}
+
+	if err := d.copy(logger, filepath.Join(d.snapshotPath(logger, snapshotName), snapshotDataDir), volumePath); err != nil {
+		// it was empty, nothing but the partial copy is lost
+		d.os.RemoveAll(volumePath)
+		return err
+	}
+	return nil
+}
+
+func (d *LocalDriver) readSnapshot(logger lager.Logger, snapshotName string) (storage_ops.Snapshot, error) {
+	var snapshot storage_ops.Snapshot
+	if !snapshotNames.MatchString(snapshotName) {
+		return snapshot, storage_ops.ErrSnapshotNotFound
+	}
+
+	metadata, err := d.ioutil.ReadFile(filepath.Join(d.snapshotPath(logger, snapshotName), snapshotMetadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return snapshot, storage_ops.ErrSnapshotNotFound
+		}
+		return snapshot, err
+	}
+	if err := json.Unmarshal(metadata, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("invalid metadata of snapshot '%s': %s", snapshotName, err.Error())
+	}
+	return snapshot, nil
+}
+
+// copy copies the contents of src into dst, sharing the blocks instead where
+// the filesystem supports reflinks (btrfs, xfs).
+func (d *LocalDriver) copy(logger lager.Logger, src, dst string) error {
+	if err := d.os.MkdirAll(dst, os.ModePerm); err != nil {
+		return err
+	}
+	return d.invoker.Invoke(logger, "cp", []string{"-a", "--reflink=auto", src + "/.", dst})
+}
+
+func (d *LocalDriver) snapshotPath(logger lager.Logger, snapshotName string) string {
+	dir, err := d.filepath.Abs(d.mountPathRoot)
+	if err != nil {
+		logger.Fatal("abs-failed", err)
+	}
+
+	snapshotsPathRoot := filepath.Join(dir, SnapshotsRootDir)
+	d.os.MkdirAll(snapshotsPathRoot, os.ModePerm)
+
+	return filepath.Join(snapshotsPathRoot, snapshotName)
+}
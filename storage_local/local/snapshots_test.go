@@ -0,0 +1,391 @@
+package storage_localdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/filepath"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_ops"
+	"../local"
+	"../mountutil"
+	"../mountutil/mountutilfakes"
+)
+
+var _ = Describe("LocalDriver snapshots", func() {
+	var (
+		logger      *lagertest.TestLogger
+		tempDir     string
+		fakeInvoker *mountutilfakes.FakeInvoker
+		driver      *storage_localdriver.LocalDriver
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "local-snapshots")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("local")
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		fakeInvoker.InvokeStub = storage_mountutil.NewRealInvoker().Invoke
+		driver = storage_localdriver.WrapLocalDriverWithInvoker(&osshim.OsShim{}, &filepathshim.FilepathShim{}, tempDir, storage_localdriver.NewSymlinkMounter(&osshim.OsShim{}), fakeInvoker)
+
+		Expect(driver.Create(logger, voldriver.CreateRequest{Name: "vol"}).Err).To(BeEmpty())
+		Expect(driver.Create(logger, voldriver.CreateRequest{Name: "other"}).Err).To(BeEmpty())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	volumeFile := func(volumeName string) string {
+		return filepath.Join(tempDir, storage_localdriver.VolumesRootDir, volumeName, "data")
+	}
+
+	writeVolume := func(volumeName, contents string) {
+		Expect(ioutil.WriteFile(volumeFile(volumeName), []byte(contents), 0644)).To(Succeed())
+	}
+
+	readVolume := func(volumeName string) string {
+		contents, err := ioutil.ReadFile(volumeFile(volumeName))
+		Expect(err).NotTo(HaveOccurred())
+		return string(contents)
+	}
+
+	// blockCopies makes the next cp wait until the returned release is
+	// called; copying is closed once it started.
+	blockCopies := func() (copying chan struct{}, release func()) {
+		copying = make(chan struct{})
+		copied := make(chan struct{})
+		started := copying
+		fakeInvoker.InvokeStub = func(logger lager.Logger, executable string, args []string) error {
+			close(started)
+			<-copied
+			return storage_mountutil.NewRealInvoker().Invoke(logger, executable, args)
+		}
+		released := false
+		return copying, func() {
+			if !released {
+				released = true
+				close(copied)
+			}
+		}
+	}
+
+	Describe("Snapshot", func() {
+		It("copies the volume and lists the snapshot", func() {
+			writeVolume("vol", "before")
+
+			snapshot, err := driver.Snapshot(logger, "vol", "snap")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshot.Volume).To(Equal("vol"))
+			Expect(snapshot.Mounted).To(BeFalse())
+
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+			_, executable, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(executable).To(Equal("cp"))
+			Expect(args).To(ContainElement("--reflink=auto"))
+
+			snapshots, err := driver.Snapshots(logger, "vol")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshots).To(ConsistOf(snapshot))
+
+			snapshots, err = driver.Snapshots(logger, "other")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshots).To(BeEmpty())
+		})
+
+		It("records that the volume was mounted", func() {
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+
+			snapshot, err := driver.Snapshot(logger, "vol", "snap")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshot.Mounted).To(BeTrue())
+		})
+
+		It("lists the snapshots of all volumes oldest first", func() {
+			_, err := driver.Snapshot(logger, "vol", "first")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = driver.Snapshot(logger, "other", "second")
+			Expect(err).NotTo(HaveOccurred())
+
+			snapshots, err := driver.Snapshots(logger, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshots).To(HaveLen(2))
+			Expect(snapshots[0].Name).To(Equal("first"))
+			Expect(snapshots[1].Name).To(Equal("second"))
+		})
+
+		It("refuses invalid and taken names and unknown volumes", func() {
+			_, err := driver.Snapshot(logger, "vol", "../escape")
+			Expect(err).To(MatchError(ContainSubstring("invalid snapshot name")))
+
+			_, err = driver.Snapshot(logger, "vol", "snap")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = driver.Snapshot(logger, "other", "snap")
+			Expect(err).To(MatchError("snapshot 'snap' already exists"))
+
+			_, err = driver.Snapshot(logger, "unknown", "snap2")
+			Expect(err).To(MatchError("volume 'unknown' not found"))
+		})
+
+		It("leaves nothing behind when the copy fails", func() {
+			fakeInvoker.InvokeReturns(os.ErrPermission)
+			fakeInvoker.InvokeStub = nil
+
+			_, err := driver.Snapshot(logger, "vol", "snap")
+			Expect(err).To(HaveOccurred())
+			Expect(filepath.Join(tempDir, storage_localdriver.SnapshotsRootDir, "snap")).NotTo(BeADirectory())
+		})
+
+		Context("while the snapshot is copied", func() {
+			var (
+				release  func()
+				snapshot chan error
+			)
+
+			BeforeEach(func() {
+				var copying chan struct{}
+				copying, release = blockCopies()
+
+				snapshot = make(chan error, 1)
+				go func(driver *storage_localdriver.LocalDriver, logger lager.Logger, snapshot chan<- error) {
+					_, err := driver.Snapshot(logger, "vol", "snap")
+					snapshot <- err
+				}(driver, logger, snapshot)
+				Eventually(copying).Should(BeClosed())
+			})
+
+			AfterEach(func() {
+				release()
+			})
+
+			It("serves the other volumes and the volume itself", func() {
+				Expect(driver.Mount(logger, voldriver.MountRequest{Name: "other"}).Err).To(BeEmpty())
+				Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+				Expect(driver.List(logger).Volumes).To(HaveLen(2))
+
+				release()
+				Eventually(snapshot).Should(Receive(BeNil()))
+			})
+
+			It("does not list the snapshot before it is complete", func() {
+				snapshots, err := driver.Snapshots(logger, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(snapshots).To(BeEmpty())
+
+				release()
+				Eventually(snapshot).Should(Receive(BeNil()))
+				snapshots, err = driver.Snapshots(logger, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(snapshots).To(HaveLen(1))
+			})
+
+			It("removes the volume once the copy is done", func() {
+				removed := make(chan voldriver.ErrorResponse, 1)
+				go func() {
+					removed <- driver.Remove(logger, voldriver.RemoveRequest{Name: "vol"})
+				}()
+				Consistently(removed).ShouldNot(Receive())
+
+				release()
+				Eventually(snapshot).Should(Receive(BeNil()))
+				Eventually(removed).Should(Receive(Equal(voldriver.ErrorResponse{})))
+			})
+		})
+	})
+
+	Describe("Restore", func() {
+		BeforeEach(func() {
+			writeVolume("vol", "before")
+			_, err := driver.Snapshot(logger, "vol", "snap")
+			Expect(err).NotTo(HaveOccurred())
+			writeVolume("vol", "after")
+		})
+
+		It("replaces the contents of the volume", func() {
+			Expect(driver.Restore(logger, "vol", "snap")).To(Succeed())
+			Expect(readVolume("vol")).To(Equal("before"))
+		})
+
+		It("restores the snapshot of another volume", func() {
+			Expect(driver.Restore(logger, "other", "snap")).To(Succeed())
+			Expect(readVolume("other")).To(Equal("before"))
+			Expect(readVolume("vol")).To(Equal("after"))
+		})
+
+		It("refuses a mounted volume", func() {
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+
+			err := driver.Restore(logger, "vol", "snap")
+			Expect(err).To(MatchError("volume 'vol' is mounted, unmount it before restoring"))
+			Expect(readVolume("vol")).To(Equal("after"))
+		})
+
+		It("refuses unknown snapshots and volumes", func() {
+			Expect(driver.Restore(logger, "vol", "unknown")).To(Equal(storage_ops.ErrSnapshotNotFound))
+			Expect(driver.Restore(logger, "unknown", "snap")).To(MatchError("volume 'unknown' not found"))
+		})
+
+		It("leaves the volume as it was when the copy fails", func() {
+			fakeInvoker.InvokeStub = nil
+			fakeInvoker.InvokeReturns(os.ErrPermission)
+
+			Expect(driver.Restore(logger, "vol", "snap")).NotTo(Succeed())
+			Expect(readVolume("vol")).To(Equal("after"))
+		})
+
+		Context("while the snapshot is copied", func() {
+			var (
+				release  func()
+				restored chan error
+			)
+
+			BeforeEach(func() {
+				var copying chan struct{}
+				copying, release = blockCopies()
+
+				restored = make(chan error, 1)
+				go func(driver *storage_localdriver.LocalDriver, logger lager.Logger, restored chan<- error) {
+					restored <- driver.Restore(logger, "vol", "snap")
+				}(driver, logger, restored)
+				Eventually(copying).Should(BeClosed())
+			})
+
+			AfterEach(func() {
+				release()
+			})
+
+			It("serves the other volumes", func() {
+				Expect(driver.Mount(logger, voldriver.MountRequest{Name: "other"}).Err).To(BeEmpty())
+				Expect(driver.List(logger).Volumes).To(HaveLen(2))
+				Expect(driver.Get(logger, voldriver.GetRequest{Name: "other"}).Err).To(BeEmpty())
+			})
+
+			It("mounts the volume once it is restored", func() {
+				mounted := make(chan voldriver.MountResponse, 1)
+				go func() {
+					mounted <- driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+				}()
+				Consistently(mounted).ShouldNot(Receive())
+
+				release()
+				Eventually(restored).Should(Receive(BeNil()))
+				Eventually(mounted).Should(Receive(WithTransform(func(response voldriver.MountResponse) string {
+					return response.Err
+				}, BeEmpty())))
+				Expect(readVolume("vol")).To(Equal("before"))
+			})
+
+			It("does not delete the snapshot", func() {
+				Expect(driver.DeleteSnapshot(logger, "snap")).To(MatchError("snapshot 'snap' is being copied"))
+
+				release()
+				Eventually(restored).Should(Receive(BeNil()))
+				Expect(driver.DeleteSnapshot(logger, "snap")).To(Succeed())
+			})
+		})
+	})
+
+	Describe("Create from a snapshot", func() {
+		fromSnapshot := func(name string) voldriver.CreateRequest {
+			return voldriver.CreateRequest{Name: "seeded", Opts: map[string]interface{}{"from_snapshot": name}}
+		}
+
+		BeforeEach(func() {
+			writeVolume("vol", "before")
+			_, err := driver.Snapshot(logger, "vol", "snap")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("seeds the new volume with the snapshot", func() {
+			Expect(driver.Create(logger, fromSnapshot("snap")).Err).To(BeEmpty())
+			Expect(readVolume("seeded")).To(Equal("before"))
+		})
+
+		It("does not create the volume from an unknown snapshot", func() {
+			response := driver.Create(logger, fromSnapshot("unknown"))
+			Expect(response.Err).To(Equal("Error creating volume from snapshot 'unknown': snapshot not found"))
+			Expect(driver.Get(logger, voldriver.GetRequest{Name: "seeded"}).Err).NotTo(BeEmpty())
+		})
+
+		Context("while the snapshot is copied", func() {
+			var (
+				release func()
+				created chan voldriver.ErrorResponse
+			)
+
+			BeforeEach(func() {
+				var copying chan struct{}
+				copying, release = blockCopies()
+
+				created = make(chan voldriver.ErrorResponse, 1)
+				go func(driver *storage_localdriver.LocalDriver, logger lager.Logger, created chan<- voldriver.ErrorResponse) {
+					created <- driver.Create(logger, fromSnapshot("snap"))
+				}(driver, logger, created)
+				Eventually(copying).Should(BeClosed())
+			})
+
+			AfterEach(func() {
+				release()
+			})
+
+			It("serves the other volumes and adds the volume once it is seeded", func() {
+				Expect(driver.Mount(logger, voldriver.MountRequest{Name: "other"}).Err).To(BeEmpty())
+				Expect(driver.List(logger).Volumes).To(HaveLen(2))
+				Expect(driver.Get(logger, voldriver.GetRequest{Name: "seeded"}).Err).NotTo(BeEmpty())
+
+				release()
+				Eventually(created).Should(Receive(Equal(voldriver.ErrorResponse{})))
+				Expect(driver.List(logger).Volumes).To(HaveLen(3))
+			})
+
+			It("lets a create of the same name wait for the seed", func() {
+				duplicate := make(chan voldriver.ErrorResponse, 1)
+				go func() {
+					duplicate <- driver.Create(logger, voldriver.CreateRequest{Name: "seeded"})
+				}()
+				Consistently(duplicate).ShouldNot(Receive())
+
+				release()
+				Eventually(created).Should(Receive(Equal(voldriver.ErrorResponse{})))
+				Eventually(duplicate).Should(Receive(Equal(voldriver.ErrorResponse{})))
+				Expect(fakeInvoker.InvokeCallCount()).To(Equal(2))
+			})
+
+			It("does not delete the snapshot", func() {
+				Expect(driver.DeleteSnapshot(logger, "snap")).To(MatchError("snapshot 'snap' is being copied"))
+			})
+		})
+	})
+
+	Describe("DeleteSnapshot", func() {
+		It("deletes the snapshot", func() {
+			_, err := driver.Snapshot(logger, "vol", "snap")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(driver.DeleteSnapshot(logger, "snap")).To(Succeed())
+			snapshots, err := driver.Snapshots(logger, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshots).To(BeEmpty())
+			Expect(driver.DeleteSnapshot(logger, "snap")).To(Equal(storage_ops.ErrSnapshotNotFound))
+		})
+
+		It("keeps the snapshot of a removed volume", func() {
+			_, err := driver.Snapshot(logger, "vol", "snap")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(driver.Remove(logger, voldriver.RemoveRequest{Name: "vol"}).Err).To(BeEmpty())
+
+			snapshots, err := driver.Snapshots(logger, "vol")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(snapshots).To(HaveLen(1))
+		})
+	})
+})
@@ -0,0 +1,328 @@
+package storage_loopdriver
+
+import (
+	"os"
+
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"fmt"
+
+	"../../storage_config"
+	"../mountutil"
+)
+
+const (
+	Name = "loop"
+)
+
+var mkfsArgs = map[string][]string{
+	"ext4": {"-F", "-q"},
+	"xfs":  {"-f", "-q"},
+}
+
+type LoopLocalDriver struct {
+	imageDir    string
+	mountRoot   string
+	userInvoker storage_mountutil.Invoker
+	os          osshim.Os
+
+	*storage_mountutil.Volumes
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	SizeBytes       int64
+	FsType          string
+	Image           string
+	LocalMountPoint string
+	LoopDevice      string
+	// GrowPending is set when an xfs image was enlarged while detached, since
+	// xfs can only be grown while mounted.
+	GrowPending bool
+}
+
+func NewLoopLocalDriver(imageDir, mountRoot string) *LoopLocalDriver {
+	return NewLoopDriverWithInvoker(&osshim.OsShim{}, storage_mountutil.NewRealInvoker(), imageDir, mountRoot)
+}
+
+func NewLoopDriverWithInvoker(os osshim.Os, invoker storage_mountutil.Invoker, imageDir, mountRoot string) *LoopLocalDriver {
+	d := &LoopLocalDriver{
+		imageDir:    imageDir,
+		mountRoot:   mountRoot,
+		userInvoker: invoker,
+		os:          os,
+		Holder:      storage_config.NewHolder(),
+	}
+	d.Volumes = storage_mountutil.NewVolumes(Name, d)
+	return d
+}
+
+func (d *LoopLocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *LoopLocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "local"},
+	}
+}
+
+func (d *LoopLocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	newVolume := &volumeMetadata{}
+	var err *voldriver.ErrorResponse
+	var size, resize string
+
+	if size, err = storage_mountutil.ExtractValue(logger, "size", createRequest.Opts); err != nil {
+		return *err
+	}
+	sizeBytes, sizeErr := storage_mountutil.ParseSize(size)
+	if sizeErr != nil {
+		logger.Info("invalid-size", lager.Data{"size": size})
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.size: %s", sizeErr.Error())}
+	}
+	newVolume.SizeBytes = sizeBytes
+
+	if newVolume.FsType, err = storage_mountutil.ExtractOptionalValue(logger, "fstype", createRequest.Opts, "ext4"); err != nil {
+		return *err
+	}
+	if _, ok := mkfsArgs[newVolume.FsType]; !ok {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.fstype '%s' is not supported, use ext4 or xfs", newVolume.FsType)}
+	}
+	if resize, err = storage_mountutil.ExtractOptionalValue(logger, "resize", createRequest.Opts, "false"); err != nil {
+		return *err
+	}
+	if newVolume.LocalMountPoint, err = storage_mountutil.ExtractOptionalValue(logger, "localmountpoint", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.LocalMountPoint == "" {
+		newVolume.LocalMountPoint = storage_mountutil.VolumeFilePath(d.mountRoot, createRequest.Name, "")
+	}
+	newVolume.Image = storage_mountutil.VolumeFilePath(d.imageDir, createRequest.Name, ".img")
+
+	if _, _, exists := d.Volume(createRequest.Name); exists && resize == "true" {
+		return d.resize(logger, createRequest.Name, newVolume)
+	}
+
+	return d.Volumes.Add(logger, createRequest.Name, newVolume, func() error {
+		return d.createImage(logger, newVolume)
+	})
+}
+
+// resize grows an existing volume to the size of newVolume, any other
+// difference in the Opts is still refused.
+func (d *LoopLocalDriver) resize(logger lager.Logger, volumeName string, newVolume *volumeMetadata) voldriver.ErrorResponse {
+	response := voldriver.ErrorResponse{}
+	err := d.Exclusive(volumeName, func(mountable storage_mountutil.Volume, mountCount int) error {
+		volume := mountable.(*volumeMetadata)
+		if volume.equals(newVolume) {
+			logger.Info("duplicate-volume", lager.Data{"volume_name": volumeName})
+			return nil
+		}
+		if volume.FsType != newVolume.FsType || volume.LocalMountPoint != newVolume.LocalMountPoint {
+			logger.Info("duplicate-volume-with-different-opts", lager.Data{"volume_name": volumeName, "existing-volume": volume})
+			return fmt.Errorf("Volume '%s' already exists with different Opts", volumeName)
+		}
+		response = d.grow(logger, volume, mountCount, volumeName, newVolume.SizeBytes)
+		return nil
+	})
+	if err != nil {
+		return voldriver.ErrorResponse{Err: err.Error()}
+	}
+	return response
+}
+
+func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
+	return volume.SizeBytes == v.SizeBytes &&
+		volume.FsType == v.FsType &&
+		volume.LocalMountPoint == v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*volumeMetadata)
+	return ok && v.equals(volume)
+}
+
+func (v *volumeMetadata) MountPoint() string {
+	return v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Target() string {
+	return v.Image
+}
+
+func (v *volumeMetadata) Server() string {
+	return "localhost"
+}
+
+// createImage allocates a sparse image file and formats it. A half created
+// image is removed again. The image of a volume created before a restart is
+// adopted with its data if its size matches.
+func (d *LoopLocalDriver) createImage(logger lager.Logger, volume *volumeMetadata) error {
+	if err := d.os.MkdirAll(d.imageDir, 0700); err != nil {
+		return err
+	}
+
+	file, err := d.os.OpenFile(volume.Image, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if d.os.IsExist(err) {
+		return d.adoptImage(logger, volume)
+	}
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	if err := d.os.Truncate(volume.Image, volume.SizeBytes); err != nil {
+		d.os.Remove(volume.Image)
+		return err
+	}
+
+	args := append(append([]string{}, mkfsArgs[volume.FsType]...), volume.Image)
+	if err := d.userInvoker.Invoke(logger, "mkfs."+volume.FsType, args); err != nil {
+		d.os.Remove(volume.Image)
+		return err
+	}
+	return nil
+}
+
+func (d *LoopLocalDriver) adoptImage(logger lager.Logger, volume *volumeMetadata) error {
+	info, err := d.os.Stat(volume.Image)
+	if err != nil {
+		return err
+	}
+	if info.Size() != volume.SizeBytes {
+		logger.Info("existing-image-size-differs", lager.Data{"image": volume.Image, "size": info.Size()})
+		return fmt.Errorf("an image of %d bytes already exists, create it with that size", info.Size())
+	}
+	logger.Info("adopting-existing-image", lager.Data{"image": volume.Image})
+	return nil
+}
+
+// grow enlarges the image of an existing volume. Mounted file systems are grown
+// online through their loop device; images cannot shrink.
+func (d *LoopLocalDriver) grow(logger lager.Logger, volume *volumeMetadata, mountCount int, volumeName string, sizeBytes int64) voldriver.ErrorResponse {
+	logger = logger.Session("grow", lager.Data{"volume_name": volumeName, "from": volume.SizeBytes, "to": sizeBytes})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if sizeBytes < volume.SizeBytes {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' cannot shrink from %d to %d bytes", volumeName, volume.SizeBytes, sizeBytes)}
+	}
+
+	if err := d.os.Truncate(volume.Image, sizeBytes); err != nil {
+		logger.Error("failed-truncating-image", err)
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Error resizing '%s' (%s)", volumeName, err.Error())}
+	}
+
+	// SizeBytes only changes once the file system fills the image, so a
+	// failed grow is retried by the next resize with the same size
+	var err error
+	if mountCount > 0 {
+		if err = d.userInvoker.Invoke(logger, "losetup", []string{"-c", volume.LoopDevice}); err == nil {
+			err = d.growFs(logger, volume)
+		}
+	} else if volume.FsType == "xfs" {
+		d.Update(func() { volume.GrowPending = true })
+	} else {
+		if err = d.userInvoker.Invoke(logger, "e2fsck", []string{"-f", "-p", volume.Image}); err == nil {
+			err = d.userInvoker.Invoke(logger, "resize2fs", []string{volume.Image})
+		}
+	}
+	if err != nil {
+		logger.Error("failed-growing-filesystem", err)
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Error resizing '%s' (%s)", volumeName, err.Error())}
+	}
+
+	d.Update(func() { volume.SizeBytes = sizeBytes })
+	return voldriver.ErrorResponse{}
+}
+
+// growFs grows the file system of a mounted volume to the size of its loop device.
+func (d *LoopLocalDriver) growFs(logger lager.Logger, volume *volumeMetadata) error {
+	if volume.FsType == "xfs" {
+		return d.userInvoker.Invoke(logger, "xfs_growfs", []string{volume.LocalMountPoint})
+	}
+	return d.userInvoker.Invoke(logger, "resize2fs", []string{volume.LoopDevice})
+}
+
+func (d *LoopLocalDriver) Attach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	config := d.Config()
+
+	if err := d.os.MkdirAll(volume.LocalMountPoint, os.ModePerm); err != nil {
+		logger.Error("failed-create-mountdir", err)
+		return fmt.Errorf("unable to create local mount point")
+	}
+
+	loopDevice, err := d.userInvoker.Output(logger, "losetup", []string{"--find", "--show", volume.Image})
+	if err != nil || loopDevice == "" {
+		logger.Error("failed-attaching-loop-device", err)
+		return fmt.Errorf("unable to attach a loop device")
+	}
+	logger.Info("attached-loop-device", lager.Data{"device": loopDevice})
+
+	cmdArgs := []string{"-t", volume.FsType, loopDevice, volume.LocalMountPoint}
+	if err := storage_mountutil.MountWithRetry(logger, d.userInvoker, config.MountRetry, "mount", cmdArgs); err != nil {
+		d.detach(logger, loopDevice)
+		return err
+	}
+	d.Update(func() { volume.LoopDevice = loopDevice })
+
+	if volume.GrowPending {
+		if err := d.growFs(logger, volume); err != nil {
+			logger.Error("failed-growing-filesystem", err)
+		} else {
+			d.Update(func() { volume.GrowPending = false })
+		}
+	}
+	return nil
+}
+
+// Detach unmounts the file system and frees its loop device. A loop device
+// that cannot be freed is only logged, the volume is not mounted anymore.
+func (d *LoopLocalDriver) Detach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	if err := d.userInvoker.Invoke(logger, "umount", []string{volume.LocalMountPoint}); err != nil {
+		logger.Error("failed-invoking-umount", err)
+		return err
+	}
+
+	if err := d.detach(logger, volume.LoopDevice); err == nil {
+		d.Update(func() { volume.LoopDevice = "" })
+	}
+
+	if err := d.os.Remove(volume.LocalMountPoint); err != nil {
+		logger.Error("failed-removing-mountpoint", err)
+	}
+	return nil
+}
+
+func (d *LoopLocalDriver) Destroy(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	logger.Info("remove-image", lager.Data{"image": volume.Image})
+	if err := d.os.Remove(volume.Image); err != nil && !d.os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *LoopLocalDriver) detach(logger lager.Logger, loopDevice string) error {
+	err := d.userInvoker.Invoke(logger, "losetup", []string{"-d", loopDevice})
+	if err != nil {
+		logger.Error("failed-detaching-loop-device", err, lager.Data{"device": loopDevice})
+	}
+	return err
+}
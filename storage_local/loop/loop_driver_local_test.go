@@ -0,0 +1,185 @@
+package storage_loopdriver_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_config"
+	"../loop"
+	"../mountutil/mountutilfakes"
+)
+
+var _ = Describe("LoopLocalDriver", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeInvoker *mountutilfakes.FakeInvoker
+		tempDir     string
+		imageDir    string
+		driver      *storage_loopdriver.LoopLocalDriver
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "loop-driver")
+		Expect(err).NotTo(HaveOccurred())
+		imageDir = filepath.Join(tempDir, "images")
+
+		logger = lagertest.NewTestLogger("loop")
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		driver = storage_loopdriver.NewLoopDriverWithInvoker(&osshim.OsShim{}, fakeInvoker, imageDir, filepath.Join(tempDir, "mounts"))
+
+		config := storage_config.DefaultConfig()
+		config.MountRetry.Interval = 0
+		Expect(driver.Reload(logger, config)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	create := func(size string, resize bool) voldriver.ErrorResponse {
+		opts := map[string]interface{}{"size": size}
+		if resize {
+			opts["resize"] = "true"
+		}
+		return driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: opts})
+	}
+
+	image := func() string {
+		images, err := filepath.Glob(filepath.Join(imageDir, "*.img"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(images).To(HaveLen(1))
+		return images[0]
+	}
+
+	imageSize := func() int64 {
+		info, err := os.Stat(image())
+		Expect(err).NotTo(HaveOccurred())
+		return info.Size()
+	}
+
+	executables := func() []string {
+		names := []string{}
+		for i := 0; i < fakeInvoker.InvokeCallCount(); i++ {
+			_, executable, _ := fakeInvoker.InvokeArgsForCall(i)
+			names = append(names, executable)
+		}
+		return names
+	}
+
+	Context("#Create", func() {
+		It("allocates and formats an image", func() {
+			Expect(create("1M", false).Err).To(BeEmpty())
+			Expect(imageSize()).To(Equal(int64(1 << 20)))
+
+			_, executable, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(executable).To(Equal("mkfs.ext4"))
+			Expect(args).To(Equal([]string{"-F", "-q", image()}))
+		})
+
+		It("removes the image when formatting fails", func() {
+			fakeInvoker.InvokeReturns(errors.New("mkfs failed"))
+			Expect(create("1M", false).Err).To(Equal("Error creating volume 'vol' (mkfs failed)"))
+
+			images, err := filepath.Glob(filepath.Join(imageDir, "*.img"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(images).To(BeEmpty())
+		})
+
+		Context("when the image survived a restart", func() {
+			BeforeEach(func() {
+				Expect(create("1M", false).Err).To(BeEmpty())
+				Expect(ioutil.WriteFile(image(), []byte("data"), 0600)).To(Succeed())
+				Expect(os.Truncate(image(), 1<<20)).To(Succeed())
+
+				fakeInvoker = &mountutilfakes.FakeInvoker{}
+				driver = storage_loopdriver.NewLoopDriverWithInvoker(&osshim.OsShim{}, fakeInvoker, imageDir, filepath.Join(tempDir, "mounts"))
+			})
+
+			It("adopts the image without formatting it", func() {
+				Expect(create("1M", false).Err).To(BeEmpty())
+				Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+
+				data, err := ioutil.ReadFile(image())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(data[:4])).To(Equal("data"))
+			})
+
+			It("refuses a different size and keeps the image", func() {
+				response := create("2M", false)
+				Expect(response.Err).To(Equal("Error creating volume 'vol' (an image of 1048576 bytes already exists, create it with that size)"))
+				Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+				Expect(imageSize()).To(Equal(int64(1 << 20)))
+				Expect(driver.List(logger).Volumes).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("resizing", func() {
+		BeforeEach(func() {
+			Expect(create("1M", false).Err).To(BeEmpty())
+		})
+
+		It("grows the image and its file system", func() {
+			Expect(create("2M", true).Err).To(BeEmpty())
+			Expect(imageSize()).To(Equal(int64(2 << 20)))
+			Expect(executables()).To(Equal([]string{"mkfs.ext4", "e2fsck", "resize2fs"}))
+
+			Expect(create("2M", true).Err).To(BeEmpty())
+			Expect(executables()).To(HaveLen(3))
+		})
+
+		It("grows again after the file system could not be grown", func() {
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				if executable == "resize2fs" {
+					return errors.New("resize2fs failed")
+				}
+				return nil
+			}
+			Expect(create("2M", true).Err).To(Equal("Error resizing 'vol' (resize2fs failed)"))
+
+			fakeInvoker.InvokeStub = nil
+			Expect(create("2M", true).Err).To(BeEmpty())
+			Expect(executables()).To(Equal([]string{"mkfs.ext4", "e2fsck", "resize2fs", "e2fsck", "resize2fs"}))
+		})
+
+		It("refuses to shrink", func() {
+			Expect(create("512K", true).Err).To(Equal("Volume 'vol' cannot shrink from 1048576 to 524288 bytes"))
+		})
+
+		It("answers creates of the volume while it is resized", func() {
+			growing := make(chan struct{})
+			grow := make(chan struct{})
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				if executable == "resize2fs" {
+					close(growing)
+					<-grow
+				}
+				return nil
+			}
+
+			resized := make(chan voldriver.ErrorResponse, 1)
+			go func(driver *storage_loopdriver.LoopLocalDriver, logger lager.Logger) {
+				resized <- driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: map[string]interface{}{"size": "2M", "resize": "true"}})
+			}(driver, logger)
+			Eventually(growing).Should(BeClosed())
+
+			Expect(create("1M", false).Err).To(BeEmpty())
+			Expect(create("2M", false).Err).To(Equal("Volume 'vol' already exists with different Opts"))
+
+			// the creates compare with the size while the resize sets it
+			close(grow)
+			Eventually(func() string { return create("2M", false).Err }).Should(BeEmpty())
+			Eventually(resized).Should(Receive(Equal(voldriver.ErrorResponse{})))
+		})
+	})
+})
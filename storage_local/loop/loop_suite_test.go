@@ -0,0 +1,13 @@
+package storage_loopdriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestLoopDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Loop Driver Suite")
+}
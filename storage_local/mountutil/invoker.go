@@ -0,0 +1,81 @@
+package storage_mountutil
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/execshim"
+	"code.cloudfoundry.org/lager"
+)
+
+type Invoker interface {
+	Invoke(logger lager.Logger, executable string, args []string) error
+	// Output runs the executable like Invoke and returns its trimmed stdout.
+	Output(logger lager.Logger, executable string, args []string) (string, error)
+}
+
+type realInvoker struct {
+	exec execshim.Exec
+}
+
+func NewRealInvoker() Invoker {
+	return NewRealInvokerWithExec(&execshim.ExecShim{})
+}
+
+func NewRealInvokerWithExec(exec execshim.Exec) Invoker {
+	return &realInvoker{
+		exec:        exec,
+	}
+}
+
+func (r *realInvoker) Invoke(logger lager.Logger, executable string, args []string) error {
+	cmdHandle := r.exec.Command(executable, args...)
+
+	_,err := cmdHandle.StdoutPipe()
+	if err != nil {
+		logger.Error("unable to get stdout", err)
+		return err
+	}
+
+	err = cmdHandle.Start()
+	if err != nil {
+		logger.Error("start command error", err)
+		return err
+	}
+
+	err = cmdHandle.Wait()
+	if err != nil {
+		logger.Error("wait command error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *realInvoker) Output(logger lager.Logger, executable string, args []string) (string, error) {
+	cmdHandle := r.exec.Command(executable, args...)
+
+	stdout, err := cmdHandle.StdoutPipe()
+	if err != nil {
+		logger.Error("unable to get stdout", err)
+		return "", err
+	}
+
+	err = cmdHandle.Start()
+	if err != nil {
+		logger.Error("start command error", err)
+		return "", err
+	}
+
+	output, err := ioutil.ReadAll(stdout)
+	if err != nil {
+		logger.Error("read stdout error", err)
+	}
+
+	if waitErr := cmdHandle.Wait(); waitErr != nil {
+		logger.Error("wait command error", waitErr)
+		return "", waitErr
+	}
+
+	return strings.TrimSpace(string(output)), err
+}
@@ -0,0 +1,170 @@
+package storage_mountutil
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/goshims/filepath"
+	"code.cloudfoundry.org/goshims/ioutil"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"../../storage_config"
+)
+
+func ExtractValue(logger lager.Logger, value string, opts map[string]interface{}) (string, *voldriver.ErrorResponse) {
+	var aString interface{}
+	var str     string
+	var ok      bool
+
+	if aString, ok = opts[value]; !ok {
+		logger.Info("missing-" + strings.ToLower(value))
+		return "", &voldriver.ErrorResponse{Err: fmt.Sprintf("Missing Mandatory '%s' field in Opts", value)}
+	}
+	if str, ok = aString.(string); !ok {
+		logger.Info("missing-" + strings.ToLower(value))
+		return "", &voldriver.ErrorResponse{Err: fmt.Sprintf("Unable to string convert '%s' field in Opts", value)}
+	}
+	return str, nil
+}
+
+// ExtractOptionalValue returns defaultValue when the option is absent. Numbers
+// are accepted too, since json decodes them as float64.
+func ExtractOptionalValue(logger lager.Logger, value string, opts map[string]interface{}, defaultValue string) (string, *voldriver.ErrorResponse) {
+	aValue, ok := opts[value]
+	if !ok {
+		return defaultValue, nil
+	}
+
+	switch typed := aValue.(type) {
+	case string:
+		return typed, nil
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(typed), nil
+	}
+
+	logger.Info("invalid-" + strings.ToLower(value))
+	return "", &voldriver.ErrorResponse{Err: fmt.Sprintf("Unable to string convert '%s' field in Opts", value)}
+}
+
+func MountWithRetry(logger lager.Logger, invoker Invoker, policy storage_config.RetryPolicy, executable string, args []string) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = invoker.Invoke(logger, executable, args)
+		if err == nil {
+			return nil
+		}
+		logger.Error("failed-mounting-volume", err, lager.Data{"attempt": attempt, "attempts": policy.Attempts})
+		if attempt >= policy.Attempts {
+			return err
+		}
+		time.Sleep(time.Duration(policy.Interval))
+	}
+}
+
+// VolumeFilePath returns a file name below dir derived from the volume name,
+// so names containing slashes cannot escape dir.
+func VolumeFilePath(dir, volumeName, extension string) string {
+	return filepath.Join(dir, fmt.Sprintf("%x%s", sha256.Sum256([]byte(volumeName)), extension))
+}
+
+// WriteSecretFile writes contents to a file only root can read, creating its
+// directory with 0700 if needed.
+func WriteSecretFile(ioutil ioutilshim.Ioutil, os osshim.Os, path string, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file
+	return os.Chmod(path, 0600)
+}
+
+func RemoveSecretFile(os osshim.Os, path string) error {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+
+// IsStaleMount reports whether err comes from a mountpoint whose FUSE daemon
+// or server went away, e.g. "transport endpoint is not connected".
+func IsStaleMount(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.ENOTCONN || err == syscall.ESTALE
+}
+
+// Tail returns at most the last n lines of contents.
+func Tail(contents []byte, n int) string {
+	lines := strings.Split(strings.TrimRight(string(contents), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ParseSize parses a byte count with an optional k, m, g or t suffix (powers
+// of 1024), as accepted by tmpfs and truncate.
+func ParseSize(original string) (int64, error) {
+	size := strings.ToLower(strings.TrimSpace(original))
+	multiplier := int64(1)
+
+	if size != "" {
+		switch size[len(size)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			size = size[:len(size)-1]
+		}
+	}
+
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size '%s'", original)
+	}
+	if value > (1<<62)/multiplier {
+		return 0, fmt.Errorf("size '%s' is too large", original)
+	}
+	return value * multiplier, nil
+}
+
+// ResolveBelowRoots resolves all symlinks of path and returns the result if it
+// lies below, or is, one of roots, so a link cannot lead out of an allowlist.
+func ResolveBelowRoots(filepath filepathshim.Filepath, path string, roots []string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range roots {
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		if resolved == resolvedRoot || strings.HasPrefix(resolved, strings.TrimSuffix(resolvedRoot, "/")+"/") {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("'%s' is not below one of the allowed roots", path)
+}
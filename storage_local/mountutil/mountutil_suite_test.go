@@ -0,0 +1,13 @@
+package storage_mountutil_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestMountutil(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Mountutil Suite")
+}
@@ -0,0 +1,138 @@
+// This file was generated by counterfeiter
+package mountutilfakes
+
+import (
+	"sync"
+
+	"../../mountutil"
+	"code.cloudfoundry.org/lager"
+)
+
+type FakeInvoker struct {
+	InvokeStub        func(logger lager.Logger, executable string, args []string) error
+	invokeMutex       sync.RWMutex
+	invokeArgsForCall []struct {
+		logger     lager.Logger
+		executable string
+		args       []string
+	}
+	invokeReturns struct {
+		result1 error
+	}
+	OutputStub        func(logger lager.Logger, executable string, args []string) (string, error)
+	outputMutex       sync.RWMutex
+	outputArgsForCall []struct {
+		logger     lager.Logger
+		executable string
+		args       []string
+	}
+	outputReturns struct {
+		result1 string
+		result2 error
+	}
+	invocations      map[string][][]interface{}
+	invocationsMutex sync.RWMutex
+}
+
+func (fake *FakeInvoker) Invoke(logger lager.Logger, executable string, args []string) error {
+	var argsCopy []string
+	if args != nil {
+		argsCopy = make([]string, len(args))
+		copy(argsCopy, args)
+	}
+	fake.invokeMutex.Lock()
+	fake.invokeArgsForCall = append(fake.invokeArgsForCall, struct {
+		logger     lager.Logger
+		executable string
+		args       []string
+	}{logger, executable, argsCopy})
+	fake.recordInvocation("Invoke", []interface{}{logger, executable, argsCopy})
+	fake.invokeMutex.Unlock()
+	if fake.InvokeStub != nil {
+		return fake.InvokeStub(logger, executable, args)
+	}
+	return fake.invokeReturns.result1
+}
+
+func (fake *FakeInvoker) InvokeCallCount() int {
+	fake.invokeMutex.RLock()
+	defer fake.invokeMutex.RUnlock()
+	return len(fake.invokeArgsForCall)
+}
+
+func (fake *FakeInvoker) InvokeArgsForCall(i int) (lager.Logger, string, []string) {
+	fake.invokeMutex.RLock()
+	defer fake.invokeMutex.RUnlock()
+	return fake.invokeArgsForCall[i].logger, fake.invokeArgsForCall[i].executable, fake.invokeArgsForCall[i].args
+}
+
+func (fake *FakeInvoker) InvokeReturns(result1 error) {
+	fake.InvokeStub = nil
+	fake.invokeReturns = struct {
+		result1 error
+	}{result1}
+}
+
+func (fake *FakeInvoker) Output(logger lager.Logger, executable string, args []string) (string, error) {
+	var argsCopy []string
+	if args != nil {
+		argsCopy = make([]string, len(args))
+		copy(argsCopy, args)
+	}
+	fake.outputMutex.Lock()
+	fake.outputArgsForCall = append(fake.outputArgsForCall, struct {
+		logger     lager.Logger
+		executable string
+		args       []string
+	}{logger, executable, argsCopy})
+	fake.recordInvocation("Output", []interface{}{logger, executable, argsCopy})
+	fake.outputMutex.Unlock()
+	if fake.OutputStub != nil {
+		return fake.OutputStub(logger, executable, args)
+	}
+	return fake.outputReturns.result1, fake.outputReturns.result2
+}
+
+func (fake *FakeInvoker) OutputCallCount() int {
+	fake.outputMutex.RLock()
+	defer fake.outputMutex.RUnlock()
+	return len(fake.outputArgsForCall)
+}
+
+func (fake *FakeInvoker) OutputArgsForCall(i int) (lager.Logger, string, []string) {
+	fake.outputMutex.RLock()
+	defer fake.outputMutex.RUnlock()
+	return fake.outputArgsForCall[i].logger, fake.outputArgsForCall[i].executable, fake.outputArgsForCall[i].args
+}
+
+func (fake *FakeInvoker) OutputReturns(result1 string, result2 error) {
+	fake.OutputStub = nil
+	fake.outputReturns = struct {
+		result1 string
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeInvoker) Invocations() map[string][][]interface{} {
+	fake.invocationsMutex.RLock()
+	defer fake.invocationsMutex.RUnlock()
+	fake.invokeMutex.RLock()
+	defer fake.invokeMutex.RUnlock()
+	fake.outputMutex.RLock()
+	defer fake.outputMutex.RUnlock()
+	return fake.invocations
+}
+
+func (fake *FakeInvoker) recordInvocation(key string, args []interface{}) {
+	fake.invocationsMutex.Lock()
+	defer fake.invocationsMutex.Unlock()
+	if fake.invocations == nil {
+		fake.invocations = map[string][][]interface{}{}
+	}
+	if fake.invocations[key] == nil {
+		fake.invocations[key] = [][]interface{}{}
+	}
+	fake.invocations[key] = append(fake.invocations[key], args)
+}
+
+var _ storage_mountutil.Invoker = new(FakeInvoker)
@@ -0,0 +1,426 @@
+package storage_mountutil
+
+import (
+	"fmt"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"../../storage_metrics"
+)
+
+// Volume is what a backend knows about one of its volumes. Volumes never logs
+// a Volume, since it may hold credentials.
+type Volume interface {
+	// Equals reports whether other was created with the same Opts.
+	Equals(other Volume) bool
+	// MountPoint is where the volume shows up on the cell while mounted.
+	MountPoint() string
+	// Target names what is mounted, for audit events and the admin api.
+	Target() string
+	// Server is the host serving the volume, for metrics.
+	Server() string
+}
+
+// Attacher does the backend specific part of mounting a volume. Volumes calls
+// Attach for the first consumer of a volume and Detach for its last one.
+type Attacher interface {
+	Attach(logger lager.Logger, name string, volume Volume) error
+	// Detach unmounts the volume and cleans up its mountpoint.
+	Detach(logger lager.Logger, name string, volume Volume) error
+}
+
+// Checker is implemented by attachers whose mounts can die behind the
+// driver's back, like FUSE clients. A mount that is no longer alive is
+// detached and attached again on the next Mount.
+type Checker interface {
+	Alive(logger lager.Logger, name string, volume Volume) bool
+}
+
+// Destroyer is implemented by attachers that keep state of a volume on the
+// cell, Destroy drops it when the volume is removed.
+type Destroyer interface {
+	Destroy(logger lager.Logger, name string, volume Volume) error
+}
+
+type volumeEntry struct {
+	volume     Volume
+	mountCount int
+	// busy is closed when the mount, unmount or other exclusive operation
+	// in flight on the volume is done; nil while the volume is idle.
+	busy chan struct{}
+}
+
+// Volumes keeps the volumes of a backend and counts their consumers. It
+// implements the voldriver.Driver calls that are the same for every backend
+// mounting one volume for many consumers.
+//
+// lock only guards the map and the mount counts. Attach, Detach, Destroy and
+// prepare run outside of it, with the volume marked busy, so a slow mount
+// neither blocks the other volumes nor the readers like /metrics.
+type Volumes struct {
+	backend   string
+	attacher  Attacher
+	volumes   map[string]*volumeEntry
+	preparing map[string]chan struct{}
+	lock      sync.RWMutex
+}
+
+// NewVolumes keeps the volumes of the backend named backend, which are
+// mounted through attacher.
+func NewVolumes(backend string, attacher Attacher) *Volumes {
+	return &Volumes{
+		backend:   backend,
+		attacher:  attacher,
+		volumes:   map[string]*volumeEntry{},
+		preparing: map[string]chan struct{}{},
+	}
+}
+
+// acquire waits until no other operation is in flight on the volume and marks
+// it busy. The volume may be removed while waiting.
+func (v *Volumes) acquire(name string) (*volumeEntry, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for {
+		entry, ok := v.volumes[name]
+		if !ok {
+			return nil, false
+		}
+		if entry.busy == nil {
+			entry.busy = make(chan struct{})
+			return entry, true
+		}
+
+		busy := entry.busy
+		v.lock.Unlock()
+		<-busy
+		v.lock.Lock()
+	}
+}
+
+func (v *Volumes) release(entry *volumeEntry) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	close(entry.busy)
+	entry.busy = nil
+}
+
+// setMountCount has to be called with the volume acquired.
+func (v *Volumes) setMountCount(entry *volumeEntry, mountCount int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	entry.mountCount = mountCount
+}
+
+// Add creates volume unless a volume of the same name exists. prepare, if not
+// nil, runs before the volume is added, e.g. to allocate its storage; an error
+// leaves the volume out.
+func (v *Volumes) Add(logger lager.Logger, name string, volume Volume, prepare func() error) voldriver.ErrorResponse {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// a concurrent create of the same name decides between duplicate and new
+	for preparing, ok := v.preparing[name]; ok; preparing, ok = v.preparing[name] {
+		v.lock.Unlock()
+		<-preparing
+		v.lock.Lock()
+	}
+
+	if entry, ok := v.volumes[name]; ok {
+		if entry.volume.Equals(volume) {
+			logger.Info("duplicate-volume", lager.Data{"volume_name": name})
+			return voldriver.ErrorResponse{}
+		}
+		logger.Info("duplicate-volume-with-different-opts", lager.Data{"volume_name": name})
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' already exists with different Opts", name)}
+	}
+
+	if prepare != nil {
+		done := make(chan struct{})
+		v.preparing[name] = done
+		v.lock.Unlock()
+		err := prepare()
+		v.lock.Lock()
+		delete(v.preparing, name)
+		close(done)
+
+		if err != nil {
+			logger.Error("failed-preparing-volume", err)
+			return voldriver.ErrorResponse{Err: fmt.Sprintf("Error creating volume '%s' (%s)", name, err.Error())}
+		}
+	}
+
+	logger.Info("create-volume", lager.Data{"volume_name": name})
+	v.volumes[name] = &volumeEntry{volume: volume}
+	return voldriver.ErrorResponse{}
+}
+
+// Volume returns the volume named name and its mount count.
+func (v *Volumes) Volume(name string) (Volume, int, bool) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	entry, ok := v.volumes[name]
+	if !ok {
+		return nil, 0, false
+	}
+	return entry.volume, entry.mountCount, true
+}
+
+// Each calls fn for every volume.
+func (v *Volumes) Each(fn func(name string, volume Volume, mountCount int)) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	for name, entry := range v.volumes {
+		fn(name, entry.volume, entry.mountCount)
+	}
+}
+
+// Exclusive runs fn while no mount or unmount of the volume is in flight. The
+// other volumes stay usable while fn runs.
+func (v *Volumes) Exclusive(name string, fn func(volume Volume, mountCount int) error) error {
+	entry, ok := v.acquire(name)
+	if !ok {
+		return fmt.Errorf("Volume '%s' not found", name)
+	}
+	defer v.release(entry)
+
+	return fn(entry.volume, entry.mountCount)
+}
+
+// Update runs fn with the lock held, for changes to an acquired volume that
+// Equals or the other readers of the volume see, e.g. its size after a resize
+// inside Exclusive.
+func (v *Volumes) Update(fn func()) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	fn()
+}
+
+func (v *Volumes) Get(logger lager.Logger, getRequest voldriver.GetRequest) voldriver.GetResponse {
+	logger = logger.Session("get")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	if entry, ok := v.volumes[getRequest.Name]; ok {
+		logger.Info(fmt.Sprintf("get-%s-volume", v.backend), lager.Data{"volume_name": getRequest.Name})
+		if entry.mountCount > 0 {
+			return voldriver.GetResponse{Volume: voldriver.VolumeInfo{
+				Name:       getRequest.Name,
+				Mountpoint: entry.volume.MountPoint(),
+				MountCount: entry.mountCount,
+			}}
+		}
+		return voldriver.GetResponse{Volume: voldriver.VolumeInfo{Name: getRequest.Name}}
+	}
+	logger.Info(fmt.Sprintf("get-%s-volume-not-found", v.backend), lager.Data{"volume_name": getRequest.Name})
+	return voldriver.GetResponse{Err: fmt.Sprintf("Volume %s not found", getRequest.Name)}
+}
+
+func (v *Volumes) Path(logger lager.Logger, pathRequest voldriver.PathRequest) voldriver.PathResponse {
+	logger = logger.Session("path")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	if entry, ok := v.volumes[pathRequest.Name]; ok {
+		if entry.mountCount > 0 {
+			return voldriver.PathResponse{Mountpoint: entry.volume.MountPoint()}
+		}
+		logger.Info(fmt.Sprintf("%s-volume-path-not-mounted", v.backend), lager.Data{"volume_name": pathRequest.Name})
+		return voldriver.PathResponse{Err: fmt.Sprintf("Volume %s is not mounted", pathRequest.Name)}
+	}
+	logger.Info(fmt.Sprintf("%s-volume-path-not-found", v.backend), lager.Data{"volume_name": pathRequest.Name})
+	return voldriver.PathResponse{Err: fmt.Sprintf("Volume %s not found", pathRequest.Name)}
+}
+
+func (v *Volumes) List(logger lager.Logger) voldriver.ListResponse {
+	logger = logger.Session("list")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	listResponse := voldriver.ListResponse{}
+	for name, entry := range v.volumes {
+		volinfo := voldriver.VolumeInfo{Name: name, MountCount: entry.mountCount}
+		if entry.mountCount > 0 {
+			volinfo.Mountpoint = entry.volume.MountPoint()
+		}
+		listResponse.Volumes = append(listResponse.Volumes, volinfo)
+	}
+	return listResponse
+}
+
+func (v *Volumes) Mount(logger lager.Logger, mountRequest voldriver.MountRequest) voldriver.MountResponse {
+	logger = logger.Session("mount", lager.Data{"volume": mountRequest.Name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	entry, ok := v.acquire(mountRequest.Name)
+	if !ok {
+		logger.Info("mount-volume-not-found", lager.Data{"volume_name": mountRequest.Name})
+		return voldriver.MountResponse{Err: fmt.Sprintf("Volume '%s' not found", mountRequest.Name)}
+	}
+	defer v.release(entry)
+
+	if entry.mountCount > 0 {
+		if v.alive(logger, mountRequest.Name, entry.volume) {
+			v.setMountCount(entry, entry.mountCount+1)
+			logger.Info("mount-volume-already-mounted", lager.Data{"volume_name": mountRequest.Name, "count": entry.mountCount})
+			return voldriver.MountResponse{Mountpoint: entry.volume.MountPoint()}
+		}
+
+		// detach the dead mount and mount again for the existing consumers
+		logger.Info("mount-gone-remounting", lager.Data{"volume_name": mountRequest.Name})
+		if err := v.attacher.Detach(logger, mountRequest.Name, entry.volume); err != nil {
+			logger.Error("failed-detaching-stale-mount", err)
+		}
+	}
+
+	if err := v.attacher.Attach(logger, mountRequest.Name, entry.volume); err != nil {
+		if entry.mountCount > 0 {
+			// the stale mount is gone, so the volume is no longer mounted for
+			// anyone and the next Mount has to attach it again
+			logger.Info("remount-failed", lager.Data{"volume_name": mountRequest.Name, "count": entry.mountCount})
+			v.setMountCount(entry, 0)
+		}
+		return voldriver.MountResponse{Err: fmt.Sprintf("Error mounting '%s' (%s)", mountRequest.Name, err.Error())}
+	}
+
+	v.setMountCount(entry, entry.mountCount+1)
+	return voldriver.MountResponse{Mountpoint: entry.volume.MountPoint()}
+}
+
+func (v *Volumes) alive(logger lager.Logger, name string, volume Volume) bool {
+	checker, ok := v.attacher.(Checker)
+	return !ok || checker.Alive(logger, name, volume)
+}
+
+func (v *Volumes) Unmount(logger lager.Logger, unmountRequest voldriver.UnmountRequest) voldriver.ErrorResponse {
+	logger = logger.Session("unmount", lager.Data{"volume": unmountRequest.Name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	entry, ok := v.acquire(unmountRequest.Name)
+	if !ok {
+		logger.Info("unmount-volume-not-found", lager.Data{"volume_name": unmountRequest.Name})
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' not found", unmountRequest.Name)}
+	}
+	defer v.release(entry)
+
+	if entry.mountCount == 0 {
+		logger.Info("unmount-volume-not-mounted", lager.Data{"volume_name": unmountRequest.Name})
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' not mounted", unmountRequest.Name)}
+	}
+
+	return v.unmount(logger, entry, unmountRequest.Name)
+}
+
+// unmount has to be called with the volume acquired.
+func (v *Volumes) unmount(logger lager.Logger, entry *volumeEntry, name string) voldriver.ErrorResponse {
+	if entry.mountCount > 1 {
+		v.setMountCount(entry, entry.mountCount-1)
+		logger.Info("unmount-volume-in-use", lager.Data{"volume_name": name, "count": entry.mountCount})
+		return voldriver.ErrorResponse{}
+	}
+
+	if err := v.attacher.Detach(logger, name, entry.volume); err != nil {
+		logger.Error("failed-unmounting-volume", err)
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Error unmount '%s' (%s)", name, err.Error())}
+	}
+
+	v.setMountCount(entry, 0)
+	return voldriver.ErrorResponse{}
+}
+
+func (v *Volumes) Remove(logger lager.Logger, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse {
+	logger = logger.Session("remove", lager.Data{"volume": removeRequest})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if removeRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	entry, exists := v.acquire(removeRequest.Name)
+	if !exists {
+		logger.Info("remove-volume-not-found", lager.Data{"volume_name": removeRequest.Name})
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' not found", removeRequest.Name)}
+	}
+	defer v.release(entry)
+
+	for entry.mountCount > 0 {
+		if response := v.unmount(logger, entry, removeRequest.Name); response.Err != "" {
+			return response
+		}
+	}
+
+	if destroyer, ok := v.attacher.(Destroyer); ok {
+		if err := destroyer.Destroy(logger, removeRequest.Name, entry.volume); err != nil {
+			logger.Error("failed-destroying-volume", err)
+			return voldriver.ErrorResponse{Err: fmt.Sprintf("Failed removing '%s' (%s)", removeRequest.Name, err.Error())}
+		}
+	}
+
+	logger.Info("removing-volume", lager.Data{"volume_name": removeRequest.Name})
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	// the volume may have been forgotten and created again meanwhile
+	if v.volumes[removeRequest.Name] == entry {
+		delete(v.volumes, removeRequest.Name)
+	}
+	return voldriver.ErrorResponse{}
+}
+
+func (v *Volumes) VolumeStats() []storage_metrics.VolumeStat {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	stats := []storage_metrics.VolumeStat{}
+	for name, entry := range v.volumes {
+		stats = append(stats, storage_metrics.VolumeStat{Name: name, Host: entry.volume.Server(), MountCount: entry.mountCount})
+	}
+	return stats
+}
+
+func (v *Volumes) VolumeTarget(name string) (string, string, bool) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	entry, ok := v.volumes[name]
+	if !ok {
+		return "", "", false
+	}
+	return entry.volume.Target(), entry.volume.MountPoint(), true
+}
+
+// Forget drops the volume without unmounting it, for mounts that were cleaned
+// up behind the driver's back. It does not wait for an operation in flight.
+func (v *Volumes) Forget(logger lager.Logger, name string) error {
+	logger = logger.Session("forget", lager.Data{"volume": name})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if _, ok := v.volumes[name]; !ok {
+		return fmt.Errorf("volume '%s' not found", name)
+	}
+	delete(v.volumes, name)
+	return nil
+}
@@ -0,0 +1,355 @@
+package storage_mountutil_test
+
+import (
+	"errors"
+	"sync"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+
+	"../../storage_metrics"
+	"../mountutil"
+)
+
+type fakeVolume struct {
+	source     string
+	mountPoint string
+}
+
+func (v *fakeVolume) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*fakeVolume)
+	return ok && *volume == *v
+}
+
+func (v *fakeVolume) MountPoint() string { return v.mountPoint }
+func (v *fakeVolume) Target() string     { return "fake:" + v.source }
+func (v *fakeVolume) Server() string     { return "fakehost" }
+
+type fakeAttacher struct {
+	lock      sync.Mutex
+	attached  []string
+	detached  []string
+	destroyed []string
+	dead      map[string]bool
+
+	attachErr  error
+	detachErr  error
+	destroyErr error
+	// attaching, if set, blocks Attach until it is closed
+	attaching chan struct{}
+}
+
+func (a *fakeAttacher) Attach(logger lager.Logger, name string, volume storage_mountutil.Volume) error {
+	if a.attaching != nil && name == "slow" {
+		<-a.attaching
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.attached = append(a.attached, name)
+	if a.attachErr == nil {
+		delete(a.dead, name)
+	}
+	return a.attachErr
+}
+
+func (a *fakeAttacher) attachedCount() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.attached)
+}
+
+func (a *fakeAttacher) Detach(logger lager.Logger, name string, volume storage_mountutil.Volume) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.detached = append(a.detached, name)
+	return a.detachErr
+}
+
+func (a *fakeAttacher) Alive(logger lager.Logger, name string, volume storage_mountutil.Volume) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return !a.dead[name]
+}
+
+func (a *fakeAttacher) Destroy(logger lager.Logger, name string, volume storage_mountutil.Volume) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.destroyed = append(a.destroyed, name)
+	return a.destroyErr
+}
+
+var _ = Describe("Volumes", func() {
+	var (
+		logger   *lagertest.TestLogger
+		attacher *fakeAttacher
+		volumes  *storage_mountutil.Volumes
+		volume   *fakeVolume
+	)
+
+	BeforeEach(func() {
+		logger = lagertest.NewTestLogger("volumes")
+		attacher = &fakeAttacher{dead: map[string]bool{}}
+		volumes = storage_mountutil.NewVolumes("fake", attacher)
+		volume = &fakeVolume{source: "/export", mountPoint: "/mnt/vol"}
+	})
+
+	Context("#Add", func() {
+		It("adds the volume", func() {
+			Expect(volumes.Add(logger, "vol", volume, nil).Err).To(BeEmpty())
+
+			got, mountCount, ok := volumes.Volume("vol")
+			Expect(ok).To(BeTrue())
+			Expect(got).To(Equal(volume))
+			Expect(mountCount).To(Equal(0))
+		})
+
+		It("accepts a duplicate with the same opts", func() {
+			volumes.Add(logger, "vol", volume, nil)
+			Expect(volumes.Add(logger, "vol", &fakeVolume{source: "/export", mountPoint: "/mnt/vol"}, nil).Err).To(BeEmpty())
+		})
+
+		It("refuses a duplicate with different opts and does not prepare it", func() {
+			volumes.Add(logger, "vol", volume, nil)
+
+			prepared := false
+			response := volumes.Add(logger, "vol", &fakeVolume{source: "/other"}, func() error {
+				prepared = true
+				return nil
+			})
+			Expect(response.Err).To(Equal("Volume 'vol' already exists with different Opts"))
+			Expect(prepared).To(BeFalse())
+		})
+
+		It("leaves the volume out when prepare fails", func() {
+			response := volumes.Add(logger, "vol", volume, func() error { return errors.New("disk full") })
+			Expect(response.Err).To(Equal("Error creating volume 'vol' (disk full)"))
+
+			_, _, ok := volumes.Volume("vol")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("#Mount and #Unmount", func() {
+		BeforeEach(func() {
+			volumes.Add(logger, "vol", volume, nil)
+		})
+
+		It("attaches for the first consumer only", func() {
+			Expect(volumes.Mount(logger, voldriver.MountRequest{Name: "vol"}).Mountpoint).To(Equal("/mnt/vol"))
+			Expect(volumes.Mount(logger, voldriver.MountRequest{Name: "vol"}).Mountpoint).To(Equal("/mnt/vol"))
+			Expect(attacher.attached).To(Equal([]string{"vol"}))
+
+			getResponse := volumes.Get(logger, voldriver.GetRequest{Name: "vol"})
+			Expect(getResponse.Volume.MountCount).To(Equal(2))
+		})
+
+		It("detaches after the last consumer", func() {
+			volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+
+			Expect(volumes.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(attacher.detached).To(BeEmpty())
+
+			Expect(volumes.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(attacher.detached).To(Equal([]string{"vol"}))
+
+			pathResponse := volumes.Path(logger, voldriver.PathRequest{Name: "vol"})
+			Expect(pathResponse.Err).To(Equal("Volume vol is not mounted"))
+		})
+
+		It("reports a failed attach and stays unmounted", func() {
+			attacher.attachErr = errors.New("no route to host")
+
+			response := volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(Equal("Error mounting 'vol' (no route to host)"))
+
+			_, mountCount, _ := volumes.Volume("vol")
+			Expect(mountCount).To(Equal(0))
+		})
+
+		It("keeps the volume mounted when the detach fails", func() {
+			volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			attacher.detachErr = errors.New("device busy")
+
+			response := volumes.Unmount(logger, voldriver.UnmountRequest{Name: "vol"})
+			Expect(response.Err).To(Equal("Error unmount 'vol' (device busy)"))
+
+			_, mountCount, _ := volumes.Volume("vol")
+			Expect(mountCount).To(Equal(1))
+		})
+
+		It("remounts a dead mount for the next consumer", func() {
+			volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			attacher.dead["vol"] = true
+
+			Expect(volumes.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(attacher.detached).To(Equal([]string{"vol"}))
+			Expect(attacher.attached).To(Equal([]string{"vol", "vol"}))
+
+			_, mountCount, _ := volumes.Volume("vol")
+			Expect(mountCount).To(Equal(2))
+		})
+
+		It("drops the consumers of a dead mount it cannot mount again", func() {
+			volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			attacher.dead["vol"] = true
+			attacher.attachErr = errors.New("transport endpoint is not connected")
+
+			response := volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(Equal("Error mounting 'vol' (transport endpoint is not connected)"))
+			Expect(attacher.detached).To(Equal([]string{"vol"}))
+
+			_, mountCount, _ := volumes.Volume("vol")
+			Expect(mountCount).To(Equal(0))
+			Expect(volumes.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(Equal("Volume 'vol' not mounted"))
+
+			attacher.attachErr = nil
+			Expect(volumes.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(attacher.attached).To(Equal([]string{"vol", "vol", "vol"}))
+			_, mountCount, _ = volumes.Volume("vol")
+			Expect(mountCount).To(Equal(1))
+		})
+
+		It("refuses unknown and unmounted volumes", func() {
+			Expect(volumes.Mount(logger, voldriver.MountRequest{Name: "missing"}).Err).To(Equal("Volume 'missing' not found"))
+			Expect(volumes.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(Equal("Volume 'vol' not mounted"))
+		})
+	})
+
+	Context("#Remove", func() {
+		BeforeEach(func() {
+			volumes.Add(logger, "vol", volume, nil)
+			volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+		})
+
+		It("unmounts every consumer and destroys the volume", func() {
+			Expect(volumes.Remove(logger, voldriver.RemoveRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(attacher.detached).To(Equal([]string{"vol"}))
+			Expect(attacher.destroyed).To(Equal([]string{"vol"}))
+
+			_, _, ok := volumes.Volume("vol")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("keeps the volume when it cannot be destroyed", func() {
+			attacher.destroyErr = errors.New("read-only file system")
+
+			response := volumes.Remove(logger, voldriver.RemoveRequest{Name: "vol"})
+			Expect(response.Err).To(Equal("Failed removing 'vol' (read-only file system)"))
+
+			_, _, ok := volumes.Volume("vol")
+			Expect(ok).To(BeTrue())
+		})
+	})
+
+	Context("#Exclusive", func() {
+		It("hands the volume and its mount count to fn", func() {
+			volumes.Add(logger, "vol", volume, nil)
+			volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+
+			err := volumes.Exclusive("vol", func(got storage_mountutil.Volume, mountCount int) error {
+				Expect(got).To(Equal(volume))
+				Expect(mountCount).To(Equal(1))
+				return errors.New("mounted")
+			})
+			Expect(err).To(MatchError("mounted"))
+		})
+
+		It("fails for unknown volumes", func() {
+			err := volumes.Exclusive("missing", func(storage_mountutil.Volume, int) error { return nil })
+			Expect(err).To(MatchError("Volume 'missing' not found"))
+		})
+	})
+
+	Context("while a mount is in flight", func() {
+		var mounted chan voldriver.MountResponse
+
+		BeforeEach(func() {
+			volumes.Add(logger, "slow", volume, nil)
+			volumes.Add(logger, "vol", volume, nil)
+
+			attacher.attaching = make(chan struct{})
+			mounted = make(chan voldriver.MountResponse, 2)
+			go func(logger lager.Logger, mounted chan<- voldriver.MountResponse, volumes *storage_mountutil.Volumes) {
+				defer GinkgoRecover()
+				mounted <- volumes.Mount(logger, voldriver.MountRequest{Name: "slow"})
+			}(logger, mounted, volumes)
+			Eventually(logger).Should(gbytes.Say("mount.start"))
+		})
+
+		AfterEach(func() {
+			close(attacher.attaching)
+		})
+
+		It("serves the other volumes and the readers", func() {
+			Expect(volumes.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(volumes.VolumeStats()).To(HaveLen(2))
+			Expect(volumes.List(logger).Volumes).To(HaveLen(2))
+			Consistently(mounted).ShouldNot(Receive())
+		})
+
+		It("attaches once for concurrent consumers of the volume", func() {
+			go func() {
+				defer GinkgoRecover()
+				mounted <- volumes.Mount(logger, voldriver.MountRequest{Name: "slow"})
+			}()
+			Consistently(mounted).ShouldNot(Receive())
+
+			attacher.attaching <- struct{}{}
+			Eventually(mounted).Should(Receive())
+			Eventually(mounted).Should(Receive())
+			Expect(attacher.attachedCount()).To(Equal(1))
+
+			_, mountCount, _ := volumes.Volume("slow")
+			Expect(mountCount).To(Equal(2))
+		})
+	})
+
+	It("does not block the other volumes while preparing one", func() {
+		preparing := make(chan struct{})
+		created := make(chan voldriver.ErrorResponse, 1)
+		go func() {
+			defer GinkgoRecover()
+			created <- volumes.Add(logger, "slow", volume, func() error {
+				<-preparing
+				return nil
+			})
+		}()
+
+		Expect(volumes.Add(logger, "vol", volume, nil).Err).To(BeEmpty())
+		Expect(volumes.List(logger).Volumes).To(HaveLen(1))
+		Consistently(created).ShouldNot(Receive())
+
+		close(preparing)
+		Eventually(created).Should(Receive(Equal(voldriver.ErrorResponse{})))
+		Expect(volumes.List(logger).Volumes).To(HaveLen(2))
+	})
+
+	It("reports stats and targets", func() {
+		volumes.Add(logger, "vol", volume, nil)
+		volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+
+		Expect(volumes.VolumeStats()).To(Equal([]storage_metrics.VolumeStat{{Name: "vol", Host: "fakehost", MountCount: 1}}))
+
+		remote, local, ok := volumes.VolumeTarget("vol")
+		Expect(ok).To(BeTrue())
+		Expect(remote).To(Equal("fake:/export"))
+		Expect(local).To(Equal("/mnt/vol"))
+	})
+
+	It("forgets a volume without detaching it", func() {
+		volumes.Add(logger, "vol", volume, nil)
+		volumes.Mount(logger, voldriver.MountRequest{Name: "vol"})
+
+		Expect(volumes.Forget(logger, "vol")).To(Succeed())
+		Expect(attacher.detached).To(BeEmpty())
+		Expect(volumes.List(logger).Volumes).To(BeEmpty())
+	})
+})
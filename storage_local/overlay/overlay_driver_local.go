@@ -0,0 +1,442 @@
+package storage_overlaydriver
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/filepath"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"fmt"
+
+	"../../storage_auth"
+	"../../storage_config"
+	"../mountutil"
+)
+
+const (
+	Name = "overlay"
+
+	BasesDir   = "bases"
+	VolumesDir = "volumes"
+	MountsDir  = "mounts"
+	CommitDir  = "commit"
+)
+
+var baseNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// BaseDrivers connects to the driver of the backend named backend, which
+// serves the base volumes of overlay volumes.
+type BaseDrivers func(logger lager.Logger, backend string) (voldriver.Driver, error)
+
+// SpecBaseDrivers finds the drivers of base volumes by their specs in
+// driversPath and sends the tokens the specs carry.
+func SpecBaseDrivers(driversPath string) BaseDrivers {
+	return func(logger lager.Logger, backend string) (voldriver.Driver, error) {
+		path, err := storage_auth.FindDriverSpec(driversPath, backend+"driver")
+		if err != nil {
+			return nil, err
+		}
+		spec, err := storage_auth.ReadDriverSpec(path)
+		if err != nil {
+			return nil, err
+		}
+		return storage_auth.NewRemoteClient(spec)
+	}
+}
+
+// OverlayLocalDriver gives every volume a private writable layer on top of a
+// read-only base, a volume of another driver or a base committed earlier.
+// Bases are never written to.
+type OverlayLocalDriver struct {
+	rootDir     string
+	baseDrivers BaseDrivers
+	userInvoker storage_mountutil.Invoker
+	os          osshim.Os
+	filepath    filepathshim.Filepath
+
+	*storage_mountutil.Volumes
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	BaseDriver      string
+	BaseVolume      string
+	Base            string
+	LayerDir        string
+	LocalMountPoint string
+}
+
+func NewOverlayLocalDriver(rootDir, driversPath string) *OverlayLocalDriver {
+	return NewOverlayDriverWithInvoker(&osshim.OsShim{}, &filepathshim.FilepathShim{}, storage_mountutil.NewRealInvoker(), SpecBaseDrivers(driversPath), rootDir)
+}
+
+func NewOverlayDriverWithInvoker(os osshim.Os, filepath filepathshim.Filepath, invoker storage_mountutil.Invoker, baseDrivers BaseDrivers, rootDir string) *OverlayLocalDriver {
+	d := &OverlayLocalDriver{
+		rootDir:     rootDir,
+		baseDrivers: baseDrivers,
+		userInvoker: invoker,
+		os:          os,
+		filepath:    filepath,
+		Holder:      storage_config.NewHolder(),
+	}
+	d.Volumes = storage_mountutil.NewVolumes(Name, d)
+	return d
+}
+
+func (v *volumeMetadata) upperDir() string {
+	return filepath.Join(v.LayerDir, "upper")
+}
+
+func (v *volumeMetadata) workDir() string {
+	return filepath.Join(v.LayerDir, "work")
+}
+
+func (d *OverlayLocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *OverlayLocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "local"},
+	}
+}
+
+func (d *OverlayLocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	newVolume := &volumeMetadata{}
+	var err *voldriver.ErrorResponse
+
+	if newVolume.BaseDriver, err = storage_mountutil.ExtractOptionalValue(logger, "base_driver", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.BaseVolume, err = storage_mountutil.ExtractOptionalValue(logger, "base_volume", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.Base, err = storage_mountutil.ExtractOptionalValue(logger, "base", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if checkErr := d.checkBase(logger, newVolume); checkErr != nil {
+		logger.Info("base-not-allowed", lager.Data{"base": newVolume.Target(), "reason": checkErr.Error()})
+		return voldriver.ErrorResponse{Err: checkErr.Error()}
+	}
+
+	if newVolume.LocalMountPoint, err = storage_mountutil.ExtractOptionalValue(logger, "localmountpoint", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.LocalMountPoint == "" {
+		newVolume.LocalMountPoint = storage_mountutil.VolumeFilePath(filepath.Join(d.rootDir, MountsDir), createRequest.Name, "")
+	}
+	newVolume.LayerDir = storage_mountutil.VolumeFilePath(filepath.Join(d.rootDir, VolumesDir), createRequest.Name, "")
+
+	return d.Volumes.Add(logger, createRequest.Name, newVolume, func() error {
+		return d.createLayer(newVolume)
+	})
+}
+
+func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
+	return volume.BaseDriver == v.BaseDriver &&
+		volume.BaseVolume == v.BaseVolume &&
+		volume.Base == v.Base &&
+		volume.LocalMountPoint == v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*volumeMetadata)
+	return ok && v.equals(volume)
+}
+
+func (v *volumeMetadata) MountPoint() string {
+	return v.LocalMountPoint
+}
+
+// Target names the base as <backend>:<volume>, committed bases belong to the
+// overlay backend.
+func (v *volumeMetadata) Target() string {
+	if v.BaseDriver == "" {
+		return Name + ":" + v.Base
+	}
+	return v.BaseDriver + ":" + v.BaseVolume
+}
+
+func (v *volumeMetadata) Server() string {
+	return "localhost"
+}
+
+func (d *OverlayLocalDriver) createLayer(volume *volumeMetadata) error {
+	if err := d.os.MkdirAll(volume.upperDir(), 0755); err != nil {
+		return err
+	}
+	return d.os.MkdirAll(volume.workDir(), 0700)
+}
+
+// checkBase makes sure the volume names either an existing volume of one of
+// the allowed base drivers or an existing committed base.
+func (d *OverlayLocalDriver) checkBase(logger lager.Logger, volume *volumeMetadata) error {
+	if volume.Base != "" {
+		if volume.BaseDriver != "" || volume.BaseVolume != "" {
+			return fmt.Errorf("Opts.base cannot be combined with Opts.base_driver and Opts.base_volume")
+		}
+		if !baseNamePattern.MatchString(volume.Base) {
+			return fmt.Errorf("Opts.base '%s' is not the name of a committed base", volume.Base)
+		}
+		_, err := d.lowerDir(filepath.Join(d.rootDir, BasesDir, volume.Base), filepath.Join(d.rootDir, BasesDir))
+		return err
+	}
+
+	if volume.BaseDriver == "" || volume.BaseVolume == "" {
+		return fmt.Errorf("Missing mandatory 'base_driver' and 'base_volume', or 'base'")
+	}
+	driver, err := d.baseDriver(logger, volume)
+	if err != nil {
+		return err
+	}
+	if response := driver.Get(logger, voldriver.GetRequest{Name: volume.BaseVolume}); response.Err != "" {
+		return fmt.Errorf("Opts.base_volume '%s' of the %s driver cannot be found (%s)", volume.BaseVolume, volume.BaseDriver, response.Err)
+	}
+	return nil
+}
+
+// baseDriver connects to the driver of the base volume, unless the backend
+// is not, or no longer, one of overlay.base_drivers.
+func (d *OverlayLocalDriver) baseDriver(logger lager.Logger, volume *volumeMetadata) (voldriver.Driver, error) {
+	allowed := false
+	for _, backend := range d.Config().Overlay.BaseDrivers {
+		allowed = allowed || backend == volume.BaseDriver
+	}
+	if !allowed {
+		return nil, fmt.Errorf("Opts.base_driver '%s' is not one of the allowed base drivers", volume.BaseDriver)
+	}
+
+	driver, err := d.baseDrivers(logger, volume.BaseDriver)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the %s driver (%s)", volume.BaseDriver, err.Error())
+	}
+	return driver, nil
+}
+
+// mountBase makes the base of the volume available and returns the directory
+// to use as lowerdir. Volumes of other drivers are mounted through them and
+// have to be given back with unmountBase.
+func (d *OverlayLocalDriver) mountBase(logger lager.Logger, volume *volumeMetadata) (string, error) {
+	if volume.BaseDriver == "" {
+		return d.lowerDir(filepath.Join(d.rootDir, BasesDir, volume.Base), filepath.Join(d.rootDir, BasesDir))
+	}
+
+	driver, err := d.baseDriver(logger, volume)
+	if err != nil {
+		return "", err
+	}
+	response := driver.Mount(logger, voldriver.MountRequest{Name: volume.BaseVolume})
+	if response.Err != "" {
+		return "", fmt.Errorf("mounting base volume '%s' of the %s driver failed (%s)", volume.BaseVolume, volume.BaseDriver, response.Err)
+	}
+
+	lower, err := d.lowerDir(response.Mountpoint, "")
+	if err != nil {
+		d.unmountBase(logger, volume)
+		return "", err
+	}
+	return lower, nil
+}
+
+func (d *OverlayLocalDriver) unmountBase(logger lager.Logger, volume *volumeMetadata) {
+	if volume.BaseDriver == "" {
+		return
+	}
+
+	driver, err := d.baseDrivers(logger, volume.BaseDriver)
+	if err != nil {
+		logger.Error("failed-unmounting-base", err, lager.Data{"base": volume.Target()})
+		return
+	}
+	if response := driver.Unmount(logger, voldriver.UnmountRequest{Name: volume.BaseVolume}); response.Err != "" {
+		logger.Info("failed-unmounting-base", lager.Data{"base": volume.Target(), "error": response.Err})
+	}
+}
+
+// lowerDir resolves path, below root unless root is empty, and returns the
+// directory it points to. The overlay is mounted on the resolved directory,
+// so a symlink swapped in afterwards cannot change what the volume shows.
+func (d *OverlayLocalDriver) lowerDir(path, root string) (string, error) {
+	var resolved string
+	var err error
+	if root == "" {
+		resolved, err = d.filepath.EvalSymlinks(path)
+	} else {
+		resolved, err = storage_mountutil.ResolveBelowRoots(d.filepath, path, []string{root})
+	}
+	if err != nil {
+		return "", fmt.Errorf("base '%s' cannot be resolved (%s)", path, err.Error())
+	}
+
+	info, err := d.os.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("base '%s' cannot be accessed (%s)", path, err.Error())
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("base '%s' is not a directory", path)
+	}
+	// commas and colons separate the options and layers of an overlay mount
+	if strings.ContainsAny(resolved, ",:") {
+		return "", fmt.Errorf("base '%s' contains ',' or ':', which overlay mounts cannot take", resolved)
+	}
+	return resolved, nil
+}
+
+func (d *OverlayLocalDriver) Discard(logger lager.Logger, volumeName string) error {
+	logger = logger.Session("discard", lager.Data{"volume": volumeName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	return d.unmounted(volumeName, func(volume *volumeMetadata) error {
+		if err := d.os.RemoveAll(volume.LayerDir); err != nil {
+			logger.Error("failed-removing-layer", err)
+			return err
+		}
+		return d.createLayer(volume)
+	})
+}
+
+func (d *OverlayLocalDriver) Commit(logger lager.Logger, volumeName, baseName string) (string, error) {
+	logger = logger.Session("commit", lager.Data{"volume": volumeName, "base": baseName})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if !baseNamePattern.MatchString(baseName) {
+		return "", fmt.Errorf("invalid base name '%s'", baseName)
+	}
+
+	err := d.unmounted(volumeName, func(volume *volumeMetadata) error {
+		return d.commit(logger, volumeName, volume, baseName)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	base := filepath.Join(d.rootDir, BasesDir, baseName)
+	logger.Info("committed", lager.Data{"path": base})
+	return base, nil
+}
+
+// commit claims the base by creating its directory, so of concurrent commits
+// of the same base name, also of different volumes, only one copies and only
+// the one that created the base removes it again on failure.
+func (d *OverlayLocalDriver) commit(logger lager.Logger, volumeName string, volume *volumeMetadata, baseName string) (err error) {
+	base := filepath.Join(d.rootDir, BasesDir, baseName)
+	if err := d.os.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return err
+	}
+	if err := d.os.Mkdir(base, 0755); err != nil {
+		if d.os.IsExist(err) {
+			return fmt.Errorf("base '%s' already exists", baseName)
+		}
+		return err
+	}
+	defer func() {
+		if err != nil {
+			d.os.RemoveAll(base)
+		}
+	}()
+
+	// a read-only overlay of upper and base resolves whiteouts, so copying it
+	// yields the merged view
+	merged := storage_mountutil.VolumeFilePath(filepath.Join(d.rootDir, CommitDir), volumeName, "")
+	if err := d.os.MkdirAll(merged, 0700); err != nil {
+		return err
+	}
+	defer d.os.Remove(merged)
+
+	lower, err := d.mountBase(logger, volume)
+	if err != nil {
+		return err
+	}
+	defer d.unmountBase(logger, volume)
+
+	overlayOptions := fmt.Sprintf("ro,lowerdir=%s:%s", volume.upperDir(), lower)
+	if err := d.userInvoker.Invoke(logger, "mount", []string{"-t", "overlay", "-o", overlayOptions, "overlay", merged}); err != nil {
+		logger.Error("failed-mounting-merged-view", err)
+		return err
+	}
+	defer d.userInvoker.Invoke(logger, "umount", []string{merged})
+
+	if err := d.userInvoker.Invoke(logger, "cp", []string{"-a", merged + "/.", base}); err != nil {
+		logger.Error("failed-copying-merged-view", err)
+		return err
+	}
+
+	return nil
+}
+
+// unmounted runs fn on the volume unless it is mounted.
+func (d *OverlayLocalDriver) unmounted(volumeName string, fn func(volume *volumeMetadata) error) error {
+	return d.Exclusive(volumeName, func(mountable storage_mountutil.Volume, mountCount int) error {
+		if mountCount > 0 {
+			return fmt.Errorf("Volume '%s' is mounted, unmount it first", volumeName)
+		}
+		return fn(mountable.(*volumeMetadata))
+	})
+}
+
+func (d *OverlayLocalDriver) Attach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	config := d.Config()
+
+	if err := d.os.MkdirAll(volume.LocalMountPoint, os.ModePerm); err != nil {
+		logger.Error("failed-create-mountdir", err)
+		return fmt.Errorf("unable to create local mount point")
+	}
+
+	// the allowed base drivers may have changed since the volume was created
+	lower, err := d.mountBase(logger, volume)
+	if err != nil {
+		logger.Info("base-not-available", lager.Data{"base": volume.Target(), "reason": err.Error()})
+		return err
+	}
+
+	overlayOptions := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, volume.upperDir(), volume.workDir())
+	cmdArgs := []string{"-t", "overlay", "-o", overlayOptions, "overlay", volume.LocalMountPoint}
+	if err := storage_mountutil.MountWithRetry(logger, d.userInvoker, config.MountRetry, "mount", cmdArgs); err != nil {
+		d.unmountBase(logger, volume)
+		return err
+	}
+	return nil
+}
+
+// Detach keeps the upper layer, so the changes of a volume survive until it
+// is discarded or removed, and gives the base back.
+func (d *OverlayLocalDriver) Detach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	if err := d.userInvoker.Invoke(logger, "umount", []string{volume.LocalMountPoint}); err != nil {
+		logger.Error("failed-invoking-umount", err)
+		return err
+	}
+	d.unmountBase(logger, volume)
+
+	if err := d.os.Remove(volume.LocalMountPoint); err != nil {
+		logger.Error("failed-removing-mountpoint", err)
+	}
+	return nil
+}
+
+// Destroy drops the layer of the volume; its base is left untouched.
+func (d *OverlayLocalDriver) Destroy(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	logger.Info("remove-layer", lager.Data{"layer": volume.LayerDir})
+	return d.os.RemoveAll(volume.LayerDir)
+}
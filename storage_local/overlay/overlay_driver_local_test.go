@@ -0,0 +1,260 @@
+package storage_overlaydriver_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/filepath"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_config"
+	"../fake"
+	"../mountutil"
+	"../mountutil/mountutilfakes"
+	"../overlay"
+)
+
+var _ = Describe("OverlayLocalDriver", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeInvoker *mountutilfakes.FakeInvoker
+		tempDir     string
+		baseRoot    string
+		baseDriver  *storage_fakedriver.FakeDriver
+		config      storage_config.Config
+		driver      *storage_overlaydriver.OverlayLocalDriver
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "overlay-driver")
+		Expect(err).NotTo(HaveOccurred())
+		tempDir, err = filepath.EvalSymlinks(tempDir)
+		Expect(err).NotTo(HaveOccurred())
+		logger = lagertest.NewTestLogger("overlay")
+
+		// the base driver hands out mountpoints through a symlink
+		baseRoot = filepath.Join(tempDir, "base")
+		Expect(os.MkdirAll(baseRoot, 0755)).To(Succeed())
+		Expect(os.Symlink(baseRoot, filepath.Join(tempDir, "base-link"))).To(Succeed())
+		baseDriver = storage_fakedriver.NewFakeDriver(filepath.Join(tempDir, "base-link"))
+		Expect(baseDriver.Create(logger, voldriver.CreateRequest{Name: "dataset"}).Err).To(BeEmpty())
+
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		baseDrivers := func(_ lager.Logger, backend string) (voldriver.Driver, error) {
+			if backend != "local" {
+				return nil, fmt.Errorf("no spec for driver '%sdriver'", backend)
+			}
+			return baseDriver, nil
+		}
+		driver = storage_overlaydriver.NewOverlayDriverWithInvoker(&osshim.OsShim{}, &filepathshim.FilepathShim{}, fakeInvoker, baseDrivers, filepath.Join(tempDir, "overlay"))
+
+		config = storage_config.DefaultConfig()
+		config.MountRetry.Interval = 0
+		Expect(driver.Reload(logger, config)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	create := func(opts map[string]interface{}) voldriver.ErrorResponse {
+		return driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: opts})
+	}
+
+	baseVolume := map[string]interface{}{"base_driver": "local", "base_volume": "dataset"}
+
+	baseMountCount := func() int {
+		return baseDriver.Get(logger, voldriver.GetRequest{Name: "dataset"}).Volume.MountCount
+	}
+
+	baseDir := func() string {
+		response := baseDriver.Mount(logger, voldriver.MountRequest{Name: "dataset"})
+		Expect(response.Err).To(BeEmpty())
+		Expect(baseDriver.Unmount(logger, voldriver.UnmountRequest{Name: "dataset"}).Err).To(BeEmpty())
+		return response.Mountpoint
+	}
+
+	lowerDir := func(call int) string {
+		_, executable, args := fakeInvoker.InvokeArgsForCall(call)
+		Expect(executable).To(Equal("mount"))
+		for _, option := range strings.Split(args[3], ",") {
+			if strings.HasPrefix(option, "lowerdir=") {
+				return strings.TrimPrefix(option, "lowerdir=")
+			}
+		}
+		Fail("mount without lowerdir")
+		return ""
+	}
+
+	Context("#Create", func() {
+		It("accepts a volume of an allowed base driver", func() {
+			Expect(create(baseVolume).Err).To(BeEmpty())
+			Expect(baseMountCount()).To(Equal(0))
+		})
+
+		It("refuses host paths as base", func() {
+			response := create(map[string]interface{}{"base": baseRoot})
+			Expect(response.Err).To(Equal(fmt.Sprintf("Opts.base '%s' is not the name of a committed base", baseRoot)))
+		})
+
+		It("refuses base drivers that are not allowed", func() {
+			response := create(map[string]interface{}{"base_driver": "hostpath", "base_volume": "dataset"})
+			Expect(response.Err).To(Equal("Opts.base_driver 'hostpath' is not one of the allowed base drivers"))
+		})
+
+		It("refuses base volumes the base driver does not know", func() {
+			response := create(map[string]interface{}{"base_driver": "local", "base_volume": "missing"})
+			Expect(response.Err).To(Equal("Opts.base_volume 'missing' of the local driver cannot be found (Volume missing not found)"))
+		})
+
+		It("requires a base", func() {
+			Expect(create(map[string]interface{}{"base_driver": "local"}).Err).To(Equal("Missing mandatory 'base_driver' and 'base_volume', or 'base'"))
+		})
+	})
+
+	Context("#Mount", func() {
+		BeforeEach(func() {
+			Expect(create(baseVolume).Err).To(BeEmpty())
+		})
+
+		It("mounts the base volume and uses its resolved directory as lowerdir", func() {
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(BeEmpty())
+			Expect(baseMountCount()).To(Equal(1))
+
+			resolved, err := filepath.EvalSymlinks(baseDir())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved).To(HavePrefix(baseRoot))
+			Expect(lowerDir(0)).To(Equal(resolved))
+		})
+
+		It("gives the base volume back on unmount", func() {
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(driver.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(baseMountCount()).To(Equal(0))
+		})
+
+		It("gives the base volume back when the overlay cannot be mounted", func() {
+			fakeInvoker.InvokeReturns(fmt.Errorf("wrong fs type"))
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).NotTo(BeEmpty())
+			Expect(baseMountCount()).To(Equal(0))
+		})
+
+		It("refuses base drivers that are no longer allowed", func() {
+			config.Overlay.BaseDrivers = []string{"nfs"}
+			Expect(driver.Reload(logger, config)).To(Succeed())
+
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(ContainSubstring("Opts.base_driver 'local' is not one of the allowed base drivers"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+			Expect(baseMountCount()).To(Equal(0))
+		})
+	})
+
+	Context("#Commit", func() {
+		BeforeEach(func() {
+			Expect(create(baseVolume).Err).To(BeEmpty())
+		})
+
+		It("copies the merged view into a new base that volumes can be created from", func() {
+			path, err := driver.Commit(logger, "vol", "dataset-v2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path).To(Equal(filepath.Join(tempDir, "overlay", "bases", "dataset-v2")))
+			Expect(baseMountCount()).To(Equal(0))
+
+			resolved, err := filepath.EvalSymlinks(baseDir())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.Split(lowerDir(0), ":")[1]).To(Equal(resolved))
+			_, executable, args := fakeInvoker.InvokeArgsForCall(1)
+			Expect(executable).To(Equal("cp"))
+			Expect(args[2]).To(Equal(path))
+
+			Expect(driver.Create(logger, voldriver.CreateRequest{Name: "vol2", Opts: map[string]interface{}{"base": "dataset-v2"}}).Err).To(BeEmpty())
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol2"}).Err).To(BeEmpty())
+			Expect(lowerDir(fakeInvoker.InvokeCallCount() - 1)).To(Equal(path))
+		})
+
+		It("refuses mounted volumes", func() {
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+
+			_, err := driver.Commit(logger, "vol", "dataset-v2")
+			Expect(err).To(MatchError("Volume 'vol' is mounted, unmount it first"))
+		})
+
+		It("refuses a base that exists and leaves it alone", func() {
+			existing := filepath.Join(tempDir, "overlay", "bases", "dataset-v2")
+			Expect(os.MkdirAll(existing, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(existing, "data"), []byte("data"), 0644)).To(Succeed())
+
+			_, err := driver.Commit(logger, "vol", "dataset-v2")
+			Expect(err).To(MatchError("base 'dataset-v2' already exists"))
+			Expect(filepath.Join(existing, "data")).To(BeAnExistingFile())
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+		})
+
+		It("removes the base again when the copy fails", func() {
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, _ []string) error {
+				if executable == "cp" {
+					return errors.New("no space left on device")
+				}
+				return nil
+			}
+
+			_, err := driver.Commit(logger, "vol", "dataset-v2")
+			Expect(err).To(MatchError("no space left on device"))
+			Expect(filepath.Join(tempDir, "overlay", "bases", "dataset-v2")).NotTo(BeADirectory())
+		})
+
+		It("lets one of concurrent commits of a base name copy and keeps its base", func() {
+			Expect(driver.Create(logger, voldriver.CreateRequest{Name: "vol2", Opts: baseVolume}).Err).To(BeEmpty())
+
+			copying := make(chan struct{})
+			copied := make(chan struct{})
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, _ []string) error {
+				if executable == "cp" {
+					close(copying)
+					<-copied
+				}
+				return nil
+			}
+
+			committed := make(chan error, 1)
+			go func(driver *storage_overlaydriver.OverlayLocalDriver, logger lager.Logger) {
+				_, err := driver.Commit(logger, "vol", "dataset-v2")
+				committed <- err
+			}(driver, logger)
+			Eventually(copying).Should(BeClosed())
+
+			_, err := driver.Commit(logger, "vol2", "dataset-v2")
+			Expect(err).To(MatchError("base 'dataset-v2' already exists"))
+			Expect(filepath.Join(tempDir, "overlay", "bases", "dataset-v2")).To(BeADirectory())
+
+			close(copied)
+			Eventually(committed).Should(Receive(BeNil()))
+			Expect(filepath.Join(tempDir, "overlay", "bases", "dataset-v2")).To(BeADirectory())
+		})
+	})
+
+	Context("#Discard", func() {
+		It("drops the changes of the volume", func() {
+			Expect(create(baseVolume).Err).To(BeEmpty())
+			upper := filepath.Join(storage_mountutil.VolumeFilePath(filepath.Join(tempDir, "overlay", "volumes"), "vol", ""), "upper")
+			Expect(ioutil.WriteFile(filepath.Join(upper, "changed"), []byte("data"), 0644)).To(Succeed())
+
+			Expect(driver.Discard(logger, "vol")).To(Succeed())
+			files, err := ioutil.ReadDir(upper)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+	})
+})
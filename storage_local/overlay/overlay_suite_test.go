@@ -0,0 +1,13 @@
+package storage_overlaydriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestOverlayDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Overlay Driver Suite")
+}
@@ -0,0 +1,77 @@
+package storage_s3driver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// BucketCheckTimeout bounds the request made before mounting a bucket.
+const BucketCheckTimeout = 10 * time.Second
+
+// DefaultRegion signs requests to endpoints that were given no region.
+const DefaultRegion = "us-east-1"
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// checkBucket lists at most one object below the prefix of the volume, so
+// wrong credentials or a missing bucket are reported with the error of the
+// server instead of a failing s3fs.
+func (d *S3LocalDriver) checkBucket(logger lager.Logger, volume *volumeMetadata) error {
+	req, err := http.NewRequest("GET", volume.bucketUrl(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Amz-Content-Sha256", EmptyPayloadHash)
+
+	region := volume.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+	SignV4(req, "s3", region, volume.AccessKeyId, volume.SecretAccessKey, time.Now())
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		logger.Error("failed-checking-bucket", err)
+		return fmt.Errorf("bucket '%s' cannot be reached (%s)", volume.Bucket, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	var s3Err s3Error
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&s3Err); err != nil || s3Err.Code == "" {
+		return fmt.Errorf("bucket '%s' cannot be listed (%s)", volume.Bucket, resp.Status)
+	}
+	logger.Info("bucket-check-failed", lager.Data{"bucket": volume.Bucket, "status": resp.StatusCode, "code": s3Err.Code})
+	return fmt.Errorf("bucket '%s' cannot be listed (%s: %s)", volume.Bucket, s3Err.Code, s3Err.Message)
+}
+
+func (v *volumeMetadata) bucketUrl() string {
+	endpoint, _ := url.Parse(v.Endpoint)
+	if v.PathStyle {
+		endpoint.Path = "/" + v.Bucket
+	} else {
+		endpoint.Host = v.Bucket + "." + endpoint.Host
+		endpoint.Path = "/"
+	}
+
+	query := url.Values{"list-type": {"2"}, "max-keys": {"1"}}
+	if v.Prefix != "" {
+		query.Set("prefix", v.Prefix+"/")
+	}
+	endpoint.RawQuery = query.Encode()
+	return endpoint.String()
+}
@@ -0,0 +1,107 @@
+package storage_s3driver_test
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../s3"
+)
+
+// fakeS3 answers ListObjectsV2 for its buckets, like minio would, to requests
+// signed with its keys.
+type fakeS3 struct {
+	accessKeyId     string
+	secretAccessKey string
+	buckets         map[string][]string
+
+	requests     []*http.Request
+	requestsLock sync.Mutex
+}
+
+type fakeS3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+type fakeS3Object struct {
+	Key string `xml:"Key"`
+}
+
+type fakeS3ListResult struct {
+	XMLName  xml.Name       `xml:"ListBucketResult"`
+	Name     string         `xml:"Name"`
+	Prefix   string         `xml:"Prefix"`
+	KeyCount int            `xml:"KeyCount"`
+	Contents []fakeS3Object `xml:"Contents"`
+}
+
+func (s *fakeS3) Requests() []*http.Request {
+	s.requestsLock.Lock()
+	defer s.requestsLock.Unlock()
+	return append([]*http.Request{}, s.requests...)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.requestsLock.Lock()
+	s.requests = append(s.requests, req)
+	s.requestsLock.Unlock()
+
+	if req.Method != "GET" || req.URL.Query().Get("list-type") != "2" {
+		s.fail(w, http.StatusNotImplemented, "NotImplemented", "A header you provided implies functionality that is not implemented")
+		return
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if !strings.Contains(authorization, "Credential="+s.accessKeyId+"/") {
+		s.fail(w, http.StatusForbidden, "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records.")
+		return
+	}
+	date, err := time.Parse("20060102T150405Z", req.Header.Get("X-Amz-Date"))
+	if err != nil {
+		s.fail(w, http.StatusForbidden, "AccessDenied", "AWS authentication requires a valid Date or x-amz-date header")
+		return
+	}
+	signed, err := http.NewRequest(req.Method, "http://"+req.Host+req.URL.RequestURI(), nil)
+	if err != nil {
+		s.fail(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	signed.Header.Set("X-Amz-Content-Sha256", req.Header.Get("X-Amz-Content-Sha256"))
+	storage_s3driver.SignV4(signed, "s3", storage_s3driver.DefaultRegion, s.accessKeyId, s.secretAccessKey, date)
+	if signed.Header.Get("Authorization") != authorization {
+		s.fail(w, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+		return
+	}
+
+	bucket := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]
+	keys, ok := s.buckets[bucket]
+	if !ok {
+		s.fail(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	maxKeys, err := strconv.Atoi(req.URL.Query().Get("max-keys"))
+	if err != nil {
+		maxKeys = 1000
+	}
+	result := fakeS3ListResult{Name: bucket, Prefix: req.URL.Query().Get("prefix")}
+	for _, key := range keys {
+		if strings.HasPrefix(key, result.Prefix) && result.KeyCount < maxKeys {
+			result.Contents = append(result.Contents, fakeS3Object{Key: key})
+			result.KeyCount++
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (s *fakeS3) fail(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(fakeS3Error{Code: code, Message: message})
+}
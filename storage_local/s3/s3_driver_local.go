@@ -0,0 +1,234 @@
+package storage_s3driver
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"fmt"
+	"strings"
+
+	"../../storage_config"
+	"../mountutil"
+)
+
+const (
+	Name = "s3"
+
+	DefaultEndpoint = "https://s3.amazonaws.com"
+)
+
+// SecretOpts are redacted from logs and the audit log.
+var SecretOpts = []string{"secret_access_key"}
+
+type S3LocalDriver struct {
+	secretsDir    string
+	userInvoker   storage_mountutil.Invoker
+	os            osshim.Os
+	useSystemUtil ioutilshim.Ioutil
+	httpClient    *http.Client
+
+	*storage_mountutil.Volumes
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	PathStyle       bool
+	AccessKeyId     string
+	SecretAccessKey string `json:"-"`
+	LocalMountPoint string
+}
+
+func NewS3LocalDriver(secretsDir string) *S3LocalDriver {
+	return NewS3DriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, storage_mountutil.NewRealInvoker(), secretsDir)
+}
+
+func NewS3DriverWithSystemUtilAndInvoker(ioutil ioutilshim.Ioutil, os osshim.Os, invoker storage_mountutil.Invoker, secretsDir string) *S3LocalDriver {
+	d := &S3LocalDriver{
+		secretsDir:    secretsDir,
+		userInvoker:   invoker,
+		os:            os,
+		useSystemUtil: ioutil,
+		httpClient:    &http.Client{Timeout: BucketCheckTimeout},
+		Holder:        storage_config.NewHolder(SecretOpts...),
+	}
+	d.Volumes = storage_mountutil.NewVolumes(Name, d)
+	return d
+}
+
+func (d *S3LocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *S3LocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "global"},
+	}
+}
+
+func (d *S3LocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	newVolume := &volumeMetadata{}
+	var err *voldriver.ErrorResponse
+	var pathStyle string
+
+	if newVolume.Endpoint, err = storage_mountutil.ExtractOptionalValue(logger, "endpoint", createRequest.Opts, DefaultEndpoint); err != nil {
+		return *err
+	}
+	if endpoint, parseErr := url.Parse(newVolume.Endpoint); parseErr != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.endpoint '%s' must be an http or https url", newVolume.Endpoint)}
+	}
+	if newVolume.Region, err = storage_mountutil.ExtractOptionalValue(logger, "region", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.Bucket, err = storage_mountutil.ExtractValue(logger, "bucket", createRequest.Opts); err != nil {
+		return *err
+	}
+	if newVolume.Bucket == "" || strings.ContainsAny(newVolume.Bucket, ":/") {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.bucket '%s' is not a valid bucket name", newVolume.Bucket)}
+	}
+	if newVolume.Prefix, err = storage_mountutil.ExtractOptionalValue(logger, "prefix", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	newVolume.Prefix = strings.Trim(newVolume.Prefix, "/")
+	if pathStyle, err = storage_mountutil.ExtractOptionalValue(logger, "path_style", createRequest.Opts, "true"); err != nil {
+		return *err
+	}
+	newVolume.PathStyle = pathStyle == "true"
+	if newVolume.AccessKeyId, err = storage_mountutil.ExtractValue(logger, "access_key_id", createRequest.Opts); err != nil {
+		return *err
+	}
+	if newVolume.SecretAccessKey, err = storage_mountutil.ExtractValue(logger, "secret_access_key", createRequest.Opts); err != nil {
+		return *err
+	}
+	if strings.ContainsAny(newVolume.AccessKeyId, ":\n") || strings.Contains(newVolume.SecretAccessKey, "\n") {
+		return voldriver.ErrorResponse{Err: "Opts.access_key_id must not contain ':' or newlines, Opts.secret_access_key must not contain newlines"}
+	}
+	if newVolume.LocalMountPoint, err = storage_mountutil.ExtractValue(logger, "localmountpoint", createRequest.Opts); err != nil {
+		return *err
+	}
+	for _, value := range []string{newVolume.Endpoint, newVolume.Region, newVolume.Bucket, newVolume.Prefix} {
+		if strings.ContainsAny(value, " \n,") {
+			return voldriver.ErrorResponse{Err: "Opts.endpoint, Opts.region, Opts.bucket and Opts.prefix must not contain whitespace or ','"}
+		}
+	}
+
+	return d.Volumes.Add(logger, createRequest.Name, newVolume, nil)
+}
+
+func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
+	return volume.Endpoint == v.Endpoint &&
+		volume.Region == v.Region &&
+		volume.Bucket == v.Bucket &&
+		volume.Prefix == v.Prefix &&
+		volume.PathStyle == v.PathStyle &&
+		volume.AccessKeyId == v.AccessKeyId &&
+		volume.SecretAccessKey == v.SecretAccessKey &&
+		volume.LocalMountPoint == v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*volumeMetadata)
+	return ok && v.equals(volume)
+}
+
+func (v *volumeMetadata) MountPoint() string {
+	return v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Target() string {
+	if v.Prefix == "" {
+		return v.Bucket
+	}
+	return v.Bucket + ":/" + v.Prefix
+}
+
+func (v *volumeMetadata) Server() string {
+	endpoint, err := url.Parse(v.Endpoint)
+	if err != nil {
+		return v.Endpoint
+	}
+	return endpoint.Host
+}
+
+func (d *S3LocalDriver) Attach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	config := d.Config()
+
+	if err := d.os.MkdirAll(volume.LocalMountPoint, os.ModePerm); err != nil {
+		logger.Error("failed-create-mountdir", err)
+		return fmt.Errorf("unable to create local mount point")
+	}
+
+	if err := d.checkBucket(logger, volume); err != nil {
+		return err
+	}
+
+	// s3fs refuses passwd files readable by others; the file stays on disk
+	// while the volume is mounted
+	passwdFile := storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".passwd")
+	passwd := []byte(volume.AccessKeyId + ":" + volume.SecretAccessKey + "\n")
+	if err := storage_mountutil.WriteSecretFile(d.useSystemUtil, d.os, passwdFile, passwd); err != nil {
+		logger.Error("failed-writing-passwd-file", err)
+		return err
+	}
+
+	mountOptions := []string{"passwd_file=" + passwdFile, "url=" + volume.Endpoint, "allow_other"}
+	if volume.PathStyle {
+		mountOptions = append(mountOptions, "use_path_request_style")
+	}
+	if volume.Region != "" {
+		mountOptions = append(mountOptions, "endpoint="+volume.Region)
+	}
+
+	cmdArgs := []string{volume.Target(), volume.LocalMountPoint, "-o", strings.Join(mountOptions, ",")}
+	if err := storage_mountutil.MountWithRetry(logger, d.userInvoker, config.MountRetry, "s3fs", cmdArgs); err != nil {
+		d.removePasswdFile(logger, volumeName)
+		return err
+	}
+	return nil
+}
+
+func (d *S3LocalDriver) Detach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	// a mount whose s3fs process died can only be detached lazily
+	cmdArgs := []string{"-u", volume.LocalMountPoint}
+	if _, err := d.os.Stat(volume.LocalMountPoint); storage_mountutil.IsStaleMount(err) {
+		cmdArgs = []string{"-u", "-z", volume.LocalMountPoint}
+	}
+	if err := d.userInvoker.Invoke(logger, "fusermount", cmdArgs); err != nil {
+		logger.Error("failed-invoking-fusermount", err)
+		return err
+	}
+
+	d.removePasswdFile(logger, volumeName)
+	if err := d.os.Remove(volume.LocalMountPoint); err != nil {
+		logger.Error("failed-removing-mountpoint", err)
+	}
+	return nil
+}
+
+func (d *S3LocalDriver) removePasswdFile(logger lager.Logger, volumeName string) {
+	if err := storage_mountutil.RemoveSecretFile(d.os, storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".passwd")); err != nil {
+		logger.Error("failed-removing-passwd-file", err)
+	}
+}
@@ -0,0 +1,206 @@
+package storage_s3driver_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_config"
+	"../mountutil/mountutilfakes"
+	"../s3"
+)
+
+const secretAccessKey = "wJalrXUtnFEMIK7MDENGbPxRfiCYs3cr3t"
+
+var _ = Describe("S3LocalDriver", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeInvoker *mountutilfakes.FakeInvoker
+		s3          *fakeS3
+		s3Server    *httptest.Server
+		tempDir     string
+		mountPoint  string
+		config      storage_config.Config
+		driver      *storage_s3driver.S3LocalDriver
+		opts        map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "s3-driver")
+		Expect(err).NotTo(HaveOccurred())
+		mountPoint = filepath.Join(tempDir, "mounts", "vol")
+
+		logger = lagertest.NewTestLogger("s3")
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		driver = storage_s3driver.NewS3DriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, fakeInvoker, filepath.Join(tempDir, "secrets"))
+
+		// the secret access key is redacted even when sensitive_opts does not
+		// name it
+		config = storage_config.DefaultConfig()
+		config.MountRetry.Interval = 0
+		config.SensitiveOpts = []string{}
+		Expect(driver.Reload(logger, config)).To(Succeed())
+
+		s3 = &fakeS3{
+			accessKeyId:     "AKIAEXAMPLE",
+			secretAccessKey: secretAccessKey,
+			buckets:         map[string][]string{"data": {"apps/index.html", "logs/today"}},
+		}
+		s3Server = httptest.NewServer(s3)
+
+		opts = map[string]interface{}{
+			"endpoint":          s3Server.URL,
+			"bucket":            "data",
+			"prefix":            "/apps/",
+			"access_key_id":     "AKIAEXAMPLE",
+			"secret_access_key": secretAccessKey,
+			"localmountpoint":   mountPoint,
+		}
+	})
+
+	AfterEach(func() {
+		s3Server.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	create := func() voldriver.ErrorResponse {
+		return driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: opts})
+	}
+
+	secretFiles := func() []os.FileInfo {
+		files, err := ioutil.ReadDir(filepath.Join(tempDir, "secrets"))
+		Expect(err).NotTo(HaveOccurred())
+		return files
+	}
+
+	It("declares the secret access key as secret", func() {
+		Expect(driver.SecretOpts()).To(ConsistOf("secret_access_key"))
+	})
+
+	It("signs requests like the examples of AWS signature version 4", func() {
+		req, err := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+		storage_s3driver.SignV4(req, "iam", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+		Expect(req.Header.Get("X-Amz-Date")).To(Equal("20150830T123600Z"))
+		Expect(req.Header.Get("Authorization")).To(Equal("AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"))
+	})
+
+	Context("#Create", func() {
+		It("requires an http or https endpoint", func() {
+			opts["endpoint"] = "ftp://127.0.0.1"
+			Expect(create().Err).To(Equal("Opts.endpoint 'ftp://127.0.0.1' must be an http or https url"))
+		})
+	})
+
+	Context("#Mount", func() {
+		BeforeEach(func() {
+			Expect(create().Err).To(BeEmpty())
+		})
+
+		It("passes the keys in a passwd file and never logs them", func() {
+			var passwd string
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				for _, option := range strings.Split(args[3], ",") {
+					if strings.HasPrefix(option, "passwd_file=") {
+						data, err := ioutil.ReadFile(strings.TrimPrefix(option, "passwd_file="))
+						Expect(err).NotTo(HaveOccurred())
+						passwd = string(data)
+					}
+				}
+				return nil
+			}
+
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(BeEmpty())
+			Expect(response.Mountpoint).To(Equal(mountPoint))
+
+			_, executable, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(executable).To(Equal("s3fs"))
+			Expect(args[0:2]).To(Equal([]string{"data:/apps", mountPoint}))
+			Expect(args[3]).To(ContainSubstring("url=" + s3Server.URL))
+			Expect(args[3]).To(ContainSubstring("use_path_request_style"))
+			Expect(strings.Join(args, " ")).NotTo(ContainSubstring(secretAccessKey))
+			Expect(passwd).To(Equal("AKIAEXAMPLE:" + secretAccessKey + "\n"))
+
+			Expect(string(logger.Buffer().Contents())).NotTo(ContainSubstring(secretAccessKey))
+		})
+
+		It("removes the passwd file after unmounting", func() {
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(secretFiles()).To(HaveLen(1))
+
+			Expect(driver.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(secretFiles()).To(BeEmpty())
+		})
+
+		It("removes the passwd file when the mount fails", func() {
+			fakeInvoker.InvokeReturns(errors.New("bucket not found"))
+
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(Equal("Error mounting 'vol' (bucket not found)"))
+			Expect(secretFiles()).To(BeEmpty())
+		})
+
+		It("lists the prefix of the bucket with a signed request before mounting", func() {
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+
+			requests := s3.Requests()
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].URL.Path).To(Equal("/data"))
+			Expect(requests[0].URL.Query().Get("prefix")).To(Equal("apps/"))
+			Expect(requests[0].Header.Get("Authorization")).To(HavePrefix("AWS4-HMAC-SHA256 Credential=AKIAEXAMPLE/"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+		})
+	})
+
+	Context("when the server refuses the volume", func() {
+		mount := func() string {
+			Expect(create().Err).To(BeEmpty())
+			return driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err
+		}
+
+		It("reports a wrong secret access key without running s3fs", func() {
+			opts["secret_access_key"] = "not-the-key"
+
+			Expect(mount()).To(Equal("Error mounting 'vol' (bucket 'data' cannot be listed (SignatureDoesNotMatch: The request signature we calculated does not match the signature you provided.))"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+			Expect(filepath.Join(tempDir, "secrets")).NotTo(BeADirectory())
+		})
+
+		It("reports an unknown access key id", func() {
+			opts["access_key_id"] = "AKIAUNKNOWN"
+
+			Expect(mount()).To(ContainSubstring("InvalidAccessKeyId"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+		})
+
+		It("reports a missing bucket", func() {
+			opts["bucket"] = "missing"
+
+			Expect(mount()).To(Equal("Error mounting 'vol' (bucket 'missing' cannot be listed (NoSuchBucket: The specified bucket does not exist))"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+		})
+
+		It("reports an unreachable endpoint", func() {
+			s3Server.Close()
+
+			Expect(mount()).To(ContainSubstring("bucket 'data' cannot be reached"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package storage_s3driver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestS3Driver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "S3 Driver Suite")
+}
@@ -0,0 +1,212 @@
+package storage_smbdriver
+
+import (
+	"os"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/goshims/ioutil"
+
+	"fmt"
+	"strings"
+
+	"../../storage_config"
+	"../mountutil"
+)
+
+const (
+	Name = "smb"
+)
+
+// SecretOpts are redacted from logs and the audit log.
+var SecretOpts = []string{"password"}
+
+type SmbLocalDriver struct {
+	secretsDir       string
+	userInvoker      storage_mountutil.Invoker
+	os               osshim.Os
+	useSystemUtil    ioutilshim.Ioutil
+
+	*storage_mountutil.Volumes
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	Share            string
+	LocalMountPoint  string
+	Username         string
+	Password         string `json:"-"`
+	Domain           string
+	Vers             string
+	Uid              string
+	Gid              string
+}
+
+func NewSmbLocalDriver(secretsDir string) *SmbLocalDriver {
+	return NewSmbDriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, storage_mountutil.NewRealInvoker(), secretsDir)
+}
+
+func NewSmbDriverWithSystemUtilAndInvoker(ioutil ioutilshim.Ioutil, os osshim.Os, invoker storage_mountutil.Invoker, secretsDir string) *SmbLocalDriver {
+	d := &SmbLocalDriver{
+		secretsDir:    secretsDir,
+		userInvoker:   invoker,
+		os:            os,
+		useSystemUtil: ioutil,
+		Holder:        storage_config.NewHolder(SecretOpts...),
+	}
+	d.Volumes = storage_mountutil.NewVolumes(Name, d)
+	return d
+}
+
+func (d *SmbLocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *SmbLocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "global"},
+	}
+}
+
+func (d *SmbLocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	newVolume := &volumeMetadata{}
+	var err *voldriver.ErrorResponse
+
+	if newVolume.Share, err = storage_mountutil.ExtractValue(logger, "share", createRequest.Opts); err != nil {
+		return *err
+	}
+	if !strings.HasPrefix(newVolume.Share, "//") || len(strings.Split(strings.TrimPrefix(newVolume.Share, "//"), "/")) < 2 {
+		logger.Info("invalid-share", lager.Data{"share": newVolume.Share})
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.share '%s' must have the form //server/share", newVolume.Share)}
+	}
+	if newVolume.LocalMountPoint, err = storage_mountutil.ExtractValue(logger, "localmountpoint", createRequest.Opts); err != nil {
+		return *err
+	}
+
+	optional := []struct {
+		key   string
+		value *string
+	}{
+		{"username", &newVolume.Username},
+		{"password", &newVolume.Password},
+		{"domain", &newVolume.Domain},
+		{"vers", &newVolume.Vers},
+		{"uid", &newVolume.Uid},
+		{"gid", &newVolume.Gid},
+	}
+	for _, option := range optional {
+		if *option.value, err = storage_mountutil.ExtractOptionalValue(logger, option.key, createRequest.Opts, ""); err != nil {
+			return *err
+		}
+		if strings.ContainsAny(*option.value, ",\n") && option.key != "password" {
+			return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.%s must not contain ',' or newlines", option.key)}
+		}
+	}
+	if strings.Contains(newVolume.Password, "\n") {
+		return voldriver.ErrorResponse{Err: "Opts.password must not contain newlines"}
+	}
+
+	return d.Volumes.Add(logger, createRequest.Name, newVolume, nil)
+}
+
+func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
+	return volume.Share == v.Share &&
+		volume.LocalMountPoint == v.LocalMountPoint &&
+		volume.Username == v.Username &&
+		volume.Password == v.Password &&
+		volume.Domain == v.Domain &&
+		volume.Vers == v.Vers &&
+		volume.Uid == v.Uid &&
+		volume.Gid == v.Gid
+}
+
+func (v *volumeMetadata) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*volumeMetadata)
+	return ok && v.equals(volume)
+}
+
+func (v *volumeMetadata) MountPoint() string {
+	return v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Target() string {
+	return v.Share
+}
+
+func (v *volumeMetadata) Server() string {
+	return strings.Split(strings.TrimPrefix(v.Share, "//"), "/")[0]
+}
+
+// Attach mounts the share for the first consumer of the volume.
+func (d *SmbLocalDriver) Attach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	config := d.Config()
+
+	err := d.os.MkdirAll(volume.LocalMountPoint, os.ModePerm)
+	if err != nil {
+		logger.Error("failed-create-mountdir", err)
+		return fmt.Errorf("unable to create local mount point")
+	}
+
+	mountOptions := []string{}
+	if volume.Username != "" || volume.Password != "" || volume.Domain != "" {
+		credentialsFile := storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".cred")
+		err = storage_mountutil.WriteSecretFile(d.useSystemUtil, d.os, credentialsFile, volume.credentials())
+		if err != nil {
+			logger.Error("failed-writing-credentials-file", err)
+			return fmt.Errorf("unable to write credentials file")
+		}
+		// mount.cifs only reads the file while mounting, keep it on disk no longer than that
+		defer storage_mountutil.RemoveSecretFile(d.os, credentialsFile)
+
+		mountOptions = append(mountOptions, "credentials="+credentialsFile)
+	} else {
+		mountOptions = append(mountOptions, "guest")
+	}
+	if volume.Vers != "" {
+		mountOptions = append(mountOptions, "vers="+volume.Vers)
+	}
+	if volume.Uid != "" {
+		mountOptions = append(mountOptions, "uid="+volume.Uid)
+	}
+	if volume.Gid != "" {
+		mountOptions = append(mountOptions, "gid="+volume.Gid)
+	}
+
+	cmdArgs := []string{"-t", "cifs", "-o", strings.Join(mountOptions, ","), volume.Share, volume.LocalMountPoint}
+	return storage_mountutil.MountWithRetry(logger, d.userInvoker, config.MountRetry, "mount", cmdArgs)
+}
+
+func (v *volumeMetadata) credentials() []byte {
+	contents := fmt.Sprintf("username=%s\npassword=%s\n", v.Username, v.Password)
+	if v.Domain != "" {
+		contents += fmt.Sprintf("domain=%s\n", v.Domain)
+	}
+	return []byte(contents)
+}
+
+// Detach unmounts the share after the last consumer of the volume is gone.
+func (d *SmbLocalDriver) Detach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	if err := d.userInvoker.Invoke(logger, "umount", []string{volume.LocalMountPoint}); err != nil {
+		logger.Error("failed-invoking-umount", err)
+		return err
+	}
+
+	if err := d.os.Remove(volume.LocalMountPoint); err != nil {
+		logger.Error("failed-removing-mountpoint", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package storage_smbdriver_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_config"
+	"../mountutil/mountutilfakes"
+	"../smb"
+)
+
+var _ = Describe("SmbLocalDriver", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeInvoker *mountutilfakes.FakeInvoker
+		tempDir     string
+		mountPoint  string
+		config      storage_config.Config
+		driver      *storage_smbdriver.SmbLocalDriver
+		opts        map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "smb-driver")
+		Expect(err).NotTo(HaveOccurred())
+		mountPoint = filepath.Join(tempDir, "mounts", "vol")
+
+		logger = lagertest.NewTestLogger("smb")
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		driver = storage_smbdriver.NewSmbDriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, fakeInvoker, filepath.Join(tempDir, "secrets"))
+
+		// the password is redacted even when sensitive_opts does not name it
+		config = storage_config.DefaultConfig()
+		config.MountRetry.Interval = 0
+		config.SensitiveOpts = []string{}
+		Expect(driver.Reload(logger, config)).To(Succeed())
+
+		opts = map[string]interface{}{
+			"share":           "//fileserver/data",
+			"localmountpoint": mountPoint,
+			"username":        "alice",
+			"password":        "s3cr3t",
+			"vers":            "3.0",
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	create := func() voldriver.ErrorResponse {
+		return driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: opts})
+	}
+
+	It("declares the password as secret", func() {
+		Expect(driver.SecretOpts()).To(ConsistOf("password"))
+	})
+
+	Context("#Create", func() {
+		It("requires a share of the form //server/share", func() {
+			opts["share"] = "fileserver"
+			Expect(create().Err).To(ContainSubstring("must have the form //server/share"))
+		})
+
+		It("refuses the same name with different opts", func() {
+			Expect(create().Err).To(BeEmpty())
+			Expect(create().Err).To(BeEmpty())
+
+			opts["vers"] = "2.1"
+			Expect(create().Err).To(Equal("Volume 'vol' already exists with different Opts"))
+		})
+	})
+
+	Context("#Mount", func() {
+		BeforeEach(func() {
+			Expect(create().Err).To(BeEmpty())
+		})
+
+		It("mounts the share with a credentials file that is gone afterwards", func() {
+			var credentials string
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				for _, option := range strings.Split(args[3], ",") {
+					if strings.HasPrefix(option, "credentials=") {
+						contents, err := ioutil.ReadFile(strings.TrimPrefix(option, "credentials="))
+						Expect(err).NotTo(HaveOccurred())
+						credentials = string(contents)
+					}
+				}
+				return nil
+			}
+
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(BeEmpty())
+			Expect(response.Mountpoint).To(Equal(mountPoint))
+			Expect(mountPoint).To(BeADirectory())
+
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+			_, executable, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(executable).To(Equal("mount"))
+			Expect(args[0:2]).To(Equal([]string{"-t", "cifs"}))
+			Expect(args[3]).To(ContainSubstring("vers=3.0"))
+			Expect(args[4:]).To(Equal([]string{"//fileserver/data", mountPoint}))
+			Expect(credentials).To(Equal("username=alice\npassword=s3cr3t\n"))
+
+			files, err := ioutil.ReadDir(filepath.Join(tempDir, "secrets"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+
+		It("mounts as guest without credentials", func() {
+			delete(opts, "username")
+			delete(opts, "password")
+			driver.Create(logger, voldriver.CreateRequest{Name: "guest", Opts: opts})
+
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "guest"}).Err).To(BeEmpty())
+			_, _, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(args[3]).To(Equal("guest,vers=3.0"))
+		})
+
+		It("mounts once for many consumers", func() {
+			driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+		})
+
+		It("retries a failing mount and reports the error", func() {
+			fakeInvoker.InvokeReturns(errors.New("host is down"))
+
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(Equal("Error mounting 'vol' (host is down)"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(3))
+		})
+
+		It("never logs the password", func() {
+			driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(logger.Buffer().Contents()).NotTo(ContainSubstring("s3cr3t"))
+		})
+	})
+
+	Context("#Unmount", func() {
+		BeforeEach(func() {
+			Expect(create().Err).To(BeEmpty())
+			driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+		})
+
+		It("unmounts after the last consumer and removes the mountpoint", func() {
+			Expect(driver.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+
+			Expect(driver.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(2))
+			_, executable, args := fakeInvoker.InvokeArgsForCall(1)
+			Expect(executable).To(Equal("umount"))
+			Expect(args).To(Equal([]string{mountPoint}))
+			Expect(mountPoint).NotTo(BeADirectory())
+		})
+
+		It("unmounts on remove", func() {
+			Expect(driver.Remove(logger, voldriver.RemoveRequest{Name: "vol"}).Err).To(BeEmpty())
+			_, executable, _ := fakeInvoker.InvokeArgsForCall(1)
+			Expect(executable).To(Equal("umount"))
+			Expect(driver.List(logger).Volumes).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,13 @@
+package storage_smbdriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSmbDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Smb Driver Suite")
+}
@@ -0,0 +1,333 @@
+package storage_sshfsdriver
+
+import (
+	"os"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/goshims/ioutil"
+
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../../storage_config"
+	"../mountutil"
+)
+
+const (
+	Name = "sshfs"
+
+	DefaultSuperviseInterval = 10 * time.Second
+)
+
+// SecretOpts are redacted from logs and the audit log.
+var SecretOpts = []string{"private_key"}
+
+type SshfsLocalDriver struct {
+	secretsDir        string
+	superviseInterval time.Duration
+	userInvoker       storage_mountutil.Invoker
+	os                osshim.Os
+	useSystemUtil     ioutilshim.Ioutil
+	supervisorLock    sync.Mutex
+	stopSupervisor    chan struct{}
+
+	*storage_mountutil.Volumes
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	Host             string
+	Port             int
+	User             string
+	RemotePath       string
+	PrivateKey       string `json:"-"`
+	HostKey          string
+	LocalMountPoint  string
+}
+
+func NewSshfsLocalDriver(secretsDir string) *SshfsLocalDriver {
+	return NewSshfsDriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, storage_mountutil.NewRealInvoker(), secretsDir, DefaultSuperviseInterval)
+}
+
+func NewSshfsDriverWithSystemUtilAndInvoker(ioutil ioutilshim.Ioutil, os osshim.Os, invoker storage_mountutil.Invoker, secretsDir string, superviseInterval time.Duration) *SshfsLocalDriver {
+	d := &SshfsLocalDriver{
+		secretsDir:        secretsDir,
+		superviseInterval: superviseInterval,
+		userInvoker:       invoker,
+		os:                os,
+		useSystemUtil:     ioutil,
+		Holder:            storage_config.NewHolder(SecretOpts...),
+	}
+	d.Volumes = storage_mountutil.NewVolumes(Name, d)
+	return d
+}
+
+func (d *SshfsLocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *SshfsLocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "global"},
+	}
+}
+
+func (d *SshfsLocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	newVolume := &volumeMetadata{}
+	var err *voldriver.ErrorResponse
+	var port string
+
+	if newVolume.Host, err = storage_mountutil.ExtractValue(logger, "host", createRequest.Opts); err != nil {
+		return *err
+	}
+	if port, err = storage_mountutil.ExtractOptionalValue(logger, "port", createRequest.Opts, "22"); err != nil {
+		return *err
+	}
+	var convErr error
+	if newVolume.Port, convErr = strconv.Atoi(port); convErr != nil || newVolume.Port < 1 || newVolume.Port > 65535 {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.port '%s' is not a valid port", port)}
+	}
+	if newVolume.User, err = storage_mountutil.ExtractValue(logger, "user", createRequest.Opts); err != nil {
+		return *err
+	}
+	if newVolume.RemotePath, err = storage_mountutil.ExtractOptionalValue(logger, "path", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.PrivateKey, err = storage_mountutil.ExtractValue(logger, "private_key", createRequest.Opts); err != nil {
+		return *err
+	}
+	if newVolume.HostKey, err = storage_mountutil.ExtractValue(logger, "host_key", createRequest.Opts); err != nil {
+		return *err
+	}
+	if len(strings.Fields(newVolume.HostKey)) != 2 {
+		return voldriver.ErrorResponse{Err: "Opts.host_key must have the form '<key type> <base64 key>', e.g. from ssh-keyscan"}
+	}
+	if newVolume.LocalMountPoint, err = storage_mountutil.ExtractValue(logger, "localmountpoint", createRequest.Opts); err != nil {
+		return *err
+	}
+	for _, value := range []string{newVolume.Host, newVolume.User, newVolume.RemotePath} {
+		if strings.ContainsAny(value, " \n,@") {
+			return voldriver.ErrorResponse{Err: "Opts.host, Opts.user and Opts.path must not contain whitespace, ',' or '@'"}
+		}
+	}
+
+	return d.Volumes.Add(logger, createRequest.Name, newVolume, nil)
+}
+
+func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
+	return volume.Host == v.Host &&
+		volume.Port == v.Port &&
+		volume.User == v.User &&
+		volume.RemotePath == v.RemotePath &&
+		volume.PrivateKey == v.PrivateKey &&
+		volume.HostKey == v.HostKey &&
+		volume.LocalMountPoint == v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*volumeMetadata)
+	return ok && v.equals(volume)
+}
+
+func (v *volumeMetadata) MountPoint() string {
+	return v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Target() string {
+	return fmt.Sprintf("%s@%s:%s", v.User, v.Host, v.RemotePath)
+}
+
+func (v *volumeMetadata) Server() string {
+	return v.Host
+}
+
+func (v *volumeMetadata) knownHosts() []byte {
+	host := v.Host
+	if v.Port != 22 {
+		host = fmt.Sprintf("[%s]:%d", v.Host, v.Port)
+	}
+	return []byte(host + " " + v.HostKey + "\n")
+}
+
+func (d *SshfsLocalDriver) Mount(logger lager.Logger, mountRequest voldriver.MountRequest) voldriver.MountResponse {
+	response := d.Volumes.Mount(logger, mountRequest)
+	if response.Err == "" {
+		d.startSupervisor(logger)
+	}
+	return response
+}
+
+func (d *SshfsLocalDriver) Unmount(logger lager.Logger, unmountRequest voldriver.UnmountRequest) voldriver.ErrorResponse {
+	defer d.stopSupervisorIfIdle()
+	return d.Volumes.Unmount(logger, unmountRequest)
+}
+
+func (d *SshfsLocalDriver) Remove(logger lager.Logger, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse {
+	defer d.stopSupervisorIfIdle()
+	return d.Volumes.Remove(logger, removeRequest)
+}
+
+func (d *SshfsLocalDriver) Forget(logger lager.Logger, name string) error {
+	defer d.stopSupervisorIfIdle()
+	return d.Volumes.Forget(logger, name)
+}
+
+func (d *SshfsLocalDriver) Attach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	config := d.Config()
+
+	if err := d.os.MkdirAll(volume.LocalMountPoint, os.ModePerm); err != nil {
+		logger.Error("failed-create-mountdir", err)
+		return err
+	}
+
+	// ssh runs again on every reconnect, so key and known hosts stay on disk
+	// for as long as the volume is mounted
+	keyFile := storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".key")
+	knownHostsFile := storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".known_hosts")
+	privateKey := strings.TrimRight(volume.PrivateKey, "\n") + "\n"
+	if err := storage_mountutil.WriteSecretFile(d.useSystemUtil, d.os, keyFile, []byte(privateKey)); err != nil {
+		logger.Error("failed-writing-key-file", err)
+		return err
+	}
+	if err := storage_mountutil.WriteSecretFile(d.useSystemUtil, d.os, knownHostsFile, volume.knownHosts()); err != nil {
+		logger.Error("failed-writing-known-hosts-file", err)
+		return err
+	}
+
+	sshOptions := []string{
+		"IdentityFile=" + keyFile,
+		"UserKnownHostsFile=" + knownHostsFile,
+		"StrictHostKeyChecking=yes",
+		"IdentitiesOnly=yes",
+		"BatchMode=yes",
+		"ServerAliveInterval=15",
+		"ServerAliveCountMax=3",
+		"reconnect",
+		"allow_other",
+	}
+	cmdArgs := []string{"-p", strconv.Itoa(volume.Port), "-o", strings.Join(sshOptions, ","), volume.Target(), volume.LocalMountPoint}
+
+	if err := storage_mountutil.MountWithRetry(logger, d.userInvoker, config.MountRetry, "sshfs", cmdArgs); err != nil {
+		d.removeSecrets(logger, volumeName)
+		return err
+	}
+	return nil
+}
+
+func (d *SshfsLocalDriver) Detach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	cmdArgs := []string{"-u", volume.LocalMountPoint}
+	if !d.alive(volume) {
+		cmdArgs = []string{"-u", "-z", volume.LocalMountPoint}
+	}
+	if err := d.userInvoker.Invoke(logger, "fusermount", cmdArgs); err != nil {
+		logger.Error("failed-invoking-fusermount", err)
+		return err
+	}
+
+	d.removeSecrets(logger, volumeName)
+	if err := d.os.Remove(volume.LocalMountPoint); err != nil {
+		logger.Error("failed-removing-mountpoint", err)
+	}
+	return nil
+}
+
+func (d *SshfsLocalDriver) removeSecrets(logger lager.Logger, volumeName string) {
+	for _, extension := range []string{".key", ".known_hosts"} {
+		if err := storage_mountutil.RemoveSecretFile(d.os, storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, extension)); err != nil {
+			logger.Error("failed-removing-secret-file", err)
+		}
+	}
+}
+
+// startSupervisor watches the mounted volumes and mounts a volume again when
+// its sshfs process died.
+func (d *SshfsLocalDriver) startSupervisor(logger lager.Logger) {
+	d.supervisorLock.Lock()
+	defer d.supervisorLock.Unlock()
+
+	if d.stopSupervisor != nil || d.superviseInterval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	d.stopSupervisor = stop
+	logger = logger.Session("supervisor")
+
+	go func() {
+		ticker := time.NewTicker(d.superviseInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				d.supervise(logger)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (d *SshfsLocalDriver) stopSupervisorIfIdle() {
+	d.supervisorLock.Lock()
+	defer d.supervisorLock.Unlock()
+
+	if d.stopSupervisor == nil || len(d.mounted()) > 0 {
+		return
+	}
+	close(d.stopSupervisor)
+	d.stopSupervisor = nil
+}
+
+func (d *SshfsLocalDriver) mounted() []string {
+	names := []string{}
+	d.Each(func(name string, volume storage_mountutil.Volume, mountCount int) {
+		if mountCount > 0 {
+			names = append(names, name)
+		}
+	})
+	return names
+}
+
+func (d *SshfsLocalDriver) supervise(logger lager.Logger) {
+	for _, name := range d.mounted() {
+		d.Exclusive(name, func(mountable storage_mountutil.Volume, mountCount int) error {
+			volume := mountable.(*volumeMetadata)
+			if mountCount == 0 || d.alive(volume) {
+				return nil
+			}
+
+			logger.Info("sshfs-process-gone-remounting", lager.Data{"volume_name": name})
+			if err := d.userInvoker.Invoke(logger, "fusermount", []string{"-u", "-z", volume.LocalMountPoint}); err != nil {
+				logger.Error("failed-detaching-stale-mount", err, lager.Data{"volume_name": name})
+			}
+			if err := d.Attach(logger, name, volume); err != nil {
+				logger.Error("failed-remounting-volume", err, lager.Data{"volume_name": name})
+			}
+			return nil
+		})
+	}
+}
+
+func (d *SshfsLocalDriver) alive(volume *volumeMetadata) bool {
+	_, err := d.os.Stat(volume.LocalMountPoint)
+	return !storage_mountutil.IsStaleMount(err)
+}
@@ -0,0 +1,13 @@
+package storage_sshfsdriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSshfsDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Sshfs Driver Suite")
+}
@@ -0,0 +1,204 @@
+package storage_tmpfsdriver
+
+import (
+	"os"
+
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"../../storage_config"
+	"../mountutil"
+)
+
+const (
+	Name = "tmpfs"
+)
+
+type TmpfsLocalDriver struct {
+	mountRoot   string
+	userInvoker storage_mountutil.Invoker
+	os          osshim.Os
+	budgetLock  sync.Mutex
+
+	*storage_mountutil.Volumes
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	SizeBytes       int64
+	Mode            string
+	Uid             string
+	Gid             string
+	LocalMountPoint string
+}
+
+func NewTmpfsLocalDriver(mountRoot string) *TmpfsLocalDriver {
+	return NewTmpfsDriverWithInvoker(&osshim.OsShim{}, storage_mountutil.NewRealInvoker(), mountRoot)
+}
+
+func NewTmpfsDriverWithInvoker(os osshim.Os, invoker storage_mountutil.Invoker, mountRoot string) *TmpfsLocalDriver {
+	d := &TmpfsLocalDriver{
+		mountRoot:   mountRoot,
+		userInvoker: invoker,
+		os:          os,
+		Holder:      storage_config.NewHolder(),
+	}
+	d.Volumes = storage_mountutil.NewVolumes(Name, d)
+	return d
+}
+
+func (d *TmpfsLocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *TmpfsLocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "local"},
+	}
+}
+
+func (d *TmpfsLocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	newVolume := &volumeMetadata{}
+	var err *voldriver.ErrorResponse
+	var size string
+
+	if size, err = storage_mountutil.ExtractValue(logger, "size", createRequest.Opts); err != nil {
+		return *err
+	}
+	sizeBytes, sizeErr := storage_mountutil.ParseSize(size)
+	if sizeErr != nil {
+		logger.Info("invalid-size", lager.Data{"size": size})
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.size: %s", sizeErr.Error())}
+	}
+	newVolume.SizeBytes = sizeBytes
+
+	if newVolume.Mode, err = storage_mountutil.ExtractOptionalValue(logger, "mode", createRequest.Opts, "0755"); err != nil {
+		return *err
+	}
+	if _, convErr := strconv.ParseUint(newVolume.Mode, 8, 32); convErr != nil {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.mode '%s' must be an octal file mode", newVolume.Mode)}
+	}
+	for _, id := range []struct {
+		key   string
+		value *string
+	}{{"uid", &newVolume.Uid}, {"gid", &newVolume.Gid}} {
+		if *id.value, err = storage_mountutil.ExtractOptionalValue(logger, id.key, createRequest.Opts, ""); err != nil {
+			return *err
+		}
+		if *id.value == "" {
+			continue
+		}
+		if _, convErr := strconv.ParseUint(*id.value, 10, 32); convErr != nil {
+			return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.%s '%s' must be a numeric id", id.key, *id.value)}
+		}
+	}
+
+	if newVolume.LocalMountPoint, err = storage_mountutil.ExtractOptionalValue(logger, "localmountpoint", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.LocalMountPoint == "" {
+		newVolume.LocalMountPoint = storage_mountutil.VolumeFilePath(d.mountRoot, createRequest.Name, "")
+	}
+
+	// the budget check and the add have to be atomic, a duplicate of an
+	// existing volume takes no budget
+	d.budgetLock.Lock()
+	defer d.budgetLock.Unlock()
+
+	if _, _, exists := d.Volume(createRequest.Name); !exists {
+		budget := d.Config().Tmpfs.BudgetBytes
+		allocated := d.allocatedBytes()
+		if budget > 0 && allocated+newVolume.SizeBytes > budget {
+			logger.Info("budget-exceeded", lager.Data{"budget": budget, "allocated": allocated, "requested": newVolume.SizeBytes})
+			return voldriver.ErrorResponse{Err: fmt.Sprintf("Volume '%s' of %d bytes exceeds the tmpfs budget of this cell (%d of %d bytes allocated)", createRequest.Name, newVolume.SizeBytes, allocated, budget)}
+		}
+	}
+
+	return d.Volumes.Add(logger, createRequest.Name, newVolume, nil)
+}
+
+func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
+	return volume.SizeBytes == v.SizeBytes &&
+		volume.Mode == v.Mode &&
+		volume.Uid == v.Uid &&
+		volume.Gid == v.Gid &&
+		volume.LocalMountPoint == v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*volumeMetadata)
+	return ok && v.equals(volume)
+}
+
+func (v *volumeMetadata) MountPoint() string {
+	return v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Target() string {
+	return fmt.Sprintf("tmpfs:%d", v.SizeBytes)
+}
+
+func (v *volumeMetadata) Server() string {
+	return "localhost"
+}
+
+// allocatedBytes has to be called with budgetLock held.
+func (d *TmpfsLocalDriver) allocatedBytes() int64 {
+	var allocated int64
+	d.Each(func(name string, volume storage_mountutil.Volume, mountCount int) {
+		allocated += volume.(*volumeMetadata).SizeBytes
+	})
+	return allocated
+}
+
+func (d *TmpfsLocalDriver) Attach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	config := d.Config()
+
+	if err := d.os.MkdirAll(volume.LocalMountPoint, os.ModePerm); err != nil {
+		logger.Error("failed-create-mountdir", err)
+		return fmt.Errorf("unable to create local mount point")
+	}
+
+	mountOptions := []string{fmt.Sprintf("size=%d", volume.SizeBytes), "mode=" + volume.Mode}
+	if volume.Uid != "" {
+		mountOptions = append(mountOptions, "uid="+volume.Uid)
+	}
+	if volume.Gid != "" {
+		mountOptions = append(mountOptions, "gid="+volume.Gid)
+	}
+
+	cmdArgs := []string{"-t", "tmpfs", "-o", strings.Join(mountOptions, ","), "tmpfs", volume.LocalMountPoint}
+	return storage_mountutil.MountWithRetry(logger, d.userInvoker, config.MountRetry, "mount", cmdArgs)
+}
+
+// Detach discards the contents of the volume once its last consumer is gone.
+func (d *TmpfsLocalDriver) Detach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	if err := d.userInvoker.Invoke(logger, "umount", []string{volume.LocalMountPoint}); err != nil {
+		logger.Error("failed-invoking-umount", err)
+		return err
+	}
+
+	if err := d.os.Remove(volume.LocalMountPoint); err != nil {
+		logger.Error("failed-removing-mountpoint", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package storage_tmpfsdriver_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_config"
+	"../mountutil/mountutilfakes"
+	"../tmpfs"
+)
+
+var _ = Describe("TmpfsLocalDriver", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeInvoker *mountutilfakes.FakeInvoker
+		tempDir     string
+		driver      *storage_tmpfsdriver.TmpfsLocalDriver
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "tmpfs-driver")
+		Expect(err).NotTo(HaveOccurred())
+
+		logger = lagertest.NewTestLogger("tmpfs")
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		driver = storage_tmpfsdriver.NewTmpfsDriverWithInvoker(&osshim.OsShim{}, fakeInvoker, tempDir)
+
+		config := storage_config.DefaultConfig()
+		config.Tmpfs.BudgetBytes = 100 * 1024 * 1024
+		Expect(driver.Reload(logger, config)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	create := func(name, size string) voldriver.ErrorResponse {
+		return driver.Create(logger, voldriver.CreateRequest{Name: name, Opts: map[string]interface{}{"size": size}})
+	}
+
+	Context("#Create", func() {
+		It("requires a valid size", func() {
+			Expect(create("vol", "lots").Err).To(HavePrefix("Opts.size: "))
+		})
+
+		It("requires an octal mode", func() {
+			response := driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: map[string]interface{}{"size": "1m", "mode": "rwx"}})
+			Expect(response.Err).To(Equal("Opts.mode 'rwx' must be an octal file mode"))
+		})
+	})
+
+	Context("the budget", func() {
+		It("refuses a volume that does not fit the budget", func() {
+			Expect(create("first", "60m").Err).To(BeEmpty())
+
+			Expect(create("second", "50m").Err).To(Equal("Volume 'second' of 52428800 bytes exceeds the tmpfs budget of this cell (62914560 of 104857600 bytes allocated)"))
+			Expect(driver.List(logger).Volumes).To(HaveLen(1))
+		})
+
+		It("accepts a volume that fills the budget exactly", func() {
+			Expect(create("first", "60m").Err).To(BeEmpty())
+			Expect(create("second", "40m").Err).To(BeEmpty())
+		})
+
+		It("takes no budget for a duplicate create", func() {
+			Expect(create("vol", "60m").Err).To(BeEmpty())
+			Expect(create("vol", "60m").Err).To(BeEmpty())
+
+			Expect(create("other", "40m").Err).To(BeEmpty())
+		})
+
+		It("frees the budget of a removed volume", func() {
+			Expect(create("first", "60m").Err).To(BeEmpty())
+			Expect(create("second", "60m").Err).NotTo(BeEmpty())
+
+			Expect(driver.Remove(logger, voldriver.RemoveRequest{Name: "first"}).Err).To(BeEmpty())
+
+			Expect(create("second", "60m").Err).To(BeEmpty())
+		})
+
+		It("has no limit with a budget of zero", func() {
+			config := storage_config.DefaultConfig()
+			config.Tmpfs.BudgetBytes = 0
+			Expect(driver.Reload(logger, config)).To(Succeed())
+
+			Expect(create("huge", "1t").Err).To(BeEmpty())
+		})
+	})
+
+	Context("#Mount", func() {
+		It("mounts a tmpfs of the requested size and mode", func() {
+			response := driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: map[string]interface{}{"size": "1m", "mode": "0700", "uid": "1000"}})
+			Expect(response.Err).To(BeEmpty())
+
+			mountResponse := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(mountResponse.Err).To(BeEmpty())
+
+			_, executable, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(executable).To(Equal("mount"))
+			Expect(args).To(Equal([]string{"-t", "tmpfs", "-o", "size=1048576,mode=0700,uid=1000", "tmpfs", mountResponse.Mountpoint}))
+		})
+	})
+})
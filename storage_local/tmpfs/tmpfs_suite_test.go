@@ -0,0 +1,13 @@
+package storage_tmpfsdriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestTmpfsDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tmpfs Driver Suite")
+}
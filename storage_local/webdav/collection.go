@@ -0,0 +1,94 @@
+package storage_webdavdriver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// CollectionCheckTimeout bounds the request made before mounting a volume.
+const CollectionCheckTimeout = 10 * time.Second
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/></D:prop></D:propfind>`
+
+type multiStatus struct {
+	Responses []struct {
+		Collection []struct{} `xml:"propstat>prop>resourcetype>collection"`
+	} `xml:"response"`
+}
+
+// checkCollection asks the server for the resource type of the url with the
+// credentials and CA of the volume, so a wrong password, a missing collection
+// or an untrusted certificate are reported as such instead of a failing
+// mount.davfs.
+func (d *WebdavLocalDriver) checkCollection(logger lager.Logger, volume *volumeMetadata) error {
+	client, err := volume.httpClient()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PROPFIND", volume.Url, strings.NewReader(propfindBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	if volume.Username != "" {
+		req.SetBasicAuth(volume.Username, volume.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Error("failed-checking-collection", err)
+		return fmt.Errorf("webdav url '%s' cannot be reached (%s)", volume.Url, err.Error())
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		logger.Info("credentials-refused", lager.Data{"url": volume.Url, "status": resp.StatusCode})
+		return fmt.Errorf("webdav url '%s' refused the credentials (%s)", volume.Url, resp.Status)
+	default:
+		logger.Info("collection-check-failed", lager.Data{"url": volume.Url, "status": resp.StatusCode})
+		return fmt.Errorf("webdav url '%s' is not a collection (%s)", volume.Url, resp.Status)
+	}
+
+	var status multiStatus
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&status); err != nil {
+		return fmt.Errorf("webdav url '%s' answered with an invalid multistatus (%s)", volume.Url, err.Error())
+	}
+	if len(status.Responses) == 0 || len(status.Responses[0].Collection) == 0 {
+		return fmt.Errorf("webdav url '%s' is not a collection", volume.Url)
+	}
+	return nil
+}
+
+// httpClient trusts the CA of the volume besides the system roots, like
+// davfs2 does with trust_ca_cert.
+func (v *volumeMetadata) httpClient() (*http.Client, error) {
+	client := &http.Client{Timeout: CollectionCheckTimeout}
+	if v.CaCert == "" {
+		return client, nil
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM([]byte(v.CaCert)) {
+		return nil, fmt.Errorf("Opts.ca_cert must be a PEM encoded certificate")
+	}
+	client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}
+	return client, nil
+}
@@ -0,0 +1,259 @@
+package storage_webdavdriver
+
+import (
+	"encoding/pem"
+	"net/url"
+	"os"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+
+	"fmt"
+	"strconv"
+	"strings"
+
+	"../../storage_config"
+	"../mountutil"
+)
+
+const (
+	Name = "webdav"
+)
+
+// SecretOpts are redacted from logs and the audit log.
+var SecretOpts = []string{"password"}
+
+var secretExtensions = []string{".conf", ".secrets", ".ca.pem"}
+
+type WebdavLocalDriver struct {
+	secretsDir    string
+	userInvoker   storage_mountutil.Invoker
+	os            osshim.Os
+	useSystemUtil ioutilshim.Ioutil
+
+	*storage_mountutil.Volumes
+	*storage_config.Holder
+}
+
+type volumeMetadata struct {
+	Url             string
+	Username        string
+	Password        string `json:"-"`
+	CaCert          string
+	Uid             string
+	Gid             string
+	LocalMountPoint string
+}
+
+func NewWebdavLocalDriver(secretsDir string) *WebdavLocalDriver {
+	return NewWebdavDriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, storage_mountutil.NewRealInvoker(), secretsDir)
+}
+
+func NewWebdavDriverWithSystemUtilAndInvoker(ioutil ioutilshim.Ioutil, os osshim.Os, invoker storage_mountutil.Invoker, secretsDir string) *WebdavLocalDriver {
+	d := &WebdavLocalDriver{
+		secretsDir:    secretsDir,
+		userInvoker:   invoker,
+		os:            os,
+		useSystemUtil: ioutil,
+		Holder:        storage_config.NewHolder(SecretOpts...),
+	}
+	d.Volumes = storage_mountutil.NewVolumes(Name, d)
+	return d
+}
+
+func (d *WebdavLocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	return voldriver.ActivateResponse{
+		Implements: []string{"VolumeDriver"},
+	}
+}
+
+func (d *WebdavLocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{
+		Capabilities: voldriver.CapabilityInfo{Scope: "global"},
+	}
+}
+
+func (d *WebdavLocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	logger = logger.Session("create", lager.Data{"request": d.Redactor().CreateRequest(createRequest)})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if createRequest.Name == "" {
+		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_name'"}
+	}
+
+	newVolume := &volumeMetadata{}
+	var err *voldriver.ErrorResponse
+
+	if newVolume.Url, err = storage_mountutil.ExtractValue(logger, "url", createRequest.Opts); err != nil {
+		return *err
+	}
+	if target, parseErr := url.Parse(newVolume.Url); parseErr != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.url '%s' must be an http or https url", newVolume.Url)}
+	}
+	if newVolume.Username, err = storage_mountutil.ExtractOptionalValue(logger, "username", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.Password, err = storage_mountutil.ExtractOptionalValue(logger, "password", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.CaCert, err = storage_mountutil.ExtractOptionalValue(logger, "ca_cert", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.CaCert != "" {
+		if !strings.HasPrefix(newVolume.Url, "https:") {
+			return voldriver.ErrorResponse{Err: "Opts.ca_cert requires an https url"}
+		}
+		if block, _ := pem.Decode([]byte(newVolume.CaCert)); block == nil || block.Type != "CERTIFICATE" {
+			return voldriver.ErrorResponse{Err: "Opts.ca_cert must be a PEM encoded certificate"}
+		}
+	}
+	if newVolume.Uid, err = storage_mountutil.ExtractOptionalValue(logger, "uid", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	if newVolume.Gid, err = storage_mountutil.ExtractOptionalValue(logger, "gid", createRequest.Opts, ""); err != nil {
+		return *err
+	}
+	for _, id := range []string{newVolume.Uid, newVolume.Gid} {
+		if _, convErr := strconv.ParseUint(id, 10, 32); id != "" && convErr != nil {
+			return voldriver.ErrorResponse{Err: fmt.Sprintf("Opts.uid and Opts.gid must be numeric ids, got '%s'", id)}
+		}
+	}
+	if newVolume.LocalMountPoint, err = storage_mountutil.ExtractValue(logger, "localmountpoint", createRequest.Opts); err != nil {
+		return *err
+	}
+	for _, value := range []string{newVolume.Url, newVolume.Username, newVolume.Password, newVolume.LocalMountPoint} {
+		if strings.ContainsAny(value, "\n") {
+			return voldriver.ErrorResponse{Err: "Opts.url, Opts.username, Opts.password and Opts.localmountpoint must not contain newlines"}
+		}
+	}
+	if strings.ContainsAny(newVolume.Url, " ,") {
+		return voldriver.ErrorResponse{Err: "Opts.url must not contain whitespace or ','"}
+	}
+
+	return d.Volumes.Add(logger, createRequest.Name, newVolume, nil)
+}
+
+func (v *volumeMetadata) equals(volume *volumeMetadata) bool {
+	return volume.Url == v.Url &&
+		volume.Username == v.Username &&
+		volume.Password == v.Password &&
+		volume.CaCert == v.CaCert &&
+		volume.Uid == v.Uid &&
+		volume.Gid == v.Gid &&
+		volume.LocalMountPoint == v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Equals(other storage_mountutil.Volume) bool {
+	volume, ok := other.(*volumeMetadata)
+	return ok && v.equals(volume)
+}
+
+func (v *volumeMetadata) MountPoint() string {
+	return v.LocalMountPoint
+}
+
+func (v *volumeMetadata) Target() string {
+	return v.Url
+}
+
+func (v *volumeMetadata) Server() string {
+	target, err := url.Parse(v.Url)
+	if err != nil {
+		return v.Url
+	}
+	return target.Host
+}
+
+// quote escapes a value for the davfs2 secrets and config files.
+func quote(value string) string {
+	return `"` + strings.Replace(strings.Replace(value, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func (d *WebdavLocalDriver) Attach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+	config := d.Config()
+
+	if err := d.os.MkdirAll(volume.LocalMountPoint, os.ModePerm); err != nil {
+		logger.Error("failed-create-mountdir", err)
+		return fmt.Errorf("unable to create local mount point")
+	}
+
+	if err := d.checkCollection(logger, volume); err != nil {
+		return err
+	}
+
+	confFile, err := d.writeSecrets(volumeName, volume)
+	if err != nil {
+		logger.Error("failed-writing-secrets", err)
+		d.removeSecrets(logger, volumeName)
+		return err
+	}
+
+	mountOptions := []string{"conf=" + confFile}
+	if volume.Uid != "" {
+		mountOptions = append(mountOptions, "uid="+volume.Uid)
+	}
+	if volume.Gid != "" {
+		mountOptions = append(mountOptions, "gid="+volume.Gid)
+	}
+
+	cmdArgs := []string{"-t", "davfs", "-o", strings.Join(mountOptions, ","), volume.Url, volume.LocalMountPoint}
+	if err := storage_mountutil.MountWithRetry(logger, d.userInvoker, config.MountRetry, "mount", cmdArgs); err != nil {
+		d.removeSecrets(logger, volumeName)
+		return err
+	}
+	return nil
+}
+
+func (d *WebdavLocalDriver) Detach(logger lager.Logger, volumeName string, mountable storage_mountutil.Volume) error {
+	volume := mountable.(*volumeMetadata)
+
+	// umount.davfs waits until the cached changes are uploaded
+	if err := d.userInvoker.Invoke(logger, "umount", []string{volume.LocalMountPoint}); err != nil {
+		logger.Error("failed-invoking-umount", err)
+		return err
+	}
+
+	d.removeSecrets(logger, volumeName)
+	if err := d.os.Remove(volume.LocalMountPoint); err != nil {
+		logger.Error("failed-removing-mountpoint", err)
+	}
+	return nil
+}
+
+// writeSecrets writes the per volume davfs2 config together with the secrets
+// and CA files it points to, and returns the path of the config. They stay on
+// disk while the volume is mounted.
+func (d *WebdavLocalDriver) writeSecrets(volumeName string, volume *volumeMetadata) (string, error) {
+	confFile := storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".conf")
+	secretsFile := storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".secrets")
+	caFile := storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, ".ca.pem")
+
+	conf := fmt.Sprintf("secrets %s\n", quote(secretsFile))
+	if volume.CaCert != "" {
+		if err := storage_mountutil.WriteSecretFile(d.useSystemUtil, d.os, caFile, []byte(volume.CaCert)); err != nil {
+			return "", err
+		}
+		conf += fmt.Sprintf("trust_ca_cert %s\n", quote(caFile))
+	}
+
+	secrets := fmt.Sprintf("%s %s %s\n", quote(volume.LocalMountPoint), quote(volume.Username), quote(volume.Password))
+	if err := storage_mountutil.WriteSecretFile(d.useSystemUtil, d.os, secretsFile, []byte(secrets)); err != nil {
+		return "", err
+	}
+	if err := storage_mountutil.WriteSecretFile(d.useSystemUtil, d.os, confFile, []byte(conf)); err != nil {
+		return "", err
+	}
+	return confFile, nil
+}
+
+func (d *WebdavLocalDriver) removeSecrets(logger lager.Logger, volumeName string) {
+	for _, extension := range secretExtensions {
+		if err := storage_mountutil.RemoveSecretFile(d.os, storage_mountutil.VolumeFilePath(d.secretsDir, volumeName, extension)); err != nil {
+			logger.Error("failed-removing-secret-file", err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package storage_webdavdriver_test
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/goshims/ioutil"
+	osshim "code.cloudfoundry.org/goshims/os"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../../storage_config"
+	"../mountutil/mountutilfakes"
+	"../webdav"
+)
+
+const password = "w3bd4vp4ssw0rd"
+
+var _ = Describe("WebdavLocalDriver", func() {
+	var (
+		logger      *lagertest.TestLogger
+		fakeInvoker *mountutilfakes.FakeInvoker
+		tempDir     string
+		davRoot     string
+		davServer   *httptest.Server
+		davUrl      string
+		mountPoint  string
+		config      storage_config.Config
+		driver      *storage_webdavdriver.WebdavLocalDriver
+		opts        map[string]interface{}
+	)
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "webdav-driver")
+		Expect(err).NotTo(HaveOccurred())
+		mountPoint = filepath.Join(tempDir, "mounts", "vol")
+
+		davRoot = filepath.Join(tempDir, "dav-root")
+		Expect(os.MkdirAll(filepath.Join(davRoot, "dav"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(davRoot, "dav", "readme.txt"), []byte("hello"), 0644)).To(Succeed())
+		davServer = newWebdavServer(davRoot, "alice", password, false)
+		davUrl = davServer.URL + "/dav"
+
+		logger = lagertest.NewTestLogger("webdav")
+		fakeInvoker = &mountutilfakes.FakeInvoker{}
+		driver = storage_webdavdriver.NewWebdavDriverWithSystemUtilAndInvoker(&ioutilshim.IoutilShim{}, &osshim.OsShim{}, fakeInvoker, filepath.Join(tempDir, "secrets"))
+
+		// the password is redacted even when sensitive_opts does not name it
+		config = storage_config.DefaultConfig()
+		config.MountRetry.Interval = 0
+		config.SensitiveOpts = []string{}
+		Expect(driver.Reload(logger, config)).To(Succeed())
+
+		opts = map[string]interface{}{
+			"url":             davUrl,
+			"username":        "alice",
+			"password":        password,
+			"uid":             "1000",
+			"localmountpoint": mountPoint,
+		}
+	})
+
+	AfterEach(func() {
+		davServer.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	create := func() voldriver.ErrorResponse {
+		return driver.Create(logger, voldriver.CreateRequest{Name: "vol", Opts: opts})
+	}
+
+	secretFiles := func() []os.FileInfo {
+		files, err := ioutil.ReadDir(filepath.Join(tempDir, "secrets"))
+		Expect(err).NotTo(HaveOccurred())
+		return files
+	}
+
+	It("declares the password as secret", func() {
+		Expect(driver.SecretOpts()).To(ConsistOf("password"))
+	})
+
+	Context("#Create", func() {
+		It("requires numeric ids", func() {
+			opts["uid"] = "vcap"
+			Expect(create().Err).To(Equal("Opts.uid and Opts.gid must be numeric ids, got 'vcap'"))
+		})
+	})
+
+	Context("#Mount", func() {
+		BeforeEach(func() {
+			Expect(create().Err).To(BeEmpty())
+		})
+
+		It("passes the credentials in a davfs2 secrets file and never logs them", func() {
+			var secrets string
+			fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+				for _, option := range strings.Split(args[3], ",") {
+					if strings.HasPrefix(option, "conf=") {
+						conf, err := ioutil.ReadFile(strings.TrimPrefix(option, "conf="))
+						Expect(err).NotTo(HaveOccurred())
+						secretsFile := strings.Trim(strings.TrimSpace(strings.TrimPrefix(string(conf), "secrets ")), `"`)
+						data, err := ioutil.ReadFile(secretsFile)
+						Expect(err).NotTo(HaveOccurred())
+						secrets = string(data)
+					}
+				}
+				return nil
+			}
+
+			response := driver.Mount(logger, voldriver.MountRequest{Name: "vol"})
+			Expect(response.Err).To(BeEmpty())
+			Expect(response.Mountpoint).To(Equal(mountPoint))
+
+			_, executable, args := fakeInvoker.InvokeArgsForCall(0)
+			Expect(executable).To(Equal("mount"))
+			Expect(args[0:2]).To(Equal([]string{"-t", "davfs"}))
+			Expect(args[3]).To(ContainSubstring("uid=1000"))
+			Expect(args[4:]).To(Equal([]string{davUrl, mountPoint}))
+			Expect(strings.Join(args, " ")).NotTo(ContainSubstring(password))
+			Expect(secrets).To(Equal(`"` + mountPoint + `" "alice" "` + password + `"` + "\n"))
+
+			Expect(string(logger.Buffer().Contents())).NotTo(ContainSubstring(password))
+		})
+
+		It("removes the secrets after unmounting", func() {
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(secretFiles()).To(HaveLen(2))
+
+			Expect(driver.Unmount(logger, voldriver.UnmountRequest{Name: "vol"}).Err).To(BeEmpty())
+			Expect(secretFiles()).To(BeEmpty())
+		})
+
+		It("removes the secrets when the mount fails", func() {
+			fakeInvoker.InvokeReturns(errors.New("401 Unauthorized"))
+
+			Expect(driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err).To(Equal("Error mounting 'vol' (401 Unauthorized)"))
+			Expect(secretFiles()).To(BeEmpty())
+		})
+	})
+
+	Context("against a local webdav server", func() {
+		mount := func() string {
+			Expect(create().Err).To(BeEmpty())
+			return driver.Mount(logger, voldriver.MountRequest{Name: "vol"}).Err
+		}
+
+		It("mounts a collection the credentials can read", func() {
+			Expect(mount()).To(BeEmpty())
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(1))
+		})
+
+		It("reports a wrong password without running mount.davfs", func() {
+			opts["password"] = "not-the-password"
+
+			Expect(mount()).To(Equal("Error mounting 'vol' (webdav url '" + davUrl + "' refused the credentials (401 Unauthorized))"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+			Expect(filepath.Join(tempDir, "secrets")).NotTo(BeADirectory())
+		})
+
+		It("reports a missing collection", func() {
+			opts["url"] = davServer.URL + "/missing"
+
+			Expect(mount()).To(Equal("Error mounting 'vol' (webdav url '" + davServer.URL + "/missing' is not a collection (404 Not Found))"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+		})
+
+		It("reports a file", func() {
+			opts["url"] = davUrl + "/readme.txt"
+
+			Expect(mount()).To(Equal("Error mounting 'vol' (webdav url '" + davUrl + "/readme.txt' is not a collection)"))
+			Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+		})
+
+		Context("over https with a custom CA", func() {
+			var tlsServer *httptest.Server
+
+			BeforeEach(func() {
+				tlsServer = newWebdavServer(davRoot, "alice", password, true)
+				opts["url"] = tlsServer.URL + "/dav"
+				opts["ca_cert"] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw}))
+			})
+
+			AfterEach(func() {
+				tlsServer.Close()
+			})
+
+			It("trusts the CA and hands it to davfs2", func() {
+				var conf string
+				fakeInvoker.InvokeStub = func(_ lager.Logger, executable string, args []string) error {
+					data, err := ioutil.ReadFile(strings.TrimPrefix(strings.Split(args[3], ",")[0], "conf="))
+					Expect(err).NotTo(HaveOccurred())
+					conf = string(data)
+					return nil
+				}
+
+				Expect(mount()).To(BeEmpty())
+				Expect(conf).To(ContainSubstring("trust_ca_cert "))
+			})
+
+			It("refuses the server without the CA", func() {
+				delete(opts, "ca_cert")
+
+				Expect(mount()).To(ContainSubstring("webdav url '" + tlsServer.URL + "/dav' cannot be reached"))
+				Expect(fakeInvoker.InvokeCallCount()).To(Equal(0))
+			})
+		})
+	})
+})
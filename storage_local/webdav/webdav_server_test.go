@@ -0,0 +1,32 @@
+package storage_webdavdriver_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"golang.org/x/net/webdav"
+)
+
+// newWebdavServer serves dir with the webdav handler of golang.org/x/net to
+// clients sending username and password, over https if secure is set.
+func newWebdavServer(dir, username, password string, secure bool) *httptest.Server {
+	handler := &webdav.Handler{
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	authenticated := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, pass, ok := req.BasicAuth()
+		if !ok || user != username || pass != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="webdav"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+
+	if secure {
+		return httptest.NewTLSServer(authenticated)
+	}
+	return httptest.NewServer(authenticated)
+}
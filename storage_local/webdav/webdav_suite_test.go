@@ -0,0 +1,13 @@
+package storage_webdavdriver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestWebdavDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Webdav Driver Suite")
+}
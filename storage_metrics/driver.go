@@ -0,0 +1,161 @@
+package storage_metrics
+
+import (
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/voldriver"
+)
+
+const (
+	OperationsMetric = "storage_driver_operations_total"
+	DurationMetric   = "storage_driver_operation_duration_seconds"
+	VolumesMetric    = "storage_driver_volumes"
+	HostMountsMetric = "storage_driver_host_mount_count"
+)
+
+type VolumeStat struct {
+	Name       string
+	Host       string
+	MountCount int
+}
+
+// VolumeReporter is implemented by backends that can describe the volumes they
+// currently know about.
+type VolumeReporter interface {
+	VolumeStats() []VolumeStat
+}
+
+type metricsDriver struct {
+	name     string
+	driver   voldriver.Driver
+	registry *Registry
+}
+
+// NewMetricsDriver wraps driver so that every call is counted and timed in
+// registry. If driver is a VolumeReporter its volumes are reported as gauges.
+func NewMetricsDriver(name string, driver voldriver.Driver, registry *Registry) voldriver.Driver {
+	if reporter, ok := driver.(VolumeReporter); ok {
+		registry.Register(&volumeCollector{name: name, reporter: reporter})
+	}
+
+	return &metricsDriver{
+		name:     name,
+		driver:   driver,
+		registry: registry,
+	}
+}
+
+func (d *metricsDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
+	start := time.Now()
+	response := d.driver.Activate(logger)
+	d.observe("activate", start, response.Err)
+	return response
+}
+
+func (d *metricsDriver) Get(logger lager.Logger, getRequest voldriver.GetRequest) voldriver.GetResponse {
+	start := time.Now()
+	response := d.driver.Get(logger, getRequest)
+	d.observe("get", start, response.Err)
+	return response
+}
+
+func (d *metricsDriver) List(logger lager.Logger) voldriver.ListResponse {
+	start := time.Now()
+	response := d.driver.List(logger)
+	d.observe("list", start, response.Err)
+	return response
+}
+
+func (d *metricsDriver) Mount(logger lager.Logger, mountRequest voldriver.MountRequest) voldriver.MountResponse {
+	start := time.Now()
+	response := d.driver.Mount(logger, mountRequest)
+	d.observe("mount", start, response.Err)
+	return response
+}
+
+func (d *metricsDriver) Path(logger lager.Logger, pathRequest voldriver.PathRequest) voldriver.PathResponse {
+	start := time.Now()
+	response := d.driver.Path(logger, pathRequest)
+	d.observe("path", start, response.Err)
+	return response
+}
+
+func (d *metricsDriver) Unmount(logger lager.Logger, unmountRequest voldriver.UnmountRequest) voldriver.ErrorResponse {
+	start := time.Now()
+	response := d.driver.Unmount(logger, unmountRequest)
+	d.observe("unmount", start, response.Err)
+	return response
+}
+
+func (d *metricsDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	start := time.Now()
+	response := d.driver.Capabilities(logger)
+	d.observe("capabilities", start, "")
+	return response
+}
+
+func (d *metricsDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
+	start := time.Now()
+	response := d.driver.Create(logger, createRequest)
+	d.observe("create", start, response.Err)
+	return response
+}
+
+func (d *metricsDriver) Remove(logger lager.Logger, removeRequest voldriver.RemoveRequest) voldriver.ErrorResponse {
+	start := time.Now()
+	response := d.driver.Remove(logger, removeRequest)
+	d.observe("remove", start, response.Err)
+	return response
+}
+
+func (d *metricsDriver) observe(operation string, start time.Time, err string) {
+	outcome := "success"
+	if err != "" {
+		outcome = "failure"
+	}
+
+	labels := map[string]string{"driver": d.name, "operation": operation, "outcome": outcome}
+	d.registry.IncCounter(OperationsMetric, "Number of driver operations.", labels)
+	d.registry.ObserveDuration(DurationMetric, "Duration of driver operations in seconds.", labels, time.Since(start))
+}
+
+type volumeCollector struct {
+	name     string
+	reporter VolumeReporter
+}
+
+func (c *volumeCollector) Collect() []Gauge {
+	known, mounted := 0, 0
+	hostMounts := map[string]int{}
+
+	for _, stat := range c.reporter.VolumeStats() {
+		known++
+		if stat.MountCount > 0 {
+			mounted++
+		}
+		hostMounts[stat.Host] += stat.MountCount
+	}
+
+	gauges := []Gauge{
+		{Name: VolumesMetric, Help: "Number of volumes known to the driver.", Labels: map[string]string{"driver": c.name, "state": "known"}, Value: float64(known)},
+		{Name: VolumesMetric, Help: "Number of volumes known to the driver.", Labels: map[string]string{"driver": c.name, "state": "mounted"}, Value: float64(mounted)},
+	}
+	hosts := []string{}
+	for host := range hostMounts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		gauges = append(gauges, Gauge{
+			Name:   HostMountsMetric,
+			Help:   "Sum of mount counts of the volumes served by a backend host.",
+			Labels: map[string]string{"driver": c.name, "host": host},
+			Value:  float64(hostMounts[host]),
+		})
+	}
+	return gauges
+}
+
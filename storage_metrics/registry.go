@@ -0,0 +1,221 @@
+package storage_metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// labelValueEscaper escapes label values the way the Prometheus text format
+// does, Go quoting would also escape tabs and non-ASCII characters.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Registry keeps counters and histograms in memory and renders them, together
+// with the gauges reported by its collectors, in the Prometheus text format.
+type Registry struct {
+	lock       sync.Mutex
+	counters   map[string]*counterFamily
+	histograms map[string]*histogramFamily
+	collectors []Collector
+}
+
+type Gauge struct {
+	Name   string
+	Help   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Collector reports gauges that are computed when the metrics are scraped.
+type Collector interface {
+	Collect() []Gauge
+}
+
+type counterFamily struct {
+	help   string
+	values map[string]float64
+}
+
+type histogramFamily struct {
+	help    string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   map[string]*counterFamily{},
+		histograms: map[string]*histogramFamily{},
+	}
+}
+
+func (r *Registry) Register(collector Collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collectors = append(r.collectors, collector)
+}
+
+func (r *Registry) IncCounter(name, help string, labels map[string]string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	family, ok := r.counters[name]
+	if !ok {
+		family = &counterFamily{help: help, values: map[string]float64{}}
+		r.counters[name] = family
+	}
+	family.values[formatLabels(labels)]++
+}
+
+func (r *Registry) ObserveDuration(name, help string, labels map[string]string, duration time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	family, ok := r.histograms[name]
+	if !ok {
+		family = &histogramFamily{help: help, buckets: DefaultBuckets, series: map[string]*histogramSeries{}}
+		r.histograms[name] = family
+	}
+
+	key := formatLabels(labels)
+	series, ok := family.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(family.buckets))}
+		family.series[key] = series
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range family.buckets {
+		if seconds <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += seconds
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	collectors := append([]Collector{}, r.collectors...)
+	r.lock.Unlock()
+
+	// collectors are called without holding the registry lock, they may take
+	// locks of their own
+	gauges := map[string][]Gauge{}
+	for _, collector := range collectors {
+		for _, gauge := range collector.Collect() {
+			gauges[gauge.Name] = append(gauges[gauge.Name], gauge)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	buffer := &bytes.Buffer{}
+
+	for _, name := range sortedKeys(r.counters) {
+		family := r.counters[name]
+		fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s counter\n", name, family.help, name)
+		for _, labels := range sortedKeys(family.values) {
+			fmt.Fprintf(buffer, "%s%s %v\n", name, labels, family.values[labels])
+		}
+	}
+
+	for _, name := range sortedKeys(r.histograms) {
+		family := r.histograms[name]
+		fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s histogram\n", name, family.help, name)
+		for _, labels := range sortedKeys(family.series) {
+			series := family.series[labels]
+			for i, bound := range family.buckets {
+				fmt.Fprintf(buffer, "%s_bucket%s %d\n", name, withLabel(labels, "le", fmt.Sprintf("%v", bound)), series.counts[i])
+			}
+			fmt.Fprintf(buffer, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), series.count)
+			fmt.Fprintf(buffer, "%s_sum%s %v\n", name, labels, series.sum)
+			fmt.Fprintf(buffer, "%s_count%s %d\n", name, labels, series.count)
+		}
+	}
+
+	for _, name := range sortedKeys(gauges) {
+		family := gauges[name]
+		fmt.Fprintf(buffer, "# HELP %s %s\n# TYPE %s gauge\n", name, family[0].Help, name)
+		for _, gauge := range family {
+			fmt.Fprintf(buffer, "%s%s %v\n", name, formatLabels(gauge.Labels), gauge.Value)
+		}
+	}
+
+	return buffer.WriteTo(w)
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := []string{}
+	for _, name := range sortedKeys(labels) {
+		pairs = append(pairs, formatLabel(name, labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatLabel(name, value string) string {
+	return name + `="` + labelValueEscaper.Replace(value) + `"`
+}
+
+func withLabel(labels, name, value string) string {
+	pair := formatLabel(name, value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + pair + "}"
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch values := m.(type) {
+	case map[string]*counterFamily:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramFamily:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramSeries:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]float64:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]string:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string][]Gauge:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,79 @@
+package storage_metrics_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_metrics"
+)
+
+type gauges []storage_metrics.Gauge
+
+func (g gauges) Collect() []storage_metrics.Gauge {
+	return g
+}
+
+const golden = `# HELP storage_driver_requests_total Requests by method and outcome.
+# TYPE storage_driver_requests_total counter
+storage_driver_requests_total{method="mount",outcome="error"} 1
+storage_driver_requests_total{method="mount",outcome="ok"} 2
+# HELP storage_driver_request_duration_seconds Request duration.
+# TYPE storage_driver_request_duration_seconds histogram
+storage_driver_request_duration_seconds_bucket{method="mount",le="0.01"} 0
+storage_driver_request_duration_seconds_bucket{method="mount",le="0.05"} 0
+storage_driver_request_duration_seconds_bucket{method="mount",le="0.1"} 0
+storage_driver_request_duration_seconds_bucket{method="mount",le="0.25"} 1
+storage_driver_request_duration_seconds_bucket{method="mount",le="0.5"} 1
+storage_driver_request_duration_seconds_bucket{method="mount",le="1"} 1
+storage_driver_request_duration_seconds_bucket{method="mount",le="2.5"} 2
+storage_driver_request_duration_seconds_bucket{method="mount",le="5"} 2
+storage_driver_request_duration_seconds_bucket{method="mount",le="10"} 2
+storage_driver_request_duration_seconds_bucket{method="mount",le="30"} 2
+storage_driver_request_duration_seconds_bucket{method="mount",le="60"} 2
+storage_driver_request_duration_seconds_bucket{method="mount",le="+Inf"} 2
+storage_driver_request_duration_seconds_sum{method="mount"} 2.25
+storage_driver_request_duration_seconds_count{method="mount"} 2
+# HELP storage_driver_volume_mounts Consumers of a volume.
+# TYPE storage_driver_volume_mounts gauge
+storage_driver_volume_mounts{volume="plain"} 3
+storage_driver_volume_mounts{volume="back\\slash \"quoted\"\nnext line	tab ünicode"} 1
+`
+
+var _ = Describe("Registry", func() {
+	var registry *storage_metrics.Registry
+
+	BeforeEach(func() {
+		registry = storage_metrics.NewRegistry()
+
+		registry.IncCounter("storage_driver_requests_total", "Requests by method and outcome.", map[string]string{"outcome": "ok", "method": "mount"})
+		registry.IncCounter("storage_driver_requests_total", "Requests by method and outcome.", map[string]string{"outcome": "error", "method": "mount"})
+		registry.IncCounter("storage_driver_requests_total", "Requests by method and outcome.", map[string]string{"outcome": "ok", "method": "mount"})
+
+		registry.ObserveDuration("storage_driver_request_duration_seconds", "Request duration.", map[string]string{"method": "mount"}, 250*time.Millisecond)
+		registry.ObserveDuration("storage_driver_request_duration_seconds", "Request duration.", map[string]string{"method": "mount"}, 2*time.Second)
+
+		registry.Register(gauges{
+			{Name: "storage_driver_volume_mounts", Help: "Consumers of a volume.", Labels: map[string]string{"volume": "plain"}, Value: 3},
+			{Name: "storage_driver_volume_mounts", Help: "Consumers of a volume.", Labels: map[string]string{"volume": "back\\slash \"quoted\"\nnext line\ttab ünicode"}, Value: 1},
+		})
+	})
+
+	It("renders the Prometheus text format", func() {
+		buffer := &bytes.Buffer{}
+		_, err := registry.WriteTo(buffer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(buffer.String()).To(Equal(golden))
+	})
+
+	It("serves the text format with its content type", func() {
+		recorder := httptest.NewRecorder()
+		registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("text/plain; version=0.0.4"))
+		Expect(recorder.Body.String()).To(Equal(golden))
+	})
+})
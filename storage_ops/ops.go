@@ -0,0 +1,62 @@
+// Package storage_ops holds what the admin api can do with a backend beyond
+// the driver contract. Backends implement the interfaces they support, the
+// admin api finds them by type assertion.
+package storage_ops
+
+import (
+	"errors"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+
+	"../storage_config"
+)
+
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+type Snapshot struct {
+	Name      string    `json:"name"`
+	Volume    string    `json:"volume"`
+	CreatedAt time.Time `json:"created_at"`
+	// Mounted tells that the volume was in use while it was copied, so the
+	// snapshot is only as consistent as a crash would have left the volume.
+	Mounted bool `json:"mounted"`
+}
+
+// Snapshotter is implemented by backends that keep point in time copies of
+// their volumes. Snapshots outlive the volume they were taken of.
+type Snapshotter interface {
+	Snapshot(logger lager.Logger, volumeName, snapshotName string) (Snapshot, error)
+	// Restore replaces the contents of an unmounted volume with a snapshot.
+	Restore(logger lager.Logger, volumeName, snapshotName string) error
+	// Snapshots lists the snapshots of a volume, or all of them for "".
+	Snapshots(logger lager.Logger, volumeName string) ([]Snapshot, error)
+	DeleteSnapshot(logger lager.Logger, snapshotName string) error
+}
+
+// LayerManager is implemented by backends whose volumes keep their own
+// changes apart from a shared base.
+type LayerManager interface {
+	// Discard drops all changes an unmounted volume made to its base.
+	Discard(logger lager.Logger, volumeName string) error
+	// Commit stores the merged view of an unmounted volume as a new base, which
+	// new volumes can name as their base, and returns its path.
+	Commit(logger lager.Logger, volumeName, baseName string) (string, error)
+}
+
+// Faults are injected into the calls of a backend.
+type Faults struct {
+	// FailMounts is the number of upcoming first mounts that fail.
+	FailMounts int `json:"fail_mounts"`
+	// Latency is added to every call.
+	Latency storage_config.Duration `json:"latency"`
+	// Stale makes mounted volumes behave like mounts of a restarted nfs server.
+	Stale bool `json:"stale"`
+}
+
+// FaultInjector is implemented by backends whose calls can be made to fail on
+// purpose, to test platform integrations.
+type FaultInjector interface {
+	Faults() Faults
+	SetFaults(logger lager.Logger, faults Faults) error
+}
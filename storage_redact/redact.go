@@ -0,0 +1,104 @@
+package storage_redact
+
+import (
+	"strings"
+
+	"code.cloudfoundry.org/voldriver"
+)
+
+const Redacted = "[REDACTED]"
+
+var DefaultSensitiveOpts = []string{"passcode", "password", "keytab", "secret"}
+
+// Redactor hides the values of Opts whose key contains one of the configured
+// sensitive names before requests are logged or recorded. A Redactor is never
+// modified once created, so it can be shared between goroutines.
+type Redactor struct {
+	keys []string
+}
+
+func NewRedactor(keys []string) *Redactor {
+	lowered := []string{}
+	for _, key := range keys {
+		if key != "" {
+			lowered = append(lowered, strings.ToLower(key))
+		}
+	}
+	return &Redactor{keys: lowered}
+}
+
+// With returns a Redactor that also hides the values of keys.
+func (r *Redactor) With(keys ...string) *Redactor {
+	return NewRedactor(append(append([]string{}, r.keys...), keys...))
+}
+
+func (r *Redactor) IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range r.keys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// Opts returns a copy of opts with sensitive values replaced. String values are
+// also scanned as comma separated mount options, so "username=u,password=p"
+// becomes "username=u,password=[REDACTED]", and maps and lists, as json
+// decodes nested objects and arrays, are redacted the same way.
+func (r *Redactor) Opts(opts map[string]interface{}) map[string]interface{} {
+	if opts == nil {
+		return nil
+	}
+
+	safe := map[string]interface{}{}
+	for key, value := range opts {
+		if r.IsSensitive(key) {
+			safe[key] = Redacted
+		} else {
+			safe[key] = r.value(value)
+		}
+	}
+	return safe
+}
+
+func (r *Redactor) value(value interface{}) interface{} {
+	switch value := value.(type) {
+	case string:
+		return r.OptionString(value)
+	case map[string]interface{}:
+		return r.Opts(value)
+	case []interface{}:
+		safe := make([]interface{}, len(value))
+		for i, element := range value {
+			safe[i] = r.value(element)
+		}
+		return safe
+	default:
+		return value
+	}
+}
+
+func (r *Redactor) OptionString(options string) string {
+	if !strings.Contains(options, "=") {
+		return options
+	}
+
+	parts := strings.Split(options, ",")
+	for i, part := range parts {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) == 2 && r.IsSensitive(strings.TrimSpace(pair[0])) {
+			parts[i] = pair[0] + "=" + Redacted
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *Redactor) CreateRequest(request voldriver.CreateRequest) voldriver.CreateRequest {
+	return voldriver.CreateRequest{Name: request.Name, Opts: r.Opts(request.Opts)}
+}
+
+func (r *Redactor) MountRequest(request voldriver.MountRequest) voldriver.MountRequest {
+	return voldriver.MountRequest{Name: request.Name, Opts: r.Opts(request.Opts)}
+}
+
@@ -0,0 +1,102 @@
+package storage_redact_test
+
+import (
+	"code.cloudfoundry.org/voldriver"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"../storage_redact"
+)
+
+var _ = Describe("Redactor", func() {
+	var redactor *storage_redact.Redactor
+
+	BeforeEach(func() {
+		redactor = storage_redact.NewRedactor(storage_redact.DefaultSensitiveOpts)
+	})
+
+	Context("IsSensitive", func() {
+		It("matches keys containing a sensitive name, whatever their case", func() {
+			Expect(redactor.IsSensitive("password")).To(BeTrue())
+			Expect(redactor.IsSensitive("DB_PASSWORD")).To(BeTrue())
+			Expect(redactor.IsSensitive("secret_access_key")).To(BeTrue())
+			Expect(redactor.IsSensitive("username")).To(BeFalse())
+		})
+
+		It("ignores empty names, which would match every key", func() {
+			redactor = storage_redact.NewRedactor([]string{"", "Token"})
+			Expect(redactor.IsSensitive("username")).To(BeFalse())
+			Expect(redactor.IsSensitive("api_token")).To(BeTrue())
+		})
+	})
+
+	Context("With", func() {
+		It("adds names without changing the redactor it was derived from", func() {
+			derived := redactor.With("private_key")
+			Expect(derived.IsSensitive("private_key")).To(BeTrue())
+			Expect(derived.IsSensitive("password")).To(BeTrue())
+			Expect(redactor.IsSensitive("private_key")).To(BeFalse())
+		})
+	})
+
+	Context("OptionString", func() {
+		It("redacts the sensitive options of a mount option string", func() {
+			Expect(redactor.OptionString("username=u,password=p,vers=3.0")).To(Equal("username=u,password=[REDACTED],vers=3.0"))
+			Expect(redactor.OptionString("ro, secret = s")).To(Equal("ro, secret =[REDACTED]"))
+		})
+
+		It("keeps strings that are not option strings", func() {
+			Expect(redactor.OptionString("//fileserver/password-share")).To(Equal("//fileserver/password-share"))
+			Expect(redactor.OptionString("")).To(Equal(""))
+		})
+	})
+
+	Context("Opts", func() {
+		It("returns a redacted copy", func() {
+			opts := map[string]interface{}{
+				"username": "alice",
+				"Password": "s3cr3t",
+				"opts":     "nolock,passcode=1234",
+				"port":     2049,
+			}
+			Expect(redactor.Opts(opts)).To(Equal(map[string]interface{}{
+				"username": "alice",
+				"Password": storage_redact.Redacted,
+				"opts":     "nolock,passcode=[REDACTED]",
+				"port":     2049,
+			}))
+			Expect(opts["Password"]).To(Equal("s3cr3t"))
+		})
+
+		It("redacts nested maps and lists", func() {
+			opts := map[string]interface{}{
+				"credentials": map[string]interface{}{"user": "alice", "secret": "s3cr3t"},
+				"mounts": []interface{}{
+					map[string]interface{}{"keytab": "a2V5"},
+					"ro,password=p",
+					7,
+				},
+			}
+			Expect(redactor.Opts(opts)).To(Equal(map[string]interface{}{
+				"credentials": map[string]interface{}{"user": "alice", "secret": storage_redact.Redacted},
+				"mounts": []interface{}{
+					map[string]interface{}{"keytab": storage_redact.Redacted},
+					"ro,password=[REDACTED]",
+					7,
+				},
+			}))
+			Expect(opts["credentials"]).To(HaveKeyWithValue("secret", "s3cr3t"))
+		})
+
+		It("keeps nil opts nil", func() {
+			Expect(redactor.Opts(nil)).To(BeNil())
+		})
+	})
+
+	It("redacts the opts of create and mount requests", func() {
+		opts := map[string]interface{}{"password": "s3cr3t"}
+		Expect(redactor.CreateRequest(voldriver.CreateRequest{Name: "vol", Opts: opts})).To(Equal(voldriver.CreateRequest{Name: "vol", Opts: map[string]interface{}{"password": storage_redact.Redacted}}))
+		Expect(redactor.MountRequest(voldriver.MountRequest{Name: "vol", Opts: opts})).To(Equal(voldriver.MountRequest{Name: "vol", Opts: map[string]interface{}{"password": storage_redact.Redacted}}))
+		Expect(opts["password"]).To(Equal("s3cr3t"))
+	})
+})
@@ -4,15 +4,41 @@ import (
 	"strings"
 	"fmt"
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 
 	"code.cloudfoundry.org/voldriver"
 	"code.cloudfoundry.org/voldriver/driverhttp"
+	"code.cloudfoundry.org/goshims/os"
 	"code.cloudfoundry.org/lager"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/http_server"
 	//"github.com/wdxxs2z/cf-storage-driver/storage_local/nfs"
 	"../storage_local/nfs"
 	"../storage_local/local"
+	"../storage_local/smb"
+	"../storage_local/cephfs"
+	"../storage_local/fake"
+	"../storage_local/glusterfs"
+	"../storage_local/hostpath"
+	"../storage_local/loop"
+	"../storage_local/overlay"
+	"../storage_local/s3"
+	"../storage_local/sshfs"
+	"../storage_local/tmpfs"
+	"../storage_local/webdav"
+	"../storage_local/mountutil"
+	"../storage_config"
+	"../storage_admin"
+	"../storage_metrics"
+	"../storage_audit"
+	"../storage_redact"
+	"../storage_auth"
+	"../storage_csi"
+	"../storage_docker"
 
 	"net/http"
 )
@@ -23,26 +49,109 @@ type DriverServerConfig struct {
 	Transport        string
 	RegistryDriver   string
 	MountDir         string
+	LocalMountMode   string
+	SecretsDir       string
+	DataDir          string
+	Backend          storage_config.Config
+	AuditLogFile     string
+	AuditLogMaxSize  int64
+	AuditLogBackups  int
+	AuthToken        string
+	DockerPlugin     string
+	DockerMountsDir  string
+	CsiEndpoint      string
+	CsiDriverName    string
+	CsiNodeId        string
+	CsiPublishMode   string
+	CsiNfsShare      string
+	CsiNfsOpts       string
 }
 
 type DriverServer struct  {
-	config DriverServerConfig
+	config  DriverServerConfig
+	driver  voldriver.Driver
+	metrics *storage_metrics.Registry
+	auditor *storage_audit.Auditor
+	csiNfs  *storage_nfsdriver.NfsLocalDriver
+	tracker *storage_admin.Tracker
+	// tempDir is the root of the fake backend, removed when the server exits
+	tempDir string
+
+	// backendLock guards config.Backend, which Reload replaces while
+	// requests are served
+	backendLock sync.RWMutex
 }
 
 type StorageDriverServer interface {
 	Runner(logger lager.Logger) (ifrit.Runner, error)
+	Reload(logger lager.Logger, config storage_config.Config) error
+	MetricsHandler() http.Handler
+	AdminHandler(logger lager.Logger, token string) (http.Handler, error)
 }
 
 func NewStorageDriverServer(storageConfig DriverServerConfig) StorageDriverServer {
 	return &DriverServer{
 		config:        storageConfig,
+		metrics:       storage_metrics.NewRegistry(),
 	}
 }
 
+func (server *DriverServer) MetricsHandler() http.Handler {
+	return server.metrics
+}
+
+// AdminHandler serves the admin api of the running backend, see
+// storage_admin.Routes.
+func (server *DriverServer) AdminHandler(logger lager.Logger, token string) (http.Handler, error) {
+	if server.tracker == nil {
+		return nil, fmt.Errorf("the admin api needs a running driver")
+	}
+	admin := storage_admin.NewAdmin(server.config.RegistryDriver, server.driver, server.tracker, server.auditor, &osshim.OsShim{})
+	return storage_admin.NewHandler(logger, admin, token)
+}
+
 func (server *DriverServer) Runner(logger lager.Logger) (ifrit.Runner, error) {
+	runner, err := server.runner(logger)
+	if err != nil {
+		server.removeTempDir(logger)
+		return nil, err
+	}
+	if server.tempDir == "" {
+		return runner, nil
+	}
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		defer server.removeTempDir(logger)
+		return runner.Run(signals, ready)
+	}), nil
+}
+
+func (server *DriverServer) removeTempDir(logger lager.Logger) {
+	if server.tempDir == "" {
+		return
+	}
+	if err := os.RemoveAll(server.tempDir); err != nil {
+		logger.Error("failed-removing-temp-dir", err, lager.Data{"dir": server.tempDir})
+	}
+}
+
+func (server *DriverServer) runner(logger lager.Logger) (ifrit.Runner, error) {
 	var err error
 	var storageDriverServer ifrit.Runner
 
+	if server.config.AuditLogFile != "" {
+		server.auditor, err = storage_audit.NewAuditor(server.config.AuditLogFile, server.config.AuditLogMaxSize, server.config.AuditLogBackups, server.backend().Redactor())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if server.config.CsiEndpoint != "" {
+		return server.CreateCsiServer(logger, server.config.CsiEndpoint)
+	}
+	if server.config.DockerPlugin != "" {
+		return server.CreateDockerServer(logger, storage_docker.SocketPath(server.config.DockerPlugin))
+	}
+
 	server.config.Transport = server.DetermineTransport(server.config.ListenAddress)
 	if server.config.Transport == "tcp" {
 		storageDriverServer, err = server.CreateTcpServer(logger, server.config.ListenAddress, server.config.DriversPath)
@@ -55,22 +164,59 @@ func (server *DriverServer) Runner(logger lager.Logger) (ifrit.Runner, error) {
 	return storageDriverServer, nil
 }
 
+func (server *DriverServer) backend() storage_config.Config {
+	server.backendLock.RLock()
+	defer server.backendLock.RUnlock()
+	return server.config.Backend
+}
+
+func (server *DriverServer) Reload(logger lager.Logger, config storage_config.Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	server.backendLock.Lock()
+	defer server.backendLock.Unlock()
+
+	if reloadable, ok := server.driver.(storage_config.Reloadable); ok {
+		if err := reloadable.Reload(logger, config); err != nil {
+			return err
+		}
+	}
+	if server.csiNfs != nil {
+		if err := server.csiNfs.Reload(logger, config); err != nil {
+			return err
+		}
+	}
+	if server.auditor != nil {
+		server.auditor.SetRedactor(server.redactor(config))
+	}
+	server.config.Backend = config
+	return nil
+}
+
+// redactor also hides the credential opts the driver declares, see
+// storage_config.NewHolder.
+func (server *DriverServer) redactor(config storage_config.Config) *storage_redact.Redactor {
+	if declarer, ok := server.driver.(interface {
+		SecretOpts() []string
+	}); ok {
+		return config.Redactor().With(declarer.SecretOpts()...)
+	}
+	return config.Redactor()
+}
+
 func (server *DriverServer) CreateTcpServer(logger lager.Logger, address string, driversPath string) (ifrit.Runner, error) {
 	logger.Session("create-tcp-server")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	driverName := server.config.RegistryDriver
-	var handler http.Handler
-	var err error
-
-	switch driverName {
-	case "nfs":
-		handler,err = server.createHttpHandler(logger, address, driverName, driversPath, "tcp", storage_nfsdriver.NewNfsLocalDriver())
-	case "local":
-		server.createHttpHandler(logger, address, driverName, driversPath, "tcp", storage_localdriver.NewLocalDriver(server.config.MountDir))
+	client, err := server.createDriver(logger)
+	if err != nil {
+		return nil, err
 	}
 
+	handler, err := server.createHttpHandler(logger, address, server.config.RegistryDriver, driversPath, "tcp", client)
 	if err != nil {
 		return nil, err
 	}
@@ -82,53 +228,243 @@ func (server *DriverServer) CreateUnixServer(logger lager.Logger, address string
 	logger.Info("start")
 	defer logger.Info("end")
 
-	driverName := server.config.RegistryDriver
-	var handler http.Handler
-	var err error
-
-	switch driverName {
-	case "nfs":
-		handler,err = server.createHttpHandler(logger, address, driverName, driversPath, "unix",storage_nfsdriver.NewNfsLocalDriver())
-	case "local":
-		server.createHttpHandler(logger, address, driverName, driversPath, "unix", storage_localdriver.NewLocalDriver(server.config.MountDir))
+	client, err := server.createDriver(logger)
+	if err != nil {
+		return nil, err
 	}
 
+	handler, err := server.createHttpHandler(logger, address, server.config.RegistryDriver, driversPath, "unix", client)
 	if err != nil {
 		return nil, err
 	}
 	return http_server.NewUnixServer(address, handler), nil
 }
 
-func (server *DriverServer) createHttpHandler(logger lager.Logger, address,driver,driversPath,mode string, client voldriver.Driver) (http.Handler, error){
-	driverName := fmt.Sprintf("%sdriver", driver)
-	logger.Session(fmt.Sprintf("create-%s-driver-spec",driver))
+// CreateDockerServer serves the Docker volume plugin protocol on socketPath.
+// Docker finds the plugin by its socket, so no driver spec is written, and it
+// cannot send a token, so the socket permissions are the only protection.
+func (server *DriverServer) CreateDockerServer(logger lager.Logger, socketPath string) (ifrit.Runner, error) {
+	logger = logger.Session("create-docker-server", lager.Data{"socket": socketPath})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	client, err := server.createDriver(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	mountsDir := server.config.DockerMountsDir
+	switch server.config.RegistryDriver {
+	case "tmpfs", "hostpath", "overlay", "loop":
+		// these mount below the data dir unless told otherwise, and hostpath
+		// refuses a localmountpoint
+		mountsDir = ""
+	}
+	handler, err := storage_docker.NewHandler(logger, client, mountsDir, filepath.Join(server.config.DataDir, "docker", "containers.json"))
+	if err != nil {
+		return nil, err
+	}
+	handler = storage_admin.NewConsumerHandler(logger, handler, server.tracker)
+	if server.auditor != nil {
+		targeter, _ := server.driver.(storage_audit.VolumeTargeter)
+		handler = storage_audit.NewAuditHandler(logger, handler, server.auditor, targeter)
+	}
+	if server.config.AuthToken != "" {
+		logger.Info("ignoring-auth-token", lager.Data{"hint": "docker does not send tokens to volume plugins"})
+	}
+
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return nil, err
+	}
+	// a socket left behind by a crashed plugin would fail the listen
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return http_server.NewUnixServer(socketPath, handler), nil
+}
+
+// CreateCsiServer serves the CSI identity and node services on socketPath,
+// and the controller service when an nfs share to provision on is configured.
+// Kubernetes passes the create opts of the backend as volume context, so no
+// driver spec is written either.
+func (server *DriverServer) CreateCsiServer(logger lager.Logger, socketPath string) (ifrit.Runner, error) {
+	logger = logger.Session("create-csi-server", lager.Data{"socket": socketPath})
 	logger.Info("start")
 	defer logger.Info("end")
 
-	switch mode {
-	case "tcp":
-		spec := voldriver.DriverSpec{
-			Name:             driverName,
-			Address:          server.rewriteAddress(address, "http"),
+	client, err := server.createDriver(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	mounter, err := storage_localdriver.NewMounter(server.config.CsiPublishMode)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := storage_csi.NewNodeServer(logger, client, mounter, storage_mountutil.NewRealInvoker(), &osshim.OsShim{}, server.config.CsiNodeId, filepath.Join(server.config.DataDir, "csi", "node.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	services := storage_csi.Services{
+		Identity: storage_csi.NewIdentityServer(server.config.CsiDriverName),
+		Node:     node,
+	}
+
+	if server.config.CsiNfsShare != "" {
+		// a driver of its own, so the temporary mounts of the export do not
+		// show up among the volumes of the node service
+		server.csiNfs = storage_nfsdriver.NewNfsLocalDriver()
+		if err := server.csiNfs.Reload(logger, server.backend()); err != nil {
+			return nil, err
 		}
+		services.Identity = storage_csi.NewIdentityServer(server.config.CsiDriverName, csi.PluginCapability_Service_CONTROLLER_SERVICE)
+		services.Controller = storage_csi.NewControllerServer(logger, server.csiNfs, &osshim.OsShim{}, filepath.Join(server.config.DataDir, "csi", "controller"), server.config.CsiNfsShare, server.config.CsiNfsOpts)
+	}
+
+	return storage_csi.NewServer(logger, socketPath, services), nil
+}
+
+func (server *DriverServer) createDriver(logger lager.Logger) (voldriver.Driver, error) {
+	var client voldriver.Driver
 
-		specJson, err := json.Marshal(spec)
+	switch server.config.RegistryDriver {
+	case "nfs":
+		client = storage_nfsdriver.NewNfsLocalDriver()
+	case "local":
+		localDriver, err := storage_localdriver.NewLocalDriverWithMode(server.config.MountDir, server.config.LocalMountMode)
 		if err != nil {
 			return nil, err
 		}
-
-		err = voldriver.WriteDriverSpec(logger, driversPath, driverName, "json", specJson)
+		client = localDriver
+	case "smb":
+		client = storage_smbdriver.NewSmbLocalDriver(filepath.Join(server.config.SecretsDir, "smb"))
+	case "cephfs":
+		client = storage_cephfsdriver.NewCephfsLocalDriver(filepath.Join(server.config.SecretsDir, "cephfs"))
+	case "glusterfs":
+		client = storage_glusterfsdriver.NewGlusterfsLocalDriver(filepath.Join(server.config.DataDir, "glusterfs", "logs"))
+	case "sshfs":
+		client = storage_sshfsdriver.NewSshfsLocalDriver(filepath.Join(server.config.SecretsDir, "sshfs"))
+	case "s3":
+		client = storage_s3driver.NewS3LocalDriver(filepath.Join(server.config.SecretsDir, "s3"))
+	case "webdav":
+		client = storage_webdavdriver.NewWebdavLocalDriver(filepath.Join(server.config.SecretsDir, "webdav"))
+	case "tmpfs":
+		client = storage_tmpfsdriver.NewTmpfsLocalDriver(filepath.Join(server.config.DataDir, "tmpfs", "mounts"))
+	case "hostpath":
+		client = storage_hostpathdriver.NewHostPathLocalDriver(filepath.Join(server.config.DataDir, "hostpath", "mounts"))
+	case "overlay":
+		client = storage_overlaydriver.NewOverlayLocalDriver(filepath.Join(server.config.DataDir, "overlay"), server.config.DriversPath)
+	case "loop":
+		client = storage_loopdriver.NewLoopLocalDriver(filepath.Join(server.config.DataDir, "loop", "images"), filepath.Join(server.config.DataDir, "loop", "mounts"))
+	case "fake":
+		rootDir, err := ioutil.TempDir("", "storage-driver-fake")
 		if err != nil {
 			return nil, err
 		}
-	case "unix":
+		server.tempDir = rootDir
+		client = storage_fakedriver.NewFakeDriver(rootDir)
+	default:
+		return nil, fmt.Errorf("unknown registry driver '%s'", server.config.RegistryDriver)
+	}
+
+	if reloadable, ok := client.(storage_config.Reloadable); ok {
+		if err := reloadable.Reload(logger, server.backend()); err != nil {
+			return nil, err
+		}
+	}
+
+	server.driver = client
+	if server.auditor != nil {
+		server.auditor.SetRedactor(server.redactor(server.backend()))
+	}
+	server.tracker = storage_admin.NewTracker(storage_metrics.NewMetricsDriver(server.config.RegistryDriver, client, server.metrics))
+	return server.tracker, nil
+}
+
+func (server *DriverServer) createHttpHandler(logger lager.Logger, address,driver,driversPath,mode string, client voldriver.Driver) (http.Handler, error){
+	driverName := fmt.Sprintf("%sdriver", driver)
+	logger.Session(fmt.Sprintf("create-%s-driver-spec",driver))
+	logger.Info("start")
+	defer logger.Info("end")
+
+	switch {
+	case mode == "tcp":
+		if err := server.writeJsonSpec(logger, driversPath, driverName, server.rewriteAddress(address, "http")); err != nil {
+			return nil, err
+		}
+	case server.config.AuthToken != "":
+		// a .spec holds nothing but the url, so the token needs a json spec;
+		// volman dials addresses ending in .sock as unix sockets
+		if err := server.writeJsonSpec(logger, driversPath, driverName, strings.TrimPrefix(address, "unix://")); err != nil {
+			return nil, err
+		}
+		if err := removeSpec(driversPath, driverName, "spec"); err != nil {
+			return nil, err
+		}
+	default:
 		url := server.rewriteAddress(address, "unix")
-		err := voldriver.WriteDriverSpec(logger, driversPath, "nfsdriver", "spec", []byte(url))
+		err := voldriver.WriteDriverSpec(logger, driversPath, driverName, "spec", []byte(url))
 		if err != nil {
 			return nil, err
 		}
+		if err := removeSpec(driversPath, driverName, "json"); err != nil {
+			return nil, err
+		}
+	}
+	handler, err := driverhttp.NewHandler(logger, client)
+	if err != nil {
+		return nil, err
+	}
+
+	handler = storage_admin.NewConsumerHandler(logger, handler, server.tracker)
+	if server.auditor != nil {
+		targeter, _ := server.driver.(storage_audit.VolumeTargeter)
+		handler = storage_audit.NewAuditHandler(logger, handler, server.auditor, targeter)
+	}
+
+	if server.config.AuthToken != "" {
+		handler = storage_auth.NewAuthHandler(logger, handler, server.config.AuthToken)
+	}
+	return handler, nil
+}
+
+// writeJsonSpec writes a json driver spec carrying the auth token, if any.
+func (server *DriverServer) writeJsonSpec(logger lager.Logger, driversPath, driverName, address string) error {
+	spec := storage_auth.AuthDriverSpec{
+		DriverSpec: voldriver.DriverSpec{
+			Name:    driverName,
+			Address: address,
+		},
+		Token: server.config.AuthToken,
+	}
+
+	specJson, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	err = voldriver.WriteDriverSpec(logger, driversPath, driverName, "json", specJson)
+	if err != nil {
+		return err
+	}
+
+	if server.config.AuthToken != "" {
+		// the spec now holds the token, only the rep (root) may read it
+		return os.Chmod(filepath.Join(driversPath, driverName+".json"), 0600)
+	}
+	return nil
+}
+
+// removeSpec removes a spec of another kind left behind by an earlier run, so
+// clients do not pick the stale one; volman prefers .spec over .json.
+func removeSpec(driversPath, driverName, extension string) error {
+	err := os.Remove(filepath.Join(driversPath, driverName+"."+extension))
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	return driverhttp.NewHandler(logger, client)
+	return nil
 }
 
 func (server *DriverServer) rewriteAddress(address string, protocol string) string {